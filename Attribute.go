@@ -0,0 +1,703 @@
+package ad
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jakobii/ps"
+)
+
+// Attribute holds the values of a single LDAP attribute. Text values are stored as
+// their UTF-8 bytes, binary (OctetString) values as is. Syntax is only known
+// once the schema of the server was loaded, see Connection.Schema.
+type Attribute struct {
+	Syntax Syntax
+	Binary bool
+	Values [][]byte
+}
+
+// Attributes maps lDAPDisplayNames to attribute values.
+// Names are case insensitive, use Get and Set to look them up.
+type Attributes map[string]Attribute
+
+// Get returns the attribute with the given name, ignoring case.
+func (a Attributes) Get(name string) (Attribute, bool) {
+	if v, ok := a[name]; ok {
+		return v, true
+	}
+	for k, v := range a {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return Attribute{}, false
+}
+
+// Set stores an attribute, replacing any existing one with the same name in any case.
+func (a Attributes) Set(name string, attr Attribute) {
+	for k := range a {
+		if strings.EqualFold(k, name) && k != name {
+			delete(a, k)
+		}
+	}
+	a[name] = attr
+}
+
+// Clear sets an attribute to no values, so Push removes it from the directory.
+func (a Attributes) Clear(name string) {
+	a.Set(name, Attribute{})
+}
+
+// Names returns the attribute names in sorted order.
+func (a Attributes) Names() []string {
+	names := make([]string, 0, len(a))
+	for k := range a {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// clone returns a deep copy of the attributes.
+func (a Attributes) clone() Attributes {
+	c := make(Attributes, len(a))
+	for k, v := range a {
+		c[k] = v.clone()
+	}
+	return c
+}
+
+// clone returns a deep copy of the attribute.
+func (a Attribute) clone() Attribute {
+	values := make([][]byte, 0, len(a.Values))
+	for _, b := range a.Values {
+		values = append(values, append([]byte(nil), b...))
+	}
+	return Attribute{Syntax: a.Syntax, Binary: a.Binary, Values: values}
+}
+
+// NewStringAttribute returns an attribute with text values.
+func NewStringAttribute(values ...string) Attribute {
+	a := Attribute{Values: make([][]byte, 0, len(values))}
+	for _, v := range values {
+		a.Values = append(a.Values, []byte(v))
+	}
+	return a
+}
+
+// NewBinaryAttribute returns an attribute with binary values.
+func NewBinaryAttribute(values ...[]byte) Attribute {
+	return Attribute{Binary: true, Values: values}
+}
+
+// NewIntAttribute returns an attribute with Integer or Integer8 values.
+func NewIntAttribute(values ...int64) Attribute {
+	a := Attribute{Values: make([][]byte, 0, len(values))}
+	for _, v := range values {
+		a.Values = append(a.Values, []byte(strconv.FormatInt(v, 10)))
+	}
+	return a
+}
+
+// NewBoolAttribute returns an attribute with a Boolean value.
+func NewBoolAttribute(value bool) Attribute {
+	if value {
+		return NewStringAttribute("TRUE")
+	}
+	return NewStringAttribute("FALSE")
+}
+
+// NewTimeAttribute returns an attribute with a GeneralizedTime value.
+func NewTimeAttribute(value time.Time) Attribute {
+	return NewStringAttribute(FormatGeneralizedTime(value))
+}
+
+// NewFileTimeAttribute returns an attribute with an Integer8 FILETIME value.
+func NewFileTimeAttribute(value time.Time) Attribute {
+	return NewIntAttribute(TimeToFileTime(value))
+}
+
+// IsEmpty returns true if the attribute has no values.
+func (a Attribute) IsEmpty() bool {
+	return len(a.Values) == 0
+}
+
+// Equal returns true if both attributes have the same values in the same order.
+func (a Attribute) Equal(o Attribute) bool {
+	if len(a.Values) != len(o.Values) {
+		return false
+	}
+	for i := range a.Values {
+		if !bytes.Equal(a.Values[i], o.Values[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the first value as text, or "" if there are none.
+func (a Attribute) String() string {
+	if len(a.Values) == 0 {
+		return ""
+	}
+	return string(a.Values[0])
+}
+
+// Strings returns all values as text.
+func (a Attribute) Strings() []string {
+	s := make([]string, 0, len(a.Values))
+	for _, v := range a.Values {
+		s = append(s, string(v))
+	}
+	return s
+}
+
+// Bytes returns the first value, or nil if there are none.
+func (a Attribute) Bytes() []byte {
+	if len(a.Values) == 0 {
+		return nil
+	}
+	return a.Values[0]
+}
+
+// Int64 returns the first value as an Integer or Integer8.
+func (a Attribute) Int64() (int64, error) {
+	if len(a.Values) == 0 {
+		return 0, errors.New("attribute has no values")
+	}
+	return strconv.ParseInt(string(a.Values[0]), 10, 64)
+}
+
+// Int returns the first value as an Integer.
+func (a Attribute) Int() (int, error) {
+	n, err := a.Int64()
+	return int(n), err
+}
+
+// Bool returns the first value as a Boolean.
+func (a Attribute) Bool() (bool, error) {
+	if len(a.Values) == 0 {
+		return false, errors.New("attribute has no values")
+	}
+	switch strings.ToUpper(string(a.Values[0])) {
+	case "TRUE":
+		return true, nil
+	case "FALSE":
+		return false, nil
+	}
+	return false, errors.New("invalid boolean " + string(a.Values[0]))
+}
+
+// Time returns the first value as a GeneralizedTime.
+func (a Attribute) Time() (time.Time, error) {
+	if len(a.Values) == 0 {
+		return time.Time{}, errors.New("attribute has no values")
+	}
+	return ParseGeneralizedTime(string(a.Values[0]))
+}
+
+// FileTime returns the first value as an Integer8 FILETIME.
+func (a Attribute) FileTime() (time.Time, error) {
+	n, err := a.Int64()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return FileTimeToTime(n), nil
+}
+
+// SID returns the first value as a security identifier, in either binary or string form.
+func (a Attribute) SID() (SID, error) {
+	if len(a.Values) == 0 {
+		return SID{}, errors.New("attribute has no values")
+	}
+	if a.Binary {
+		return SIDFromBytes(a.Values[0])
+	}
+	return ParseSID(string(a.Values[0]))
+}
+
+// psExpr returns a PowerShell array expression holding the values of the attribute.
+func (a Attribute) psExpr() string {
+	exprs := make([]string, 0, len(a.Values))
+	for _, v := range a.Values {
+		if a.Binary {
+			exprs = append(exprs, "([byte[]][Convert]::FromBase64String('"+base64.StdEncoding.EncodeToString(v)+"'))")
+		} else {
+			exprs = append(exprs, ps.QuoteString(string(v)))
+		}
+	}
+	return "@(" + strings.Join(exprs, ",") + ")"
+}
+
+// psAttributesFunc converts the requested properties of an AD object to a list of
+// name, binary flag and values. Binary values, GUIDs and SIDs are base64 encoded, dates are
+// converted to GeneralizedTime, and everything else is converted to a string with the invariant culture.
+const psAttributesFunc string = `function ConvertTo-ADAttributes($o, [string[]]$names) {
+	foreach ($n in $names) {
+		$vals = @(); $bin = $false
+		foreach ($x in $o[$n]) {
+			if ($null -eq $x) { continue }
+			if ($x -is [byte[]]) { $bin = $true; $vals += [Convert]::ToBase64String($x) }
+			elseif ($x -is [guid]) { $bin = $true; $vals += [Convert]::ToBase64String($x.ToByteArray()) }
+			elseif ($x -is [System.Security.Principal.SecurityIdentifier]) { $b = New-Object byte[] $x.BinaryLength; $x.GetBinaryForm($b, 0); $bin = $true; $vals += [Convert]::ToBase64String($b) }
+			elseif ($x -is [datetime]) { $vals += $x.ToUniversalTime().ToString('yyyyMMddHHmmss.0Z') }
+			elseif ($x -is [bool]) { $vals += $x.ToString().ToUpper() }
+			else { $vals += [string]$x }
+		}
+		[pscustomobject]@{ Name = $n; Binary = $bin; Values = $vals }
+	}
+}; `
+
+// decodeAttributes decodes the output of psAttributesFunc.
+func decodeAttributes(data []byte) (Attributes, error) {
+	var raw []struct {
+		Name   string
+		Binary bool
+		Values []string
+	}
+	err := unmarshalList(data, &raw)
+	if err != nil {
+		return nil, err
+	}
+	attrs := make(Attributes, len(raw))
+	for _, v := range raw {
+		a := Attribute{Binary: v.Binary, Values: make([][]byte, 0, len(v.Values))}
+		for _, s := range v.Values {
+			if v.Binary {
+				b, err := base64.StdEncoding.DecodeString(s)
+				if err != nil {
+					return nil, err
+				}
+				a.Values = append(a.Values, b)
+			} else {
+				a.Values = append(a.Values, []byte(s))
+			}
+		}
+		attrs[v.Name] = a
+	}
+	return attrs, nil
+}
+
+// GetAttributes reads the named attributes of an object.
+// Attributes without values are returned empty rather than left out.
+// If the schema of the server was loaded, the Syntax of every attribute is set.
+func (c *Connection) GetAttributes(Identity string, names ...string) (attrs Attributes, err error) {
+
+	if len(names) == 0 {
+		return Attributes{}, nil
+	}
+
+	list := psNames(names)
+
+	var cmd bytes.Buffer
+	cmd.WriteString(psAttributesFunc)
+	cmd.WriteString("$o = Get-ADObject -Server ")
+	cmd.WriteString(ps.QuoteString(c.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(c.Credential.Expr())
+	cmd.WriteString(" -Identity ")
+	cmd.WriteString(ps.QuoteString(Identity))
+	cmd.WriteString(" -Properties ")
+	cmd.WriteString(list)
+	cmd.WriteString("; ConvertTo-Json -Depth 4 -InputObject @(ConvertTo-ADAttributes $o ")
+	cmd.WriteString(list)
+	cmd.WriteString(")")
+
+	result, err := powershell(cmd.String())
+	if err != nil {
+		return attrs, err
+	}
+
+	attrs, err = decodeAttributes(result)
+	if err != nil {
+		return attrs, err
+	}
+
+	c.applySchema(attrs)
+
+	return attrs, nil
+}
+
+// applySchema sets the Syntax of every attribute if the schema of c.Server was loaded.
+func (c *Connection) applySchema(attrs Attributes) {
+	schema := c.cachedSchema()
+	if schema == nil {
+		return
+	}
+	for k, v := range attrs {
+		if a, ok := schema.Attribute(k); ok {
+			v.Syntax = a.Syntax
+			attrs[k] = v
+		}
+	}
+}
+
+// encode prepares a value for writing according to the syntax of the attribute. SIDs given
+// in their string form are converted to binary, and Boolean values are written in upper case.
+func (s *AttributeSchema) encode(a Attribute) Attribute {
+	switch s.Syntax {
+	case SyntaxSID:
+		if a.Binary {
+			return a
+		}
+		b := Attribute{Syntax: s.Syntax, Binary: true, Values: make([][]byte, 0, len(a.Values))}
+		for _, v := range a.Values {
+			sid, err := ParseSID(string(v))
+			if err != nil {
+				// let the domain controller reject it
+				return a
+			}
+			b.Values = append(b.Values, sid.Bytes())
+		}
+		return b
+	case SyntaxBoolean:
+		b := Attribute{Syntax: s.Syntax, Values: make([][]byte, 0, len(a.Values))}
+		for _, v := range a.Values {
+			b.Values = append(b.Values, bytes.ToUpper(v))
+		}
+		return b
+	}
+	if a.Syntax == SyntaxUnknown {
+		a.Syntax = s.Syntax
+	}
+	return a
+}
+
+// PullAttributes reads the named attributes into o.Attributes. Attributes that were
+// already loaded are refreshed and count as unchanged afterwards.
+func (o *Object) PullAttributes(names ...string) error {
+	id, err := o.Identity()
+	if err != nil {
+		return err
+	}
+	attrs, err := o.GetAttributes(id, names...)
+	if err != nil {
+		return err
+	}
+	if o.Attributes == nil {
+		o.Attributes = make(Attributes, len(attrs))
+	}
+	if o.originalAttributes == nil {
+		o.originalAttributes = make(Attributes, len(attrs))
+	}
+	for k, v := range attrs {
+		o.Attributes.Set(k, v)
+		o.originalAttributes.Set(k, v.clone())
+	}
+	return nil
+}
+
+// PushAttributes writes every attribute in o.Attributes that changed since it was pulled.
+// Attributes without values, and attributes removed from the map, are cleared. Multi-valued
+// attributes are changed value by value, so values added elsewhere in the meantime are kept.
+// The schema is loaded, once there is a value to write, to tell multi-valued attributes apart
+// and to encode values. If it can not be read, attributes with more than one value are taken
+// to be multi-valued.
+func (o *Object) PushAttributes() error {
+
+	var m modification
+	var changed []string
+	for _, name := range o.Attributes.Names() {
+		v := o.Attributes[name]
+		old, ok := o.originalAttributes.Get(name)
+		if ok && old.Equal(v) {
+			continue
+		}
+		if v.IsEmpty() {
+			if ok && !old.IsEmpty() {
+				m.clear(name)
+			}
+			continue
+		}
+		changed = append(changed, name)
+	}
+	for _, name := range o.originalAttributes.Names() {
+		if _, ok := o.Attributes.Get(name); !ok && !o.originalAttributes[name].IsEmpty() {
+			m.clear(name)
+		}
+	}
+
+	var schema *Schema
+	if len(changed) > 0 {
+		schema, _ = o.Schema()
+	}
+	for _, name := range changed {
+		v := o.Attributes[name]
+		old, ok := o.originalAttributes.Get(name)
+
+		multiValued := len(old.Values) > 1 || len(v.Values) > 1
+		if schema != nil {
+			if a, found := schema.Attribute(name); found {
+				multiValued = !a.SingleValued
+				v = a.encode(v)
+				old = a.encode(old)
+			}
+		}
+		if ok && !old.IsEmpty() && multiValued {
+			// change single values of multi-valued attributes so values added
+			// by someone else since the last pull are kept
+			add, remove := v.diff(old)
+			m.add(name, add)
+			m.remove(name, remove)
+			continue
+		}
+		m.replace(name, v)
+	}
+
+	err := o.modify(m)
+	if err != nil {
+		return err
+	}
+
+	o.originalAttributes = o.Attributes.clone()
+	return nil
+}
+
+// diff returns the values of a that are missing from old, and the values of old that are
+// missing from a. Values are compared byte by byte.
+func (a Attribute) diff(old Attribute) (add, remove Attribute) {
+	add = Attribute{Syntax: a.Syntax, Binary: a.Binary}
+	remove = Attribute{Syntax: old.Syntax, Binary: a.Binary || old.Binary}
+	for _, v := range a.Values {
+		if !containsValue(old.Values, v) {
+			add.Values = append(add.Values, v)
+		}
+	}
+	for _, v := range old.Values {
+		if !containsValue(a.Values, v) {
+			remove.Values = append(remove.Values, v)
+		}
+	}
+	return add, remove
+}
+
+func containsValue(values [][]byte, v []byte) bool {
+	for _, x := range values {
+		if bytes.Equal(x, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// modification collects the changes of a single Set-ADObject call.
+type modification struct {
+	adds, removes, replaces, clears []string
+}
+
+func (m *modification) add(name string, a Attribute) {
+	if !a.IsEmpty() {
+		m.adds = append(m.adds, ps.QuoteString(name)+"="+a.psExpr())
+	}
+}
+
+func (m *modification) remove(name string, a Attribute) {
+	if !a.IsEmpty() {
+		m.removes = append(m.removes, ps.QuoteString(name)+"="+a.psExpr())
+	}
+}
+
+func (m *modification) replace(name string, a Attribute) {
+	if a.IsEmpty() {
+		m.clear(name)
+		return
+	}
+	m.replaces = append(m.replaces, ps.QuoteString(name)+"="+a.psExpr())
+}
+
+func (m *modification) clear(name string) {
+	m.clears = append(m.clears, ps.QuoteString(name))
+}
+
+func (m *modification) isEmpty() bool {
+	return len(m.adds) == 0 && len(m.removes) == 0 && len(m.replaces) == 0 && len(m.clears) == 0
+}
+
+// modify applies m to the object. Set-ADObject removes values first, then adds, replaces
+// and clears, all in one LDAP modify request.
+func (o *Object) modify(m modification) error {
+
+	if m.isEmpty() {
+		return nil
+	}
+
+	id, err := o.Identity()
+	if err != nil {
+		return err
+	}
+
+	var cmd bytes.Buffer
+	cmd.WriteString("Set-ADObject -Server ")
+	cmd.WriteString(ps.QuoteString(o.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(o.Credential.Expr())
+	cmd.WriteString(" -Identity ")
+	cmd.WriteString(ps.QuoteString(id))
+	if len(m.removes) > 0 {
+		cmd.WriteString(" -Remove @{")
+		cmd.WriteString(strings.Join(m.removes, "; "))
+		cmd.WriteString("}")
+	}
+	if len(m.adds) > 0 {
+		cmd.WriteString(" -Add @{")
+		cmd.WriteString(strings.Join(m.adds, "; "))
+		cmd.WriteString("}")
+	}
+	if len(m.replaces) > 0 {
+		cmd.WriteString(" -Replace @{")
+		cmd.WriteString(strings.Join(m.replaces, "; "))
+		cmd.WriteString("}")
+	}
+	if len(m.clears) > 0 {
+		cmd.WriteString(" -Clear @(")
+		cmd.WriteString(strings.Join(m.clears, ","))
+		cmd.WriteString(")")
+	}
+	cmd.WriteString(" -Confirm:$false")
+
+	_, err = powershell(cmd.String())
+	return err
+}
+
+// AddValues adds values to a multi-valued attribute, keeping the values already there.
+func (o *Object) AddValues(name string, values ...string) error {
+	var m modification
+	m.add(name, NewStringAttribute(values...))
+	return o.modify(m)
+}
+
+// RemoveValues removes values from a multi-valued attribute, keeping all other values.
+func (o *Object) RemoveValues(name string, values ...string) error {
+	var m modification
+	m.remove(name, NewStringAttribute(values...))
+	return o.modify(m)
+}
+
+// ReplaceValues replaces all values of an attribute. No values clears it.
+func (o *Object) ReplaceValues(name string, values ...string) error {
+	var m modification
+	m.replace(name, NewStringAttribute(values...))
+	return o.modify(m)
+}
+
+// attributeJSON is the JSON form of an Attribute.
+type attributeJSON struct {
+	Syntax Syntax `json:",omitempty"`
+	Binary bool   `json:",omitempty"`
+	Values []string
+}
+
+// MarshalJSON encodes binary values as base64 and text values as strings.
+func (a Attribute) MarshalJSON() ([]byte, error) {
+	raw := attributeJSON{Syntax: a.Syntax, Binary: a.Binary, Values: make([]string, 0, len(a.Values))}
+	for _, v := range a.Values {
+		if a.Binary {
+			raw.Values = append(raw.Values, base64.StdEncoding.EncodeToString(v))
+		} else {
+			raw.Values = append(raw.Values, string(v))
+		}
+	}
+	return json.Marshal(raw)
+}
+
+// UnmarshalJSON decodes the output of MarshalJSON.
+func (a *Attribute) UnmarshalJSON(data []byte) error {
+	raw := attributeJSON{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	*a = Attribute{Syntax: raw.Syntax, Binary: raw.Binary, Values: make([][]byte, 0, len(raw.Values))}
+	for _, v := range raw.Values {
+		if raw.Binary {
+			b, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return err
+			}
+			a.Values = append(a.Values, b)
+		} else {
+			a.Values = append(a.Values, []byte(v))
+		}
+	}
+	return nil
+}
+
+// Value decodes every value according to the Syntax of the attribute:
+// Boolean as bool, Integer, Enumeration and Integer8 as int64, GeneralizedTime and
+// UTCTime as time.Time, SID as SID, other binary syntaxes as []byte, everything else as string.
+func (a Attribute) Value() ([]interface{}, error) {
+	values := make([]interface{}, 0, len(a.Values))
+	for _, v := range a.Values {
+		single := Attribute{Syntax: a.Syntax, Binary: a.Binary, Values: [][]byte{v}}
+		var x interface{}
+		var err error
+		switch {
+		case a.Syntax == SyntaxBoolean:
+			x, err = single.Bool()
+		case a.Syntax == SyntaxInteger || a.Syntax == SyntaxEnumeration || a.Syntax == SyntaxInteger8:
+			x, err = single.Int64()
+		case a.Syntax == SyntaxGeneralizedTime || a.Syntax == SyntaxUTCTime:
+			x, err = single.Time()
+		case a.Syntax == SyntaxSID:
+			x, err = single.SID()
+		case a.Binary || a.Syntax.IsBinary():
+			x = v
+		default:
+			x = string(v)
+		}
+		if err != nil {
+			return values, err
+		}
+		values = append(values, x)
+	}
+	return values, nil
+}
+
+// NewAttribute encodes values according to syntax. Values may be strings, []byte,
+// bool, any integer type, time.Time or SID. A time.Time is encoded as a FILETIME for
+// Integer8 and as a GeneralizedTime otherwise.
+func NewAttribute(syntax Syntax, values ...interface{}) (Attribute, error) {
+	a := Attribute{Syntax: syntax, Binary: syntax.IsBinary(), Values: make([][]byte, 0, len(values))}
+	for _, v := range values {
+		var b []byte
+		switch x := v.(type) {
+		case string:
+			b = []byte(x)
+		case []byte:
+			b = x
+		case bool:
+			b = NewBoolAttribute(x).Values[0]
+		case int:
+			b = []byte(strconv.FormatInt(int64(x), 10))
+		case int32:
+			b = []byte(strconv.FormatInt(int64(x), 10))
+		case int64:
+			b = []byte(strconv.FormatInt(x, 10))
+		case uint32:
+			b = []byte(strconv.FormatUint(uint64(x), 10))
+		case time.Time:
+			if syntax == SyntaxInteger8 {
+				b = []byte(strconv.FormatInt(TimeToFileTime(x), 10))
+			} else {
+				b = []byte(FormatGeneralizedTime(x))
+			}
+		case SID:
+			if a.Binary {
+				b = x.Bytes()
+			} else {
+				b = []byte(x.String())
+			}
+		default:
+			return a, fmt.Errorf("can not encode %T as %s", v, syntax)
+		}
+		a.Values = append(a.Values, b)
+	}
+	return a, nil
+}
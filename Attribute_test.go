@@ -0,0 +1,121 @@
+package ad
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jakobii/ps"
+)
+
+func TestAttributeDiff(t *testing.T) {
+	old := NewStringAttribute("a", "b", "c")
+	add, remove := NewStringAttribute("b", "c", "d").diff(old)
+	if len(add.Values) != 1 || string(add.Values[0]) != "d" {
+		t.Errorf("add = %q", add.Strings())
+	}
+	if len(remove.Values) != 1 || string(remove.Values[0]) != "a" {
+		t.Errorf("remove = %q", remove.Strings())
+	}
+	add, remove = old.diff(old)
+	if !add.IsEmpty() || !remove.IsEmpty() {
+		t.Error("equal attributes have a diff")
+	}
+}
+
+func TestAttributeSchemaEncode(t *testing.T) {
+	sid := &AttributeSchema{LDAPDisplayName: "sIDHistory", Syntax: SyntaxSID}
+	a := sid.encode(NewStringAttribute("S-1-5-21-1-2-3-1104"))
+	if !a.Binary {
+		t.Fatal("SID was not encoded as binary")
+	}
+	if s, err := a.SID(); err != nil || s.String() != "S-1-5-21-1-2-3-1104" {
+		t.Errorf("SID() = %s, %v", s, err)
+	}
+
+	boolean := &AttributeSchema{LDAPDisplayName: "msExchHideFromAddressLists", Syntax: SyntaxBoolean}
+	if v := boolean.encode(NewStringAttribute("true")).String(); v != "TRUE" {
+		t.Errorf("Boolean encoded as %q", v)
+	}
+
+	text := &AttributeSchema{LDAPDisplayName: "description", Syntax: SyntaxUnicode}
+	if a := text.encode(NewStringAttribute("x")); a.Syntax != SyntaxUnicode || a.String() != "x" {
+		t.Errorf("Unicode encoded as %+v", a)
+	}
+}
+
+func TestPushAttributesBySchema(t *testing.T) {
+
+	cacheSchema(t, "dc1",
+		&AttributeSchema{LDAPDisplayName: "otherTelephone", Syntax: SyntaxUnicode},
+		&AttributeSchema{LDAPDisplayName: "description", Syntax: SyntaxUnicode, SingleValued: true},
+	)
+	scripts := recordPowershell(t, nil)
+
+	o := Object{Connection: Connection{Server: "dc1"}, DistinguishedName: "CN=Pat,DC=example,DC=com"}
+	o.Attributes = Attributes{}
+	o.Attributes.Set("otherTelephone", NewStringAttribute("1"))
+	o.Attributes.Set("description", NewStringAttribute("old"))
+	o.originalAttributes = o.Attributes.clone()
+
+	// one value replaced by another
+	o.Attributes.Set("otherTelephone", NewStringAttribute("2"))
+	o.Attributes.Set("description", NewStringAttribute("new"))
+	if err := o.PushAttributes(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*scripts) != 1 {
+		t.Fatalf("ran %d scripts", len(*scripts))
+	}
+	script := (*scripts)[0]
+
+	phone := ps.QuoteString("otherTelephone")
+	for _, want := range []string{
+		"-Remove @{" + phone + "=@(" + ps.QuoteString("1") + ")}",
+		"-Add @{" + phone + "=@(" + ps.QuoteString("2") + ")}",
+		"-Replace @{" + ps.QuoteString("description") + "=@(" + ps.QuoteString("new") + ")}",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script does not contain %s:\n%s", want, script)
+		}
+	}
+	if strings.Contains(script, "-Replace @{"+phone) {
+		t.Error("multi-valued attribute was replaced")
+	}
+
+	// nothing changed since the push
+	*scripts = nil
+	if err := o.PushAttributes(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*scripts) != 0 {
+		t.Errorf("unchanged attributes ran %q", *scripts)
+	}
+}
+
+func TestPushAttributesLoadsSchemaLazily(t *testing.T) {
+
+	scripts := recordPowershell(t, func(script string) ([]byte, error) {
+		return nil, errors.New("schema unavailable")
+	})
+
+	o := Object{Connection: Connection{Server: "dc-noschema"}, DistinguishedName: "CN=Pat,DC=example,DC=com"}
+	o.Attributes = Attributes{}
+	o.Attributes.Set("description", NewStringAttribute("x"))
+	o.originalAttributes = o.Attributes.clone()
+
+	// nothing to write, so nothing is read
+	if err := o.PushAttributes(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*scripts) != 0 {
+		t.Errorf("unchanged attributes ran %q", *scripts)
+	}
+
+	// a clear is written without the schema
+	o.Attributes.Clear("description")
+	o.PushAttributes()
+	if len(*scripts) != 1 || !strings.HasPrefix((*scripts)[0], "Set-ADObject") {
+		t.Errorf("clearing an attribute ran %q", *scripts)
+	}
+}
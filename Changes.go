@@ -0,0 +1,206 @@
+package ad
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jakobii/ps"
+)
+
+// ErrResyncRequired is returned by Changes when a cookie can not be continued from, because
+// the database of the domain controller it was issued by was restored from backup or replaced,
+// so it answers with another invocation id. The consumer has to start over with a blank cookie.
+var ErrResyncRequired = errors.New("change cookie is no longer valid, a full sync is required")
+
+// Change is an object that was created, changed or deleted since a cookie was issued.
+type Change struct {
+	// Object holds the requested attributes. Deleted objects only keep a few attributes,
+	// and their DistinguishedName is in CN=Deleted Objects.
+	Object
+	// Created is true if the object was created since the cookie was issued.
+	Created bool
+	// Deleted is true for tombstones of deleted objects.
+	Deleted bool
+	// LastKnownParent is the container a deleted object was in.
+	LastKnownParent string
+	// USN is the update sequence number of the change on the domain controller.
+	USN int64
+}
+
+// changeCookie is the state behind an opaque cookie. USNs are local to a domain controller,
+// so the cookie pins the domain controller and its database by invocation id.
+type changeCookie struct {
+	Server       string
+	InvocationID string
+	USN          int64
+}
+
+func (c changeCookie) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeChangeCookie(cookie string) (c changeCookie, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(cookie)
+	if err != nil {
+		return c, errors.New("invalid change cookie")
+	}
+	err = json.Unmarshal(b, &c)
+	if err != nil || c.Server == "" {
+		return c, errors.New("invalid change cookie")
+	}
+	return c, nil
+}
+
+// dcState is the current position of a domain controller's database.
+type dcState struct {
+	Server       string
+	InvocationID string
+	USN          int64
+}
+
+// getDCState returns the host name, invocation id and highest committed USN of the domain
+// controller c.Server is served by.
+func (c *Connection) getDCState() (state dcState, err error) {
+
+	var cmd bytes.Buffer
+	cmd.WriteString("$r = Get-ADRootDSE -Server ")
+	cmd.WriteString(ps.QuoteString(c.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(c.Credential.Expr())
+	cmd.WriteString("; $n = Get-ADObject -Server $r.dnsHostName -Credential ")
+	cmd.WriteString(c.Credential.Expr())
+	cmd.WriteString(" -Identity $r.dsServiceName -Properties invocationId")
+	cmd.WriteString("; [pscustomobject]@{ Server = [string]$r.dnsHostName; InvocationID = [string]$n.invocationId; USN = [int64][string]$r.highestCommittedUSN } | ConvertTo-Json")
+
+	result, err := powershell(cmd.String())
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(result, &state)
+	return state, err
+}
+
+// Changes returns the objects created, changed or deleted since the cookie was issued, and a
+// new cookie to continue from next time. A blank cookie returns every object, without
+// deletions, as a starting point.
+func (c *Connection) Changes(cookie string) (changes []Change, next string, err error) {
+	return c.ChangesWithOptions(cookie, Search{})
+}
+
+// ChangesWithOptions is Changes limited to the objects matching s. The filter is also
+// matched against deleted objects, which lose most attributes but keep objectClass, so
+// filter on objectClass rather than objectCategory to see deletions.
+//
+// Changes are found by uSNChanged on a single domain controller, which the cookie is pinned
+// to. The DirSync control is not available through the ActiveDirectory module. An object that
+// changed several times is returned once, with its current state. If the database of the
+// domain controller was restored, ErrResyncRequired is returned. If the domain controller can
+// not be reached, its error is returned with the same cookie, so the call can be retried; to
+// continue on another domain controller, start over with a blank cookie.
+func (c *Connection) ChangesWithOptions(cookie string, s Search) (changes []Change, next string, err error) {
+
+	var from changeCookie
+	dc := *c
+	if cookie != "" {
+		from, err = decodeChangeCookie(cookie)
+		if err != nil {
+			return changes, cookie, err
+		}
+		dc.Server = from.Server
+	}
+
+	state, err := dc.getDCState()
+	if err != nil {
+		return changes, cookie, err
+	}
+	if cookie != "" && !strings.EqualFold(state.InvocationID, from.InvocationID) {
+		return changes, cookie, ErrResyncRequired
+	}
+	dc.Server = state.Server
+	next = changeCookie{Server: state.Server, InvocationID: state.InvocationID, USN: state.USN}.encode()
+	if cookie != "" && from.USN >= state.USN {
+		return changes, next, nil
+	}
+
+	extra := []string{"uSNChanged", "uSNCreated", "isDeleted", "lastKnownParent"}
+	q := s
+	q.Attributes = append(append([]string(nil), s.Attributes...), extra...)
+	q.Filter = "(&(uSNChanged>=" + strconv.FormatInt(from.USN+1, 10) + ")(uSNChanged<=" + strconv.FormatInt(state.USN, 10) + ")" + s.Filter + ")"
+
+	collect := func(obj Object) error {
+		ch := Change{Object: obj}
+		usn, _ := obj.Attributes.Get("uSNChanged")
+		created, _ := obj.Attributes.Get("uSNCreated")
+		deleted, _ := obj.Attributes.Get("isDeleted")
+		parent, _ := obj.Attributes.Get("lastKnownParent")
+		ch.USN, _ = usn.Int64()
+		n, _ := created.Int64()
+		ch.Created = n > from.USN
+		ch.Deleted, _ = deleted.Bool()
+		ch.LastKnownParent = parent.String()
+
+		// a blank cookie is a starting point, and nothing before it was ever seen
+		if ch.Deleted && (cookie == "" || ch.Created) {
+			return nil
+		}
+		if ch.Deleted && s.Base != "" && !isUnder(ch.LastKnownParent, s.Base) {
+			return nil
+		}
+
+		for name := range ch.Attributes {
+			if containsFold(extra, name) && !containsFold(s.Attributes, name) {
+				delete(ch.Attributes, name)
+			}
+		}
+		ch.originalAttributes = ch.Attributes.clone()
+		changes = append(changes, ch)
+		return nil
+	}
+
+	if s.Base == "" {
+		q.IncludeDeleted = cookie != ""
+		err = dc.eachObject(q, collect)
+	} else {
+		// tombstones are not below the base anymore, look for them separately
+		err = dc.eachObject(q, collect)
+		if err == nil && cookie != "" {
+			d := q
+			d.Base = ""
+			d.Scope = ScopeSubtree
+			d.IncludeDeleted = true
+			d.Filter = "(&(isDeleted=TRUE)" + q.Filter + ")"
+			err = dc.eachObject(d, collect)
+		}
+	}
+	if err != nil {
+		return changes, cookie, err
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].USN < changes[j].USN })
+
+	for i := range changes {
+		changes[i].Connection = *c
+	}
+	return changes, next, nil
+}
+
+// isUnder returns true if dn is base or below it.
+func isUnder(dn, base string) bool {
+	dn, base = strings.ToLower(dn), strings.ToLower(base)
+	return dn == base || strings.HasSuffix(dn, ","+base)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package ad
+
+import (
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jakobii/ps"
+)
+
+func TestChangeCookie(t *testing.T) {
+
+	c := changeCookie{Server: "dc1.example.com", InvocationID: "2f5c1a0e-7f4b-4f7e-8d8e-0a8c0f4a1b2c", USN: 1234567}
+	encoded := c.encode()
+	if strings.ContainsAny(encoded, "+/=") {
+		t.Errorf("cookie %q is not URL safe", encoded)
+	}
+	back, err := decodeChangeCookie(encoded)
+	if err != nil || back != c {
+		t.Errorf("decodeChangeCookie(%q) = %+v, %v", encoded, back, err)
+	}
+
+	tests := []string{
+		"",
+		"not a cookie!",
+		base64.RawURLEncoding.EncodeToString([]byte("not json")),
+		base64.RawURLEncoding.EncodeToString([]byte(`{"InvocationID":"x","USN":1}`)),
+		base64.RawURLEncoding.EncodeToString([]byte(`{"Server":"dc1","USN":"many"}`)),
+		base64.StdEncoding.EncodeToString([]byte(`{"Server":"dc1"}`)),
+	}
+	for _, in := range tests {
+		if _, err := decodeChangeCookie(in); err == nil {
+			t.Errorf("decodeChangeCookie(%q) succeeded", in)
+		}
+	}
+}
+
+func TestChangesCookieState(t *testing.T) {
+
+	cookie := changeCookie{Server: "dc1.example.com", InvocationID: "2f5c1a0e-7f4b-4f7e-8d8e-0a8c0f4a1b2c", USN: 500}.encode()
+	state := `{"Server":"dc1.example.com","InvocationID":"2F5C1A0E-7F4B-4F7E-8D8E-0A8C0F4A1B2C","USN":500}`
+	scripts := recordPowershell(t, func(string) ([]byte, error) { return []byte(state), nil })
+	c := NewConnection("example.com", "svc", "secret")
+
+	// nothing was committed since the cookie
+	changes, next, err := c.Changes(cookie)
+	if err != nil || len(changes) != 0 {
+		t.Errorf("Changes() = %v, %v", changes, err)
+	}
+	if n, err := decodeChangeCookie(next); err != nil || n.USN != 500 || n.Server != "dc1.example.com" {
+		t.Errorf("next cookie = %+v, %v", n, err)
+	}
+	if len(*scripts) != 1 || !strings.Contains((*scripts)[0], ps.QuoteString("dc1.example.com")) {
+		t.Errorf("the domain controller of the cookie was not asked: %v", *scripts)
+	}
+
+	// the database was restored
+	state = `{"Server":"dc1.example.com","InvocationID":"9d7c2b1a-0000-4f7e-8d8e-0a8c0f4a1b2c","USN":900}`
+	if _, next, err := c.Changes(cookie); err != ErrResyncRequired || next != cookie {
+		t.Errorf("Changes() = %q, %v, want ErrResyncRequired", next, err)
+	}
+}
+
+// changeTestObject returns a search result line with the attributes Changes asks for.
+func changeTestObject(guid, dn string, created, changed int, deleted bool, parent string) string {
+	attrs := `{"Name":"uSNCreated","Values":["` + strconv.Itoa(created) + `"]},{"Name":"uSNChanged","Values":["` + strconv.Itoa(changed) + `"]},` +
+		`{"Name":"description","Values":["x"]}`
+	if deleted {
+		attrs += `,{"Name":"isDeleted","Values":["TRUE"]},{"Name":"lastKnownParent","Values":["` + parent + `"]}`
+	}
+	name, _ := ParseDistinguishedName(dn)
+	return `{"ObjectGuid":"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0` + guid + `","ObjectClass":"user","DistinguishedName":"` + dn + `","Name":"` + name + `","Attributes":[` + attrs + "]}\n"
+}
+
+func TestChangesWindow(t *testing.T) {
+
+	const base = "OU=Staff,DC=example,DC=com"
+	cookie := changeTestCookie(500)
+	changed := changeTestObject("c01", "CN=changed,"+base, 100, 600, false, "")
+	created := changeTestObject("c02", "CN=created,"+base, 700, 700, false, "")
+	deleted := changeTestObject("c03", `CN=deleted DEL:1,CN=Deleted Objects,DC=example,DC=com`, 100, 800, true, base)
+	elsewhere := changeTestObject("c04", `CN=elsewhere DEL:2,CN=Deleted Objects,DC=example,DC=com`, 100, 810, true, "OU=Other,DC=example,DC=com")
+	shortLived := changeTestObject("c05", `CN=short DEL:3,CN=Deleted Objects,DC=example,DC=com`, 650, 820, true, base)
+
+	var searches []string
+	recordPowershell(t, func(script string) ([]byte, error) {
+		if strings.Contains(script, "Get-ADRootDSE") {
+			return []byte(`{"Server":"dc1.example.com","InvocationID":"2f5c1a0e-7f4b-4f7e-8d8e-0a8c0f4a1b2c","USN":900}`), nil
+		}
+		searches = append(searches, script)
+		if strings.Contains(script, "(isDeleted=TRUE)") {
+			return []byte(elsewhere + shortLived + deleted), nil
+		}
+		return []byte(created + changed), nil
+	})
+	c := NewConnection("example.com", "svc", "secret")
+
+	changes, _, err := c.ChangesWithOptions(cookie, Search{Base: base, Filter: "(objectClass=user)", Attributes: []string{"description"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, ch := range changes {
+		got = append(got, ch.Name+" "+strconv.FormatInt(ch.USN, 10)+" "+strconv.FormatBool(ch.Created)+" "+strconv.FormatBool(ch.Deleted)+" "+ch.LastKnownParent)
+		for _, name := range []string{"uSNChanged", "uSNCreated", "isDeleted", "lastKnownParent"} {
+			if _, ok := ch.Attributes.Get(name); ok {
+				t.Errorf("%s has the unrequested attribute %s", ch.Name, name)
+			}
+		}
+		if _, ok := ch.Attributes.Get("description"); !ok {
+			t.Errorf("%s lost the requested description", ch.Name)
+		}
+	}
+	want := []string{"changed 600 false false ", "created 700 true false ", "deleted DEL:1 800 false true " + base}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("changes = %q, want %q", got, want)
+	}
+
+	if len(searches) != 2 {
+		t.Fatalf("searches = %v", searches)
+	}
+	window := "(&(uSNChanged>=501)(uSNChanged<=900)(objectClass=user))"
+	if !strings.Contains(searches[0], ps.QuoteString(window)) || !strings.Contains(searches[0], " -SearchBase "+ps.QuoteString(base)) ||
+		strings.Contains(searches[0], "-IncludeDeletedObjects") {
+		t.Errorf("search below the base = %s", searches[0])
+	}
+	if !strings.Contains(searches[1], ps.QuoteString("(&(isDeleted=TRUE)"+window+")")) || strings.Contains(searches[1], "-SearchBase") ||
+		!strings.Contains(searches[1], "-IncludeDeletedObjects") {
+		t.Errorf("search for tombstones = %s", searches[1])
+	}
+}
+
+func TestChangesStart(t *testing.T) {
+
+	var searches []string
+	recordPowershell(t, func(script string) ([]byte, error) {
+		if strings.Contains(script, "Get-ADRootDSE") {
+			return []byte(`{"Server":"dc1.example.com","InvocationID":"2f5c1a0e-7f4b-4f7e-8d8e-0a8c0f4a1b2c","USN":900}`), nil
+		}
+		searches = append(searches, script)
+		return []byte(changeTestObject("c01", "CN=a,DC=example,DC=com", 100, 600, false, "") +
+			changeTestObject("c02", `CN=b DEL:1,CN=Deleted Objects,DC=example,DC=com`, 100, 800, true, "DC=example,DC=com")), nil
+	})
+	c := NewConnection("example.com", "svc", "secret")
+
+	// a blank cookie returns everything up to now, without tombstones
+	changes, next, err := c.Changes("")
+	if err != nil || len(changes) != 1 || changes[0].Name != "a" || !changes[0].Created {
+		t.Errorf("Changes() = %+v, %v", changes, err)
+	}
+	if len(searches) != 1 || !strings.Contains(searches[0], "(uSNChanged>=1)(uSNChanged<=900)") || strings.Contains(searches[0], "-IncludeDeletedObjects") {
+		t.Errorf("searches = %v", searches)
+	}
+	if n, _ := decodeChangeCookie(next); n.USN != 900 {
+		t.Errorf("next cookie = %+v", n)
+	}
+
+	// without a base, tombstones are found by the same search
+	searches = nil
+	if _, _, err := c.Changes(changeTestCookie(500)); err != nil {
+		t.Fatal(err)
+	}
+	if len(searches) != 1 || !strings.Contains(searches[0], "-IncludeDeletedObjects") {
+		t.Errorf("searches = %v", searches)
+	}
+}
+
+func TestChangesUnreachable(t *testing.T) {
+
+	recordPowershell(t, func(string) ([]byte, error) { return nil, errors.New("the server is not operational") })
+	c := NewConnection("example.com", "svc", "secret")
+
+	cookie := changeTestCookie(500)
+	_, next, err := c.Changes(cookie)
+	if err == nil || err == ErrResyncRequired || next != cookie {
+		t.Errorf("Changes() = %q, %v, want the error and the same cookie", next, err)
+	}
+}
+
+func changeTestCookie(usn int64) string {
+	return changeCookie{Server: "dc1.example.com", InvocationID: "2f5c1a0e-7f4b-4f7e-8d8e-0a8c0f4a1b2c", USN: usn}.encode()
+}
@@ -0,0 +1,106 @@
+package ad
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/jakobii/ps"
+)
+
+// Contact is a mail-enabled contact, a recipient outside of the organization.
+type Contact struct {
+	Object
+	Recipient
+
+	DisplayName string
+	GivenName   string
+	Surname     string
+	Initials    string
+	Description string
+	Mail        string
+}
+
+// GetContact returns a contact with its mail attributes.
+func (c *Connection) GetContact(Identity string) (contact Contact, err error) {
+
+	var cmd bytes.Buffer
+	cmd.WriteString("Get-ADObject -Server ")
+	cmd.WriteString(ps.QuoteString(c.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(c.Credential.Expr())
+	cmd.WriteString(" -Identity ")
+	cmd.WriteString(ps.QuoteString(Identity))
+	cmd.WriteString(" -Properties * | Select-Object @('ObjectGuid', 'ObjectClass',  'DistinguishedName', 'Name', 'displayName', 'givenName', @{n='Surname';e={$_.sn}}, 'initials', 'description', 'mail', ")
+	cmd.WriteString(psRecipientSelect)
+	cmd.WriteString(" ) | ConvertTo-Json")
+
+	result, err := powershell(cmd.String())
+	if err != nil {
+		return contact, err
+	}
+
+	// Object
+	err = json.Unmarshal(result, &contact.Object)
+	if err != nil {
+		return contact, err
+	}
+	if contact.ObjectClass != "contact" {
+		return contact, errors.New(Identity + " is a " + contact.ObjectClass + ", not a contact")
+	}
+
+	// Contact
+	err = json.Unmarshal(result, &contact)
+	if err != nil {
+		return contact, err
+	}
+
+	contact.Recipient.pulled()
+	contact.Connection = *c
+	return contact, nil
+}
+
+func (c *Contact) Pull() error {
+	id, err := c.Identity()
+	if err != nil {
+		return err
+	}
+	contact, err := c.GetContact(id)
+	if err != nil {
+		return err
+	}
+	*c = contact
+	return nil
+}
+
+// Push writes the contact, creating it at DistinguishedName if it has no ObjectGuid.
+func (c *Contact) Push() error {
+
+	if c.ObjectGuid.String() == "00000000-0000-0000-0000-000000000000" {
+		if strings.TrimSpace(c.DistinguishedName) == "" {
+			return errors.New("DistinguishedName can not be blank")
+		}
+		c.ObjectClass = "contact"
+		err := c.create()
+		if err != nil {
+			return err
+		}
+	}
+
+	var m modification
+	m.replace("displayName", NewStringAttribute(c.DisplayName))
+	m.replace("givenName", NewStringAttribute(c.GivenName))
+	m.replace("sn", NewStringAttribute(c.Surname))
+	m.replace("initials", NewStringAttribute(c.Initials))
+	m.replace("description", NewStringAttribute(c.Description))
+	m.replace("mail", NewStringAttribute(c.Mail))
+	c.Recipient.changes(&m)
+
+	err := c.modify(m)
+	if err != nil {
+		return err
+	}
+	c.Recipient.pulled()
+	return nil
+}
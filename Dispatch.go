@@ -0,0 +1,445 @@
+package ad
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Notification is a directory event as delivered to sinks. Topic is the kind of object and
+// what happened to it, e.g. user.created, user.disabled, group.membership_changed or
+// organizationalUnit.moved.
+type Notification struct {
+	ID                   string
+	Topic                string
+	Time                 time.Time
+	DistinguishedName    string
+	OldDistinguishedName string `json:",omitempty"`
+	ObjectGuid           string
+	ObjectClass          string
+	Name                 string
+	// Attributes are the attributes loaded by the watch, binary values base64 encoded.
+	Attributes map[string][]string `json:",omitempty"`
+}
+
+// Notification topics, prefixed with user., group. or organizationalUnit.
+const (
+	TopicCreated           = "created"
+	TopicUpdated           = "updated"
+	TopicMoved             = "moved"
+	TopicDeleted           = "deleted"
+	TopicDisabled          = "disabled"
+	TopicEnabled           = "enabled"
+	TopicMembershipChanged = "membership_changed"
+)
+
+// Sink delivers notifications somewhere, e.g. to a webhook or a message queue.
+type Sink interface {
+	Send(ctx context.Context, n Notification) error
+}
+
+// PermanentError wraps sink errors that retrying will not fix, like a rejected request.
+type PermanentError struct {
+	Err error
+}
+
+func (e PermanentError) Error() string { return e.Err.Error() }
+func (e PermanentError) Unwrap() error { return e.Err }
+
+// WebhookSink posts every notification as JSON to URL. If Secret is set, the request is signed
+// with an HMAC-SHA256 of the timestamp, a dot and the body, sent as
+// X-Directory-Signature: sha256=<hex> along with X-Directory-Timestamp, so receivers can check
+// where it came from and reject replays.
+type WebhookSink struct {
+	URL     string
+	Secret  []byte
+	Header  http.Header
+	Client  *http.Client // http.DefaultClient if nil
+	Timeout time.Duration
+}
+
+// Sign returns the signature of a webhook body sent at timestamp, in the form of the
+// X-Directory-Signature header.
+func (s *WebhookSink) Sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, s.Secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *WebhookSink) Send(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return PermanentError{err}
+	}
+
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return PermanentError{err}
+	}
+	for k, v := range s.Header {
+		req.Header[k] = v
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Directory-Event", n.Topic)
+	req.Header.Set("X-Directory-Delivery", n.ID)
+	req.Header.Set("X-Directory-Timestamp", timestamp)
+	if len(s.Secret) > 0 {
+		req.Header.Set("X-Directory-Signature", s.Sign(timestamp, body))
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("webhook %s answered %s", s.URL, resp.Status)
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return PermanentError{err}
+	}
+	return err
+}
+
+// WriterSink writes every notification as a line of JSON. It stands in for a message queue
+// when trying out a setup, or pipes notifications to another process.
+type WriterSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewWriterSink returns a sink writing to w.
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{enc: json.NewEncoder(w)}
+}
+
+func (s *WriterSink) Send(ctx context.Context, n Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(n)
+}
+
+// SinkFunc adapts a function to a Sink, e.g. to publish to NATS or Kafka with their clients.
+type SinkFunc func(ctx context.Context, n Notification) error
+
+func (f SinkFunc) Send(ctx context.Context, n Notification) error { return f(ctx, n) }
+
+// Dispatcher turns directory changes into notifications and delivers them to sinks.
+type Dispatcher struct {
+	Watch WatchOptions
+	Sinks []Sink
+	// Topics limits the notifications sent to those matching any of the patterns, e.g.
+	// user.disabled, group.* or *.deleted, in the syntax of path.Match. All are sent if empty.
+	Topics []string
+	// Retries is how often a failed delivery is retried, 5 if it is not set. The first retry
+	// is after RetryInterval, 1 second if it is not set, and the interval doubles every time.
+	Retries       int
+	RetryInterval time.Duration
+	// DeadLetter is a file that notifications are appended to, as lines of JSON with the error,
+	// when a sink did not take them after all retries.
+	DeadLetter string
+	// CookieFile keeps the watch cookie, so a restarted dispatcher resumes where it stopped.
+	CookieFile string
+	// OnError is called with errors the dispatcher recovers from. It must not block.
+	OnError func(error)
+}
+
+// deadLetter is a line in the dead letter file.
+type deadLetter struct {
+	Notification Notification
+	Sink         string
+	Error        string
+	Time         time.Time
+}
+
+// objectState is what the dispatcher needs to know about an object to tell what changed.
+type objectState struct {
+	disabled bool
+	members  [sha256.Size]byte
+}
+
+// Dispatch runs the dispatcher until ctx is done or the watch fails.
+func (c *Connection) Dispatch(ctx context.Context, d Dispatcher) error {
+
+	if len(d.Sinks) == 0 {
+		return errors.New("no sinks")
+	}
+	for _, t := range d.Topics {
+		if _, err := path.Match(t, ""); err != nil {
+			return fmt.Errorf("topic %q: %v", t, err)
+		}
+	}
+	if d.Retries <= 0 {
+		d.Retries = 5
+	}
+	if d.RetryInterval <= 0 {
+		d.RetryInterval = time.Second
+	}
+	if d.OnError == nil {
+		d.OnError = func(error) {}
+	}
+	if d.Watch.OnError == nil {
+		d.Watch.OnError = d.OnError
+	}
+
+	if d.CookieFile != "" && d.Watch.Cookie == "" {
+		b, err := os.ReadFile(d.CookieFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		d.Watch.Cookie = strings.TrimSpace(string(b))
+	}
+
+	// userAccountControl and member tell disabled accounts and membership changes apart
+	for _, name := range []string{"userAccountControl", "member"} {
+		if !containsFold(d.Watch.Attributes, name) {
+			d.Watch.Attributes = append(d.Watch.Attributes, name)
+		}
+	}
+
+	// remember the current state, so the first change already has something to compare with
+	states := make(map[uuid.UUID]objectState)
+	seed := d.Watch.Search
+	seed.Filter = "(&(|(&(objectClass=user)(!(objectClass=computer)))(objectClass=group))" + seed.Filter + ")"
+	seed.Attributes = []string{"userAccountControl", "member"}
+	err := c.eachObject(seed, func(obj Object) error {
+		states[obj.ObjectGuid] = stateOf(obj)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	events, errc := c.WatchWithOptions(ctx, d.Watch)
+	for e := range events {
+		for _, n := range d.notifications(e, states) {
+			if !d.wants(n.Topic) {
+				continue
+			}
+			for i, s := range d.Sinks {
+				err := d.deliver(ctx, s, n)
+				if err != nil && ctx.Err() == nil {
+					d.OnError(err)
+					err = d.deadLetter(n, fmt.Sprintf("%d %T", i, s), err)
+					if err != nil {
+						d.OnError(err)
+					}
+				}
+			}
+		}
+		if e.Cookie != "" && d.CookieFile != "" {
+			err := writeFileAtomic(d.CookieFile, []byte(e.Cookie))
+			if err != nil {
+				d.OnError(err)
+			}
+		}
+	}
+
+	err = <-errc
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+func stateOf(obj Object) objectState {
+	uac, _ := obj.Attributes.Get("userAccountControl")
+	n, _ := uac.Int64()
+	member, _ := obj.Attributes.Get("member")
+	values := member.Strings()
+	for i := range values {
+		values[i] = strings.ToLower(values[i])
+	}
+	sort.Strings(values)
+	return objectState{
+		disabled: UserAccountControl(n).Disabled(),
+		members:  sha256.Sum256([]byte(strings.Join(values, "\n"))),
+	}
+}
+
+// notifications returns the notifications for an event and updates the known state.
+func (d *Dispatcher) notifications(e Event, states map[uuid.UUID]objectState) []Notification {
+
+	kind := e.Object.ObjectClass
+	switch kind {
+	case "group", "organizationalUnit":
+	default:
+		kind = "user"
+	}
+
+	base := Notification{
+		Time:                 time.Now().UTC(),
+		DistinguishedName:    e.Object.DistinguishedName,
+		OldDistinguishedName: e.OldDistinguishedName,
+		ObjectGuid:           e.Object.ObjectGuid.String(),
+		ObjectClass:          e.Object.ObjectClass,
+		Name:                 e.Object.Name,
+		Attributes:           notificationAttributes(e.Object.Attributes),
+	}
+	var topics []string
+
+	old, seen := states[e.Object.ObjectGuid]
+	now := stateOf(e.Object)
+	switch e.Type {
+	case EventAdd:
+		topics = append(topics, TopicCreated)
+		states[e.Object.ObjectGuid] = now
+	case EventDelete:
+		topics = append(topics, TopicDeleted)
+		delete(states, e.Object.ObjectGuid)
+	case EventMove, EventModify:
+		// a move may come with other changes, which are reported along with it
+		if e.Type == EventMove {
+			topics = append(topics, TopicMoved)
+		} else {
+			topics = append(topics, TopicUpdated)
+		}
+		if kind == "user" && seen && old.disabled != now.disabled {
+			if now.disabled {
+				topics = append(topics, TopicDisabled)
+			} else {
+				topics = append(topics, TopicEnabled)
+			}
+		}
+		if kind == "group" && seen && old.members != now.members {
+			topics = append(topics, TopicMembershipChanged)
+		}
+		states[e.Object.ObjectGuid] = now
+	}
+
+	list := make([]Notification, 0, len(topics))
+	for _, t := range topics {
+		n := base
+		n.ID = newDeliveryID()
+		n.Topic = kind + "." + t
+		list = append(list, n)
+	}
+	return list
+}
+
+func notificationAttributes(attrs Attributes) map[string][]string {
+	if len(attrs) == 0 {
+		return nil
+	}
+	m := make(map[string][]string, len(attrs))
+	for name, a := range attrs {
+		values := make([]string, 0, len(a.Values))
+		for _, v := range a.Values {
+			if a.Binary {
+				values = append(values, base64.StdEncoding.EncodeToString(v))
+			} else {
+				values = append(values, string(v))
+			}
+		}
+		m[name] = values
+	}
+	return m
+}
+
+func newDeliveryID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// wants returns true if the topic passes the Topics filter.
+func (d *Dispatcher) wants(topic string) bool {
+	if len(d.Topics) == 0 {
+		return true
+	}
+	for _, t := range d.Topics {
+		if ok, _ := path.Match(t, topic); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver sends a notification to a sink, retrying with backoff.
+func (d *Dispatcher) deliver(ctx context.Context, s Sink, n Notification) error {
+	wait := d.RetryInterval
+	for attempt := 0; ; attempt++ {
+		err := s.Send(ctx, n)
+		var permanent PermanentError
+		if err == nil || errors.As(err, &permanent) || attempt >= d.Retries {
+			return err
+		}
+		d.OnError(err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		wait *= 2
+	}
+}
+
+func (d *Dispatcher) deadLetter(n Notification, sink string, cause error) error {
+	if d.DeadLetter == "" {
+		return nil
+	}
+	line, err := json.Marshal(deadLetter{Notification: n, Sink: sink, Error: cause.Error(), Time: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(d.DeadLetter, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeFileAtomic replaces a file, so a crash never leaves half of it behind.
+func writeFileAtomic(name string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
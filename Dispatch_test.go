@@ -0,0 +1,290 @@
+package ad
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestWebhookSink(t *testing.T) {
+
+	var status int32 = http.StatusOK
+	var got struct {
+		header http.Header
+		body   []byte
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got.header = r.Header.Clone()
+		got.body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+
+	s := &WebhookSink{URL: srv.URL, Secret: []byte("s3cret"), Header: http.Header{"Authorization": {"Bearer x"}}}
+	n := Notification{ID: "d1", Topic: "user.disabled", DistinguishedName: "CN=a,DC=example,DC=com"}
+	if err := s.Send(context.Background(), n); err != nil {
+		t.Fatal(err)
+	}
+
+	timestamp := got.header.Get("X-Directory-Timestamp")
+	if sig := got.header.Get("X-Directory-Signature"); sig == "" || sig != s.Sign(timestamp, got.body) {
+		t.Errorf("signature %q does not match the body", sig)
+	}
+	if other := (&WebhookSink{Secret: []byte("other")}).Sign(timestamp, got.body); other == got.header.Get("X-Directory-Signature") {
+		t.Error("signature does not depend on the secret")
+	}
+	if s.Sign(timestamp, got.body) == s.Sign(timestamp+"1", got.body) {
+		t.Error("signature does not depend on the timestamp")
+	}
+	if got.header.Get("X-Directory-Event") != "user.disabled" || got.header.Get("X-Directory-Delivery") != "d1" ||
+		got.header.Get("Authorization") != "Bearer x" || got.header.Get("Content-Type") != "application/json" {
+		t.Errorf("headers = %v", got.header)
+	}
+	var sent Notification
+	if err := json.Unmarshal(got.body, &sent); err != nil || sent.DistinguishedName != n.DistinguishedName {
+		t.Errorf("body = %s, %v", got.body, err)
+	}
+
+	// without a secret there is no signature
+	if err := (&WebhookSink{URL: srv.URL}).Send(context.Background(), n); err != nil || got.header.Get("X-Directory-Signature") != "" {
+		t.Errorf("unsigned Send() = %v, signature %q", err, got.header.Get("X-Directory-Signature"))
+	}
+
+	tests := []struct {
+		status    int
+		permanent bool
+	}{
+		{http.StatusNoContent, false},
+		{http.StatusBadRequest, true},
+		{http.StatusUnauthorized, true},
+		{http.StatusNotFound, true},
+		{http.StatusRequestTimeout, false},
+		{http.StatusTooManyRequests, false},
+		{http.StatusInternalServerError, false},
+		{http.StatusServiceUnavailable, false},
+	}
+	for _, test := range tests {
+		atomic.StoreInt32(&status, int32(test.status))
+		err := s.Send(context.Background(), n)
+		var permanent PermanentError
+		if test.status < 300 {
+			if err != nil {
+				t.Errorf("%d: %v", test.status, err)
+			}
+			continue
+		}
+		if err == nil || errors.As(err, &permanent) != test.permanent {
+			t.Errorf("%d: Send() = %v, want permanent %t", test.status, err, test.permanent)
+		}
+	}
+}
+
+func TestDeliverRetries(t *testing.T) {
+
+	tests := []struct {
+		statuses []int
+		requests int32
+		ok       bool
+	}{
+		{[]int{503, 500, 200}, 3, true},
+		{[]int{400}, 1, false},
+		{[]int{503, 404}, 2, false},
+		{[]int{500, 500, 500, 500}, 3, false},
+	}
+
+	for _, test := range tests {
+		var requests int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			i := atomic.AddInt32(&requests, 1) - 1
+			w.WriteHeader(test.statuses[int(i)%len(test.statuses)])
+		}))
+
+		var errs int
+		d := Dispatcher{Retries: 2, RetryInterval: time.Millisecond, OnError: func(error) { errs++ }}
+		err := d.deliver(context.Background(), &WebhookSink{URL: srv.URL}, Notification{ID: "d1"})
+		srv.Close()
+
+		if (err == nil) != test.ok || requests != test.requests {
+			t.Errorf("%v: deliver() = %v after %d requests, want %d", test.statuses, err, requests, test.requests)
+		}
+		if errs != int(requests)-1 && test.ok {
+			t.Errorf("%v: OnError was called %d times", test.statuses, errs)
+		}
+	}
+
+	// a canceled context stops the retries
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d := Dispatcher{Retries: 5, RetryInterval: time.Hour, OnError: func(error) {}}
+	err := d.deliver(ctx, SinkFunc(func(context.Context, Notification) error { return errors.New("down") }), Notification{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("deliver() = %v, want context.Canceled", err)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+
+	name := filepath.Join(t.TempDir(), "dead.jsonl")
+	d := Dispatcher{DeadLetter: name}
+	for _, id := range []string{"d1", "d2"} {
+		if err := d.deadLetter(Notification{ID: id, Topic: "user.created"}, "0 *ad.WebhookSink", errors.New("webhook answered 500")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var ids []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var l deadLetter
+		if err := json.Unmarshal(s.Bytes(), &l); err != nil {
+			t.Fatalf("line %q: %v", s.Text(), err)
+		}
+		if l.Error != "webhook answered 500" || l.Sink != "0 *ad.WebhookSink" || l.Time.IsZero() {
+			t.Errorf("dead letter = %+v", l)
+		}
+		ids = append(ids, l.Notification.ID)
+	}
+	if !reflect.DeepEqual(ids, []string{"d1", "d2"}) {
+		t.Errorf("dead letters = %v", ids)
+	}
+	if info, err := os.Stat(name); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("dead letter file mode = %v, %v", info.Mode(), err)
+	}
+
+	// without a file nothing is written
+	if err := (&Dispatcher{}).deadLetter(Notification{}, "", errors.New("x")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "cookie")
+	for _, data := range []string{"first cookie", "second"} {
+		if err := writeFileAtomic(name, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(name)
+		if err != nil || string(b) != data {
+			t.Errorf("file = %q, %v, want %q", b, err, data)
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("temporary files were left behind: %v", entries)
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, "missing", "cookie"), []byte("x")); err == nil {
+		t.Error("writing into a missing directory succeeded")
+	}
+}
+
+// dispatchObject returns an object with the attributes the dispatcher keeps state of.
+func dispatchObject(guid uuid.UUID, class string, uac UserAccountControl, members ...string) Object {
+	obj := Object{ObjectGuid: guid, ObjectClass: class, DistinguishedName: "CN=x,DC=example,DC=com", Attributes: Attributes{}}
+	if uac != 0 {
+		obj.Attributes.Set("userAccountControl", NewStringAttribute(strconv.Itoa(int(uac))))
+	}
+	if class == "group" {
+		obj.Attributes.Set("member", NewStringAttribute(members...))
+	}
+	return obj
+}
+
+func TestNotifications(t *testing.T) {
+
+	user, group, ou := uuid.New(), uuid.New(), uuid.New()
+	states := map[uuid.UUID]objectState{
+		user:  stateOf(dispatchObject(user, "user", UACNormalAccount)),
+		group: stateOf(dispatchObject(group, "group", 0, "CN=a,DC=example,DC=com")),
+	}
+	var d Dispatcher
+
+	tests := []struct {
+		name  string
+		event Event
+		want  []string
+	}{
+		{"modify", Event{Type: EventModify, Object: dispatchObject(user, "user", UACNormalAccount)}, []string{"user.updated"}},
+		{"disable", Event{Type: EventModify, Object: dispatchObject(user, "user", UACNormalAccount|UACAccountDisable)}, []string{"user.updated", "user.disabled"}},
+		{"move and enable", Event{Type: EventMove, Object: dispatchObject(user, "user", UACNormalAccount)}, []string{"user.moved", "user.enabled"}},
+		{"move", Event{Type: EventMove, Object: dispatchObject(user, "user", UACNormalAccount)}, []string{"user.moved"}},
+		{"members in another order", Event{Type: EventModify, Object: dispatchObject(group, "group", 0, "cn=A,DC=example,DC=com")}, []string{"group.updated"}},
+		{"move and add member", Event{Type: EventMove, Object: dispatchObject(group, "group", 0, "CN=a,DC=example,DC=com", "CN=b,DC=example,DC=com")}, []string{"group.moved", "group.membership_changed"}},
+		{"add member", Event{Type: EventModify, Object: dispatchObject(group, "group", 0, "CN=a,DC=example,DC=com", "CN=b,DC=example,DC=com", "CN=c,DC=example,DC=com")}, []string{"group.updated", "group.membership_changed"}},
+		{"create", Event{Type: EventAdd, Object: dispatchObject(ou, "organizationalUnit", 0)}, []string{"organizationalUnit.created"}},
+		{"delete", Event{Type: EventDelete, Object: dispatchObject(user, "user", UACNormalAccount)}, []string{"user.deleted"}},
+		{"unknown user", Event{Type: EventModify, Object: dispatchObject(user, "inetOrgPerson", UACNormalAccount|UACAccountDisable)}, []string{"user.updated"}},
+	}
+
+	for _, test := range tests {
+		var topics []string
+		ids := make(map[string]bool)
+		for _, n := range d.notifications(test.event, states) {
+			topics = append(topics, n.Topic)
+			if n.ID == "" || ids[n.ID] || n.ObjectGuid != test.event.Object.ObjectGuid.String() {
+				t.Errorf("%s: notification %+v", test.name, n)
+			}
+			ids[n.ID] = true
+		}
+		if !reflect.DeepEqual(topics, test.want) {
+			t.Errorf("%s: topics = %v, want %v", test.name, topics, test.want)
+		}
+	}
+	if _, ok := states[user]; !ok {
+		t.Error("the state of an object modified after its deletion was not kept")
+	}
+}
+
+func TestDispatcherWants(t *testing.T) {
+
+	tests := []struct {
+		topics []string
+		topic  string
+		want   bool
+	}{
+		{nil, "user.created", true},
+		{[]string{"user.disabled"}, "user.disabled", true},
+		{[]string{"user.disabled"}, "user.enabled", false},
+		{[]string{"group.*"}, "group.membership_changed", true},
+		{[]string{"group.*"}, "groups.created", false},
+		{[]string{"group.*"}, "user.created", false},
+		{[]string{"*.deleted"}, "organizationalUnit.deleted", true},
+		{[]string{"*.deleted"}, "user.created", false},
+		{[]string{"user.*abled"}, "user.enabled", true},
+		{[]string{"*"}, "user.created", true},
+		{[]string{"user.created", "group.*"}, "group.created", true},
+		{[]string{"user"}, "user.created", false},
+	}
+	for _, test := range tests {
+		d := Dispatcher{Topics: test.topics}
+		if got := d.wants(test.topic); got != test.want {
+			t.Errorf("%v wants %q = %t", test.topics, test.topic, got)
+		}
+	}
+
+	c := NewConnection("dc1", "svc", "secret")
+	err := c.Dispatch(context.Background(), Dispatcher{Sinks: []Sink{NewWriterSink(io.Discard)}, Topics: []string{"user.["}})
+	if err == nil {
+		t.Error("a malformed topic pattern was accepted")
+	}
+}
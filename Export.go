@@ -0,0 +1,195 @@
+package ad
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+)
+
+// ExportFormat is the output format of an export.
+type ExportFormat string
+
+const (
+	// ExportJSONLines writes one JSON object per line.
+	ExportJSONLines ExportFormat = "jsonl"
+	// ExportCSV writes a header row and one row per object.
+	ExportCSV ExportFormat = "csv"
+	// ExportLDIF writes LDIF content records (RFC 2849).
+	ExportLDIF ExportFormat = "ldif"
+)
+
+// ExportKind limits an export to one kind of object and picks default attributes for it.
+type ExportKind string
+
+const (
+	ExportObjects   ExportKind = ""
+	ExportUsers     ExportKind = "user"
+	ExportGroups    ExportKind = "group"
+	ExportOrgUnits  ExportKind = "organizationalUnit"
+	ExportComputers ExportKind = "computer"
+)
+
+var exportFilters = map[ExportKind]string{
+	ExportUsers:     "(&(objectCategory=person)(objectClass=user))",
+	ExportGroups:    "(objectClass=group)",
+	ExportOrgUnits:  "(objectClass=organizationalUnit)",
+	ExportComputers: "(objectClass=computer)",
+}
+
+var exportAttributes = map[ExportKind][]string{
+	ExportObjects:   {"name", "description", "whenCreated", "whenChanged"},
+	ExportUsers:     {"sAMAccountName", "userPrincipalName", "displayName", "givenName", "sn", "mail", "employeeID", "title", "department", "manager", "userAccountControl", "objectSid", "memberOf", "whenCreated", "whenChanged"},
+	ExportGroups:    {"sAMAccountName", "displayName", "description", "groupType", "objectSid", "member", "memberOf", "whenCreated", "whenChanged"},
+	ExportOrgUnits:  {"ou", "description", "whenCreated", "whenChanged"},
+	ExportComputers: {"sAMAccountName", "dNSHostName", "operatingSystem", "operatingSystemVersion", "userAccountControl", "objectSid", "lastLogonTimestamp", "whenCreated", "whenChanged"},
+}
+
+// Export describes a directory export.
+type Export struct {
+	// Search selects the objects. Its Filter is combined with the filter of Kind,
+	// and blank Attributes default to a set of attributes for Kind.
+	Search
+	Kind   ExportKind
+	Format ExportFormat
+	// Columns are the attributes written as CSV columns, Attributes if blank.
+	// distinguishedName and objectGUID are always available.
+	Columns []string
+	// Separator joins the values of multi-valued attributes in CSV, ";" if blank.
+	Separator string
+}
+
+// exportEntry is an exported object in JSON Lines.
+type exportEntry struct {
+	DistinguishedName string
+	ObjectClass       string
+	ObjectGuid        string
+	Attributes        Attributes
+}
+
+// Export writes every object matching the export to w and returns the number of objects
+// written. Objects are written as PowerShell outputs them, so the export is never held in
+// memory as a whole. Binary values are base64 encoded, except SIDs in CSV.
+func (c *Connection) Export(e Export, w io.Writer) (n int, err error) {
+
+	s := e.Search
+	if f, ok := exportFilters[e.Kind]; ok {
+		if strings.TrimSpace(s.Filter) == "" {
+			s.Filter = f
+		} else {
+			s.Filter = "(&" + f + s.Filter + ")"
+		}
+	} else if e.Kind != ExportObjects {
+		return 0, errors.New("unknown export kind " + string(e.Kind))
+	}
+	if len(s.Attributes) == 0 {
+		s.Attributes = exportAttributes[e.Kind]
+	}
+
+	var write func(Object) error
+	var flush func() error
+	switch e.Format {
+	case ExportJSONLines:
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		write = func(obj Object) error {
+			return enc.Encode(exportEntry{
+				DistinguishedName: obj.DistinguishedName,
+				ObjectClass:       obj.ObjectClass,
+				ObjectGuid:        obj.ObjectGuid.String(),
+				Attributes:        obj.Attributes,
+			})
+		}
+		flush = bw.Flush
+
+	case ExportCSV:
+		columns := e.Columns
+		if len(columns) == 0 {
+			columns = append([]string{"distinguishedName"}, s.Attributes...)
+		}
+		separator := e.Separator
+		if separator == "" {
+			separator = ";"
+		}
+		cw := csv.NewWriter(w)
+		err = cw.Write(columns)
+		if err != nil {
+			return 0, err
+		}
+		write = func(obj Object) error {
+			row := make([]string, len(columns))
+			for i, col := range columns {
+				row[i] = exportColumn(obj, col, separator)
+			}
+			return cw.Write(row)
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+
+	case ExportLDIF:
+		lw := NewLDIFWriter(w)
+		names := s.Attributes
+		hasClass := false
+		for _, v := range names {
+			hasClass = hasClass || strings.EqualFold(v, "objectClass")
+		}
+		if !hasClass {
+			names = append([]string{"objectClass"}, names...)
+		}
+		write = func(obj Object) error {
+			if _, ok := obj.Attributes.Get("objectClass"); !ok {
+				obj.Attributes.Set("objectClass", NewStringAttribute(obj.ObjectClass))
+			}
+			return lw.WriteEntry(obj.DistinguishedName, names, obj.Attributes)
+		}
+		flush = lw.Flush
+
+	default:
+		return 0, errors.New("unknown export format " + string(e.Format))
+	}
+
+	err = c.eachObject(s, func(obj Object) error {
+		n++
+		return write(obj)
+	})
+	if err != nil {
+		flush()
+		return n, err
+	}
+	return n, flush()
+}
+
+// exportColumn returns the values of an attribute as a CSV field.
+func exportColumn(obj Object, name, separator string) string {
+	switch strings.ToLower(name) {
+	case "distinguishedname":
+		return obj.DistinguishedName
+	case "objectguid":
+		return obj.ObjectGuid.String()
+	}
+
+	a, ok := obj.Attributes.Get(name)
+	if !ok {
+		return ""
+	}
+	values := make([]string, 0, len(a.Values))
+	for _, v := range a.Values {
+		if a.Syntax == SyntaxSID {
+			if sid, err := (Attribute{Binary: a.Binary, Values: [][]byte{v}}).SID(); err == nil {
+				values = append(values, sid.String())
+				continue
+			}
+		}
+		if a.Binary {
+			values = append(values, base64.StdEncoding.EncodeToString(v))
+		} else {
+			values = append(values, string(v))
+		}
+	}
+	return strings.Join(values, separator)
+}
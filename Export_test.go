@@ -0,0 +1,155 @@
+package ad
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/jakobii/ps"
+)
+
+// exportTestDirectory answers the search of an export with two users.
+func exportTestDirectory(t *testing.T) *[]string {
+	sid, err := ParseSID("S-1-5-21-1-2-3-1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := `{"ObjectGuid":"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c01","ObjectClass":"user","DistinguishedName":"CN=Jane Doe,DC=example,DC=com","Name":"Jane Doe","Attributes":[` +
+		`{"Name":"sAMAccountName","Values":["jdoe"]},` +
+		`{"Name":"objectSid","Binary":true,"Values":["` + base64.StdEncoding.EncodeToString(sid.Bytes()) + `"]},` +
+		`{"Name":"thumbnailPhoto","Binary":true,"Values":["AQID"]},` +
+		`{"Name":"memberOf","Values":["CN=Staff,DC=example,DC=com","CN=All,DC=example,DC=com"]}]}` + "\n" +
+		`{"ObjectGuid":"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c02","ObjectClass":"user","DistinguishedName":"CN=Al Smith,DC=example,DC=com","Name":"Al Smith","Attributes":[` +
+		`{"Name":"sAMAccountName","Values":["asmith"]},` +
+		`{"Name":"objectClass","Values":["top","person","user"]}]}` + "\n"
+	return recordPowershell(t, func(script string) ([]byte, error) {
+		if strings.Contains(script, "ForEach-Object") {
+			return []byte(objects), nil
+		}
+		return nil, nil
+	})
+}
+
+func TestExportSearch(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		e          Export
+		filter     string
+		attributes []string
+		err        bool
+	}{
+		{name: "objects", e: Export{}, filter: "(objectClass=*)", attributes: exportAttributes[ExportObjects]},
+		{name: "kind", e: Export{Kind: ExportGroups}, filter: "(objectClass=group)", attributes: exportAttributes[ExportGroups]},
+		{name: "kind and filter", e: Export{Kind: ExportUsers, Search: Search{Filter: "(department=Sales)", Attributes: []string{"mail"}}},
+			filter: "(&(&(objectCategory=person)(objectClass=user))(department=Sales))", attributes: []string{"mail"}},
+		{name: "filter", e: Export{Search: Search{Filter: "(cn=x*)"}}, filter: "(cn=x*)", attributes: exportAttributes[ExportObjects]},
+		{name: "unknown kind", e: Export{Kind: "printer"}, err: true},
+		{name: "unknown format", e: Export{Format: "xml"}, err: true},
+	}
+
+	c := NewConnection("dc1", "svc", "secret")
+	for _, test := range tests {
+		scripts := recordPowershell(t, nil)
+		if test.e.Format == "" {
+			test.e.Format = ExportJSONLines
+		}
+		_, err := c.Export(test.e, new(bytes.Buffer))
+		if test.err {
+			if err == nil || len(*scripts) != 0 {
+				t.Errorf("%s: err = %v, scripts = %v", test.name, err, *scripts)
+			}
+			continue
+		}
+		if err != nil || len(*scripts) != 1 {
+			t.Errorf("%s: err = %v, scripts = %v", test.name, err, *scripts)
+			continue
+		}
+		script := (*scripts)[0]
+		if !strings.Contains(script, " -LDAPFilter "+ps.QuoteString(test.filter)+" ") {
+			t.Errorf("%s: filter %s, want %s", test.name, script, test.filter)
+		}
+		if !strings.Contains(script, "$names = "+psNames(test.attributes)+";") {
+			t.Errorf("%s: attributes %s, want %v", test.name, script, test.attributes)
+		}
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+
+	c := NewConnection("dc-export", "svc", "secret")
+	cacheSchema(t, c.Server, &AttributeSchema{LDAPDisplayName: "objectSid", Syntax: SyntaxSID, SingleValued: true})
+
+	tests := []struct {
+		name string
+		e    Export
+		want string
+	}{
+		{
+			name: "default columns",
+			e:    Export{Search: Search{Attributes: []string{"sAMAccountName", "objectSid", "memberOf"}}},
+			want: "distinguishedName,sAMAccountName,objectSid,memberOf\n" +
+				"\"CN=Jane Doe,DC=example,DC=com\",jdoe,S-1-5-21-1-2-3-1001,\"CN=Staff,DC=example,DC=com;CN=All,DC=example,DC=com\"\n" +
+				"\"CN=Al Smith,DC=example,DC=com\",asmith,,\n",
+		},
+		{
+			name: "columns",
+			e:    Export{Columns: []string{"objectGUID", "thumbnailPhoto", "memberOf"}, Separator: "|"},
+			want: "objectGUID,thumbnailPhoto,memberOf\n" +
+				"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c01,AQID,\"CN=Staff,DC=example,DC=com|CN=All,DC=example,DC=com\"\n" +
+				"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c02,,\n",
+		},
+	}
+
+	for _, test := range tests {
+		exportTestDirectory(t)
+		test.e.Format = ExportCSV
+		var out bytes.Buffer
+		n, err := c.Export(test.e, &out)
+		if err != nil || n != 2 {
+			t.Errorf("%s: n = %d, err = %v", test.name, n, err)
+		}
+		if out.String() != test.want {
+			t.Errorf("%s:\n%s\nwant\n%s", test.name, out.String(), test.want)
+		}
+	}
+}
+
+func TestExportLDIF(t *testing.T) {
+
+	c := NewConnection("dc1", "svc", "secret")
+
+	tests := []struct {
+		name       string
+		attributes []string
+		want       string
+	}{
+		{
+			name:       "objectClass added",
+			attributes: []string{"sAMAccountName"},
+			want: "version: 1\n\n" +
+				"dn: CN=Jane Doe,DC=example,DC=com\nobjectClass: user\nsAMAccountName: jdoe\n\n" +
+				"dn: CN=Al Smith,DC=example,DC=com\nobjectClass: top\nobjectClass: person\nobjectClass: user\nsAMAccountName: asmith\n",
+		},
+		{
+			name:       "objectClass requested",
+			attributes: []string{"sAMAccountName", "objectClass", "thumbnailPhoto"},
+			want: "version: 1\n\n" +
+				"dn: CN=Jane Doe,DC=example,DC=com\nsAMAccountName: jdoe\nobjectClass: user\nthumbnailPhoto:: AQID\n\n" +
+				"dn: CN=Al Smith,DC=example,DC=com\nsAMAccountName: asmith\nobjectClass: top\nobjectClass: person\nobjectClass: user\n",
+		},
+	}
+
+	for _, test := range tests {
+		exportTestDirectory(t)
+		var out bytes.Buffer
+		n, err := c.Export(Export{Format: ExportLDIF, Search: Search{Attributes: test.attributes}}, &out)
+		if err != nil || n != 2 {
+			t.Errorf("%s: n = %d, err = %v", test.name, n, err)
+		}
+		if out.String() != test.want {
+			t.Errorf("%s:\n%s\nwant\n%s", test.name, out.String(), test.want)
+		}
+	}
+}
@@ -2,12 +2,61 @@ package ad
 
 type Group struct {
 	Object
+	// Recipient is only loaded by PullMail and written by PushMail.
+	Recipient
 
 	SamAccountName string
 	DisplayName    string
 	Description    string
+	Mail           string
+	SIDHistory     []SID
 	//GroupCategory  string // FIX ME! json returns int not string
 	OrgUnit OrgUnit
 	Groups  []Group
 	Members []string
+
+	// groupsLoaded is false when Groups only holds references.
+	groupsLoaded bool
+}
+
+// GroupOptions controls how GetGroupWithOptions loads parent groups.
+type GroupOptions struct {
+	// Depth is the number of levels of parent groups to load, negative is unlimited.
+	// Parents beyond Depth are references that only have Name and DistinguishedName set,
+	// and can be loaded later with ParentGroups.
+	Depth int
+}
+
+// IsReference returns true if only the name and distinguished name of the group are known.
+func (g *Group) IsReference() bool {
+	return g.ObjectGuid.String() == "00000000-0000-0000-0000-000000000000" && g.DistinguishedName != ""
+}
+
+// ParentGroups returns the groups this group is a direct member of,
+// loading any that are still references.
+func (g *Group) ParentGroups() ([]Group, error) {
+	if g.IsReference() {
+		loaded, err := g.GetGroupWithOptions(g.DistinguishedName, GroupOptions{Depth: 0})
+		if err != nil {
+			return nil, err
+		}
+		*g = loaded
+	}
+	if g.groupsLoaded {
+		return g.Groups, nil
+	}
+
+	l := newGroupLoader(&g.Connection)
+	for i, v := range g.Groups {
+		if !v.IsReference() {
+			continue
+		}
+		parent, err := l.load(v.DistinguishedName, 0)
+		if err != nil {
+			return nil, err
+		}
+		g.Groups[i] = parent
+	}
+	g.groupsLoaded = true
+	return g.Groups, nil
 }
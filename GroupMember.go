@@ -0,0 +1,242 @@
+package ad
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jakobii/ps"
+)
+
+// memberRangeSize is the number of member values requested per range. Domain controllers
+// return at most MaxValRange values, which is 1500 by default.
+const memberRangeSize = 1500
+
+// psMemberRangeSelect selects the values and the name of a ranged member property,
+// e.g. "member;range=0-1499", or "member;range=1500-*" for the last range.
+const psMemberRangeSelect string = `@{n='MemberRange';e={@($_.PropertyNames | Where-Object { $_ -like 'member;range=*' })[0]}}, @{n='Members';e={$g = $_; @($g.PropertyNames | Where-Object { $_ -like 'member;range=*' } | ForEach-Object { $g.$_ })}}`
+
+var reMemberRange = regexp.MustCompile(`(?i)^member;range=(\d+)-(\d+|\*)$`)
+
+// nextMemberRange returns where the range after rangeName starts, or 0 if it was the last one.
+func nextMemberRange(rangeName string) (int, error) {
+	if rangeName == "" {
+		return 0, nil
+	}
+	m := reMemberRange.FindStringSubmatch(rangeName)
+	if m == nil {
+		return 0, errors.New("unexpected member range " + rangeName)
+	}
+	if m[2] == "*" {
+		return 0, nil
+	}
+	hi, err := strconv.Atoi(m[2])
+	if err != nil {
+		return 0, err
+	}
+	return hi + 1, nil
+}
+
+// memberRange fetches one range of member values of a group starting at lo, and
+// returns where the next range starts, or 0 if it was the last one.
+func (c *Connection) memberRange(dn string, lo int) (members []string, next int, err error) {
+
+	var cmd bytes.Buffer
+	cmd.WriteString("Get-ADObject -Server ")
+	cmd.WriteString(ps.QuoteString(c.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(c.Credential.Expr())
+	cmd.WriteString(" -Identity ")
+	cmd.WriteString(ps.QuoteString(dn))
+	cmd.WriteString(" -Properties ")
+	cmd.WriteString(ps.QuoteString("member;range=" + strconv.Itoa(lo) + "-" + strconv.Itoa(lo+memberRangeSize-1)))
+	cmd.WriteString(" | Select-Object @(")
+	cmd.WriteString(psMemberRangeSelect)
+	cmd.WriteString(") | ConvertTo-Json")
+
+	result, err := powershell(cmd.String())
+	if err != nil {
+		return members, 0, err
+	}
+
+	m := struct {
+		MemberRange string
+		Members     []string
+	}{}
+	err = json.Unmarshal(result, &m)
+	if err != nil {
+		return members, 0, err
+	}
+
+	next, err = nextMemberRange(m.MemberRange)
+	if err != nil {
+		return m.Members, 0, err
+	}
+	return m.Members, next, nil
+}
+
+// MemberKind is the kind of object a group member is.
+type MemberKind string
+
+// member kinds
+const (
+	MemberUser                     MemberKind = "user"
+	MemberGroup                    MemberKind = "group"
+	MemberComputer                 MemberKind = "computer"
+	MemberContact                  MemberKind = "contact"
+	MemberForeignSecurityPrincipal MemberKind = "foreignSecurityPrincipal"
+	MemberUnknown                  MemberKind = ""
+)
+
+// GroupMember is a typed reference to a member of a group.
+type GroupMember struct {
+	Object
+	Kind MemberKind
+}
+
+// memberKind returns the kind of a member from its objectClass,
+// falling back to its distinguished name for members that were not found.
+func memberKind(objectClass string, dn string) MemberKind {
+	switch strings.ToLower(objectClass) {
+	case "user", "inetorgperson":
+		return MemberUser
+	case "group":
+		return MemberGroup
+	case "computer":
+		return MemberComputer
+	case "contact":
+		return MemberContact
+	case "foreignsecurityprincipal":
+		return MemberForeignSecurityPrincipal
+	}
+	if strings.Contains(strings.ToLower(dn), ",cn=foreignsecurityprincipals,") {
+		return MemberForeignSecurityPrincipal
+	}
+	return MemberUnknown
+}
+
+// memberTypeBatchSize is the number of members looked up with a single search.
+const memberTypeBatchSize = 200
+
+// typeMembers looks up the objectClass of every member. Members that can not be
+// found, e.g. because they live in another domain, are returned as references.
+func (c *Connection) typeMembers(dns []string) (members []GroupMember, err error) {
+
+	members = make([]GroupMember, 0, len(dns))
+	for len(dns) > 0 {
+		n := memberTypeBatchSize
+		if n > len(dns) {
+			n = len(dns)
+		}
+		batch := dns[:n]
+		dns = dns[n:]
+
+		var filter strings.Builder
+		filter.WriteString("(|")
+		for _, v := range batch {
+			filter.WriteString("(distinguishedName=")
+			filter.WriteString(escapeFilterValue(v))
+			filter.WriteString(")")
+		}
+		filter.WriteString(")")
+
+		found, err := c.findObjectsLDAP(filter.String())
+		if err != nil {
+			return members, err
+		}
+		byDN := make(map[string]Object, len(found))
+		for _, v := range found {
+			byDN[strings.ToLower(v.DistinguishedName)] = v
+		}
+
+		for _, dn := range batch {
+			obj, ok := byDN[strings.ToLower(dn)]
+			if !ok {
+				obj = Object{Connection: *c, DistinguishedName: dn}
+				obj.Name, _ = ParseDistinguishedName(dn)
+			}
+			members = append(members, GroupMember{
+				Object: obj,
+				Kind:   memberKind(obj.ObjectClass, dn),
+			})
+		}
+	}
+
+	return members, nil
+}
+
+// StreamMembers sends every direct member of the group on the returned channel, one
+// range at a time, so very large groups never have to be held in memory. The member
+// channel is closed when all members were sent, ctx is done, or an error occurred,
+// in which case the error is sent on the error channel.
+func (g *Group) StreamMembers(ctx context.Context) (<-chan GroupMember, <-chan error) {
+
+	out := make(chan GroupMember)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(out)
+		defer close(errc)
+
+		dn := g.DistinguishedName
+		if dn == "" {
+			id, err := g.Identity()
+			if err != nil {
+				errc <- err
+				return
+			}
+			obj, err := g.GetObject(id)
+			if err != nil {
+				errc <- err
+				return
+			}
+			dn = obj.DistinguishedName
+		}
+
+		for lo := 0; ; {
+			dns, next, err := g.memberRange(dn, lo)
+			if err != nil {
+				errc <- err
+				return
+			}
+			members, err := g.typeMembers(dns)
+			if err != nil {
+				errc <- err
+				return
+			}
+			for _, v := range members {
+				select {
+				case out <- v:
+				case <-ctx.Done():
+					errc <- ctx.Err()
+					return
+				}
+			}
+			if next == 0 {
+				return
+			}
+			lo = next
+		}
+	}()
+
+	return out, errc
+}
+
+// GetMembers returns every direct member of the group as a typed reference.
+func (g *Group) GetMembers() (members []GroupMember, err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	out, errc := g.StreamMembers(ctx)
+	for v := range out {
+		members = append(members, v)
+	}
+	if err := <-errc; err != nil {
+		return members, err
+	}
+	return members, nil
+}
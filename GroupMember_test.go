@@ -0,0 +1,206 @@
+package ad
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestNextMemberRange(t *testing.T) {
+
+	tests := []struct {
+		in      string
+		next    int
+		invalid bool
+	}{
+		{in: "", next: 0},
+		{in: "member;range=0-1499", next: 1500},
+		{in: "Member;Range=1500-2999", next: 3000},
+		{in: "member;range=3000-*", next: 0},
+		{in: "member", invalid: true},
+		{in: "member;range=0-", invalid: true},
+		{in: "memberOf;range=0-1499", invalid: true},
+	}
+
+	for _, test := range tests {
+		next, err := nextMemberRange(test.in)
+		if (err != nil) != test.invalid || next != test.next {
+			t.Errorf("nextMemberRange(%q) = %d, %v", test.in, next, err)
+		}
+	}
+}
+
+var reMemberRangeRequest = regexp.MustCompile(`'member;range=(\d+)-(\d+)'`)
+
+// memberRangeTestGroup answers ranged member requests like a domain controller with a
+// MaxValRange of memberRangeSize. A range starting at failAt fails.
+func memberRangeTestGroup(t *testing.T, members []string, failAt int) (ranges *[]int) {
+	t.Helper()
+	ranges = new([]int)
+	recordPowershell(t, func(script string) ([]byte, error) {
+		m := reMemberRangeRequest.FindStringSubmatch(script)
+		if m == nil {
+			return nil, errors.New("unexpected script " + script)
+		}
+		lo, _ := strconv.Atoi(m[1])
+		hi, _ := strconv.Atoi(m[2])
+		if hi != lo+memberRangeSize-1 {
+			t.Errorf("requested range %s-%s", m[1], m[2])
+		}
+		*ranges = append(*ranges, lo)
+		if lo == failAt {
+			return nil, errors.New("server busy")
+		}
+		if len(members) == 0 {
+			return []byte(`{"MemberRange":null,"Members":[]}`), nil
+		}
+
+		name := fmt.Sprintf("member;range=%d-*", lo)
+		page := members[lo:]
+		if len(page) > memberRangeSize {
+			page = page[:memberRangeSize]
+			name = fmt.Sprintf("member;range=%d-%d", lo, hi)
+		}
+		out := `{"MemberRange":"` + name + `","Members":["` + strings.Join(page, `","`) + `"]`
+		if strings.HasPrefix(script, "Get-ADGroup") {
+			out += `,"ObjectGuid":"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c10","ObjectClass":"group","DistinguishedName":"CN=All,DC=example,DC=com","Name":"All","SamAccountName":"all","memberOf":[]`
+		}
+		return []byte(out + "}"), nil
+	})
+	return ranges
+}
+
+func memberRangeTestMembers(n int) []string {
+	members := make([]string, n)
+	for i := range members {
+		members[i] = fmt.Sprintf("CN=User %d,OU=Staff,DC=example,DC=com", i)
+	}
+	return members
+}
+
+func TestGetMembers(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		n      int
+		failAt int
+		ranges []int
+		err    bool
+	}{
+		{name: "empty", n: 0, failAt: -1, ranges: []int{0}},
+		{name: "one range", n: 1200, failAt: -1, ranges: []int{0}},
+		{name: "full ranges", n: 3 * memberRangeSize, failAt: -1, ranges: []int{0, 1500, 3000}},
+		{name: "partial last range", n: 3200, failAt: -1, ranges: []int{0, 1500, 3000}},
+		{name: "failed range", n: 3200, failAt: 1500, ranges: []int{0, 1500}, err: true},
+	}
+
+	c := NewConnection("dc1", "svc", "secret")
+	for _, test := range tests {
+		members := memberRangeTestMembers(test.n)
+		ranges := memberRangeTestGroup(t, members, test.failAt)
+		got, err := c.getMembers("CN=All,DC=example,DC=com")
+		if (err != nil) != test.err {
+			t.Errorf("%s: err = %v", test.name, err)
+		}
+		if !reflect.DeepEqual(*ranges, test.ranges) {
+			t.Errorf("%s: ranges %v, want %v", test.name, *ranges, test.ranges)
+		}
+		if test.err {
+			members = members[:test.failAt]
+		}
+		if len(got) != len(members) || len(got) > 0 && !reflect.DeepEqual(got, members) {
+			t.Errorf("%s: %d members, want %d", test.name, len(got), len(members))
+		}
+	}
+}
+
+func TestGetGroupMemberRanges(t *testing.T) {
+
+	members := memberRangeTestMembers(3200)
+	ranges := memberRangeTestGroup(t, members, -1)
+
+	c := NewConnection("dc1", "svc", "secret")
+	group, _, err := c.getGroup("all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*ranges, []int{0, 1500, 3000}) {
+		t.Errorf("ranges %v", *ranges)
+	}
+	if !reflect.DeepEqual(group.Members, members) {
+		t.Errorf("%d members, want %d", len(group.Members), len(members))
+	}
+}
+
+func TestStreamMembers(t *testing.T) {
+
+	dns := append(memberRangeTestMembers(memberTypeBatchSize+50),
+		"CN=Sales,OU=Groups,DC=example,DC=com",
+		"CN=S-1-5-21-9-9-9-1001,CN=ForeignSecurityPrincipals,DC=example,DC=com")
+	typeBatches := 0
+	recordPowershell(t, func(script string) ([]byte, error) {
+		if strings.Contains(script, "member;range=") {
+			return []byte(`{"MemberRange":"member;range=0-*","Members":["` + strings.Join(dns, `","`) + `"]}`), nil
+		}
+		typeBatches++
+		var found []string
+		for _, dn := range dns {
+			if !strings.Contains(script, "(distinguishedName="+escapeFilterValue(dn)+")") {
+				continue
+			}
+			class := "user"
+			switch {
+			case strings.Contains(dn, "CN=User 7,"):
+				continue // in another domain
+			case strings.HasPrefix(dn, "CN=Sales,"):
+				class = "group"
+			case strings.Contains(dn, "ForeignSecurityPrincipals"):
+				continue
+			}
+			found = append(found, `{"ObjectGuid":"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c01","ObjectClass":"`+class+`","DistinguishedName":"`+dn+`","Name":"x"}`)
+		}
+		return []byte("[" + strings.Join(found, ",") + "]"), nil
+	})
+
+	g := Group{}
+	g.Connection = NewConnection("dc1", "svc", "secret")
+	g.DistinguishedName = "CN=All,DC=example,DC=com"
+	members, err := g.GetMembers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != len(dns) || typeBatches != 2 {
+		t.Fatalf("%d members in %d batches", len(members), typeBatches)
+	}
+
+	kinds := map[string]MemberKind{
+		dns[0]:          MemberUser,
+		dns[7]:          MemberUnknown,
+		dns[len(dns)-2]: MemberGroup,
+		dns[len(dns)-1]: MemberForeignSecurityPrincipal,
+	}
+	for i, v := range members {
+		if v.DistinguishedName != dns[i] {
+			t.Errorf("member %d = %s, want %s", i, v.DistinguishedName, dns[i])
+		}
+		if want, ok := kinds[v.DistinguishedName]; ok && v.Kind != want {
+			t.Errorf("%s is a %q member, want %q", v.DistinguishedName, v.Kind, want)
+		}
+	}
+	if members[7].Name != "User 7" {
+		t.Errorf("unresolved member name = %q", members[7].Name)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	out, errc := g.StreamMembers(ctx)
+	<-out
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("cancelled stream err = %v", err)
+	}
+}
@@ -0,0 +1,551 @@
+package ad
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ImportColumn maps a CSV column to a User field or to an attribute.
+type ImportColumn struct {
+	// Column is the CSV header of the column.
+	Column string
+	// Field is the name of a User field, e.g. GivenName. string, []string, bool and
+	// time.Time fields are supported, and Manager takes a SamAccountName or distinguished name.
+	Field string
+	// Attribute is the LDAP display name of an attribute not modeled as a User field.
+	Attribute string
+	// Separator splits the value into multiple values for []string fields and attributes.
+	Separator string
+	// Transform changes the value after surrounding white space was trimmed.
+	Transform func(string) (string, error)
+	// Required rejects rows where the value is blank.
+	Required bool
+	// ClearIfBlank clears the field when the value is blank. Blank values are ignored otherwise.
+	ClearIfBlank bool
+}
+
+// Import transformations.
+var (
+	TransformLower = func(s string) (string, error) { return strings.ToLower(s), nil }
+	TransformUpper = func(s string) (string, error) { return strings.ToUpper(s), nil }
+)
+
+// TransformMap replaces values found in m, and leaves other values alone.
+func TransformMap(m map[string]string) func(string) (string, error) {
+	return func(s string) (string, error) {
+		if v, ok := m[s]; ok {
+			return v, nil
+		}
+		return s, nil
+	}
+}
+
+// TransformDate parses a date in layout and formats it as 2006-01-02, the format
+// time.Time fields are imported from.
+func TransformDate(layout string) func(string) (string, error) {
+	return func(s string) (string, error) {
+		if s == "" {
+			return s, nil
+		}
+		t, err := time.Parse(layout, s)
+		if err != nil {
+			return s, err
+		}
+		return t.Format("2006-01-02"), nil
+	}
+}
+
+// Importer provisions users from CSV rows. Every row is matched to an existing user by
+// EmployeeID, then by SamAccountName, updated with the mapped columns and pushed.
+type Importer struct {
+	Columns []ImportColumn
+	// Create creates users that do not match an existing user in Path. Otherwise
+	// rows without a match are reported as errors.
+	Create bool
+	Path   string
+	// Validate is called for every row after the columns were mapped onto the user.
+	Validate func(u *User, row map[string]string) error
+	// Concurrency is the number of rows pushed at the same time, 1 if it is not set.
+	Concurrency int
+	// DryRun only reports what would change.
+	DryRun bool
+}
+
+// ImportResult is the outcome of importing one CSV row.
+type ImportResult struct {
+	Row    int // the first data row is 1
+	Key    string
+	Action ReconcileAction // create or update, blank when the user did not change
+	Detail string
+	Err    error
+
+	// Password is the random initial password of a created user that is enabled but was
+	// not given one. It is the only copy, and it is written to the results as well, so
+	// results with passwords must be kept secret.
+	Password string
+}
+
+// Import reads CSV rows from r with a header row, imports them concurrently, and writes
+// one result row per data row to results, in the same order, including generated passwords.
+// Rows that share an EmployeeID or SamAccountName with another row fail before any row is
+// imported. Rows that fail do not stop the import; the returned error is only set if the CSV
+// could not be read or written.
+func (c *Connection) Import(imp Importer, r io.Reader, results io.Writer) ([]ImportResult, error) {
+
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("CSV has no header row")
+	}
+
+	header := rows[0]
+	for _, col := range imp.Columns {
+		if !contains(header, col.Column) {
+			return nil, errors.New("CSV has no column " + col.Column)
+		}
+		if (col.Field == "") == (col.Attribute == "") {
+			return nil, errors.New("column " + col.Column + " needs either a Field or an Attribute")
+		}
+	}
+
+	list := make([]ImportResult, len(rows)-1)
+	entries := make([]importEntry, len(rows)-1)
+	for i, row := range rows[1:] {
+		values := make(map[string]string, len(header))
+		for j, name := range header {
+			if j < len(row) {
+				values[name] = row[j]
+			}
+		}
+		entries[i], list[i].Err = imp.entry(values)
+		list[i].Row = i + 1
+		list[i].Key = entries[i].key()
+	}
+	markDuplicateImportKeys(entries, list)
+
+	n := imp.Concurrency
+	if n < 1 {
+		n = 1
+	}
+	sem := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	for i := range entries {
+		if list[i].Err != nil {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			list[i] = c.importRow(imp, entries[i])
+			list[i].Row = i + 1
+		}(i)
+	}
+	wg.Wait()
+
+	if results != nil {
+		err = writeImportResults(results, list)
+	}
+	return list, err
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func writeImportResults(w io.Writer, list []ImportResult) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"Row", "Key", "Result", "Action", "Detail", "Error", "Password"})
+	if err != nil {
+		return err
+	}
+	for _, v := range list {
+		result, msg := "success", ""
+		if v.Err != nil {
+			result, msg = "error", v.Err.Error()
+		}
+		err = cw.Write([]string{strconv.Itoa(v.Row), v.Key, result, string(v.Action), v.Detail, msg, v.Password})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// importEntry is a CSV row whose values were transformed and checked.
+type importEntry struct {
+	row    map[string]string // the values as read, by column
+	values map[string]string // the transformed values, by column
+
+	// employeeID and sam are the values the row is matched by
+	employeeID string
+	sam        string
+}
+
+// key returns the EmployeeID of the row, or else its SamAccountName.
+func (e importEntry) key() string {
+	if e.employeeID != "" {
+		return e.employeeID
+	}
+	return e.sam
+}
+
+// entry transforms and checks the values of a row.
+func (imp *Importer) entry(row map[string]string) (e importEntry, err error) {
+
+	e.row = row
+	e.values = make(map[string]string, len(imp.Columns))
+	for _, col := range imp.Columns {
+		v := strings.TrimSpace(row[col.Column])
+		if col.Transform != nil {
+			v, err = col.Transform(v)
+			if err != nil {
+				return e, fmt.Errorf("%s: %v", col.Column, err)
+			}
+		}
+		if v == "" && col.Required {
+			return e, errors.New(col.Column + " is required")
+		}
+		e.values[col.Column] = v
+	}
+
+	for _, col := range imp.Columns {
+		switch {
+		case col.Field == "EmployeeID" || strings.EqualFold(col.Attribute, "employeeID"):
+			e.employeeID = e.values[col.Column]
+		case col.Field == "SamAccountName" || strings.EqualFold(col.Attribute, "sAMAccountName"):
+			e.sam = e.values[col.Column]
+		}
+	}
+	return e, nil
+}
+
+// markDuplicateImportKeys fails every row that shares its EmployeeID or SamAccountName with
+// another row. Rows are imported concurrently, so which of them would win is left to chance,
+// and two rows with the same new SamAccountName would both try to create it.
+func markDuplicateImportKeys(entries []importEntry, list []ImportResult) {
+
+	rows := make(map[[2]string][]int)
+	for i, e := range entries {
+		if list[i].Err != nil {
+			continue
+		}
+		if e.employeeID != "" {
+			k := [2]string{"EmployeeID", strings.ToLower(e.employeeID)}
+			rows[k] = append(rows[k], i)
+		}
+		if e.sam != "" {
+			k := [2]string{"SamAccountName", strings.ToLower(e.sam)}
+			rows[k] = append(rows[k], i)
+		}
+	}
+
+	for i, e := range entries {
+		if list[i].Err != nil {
+			continue
+		}
+		for _, k := range [][2]string{{"EmployeeID", e.employeeID}, {"SamAccountName", e.sam}} {
+			dup := rows[[2]string{k[0], strings.ToLower(k[1])}]
+			if k[1] == "" || len(dup) < 2 {
+				continue
+			}
+			numbers := make([]string, len(dup))
+			for j, n := range dup {
+				numbers[j] = strconv.Itoa(n + 1)
+			}
+			list[i].Err = fmt.Errorf("%s %s is in rows %s", k[0], k[1], strings.Join(numbers, ", "))
+			break
+		}
+	}
+}
+
+// importRow imports a single row.
+func (c *Connection) importRow(imp Importer, e importEntry) (result ImportResult) {
+
+	values, employeeID, sam := e.values, e.employeeID, e.sam
+	result.Key = e.key()
+
+	// match
+	obj, err := c.matchUser(employeeID, sam)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	attributes := make([]string, 0)
+	for _, col := range imp.Columns {
+		if col.Attribute != "" {
+			attributes = append(attributes, col.Attribute)
+		}
+	}
+
+	var u User
+	if obj == nil {
+		if !imp.Create {
+			result.Err = errors.New("no user with this EmployeeID or SamAccountName")
+			return result
+		}
+		if sam == "" {
+			result.Err = errors.New("a SamAccountName is needed to create a user")
+			return result
+		}
+		result.Action = ActionCreate
+		u = User{SamAccountName: sam, EmployeeID: employeeID}
+		u.Connection = *c
+	} else {
+		u, err = c.GetUserWithOptions(obj.DistinguishedName, UserOptions{Load: LoadReferences, Attributes: attributes})
+		if err != nil {
+			result.Err = err
+			return result
+		}
+	}
+
+	// map
+	var changed []string
+	for _, col := range imp.Columns {
+		v := values[col.Column]
+		if v == "" && !col.ClearIfBlank {
+			continue
+		}
+		var ok bool
+		if col.Field != "" {
+			ok, err = c.setUserField(&u, col.Field, v, col.Separator)
+		} else {
+			ok = setUserAttribute(&u, col.Attribute, v, col.Separator)
+		}
+		if err != nil {
+			result.Err = fmt.Errorf("%s: %v", col.Column, err)
+			return result
+		}
+		if ok {
+			changed = append(changed, col.Column)
+		}
+	}
+
+	// validate
+	err = validateImportedUser(&u)
+	if err == nil && imp.Validate != nil {
+		err = imp.Validate(&u, e.row)
+	}
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	if result.Action != ActionCreate {
+		if len(changed) == 0 {
+			return result
+		}
+		result.Action = ActionUpdate
+	}
+	result.Detail = strings.Join(changed, ", ")
+	if imp.DryRun {
+		return result
+	}
+
+	// push
+	if result.Action == ActionCreate {
+		name := u.Name
+		if name == "" {
+			name = u.DisplayName
+		}
+		err = c.newUser(DesiredUser{SamAccountName: sam, Name: name, Path: imp.Path})
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		created, err := c.GetUserWithOptions(sam, UserOptions{Load: LoadReferences})
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		// keep the imported values, take the identity and state of the new user
+		u.Object.ObjectGuid = created.ObjectGuid
+		u.Object.DistinguishedName = created.DistinguishedName
+		u.Object.Name = created.Name
+		u.UserAccountControl = created.UserAccountControl
+		u.originalUserAccountControl = created.UserAccountControl
+		if u.Enabled && u.AccountPassword == "" {
+			result.Password, err = u.SetRandomPassword(nil)
+			if err != nil {
+				result.Err = err
+				return result
+			}
+		}
+	}
+	result.Err = u.Push()
+	return result
+}
+
+// matchUser finds a user by EmployeeID, then by SamAccountName. It returns nil if neither
+// matches, and an error if the EmployeeID matches more than one user.
+func (c *Connection) matchUser(employeeID, sam string) (*Object, error) {
+	if employeeID != "" {
+		objs, err := c.findObjectsLDAP("(&(objectCategory=person)(objectClass=user)(employeeID=" + escapeFilterValue(employeeID) + "))")
+		if err != nil {
+			return nil, err
+		}
+		if len(objs) > 1 {
+			return nil, errors.New("EmployeeID " + employeeID + " matches more than one user")
+		}
+		if len(objs) == 1 {
+			return &objs[0], nil
+		}
+	}
+	if sam != "" {
+		objs, err := c.findObjectsLDAP("(&(objectCategory=person)(objectClass=user)(sAMAccountName=" + escapeFilterValue(sam) + "))")
+		if err != nil || len(objs) == 0 {
+			return nil, err
+		}
+		return &objs[0], nil
+	}
+	return nil, nil
+}
+
+var boolValues = map[string]bool{
+	"true": true, "yes": true, "y": true, "1": true,
+	"false": false, "no": false, "n": false, "0": false,
+}
+
+// setUserField sets a User field from a CSV value and returns true if it changed.
+func (c *Connection) setUserField(u *User, name, value, separator string) (bool, error) {
+
+	if name == "Manager" {
+		if value == "" {
+			changed := u.Manager.DistinguishedName != ""
+			u.Manager = Object{}
+			return changed, nil
+		}
+		obj, err := c.matchUser("", value)
+		if err == nil && obj == nil && strings.Contains(value, "=") {
+			objs, err2 := c.findObjectsLDAP("(distinguishedName=" + escapeFilterValue(value) + ")")
+			if err2 == nil && len(objs) > 0 {
+				obj = &objs[0]
+			}
+			err = err2
+		}
+		if err != nil {
+			return false, err
+		}
+		if obj == nil {
+			return false, errors.New("manager " + value + " not found")
+		}
+		changed := !u.Manager.Is(*obj)
+		u.Manager = *obj
+		return changed, nil
+	}
+
+	f := reflect.ValueOf(u).Elem().FieldByName(name)
+	if !f.IsValid() || !f.CanSet() {
+		return false, errors.New("User has no field " + name)
+	}
+
+	switch f.Type() {
+	case reflect.TypeOf(""):
+		changed := f.String() != value
+		f.SetString(value)
+		return changed, nil
+	case reflect.TypeOf(true):
+		b, ok := boolValues[strings.ToLower(value)]
+		if !ok && value != "" {
+			return false, errors.New("not a boolean: " + value)
+		}
+		changed := f.Bool() != b
+		f.SetBool(b)
+		return changed, nil
+	case timeType:
+		var t time.Time
+		if value != "" {
+			var err error
+			t, err = time.ParseInLocation("2006-01-02", value, time.Local)
+			if err != nil {
+				return false, err
+			}
+		}
+		changed := !f.Interface().(time.Time).Equal(t)
+		f.Set(reflect.ValueOf(t))
+		return changed, nil
+	}
+
+	if f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String {
+		values := splitValues(value, separator)
+		old := make([]string, f.Len())
+		for i := range old {
+			old[i] = f.Index(i).String()
+		}
+		changed := !NewStringAttribute(old...).Equal(NewStringAttribute(values...))
+		f.Set(reflect.ValueOf(values).Convert(f.Type()))
+		return changed, nil
+	}
+
+	return false, fmt.Errorf("can not import into %s of type %s", name, f.Type())
+}
+
+// setUserAttribute sets an attribute of a user from a CSV value and returns true if it changed.
+func setUserAttribute(u *User, name, value, separator string) bool {
+	a := NewStringAttribute(splitValues(value, separator)...)
+	old, _ := u.Attributes.Get(name)
+	if !old.IsEmpty() {
+		a.Syntax, a.Binary = old.Syntax, old.Binary
+	}
+	if old.Equal(a) {
+		return false
+	}
+	if u.Attributes == nil {
+		u.Attributes = make(Attributes)
+	}
+	u.Attributes.Set(name, a)
+	return true
+}
+
+func splitValues(value, separator string) []string {
+	if value == "" {
+		return nil
+	}
+	if separator == "" {
+		return []string{value}
+	}
+	var values []string
+	for _, v := range strings.Split(value, separator) {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// validateImportedUser checks the values AD would reject.
+func validateImportedUser(u *User) error {
+	if len(u.SamAccountName) > 20 {
+		return errors.New("SamAccountName is longer than 20 characters")
+	}
+	if strings.ContainsAny(u.SamAccountName, `"/\[]:;|=,+*?<>@`) {
+		return errors.New("SamAccountName contains characters that are not allowed")
+	}
+	if u.EmailAddress != "" {
+		if _, err := mail.ParseAddress(u.EmailAddress); err != nil {
+			return errors.New("invalid EmailAddress " + u.EmailAddress)
+		}
+	}
+	if u.UserPrincipalName != "" && !strings.Contains(u.UserPrincipalName, "@") {
+		return errors.New("UserPrincipalName has no @")
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package ad
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/jakobii/ps"
+)
+
+func TestWriteImportResults(t *testing.T) {
+	list := []ImportResult{
+		{Row: 1, Key: "jdoe", Action: ActionCreate, Password: "Tiger-Apple-7"},
+		{Row: 2, Key: "asmith", Action: ActionUpdate, Detail: "Title"},
+		{Row: 3, Key: "bad", Err: errors.New("no such user")},
+	}
+
+	var b bytes.Buffer
+	if err := writeImportResults(&b, list); err != nil {
+		t.Fatal(err)
+	}
+	want := "Row,Key,Result,Action,Detail,Error,Password\n" +
+		"1,jdoe,success,create,,,Tiger-Apple-7\n" +
+		"2,asmith,success,update,Title,,\n" +
+		"3,bad,error,,,no such user,\n"
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+// importTestUsers are the users of the directory the import tests run against.
+var importTestUsers = map[string]struct{ guid, dn, employeeID, title string }{
+	"jdoe":   {"c01", "CN=Jane Doe,OU=Staff,DC=example,DC=com", "42", "Engineer"},
+	"asmith": {"c02", "CN=Al Smith,OU=Staff,DC=example,DC=com", "99", "Intern"},
+	"boss":   {"c03", "CN=Boss,OU=Staff,DC=example,DC=com", "", ""},
+	"jdoe2":  {"c04", "CN=Jane Doe 2,OU=Staff,DC=example,DC=com", "99", ""},
+	"newbie": {"c05", "CN=newbie,OU=New,DC=example,DC=com", "", ""},
+}
+
+var reImportTestFilter = regexp.MustCompile(`\((employeeID|sAMAccountName|distinguishedName)=([^()]*)\)`)
+
+// recordImportTestDirectory answers the scripts of importRow from importTestUsers. newbie only
+// exists once New-ADUser ran.
+func recordImportTestDirectory(t *testing.T) *[]string {
+	created := false
+	return recordPowershell(t, func(script string) ([]byte, error) {
+		created = created || strings.HasPrefix(script, "New-ADUser")
+		var found []string
+		for sam, u := range importTestUsers {
+			if sam == "newbie" && !created {
+				continue
+			}
+			obj := `{"ObjectGuid":"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0` + u.guid + `","ObjectClass":"user","DistinguishedName":"` + u.dn + `","Name":"` + sam + `"`
+			switch {
+			case strings.HasPrefix(script, "Get-ADUser"):
+				if strings.Contains(script, ps.QuoteString(u.dn)) || strings.Contains(script, ps.QuoteString(sam)) {
+					return []byte(obj + `,"SamAccountName":"` + sam + `","EmployeeID":"` + u.employeeID + `","Title":"` + u.title +
+						`","userAccountControl":514,"whenCreated":"20240102030405.0Z","whenChanged":"20240102030405.0Z"}`), nil
+				}
+			case strings.HasPrefix(script, "Get-ADObject"):
+				m := reImportTestFilter.FindStringSubmatch(script)
+				if m != nil && (m[1] == "employeeID" && m[2] == u.employeeID || m[1] == "sAMAccountName" && m[2] == sam || m[1] == "distinguishedName" && m[2] == u.dn) {
+					found = append(found, obj+"}")
+				}
+			}
+		}
+		sort.Strings(found)
+		return []byte("[" + strings.Join(found, ",") + "]"), nil
+	})
+}
+
+var importTestColumns = []ImportColumn{
+	{Column: "ID", Field: "EmployeeID"},
+	{Column: "SAM", Field: "SamAccountName", Transform: TransformLower, Required: true},
+	{Column: "Title", Field: "Title", ClearIfBlank: true},
+	{Column: "Manager", Field: "Manager"},
+}
+
+func TestImportRow(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		row     map[string]string
+		create  bool
+		matched string // the distinguished name of the matched user
+		action  ReconcileAction
+		detail  string
+		err     string
+	}{
+		{name: "EmployeeID first", row: map[string]string{"ID": "42", "SAM": "jdoe", "Title": "Manager"},
+			matched: "CN=Jane Doe", action: ActionUpdate, detail: "Title"},
+		{name: "SamAccountName next", row: map[string]string{"ID": "77", "SAM": " ASmith ", "Title": "Intern"},
+			matched: "CN=Al Smith", action: ActionUpdate, detail: "ID"},
+		{name: "EmployeeID not unique", row: map[string]string{"ID": "99", "SAM": "asmith"},
+			err: "matches more than one user"},
+		{name: "required", row: map[string]string{"ID": "42", "SAM": " "},
+			err: "SAM is required"},
+		{name: "clear if blank", row: map[string]string{"SAM": "asmith", "Title": ""},
+			matched: "CN=Al Smith", action: ActionUpdate, detail: "Title"},
+		{name: "manager by SamAccountName", row: map[string]string{"SAM": "jdoe", "Title": "Engineer", "Manager": "boss"},
+			matched: "CN=Jane Doe", action: ActionUpdate, detail: "Manager"},
+		{name: "manager by distinguished name", row: map[string]string{"SAM": "jdoe", "Title": "Engineer", "Manager": "CN=Boss,OU=Staff,DC=example,DC=com"},
+			matched: "CN=Jane Doe", action: ActionUpdate, detail: "Manager"},
+		{name: "unknown manager", row: map[string]string{"SAM": "jdoe", "Manager": "nobody"},
+			err: "manager nobody not found"},
+		{name: "no match", row: map[string]string{"SAM": "newbie", "Title": "Trainee"},
+			err: "no user with this EmployeeID or SamAccountName"},
+		{name: "create", row: map[string]string{"SAM": "newbie", "Title": "Trainee"}, create: true,
+			action: ActionCreate, detail: "Title"},
+	}
+
+	c := NewConnection("dc1", "svc", "secret")
+	for _, test := range tests {
+		scripts := recordImportTestDirectory(t)
+		imp := Importer{Columns: importTestColumns, Create: test.create, Path: "OU=New,DC=example,DC=com", DryRun: !test.create}
+
+		var result ImportResult
+		e, err := imp.entry(test.row)
+		if err != nil {
+			result.Err = err
+		} else {
+			result = c.importRow(imp, e)
+		}
+
+		if (result.Err == nil) != (test.err == "") || result.Err != nil && !strings.Contains(result.Err.Error(), test.err) {
+			t.Errorf("%s: err = %v, want %q", test.name, result.Err, test.err)
+			continue
+		}
+		if result.Action != test.action || result.Detail != test.detail {
+			t.Errorf("%s: result = %q %q, want %q %q", test.name, result.Action, result.Detail, test.action, test.detail)
+		}
+
+		var loaded, created string
+		for _, s := range *scripts {
+			switch {
+			case strings.HasPrefix(s, "Get-ADUser") && loaded == "":
+				loaded = s
+			case strings.HasPrefix(s, "New-ADUser"):
+				created = s
+			}
+		}
+		if test.matched != "" && !strings.Contains(loaded, "-Identity '"+test.matched+",OU=") {
+			t.Errorf("%s: loaded %q, want %s", test.name, loaded, test.matched)
+		}
+		if test.create && (!strings.Contains(created, " -SamAccountName "+ps.QuoteString("newbie")) || !strings.Contains(created, ps.QuoteString("OU=New,DC=example,DC=com"))) {
+			t.Errorf("%s: created %q", test.name, created)
+		}
+	}
+}
+
+func TestImportDuplicateKeys(t *testing.T) {
+
+	scripts := recordImportTestDirectory(t)
+	c := NewConnection("dc1", "svc", "secret")
+	imp := Importer{Columns: importTestColumns, Create: true, Concurrency: 4}
+
+	in := "ID,SAM,Title,Manager\n" +
+		",newbie,Trainee,\n" +
+		"42,jdoe,Engineer,\n" +
+		",NEWBIE,Apprentice,\n" +
+		"7,asmith,Intern,\n" +
+		"7,other,Intern,\n"
+	list, err := c.Import(imp, strings.NewReader(in), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"SamAccountName newbie is in rows 1, 3",
+		"",
+		"SamAccountName newbie is in rows 1, 3",
+		"EmployeeID 7 is in rows 4, 5",
+		"EmployeeID 7 is in rows 4, 5",
+	}
+	for i, r := range list {
+		msg := ""
+		if r.Err != nil {
+			msg = r.Err.Error()
+		}
+		if r.Row != i+1 || msg != want[i] {
+			t.Errorf("row %d = %d %q, want %q", i+1, r.Row, msg, want[i])
+		}
+	}
+	for _, s := range *scripts {
+		if strings.HasPrefix(s, "New-ADUser") {
+			t.Errorf("a duplicated row was imported: %s", s)
+		}
+	}
+}
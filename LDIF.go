@@ -0,0 +1,578 @@
+package ad
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jakobii/ps"
+)
+
+// ldifLineLength is where LDIF lines are folded.
+const ldifLineLength = 76
+
+// LDIFWriter writes LDIF content records (RFC 2849).
+type LDIFWriter struct {
+	w       *bufio.Writer
+	started bool
+}
+
+// NewLDIFWriter returns a writer that writes LDIF to w. Call Flush when done.
+func NewLDIFWriter(w io.Writer) *LDIFWriter {
+	return &LDIFWriter{w: bufio.NewWriter(w)}
+}
+
+// WriteEntry writes a content record with the attributes in the order of names.
+// Attributes without values are left out.
+func (l *LDIFWriter) WriteEntry(dn string, names []string, attrs Attributes) error {
+	if !l.started {
+		l.started = true
+		l.line("version: 1")
+	}
+	l.w.WriteString("\n")
+	l.value("dn", []byte(dn), false)
+	for _, name := range names {
+		a, ok := attrs.Get(name)
+		if !ok {
+			continue
+		}
+		for _, v := range a.Values {
+			l.value(name, v, a.Binary)
+		}
+	}
+	return l.Flush()
+}
+
+// Flush writes any buffered data.
+func (l *LDIFWriter) Flush() error {
+	return l.w.Flush()
+}
+
+// value writes an attribute value, base64 encoded if it is binary or not a SAFE-STRING.
+func (l *LDIFWriter) value(name string, v []byte, binary bool) {
+	if binary || !ldifSafe(v) {
+		l.line(name + ":: " + base64.StdEncoding.EncodeToString(v))
+		return
+	}
+	l.line(name + ": " + string(v))
+}
+
+// line writes a line, folded into continuation lines that start with a space.
+func (l *LDIFWriter) line(s string) {
+	for len(s) > ldifLineLength {
+		l.w.WriteString(s[:ldifLineLength])
+		l.w.WriteString("\n ")
+		s = s[ldifLineLength:]
+	}
+	l.w.WriteString(s)
+	l.w.WriteString("\n")
+}
+
+// ldifSafe returns true if v is a SAFE-STRING as defined by RFC 2849, and does not end
+// with a space, which would be lost by many parsers.
+func ldifSafe(v []byte) bool {
+	if len(v) == 0 {
+		return true
+	}
+	if v[0] == ' ' || v[0] == ':' || v[0] == '<' || v[len(v)-1] == ' ' {
+		return false
+	}
+	for _, b := range v {
+		if b == 0 || b == '\n' || b == '\r' || b > 127 {
+			return false
+		}
+	}
+	return true
+}
+
+// LDIF change types. A content record has no change type and is applied like an add.
+const (
+	ChangeAdd    = "add"
+	ChangeModify = "modify"
+	ChangeDelete = "delete"
+	ChangeModRDN = "modrdn"
+)
+
+// LDIFRecord is a content or change record.
+type LDIFRecord struct {
+	// Line is the line the record starts on.
+	Line       int
+	DN         string
+	ChangeType string
+
+	// Attributes of content and add records.
+	Attributes Attributes
+	// Modifications of modify records, in order.
+	Modifications []LDIFModification
+
+	// NewRDN, DeleteOldRDN and NewSuperior of modrdn records.
+	NewRDN       string
+	DeleteOldRDN bool
+	NewSuperior  string
+}
+
+// LDIFModification is one add, delete or replace of a modify record. A delete without
+// values removes the attribute.
+type LDIFModification struct {
+	Op        string
+	Attribute string
+	Values    Attribute
+}
+
+// LDIFReader reads LDIF records one at a time.
+type LDIFReader struct {
+	// FileBase is the directory that values given as file:// URLs (attr:< file:///path) may
+	// be read from. URLs are rejected if it is empty, as LDIF from elsewhere could otherwise
+	// read any file the process can.
+	FileBase string
+
+	s    *bufio.Scanner
+	line int
+	// next is a line that was read ahead, with the line number it starts on.
+	next     string
+	nextLine int
+	hasNext  bool
+}
+
+// NewLDIFReader returns a reader of the LDIF in r.
+func NewLDIFReader(r io.Reader) *LDIFReader {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return &LDIFReader{s: s}
+}
+
+// ReadLDIF reads every record of the LDIF in r.
+func ReadLDIF(r io.Reader) (records []LDIFRecord, err error) {
+	lr := NewLDIFReader(r)
+	for {
+		rec, err := lr.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, rec)
+	}
+}
+
+// logicalLine returns the next unfolded line, skipping comments.
+func (l *LDIFReader) logicalLine() (string, int, bool) {
+	for {
+		var line string
+		var start int
+		if l.hasNext {
+			line, start, l.hasNext = l.next, l.nextLine, false
+		} else {
+			if !l.s.Scan() {
+				return "", 0, false
+			}
+			l.line++
+			line, start = strings.TrimSuffix(l.s.Text(), "\r"), l.line
+		}
+
+		// unfold continuation lines
+		for l.s.Scan() {
+			l.line++
+			next := strings.TrimSuffix(l.s.Text(), "\r")
+			if strings.HasPrefix(next, " ") {
+				line += next[1:]
+				continue
+			}
+			l.next, l.nextLine, l.hasNext = next, l.line, true
+			break
+		}
+
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		return line, start, true
+	}
+}
+
+// Next returns the next record, or io.EOF after the last one.
+func (l *LDIFReader) Next() (rec LDIFRecord, err error) {
+
+	// skip blank lines and the version
+	var lines []string
+	var numbers []int
+	for {
+		line, n, ok := l.logicalLine()
+		if !ok {
+			if err := l.s.Err(); err != nil {
+				return rec, err
+			}
+			if len(lines) == 0 {
+				return rec, io.EOF
+			}
+			break
+		}
+		if line == "" {
+			if len(lines) == 0 {
+				continue
+			}
+			break
+		}
+		if len(lines) == 0 && strings.HasPrefix(strings.ToLower(line), "version:") {
+			continue
+		}
+		lines = append(lines, line)
+		numbers = append(numbers, n)
+	}
+
+	rec.Line = numbers[0]
+	name, value, err := l.parseLine(lines[0])
+	if err != nil {
+		return rec, fmt.Errorf("line %d: %v", numbers[0], err)
+	}
+	if !strings.EqualFold(name, "dn") {
+		return rec, fmt.Errorf("line %d: record does not start with dn", numbers[0])
+	}
+	rec.DN = string(value.Values[0])
+
+	i := 1
+	for i < len(lines) && strings.HasPrefix(strings.ToLower(lines[i]), "control:") {
+		// controls are not supported by the AD module and are ignored
+		i++
+	}
+	if i < len(lines) && strings.HasPrefix(strings.ToLower(lines[i]), "changetype:") {
+		_, v, err := l.parseLine(lines[i])
+		if err != nil {
+			return rec, fmt.Errorf("line %d: %v", numbers[i], err)
+		}
+		rec.ChangeType = strings.ToLower(v.String())
+		if rec.ChangeType == "moddn" {
+			rec.ChangeType = ChangeModRDN
+		}
+		i++
+	}
+
+	switch rec.ChangeType {
+	case "", ChangeAdd:
+		rec.Attributes = make(Attributes)
+		for ; i < len(lines); i++ {
+			name, v, err := l.parseLine(lines[i])
+			if err != nil {
+				return rec, fmt.Errorf("line %d: %v", numbers[i], err)
+			}
+			a, _ := rec.Attributes.Get(name)
+			a.Binary = a.Binary || v.Binary
+			a.Values = append(a.Values, v.Values...)
+			rec.Attributes.Set(name, a)
+		}
+
+	case ChangeDelete:
+		if i < len(lines) {
+			return rec, fmt.Errorf("line %d: delete records have no attributes", numbers[i])
+		}
+
+	case ChangeModRDN:
+		for ; i < len(lines); i++ {
+			name, v, err := l.parseLine(lines[i])
+			if err != nil {
+				return rec, fmt.Errorf("line %d: %v", numbers[i], err)
+			}
+			switch strings.ToLower(name) {
+			case "newrdn":
+				rec.NewRDN = v.String()
+			case "deleteoldrdn":
+				rec.DeleteOldRDN = v.String() == "1"
+			case "newsuperior":
+				rec.NewSuperior = v.String()
+			default:
+				return rec, fmt.Errorf("line %d: unexpected %s in modrdn record", numbers[i], name)
+			}
+		}
+		if rec.NewRDN == "" {
+			return rec, fmt.Errorf("line %d: modrdn record without newrdn", rec.Line)
+		}
+
+	case ChangeModify:
+		for i < len(lines) {
+			op, v, err := l.parseLine(lines[i])
+			if err != nil {
+				return rec, fmt.Errorf("line %d: %v", numbers[i], err)
+			}
+			op = strings.ToLower(op)
+			if op != "add" && op != "delete" && op != "replace" {
+				return rec, fmt.Errorf("line %d: unexpected %s in modify record", numbers[i], op)
+			}
+			mod := LDIFModification{Op: op, Attribute: v.String()}
+			for i++; i < len(lines) && lines[i] != "-"; i++ {
+				name, v, err := l.parseLine(lines[i])
+				if err != nil {
+					return rec, fmt.Errorf("line %d: %v", numbers[i], err)
+				}
+				if !strings.EqualFold(name, mod.Attribute) {
+					return rec, fmt.Errorf("line %d: %s in a modification of %s", numbers[i], name, mod.Attribute)
+				}
+				mod.Values.Binary = mod.Values.Binary || v.Binary
+				mod.Values.Values = append(mod.Values.Values, v.Values...)
+			}
+			i++ // the "-"
+			rec.Modifications = append(rec.Modifications, mod)
+		}
+
+	default:
+		return rec, fmt.Errorf("line %d: unknown changetype %s", rec.Line, rec.ChangeType)
+	}
+
+	return rec, nil
+}
+
+// parseLine splits an attribute line into the attribute and its value. The ;binary
+// option is dropped and marks the value as binary, as do base64 encoded values that are
+// not valid UTF-8 or contain NUL bytes.
+func (l *LDIFReader) parseLine(line string) (name string, a Attribute, err error) {
+	i := strings.Index(line, ":")
+	if i <= 0 {
+		return "", a, errors.New("missing colon")
+	}
+	name = line[:i]
+	rest := line[i+1:]
+	if j := strings.Index(name, ";"); j > 0 {
+		a.Binary = strings.EqualFold(name[j+1:], "binary")
+		name = name[:j]
+	}
+
+	var value []byte
+	switch {
+	case strings.HasPrefix(rest, ":"):
+		value, err = base64.StdEncoding.DecodeString(strings.TrimSpace(rest[1:]))
+		if err != nil {
+			return name, a, err
+		}
+		a.Binary = a.Binary || !utf8.Valid(value) || bytes.IndexByte(value, 0) >= 0
+	case strings.HasPrefix(rest, "<"):
+		value, err = l.readFile(strings.TrimSpace(rest[1:]))
+		if err != nil {
+			return name, a, err
+		}
+		a.Binary = true
+	default:
+		value = []byte(strings.TrimLeft(rest, " "))
+	}
+	a.Values = [][]byte{value}
+	return name, a, nil
+}
+
+// readFile returns the content of a file:// URL, which must name a file in FileBase.
+func (l *LDIFReader) readFile(rawURL string) ([]byte, error) {
+	if l.FileBase == "" {
+		return nil, errors.New("file:// URLs are not allowed")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "file" || (u.Host != "" && u.Host != "localhost") {
+		return nil, errors.New("only local file:// URLs are supported")
+	}
+
+	base, err := filepath.EvalSymlinks(l.FileBase)
+	if err != nil {
+		return nil, err
+	}
+	base, err = filepath.Abs(base)
+	if err != nil {
+		return nil, err
+	}
+	path := u.Path
+	if runtime.GOOS == "windows" {
+		// file:///C:/dir/file
+		path = strings.TrimPrefix(path, "/")
+	}
+	path, err = filepath.EvalSymlinks(filepath.FromSlash(path))
+	if err != nil {
+		return nil, err
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(base, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, errors.New(rawURL + " is outside of " + l.FileBase)
+	}
+	return os.ReadFile(path)
+}
+
+// LDIFResult is the outcome of applying one LDIF record.
+type LDIFResult struct {
+	Line       int
+	DN         string
+	ChangeType string
+	Err        error
+}
+
+// ApplyLDIF applies every record in r and returns a result per record. Unless stopOnError is
+// set, a failing record does not stop the rest. Content records are added. The returned error
+// is set if the LDIF could not be parsed, or a record failed and stopOnError is set.
+func (c *Connection) ApplyLDIF(r io.Reader, stopOnError bool) (results []LDIFResult, err error) {
+	lr := NewLDIFReader(r)
+	for {
+		rec, err := lr.Next()
+		if err == io.EOF {
+			return results, nil
+		}
+		if err != nil {
+			return results, err
+		}
+		res := LDIFResult{Line: rec.Line, DN: rec.DN, ChangeType: rec.ChangeType, Err: c.ApplyLDIFRecord(rec)}
+		if res.ChangeType == "" {
+			res.ChangeType = ChangeAdd
+		}
+		results = append(results, res)
+		if res.Err != nil && stopOnError {
+			return results, fmt.Errorf("line %d: %v", res.Line, res.Err)
+		}
+	}
+}
+
+// ApplyLDIFRecord applies a single record. The modifications of a modify record are made in
+// order, one request each, and the first that fails stops the rest; the ones before it stay
+// applied. A modrdn record always removes the old RDN value, as AD does not keep it.
+func (c *Connection) ApplyLDIFRecord(rec LDIFRecord) error {
+	obj := c.objectReference(rec.DN)
+
+	switch rec.ChangeType {
+	case "", ChangeAdd:
+		return c.addLDIFRecord(rec)
+
+	case ChangeDelete:
+		return obj.Delete()
+
+	case ChangeModify:
+		for i, mod := range rec.Modifications {
+			var m modification
+			switch {
+			case mod.Op == "add":
+				m.add(mod.Attribute, mod.Values)
+			case mod.Op == "replace":
+				m.replace(mod.Attribute, mod.Values)
+			case mod.Values.IsEmpty():
+				m.clear(mod.Attribute)
+			default:
+				m.remove(mod.Attribute, mod.Values)
+			}
+			if err := obj.modify(m); err != nil {
+				return fmt.Errorf("%s %s (change %d of %d): %v", mod.Op, mod.Attribute, i+1, len(rec.Modifications), err)
+			}
+		}
+		return nil
+
+	case ChangeModRDN:
+		_, name, _, err := splitRDN(rec.NewRDN)
+		if err != nil {
+			return err
+		}
+		err = obj.rename(name)
+		if err != nil || rec.NewSuperior == "" {
+			return err
+		}
+		return obj.Move(rec.NewSuperior)
+	}
+	return errors.New("unknown changetype " + rec.ChangeType)
+}
+
+// splitRDN splits a distinguished name into the attribute type and value of its first RDN,
+// and the parent (RFC 4514). Escaped characters in the value, like \, or \2C, are unescaped.
+func splitRDN(dn string) (attr, value, parent string, err error) {
+	i := strings.Index(dn, "=")
+	if i <= 0 {
+		return "", "", "", errors.New("invalid distinguished name: " + dn)
+	}
+	attr = strings.TrimSpace(dn[:i])
+
+	var v []byte
+	for j := i + 1; j < len(dn); j++ {
+		switch c := dn[j]; c {
+		case '\\':
+			if j+2 < len(dn) && isHex(dn[j+1]) && isHex(dn[j+2]) {
+				b, _ := strconv.ParseUint(dn[j+1:j+3], 16, 8)
+				v = append(v, byte(b))
+				j += 2
+				continue
+			}
+			if j+1 == len(dn) {
+				return "", "", "", errors.New("invalid distinguished name: " + dn)
+			}
+			j++
+			v = append(v, dn[j])
+		case '+':
+			return "", "", "", errors.New("multi-valued RDNs are not supported: " + dn)
+		case ',':
+			return attr, string(v), strings.TrimSpace(dn[j+1:]), nil
+		default:
+			v = append(v, c)
+		}
+	}
+	return attr, string(v), "", nil
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// addLDIFRecord creates the object of a content or add record.
+func (c *Connection) addLDIFRecord(rec LDIFRecord) error {
+
+	rdnName, rdn, parent, err := splitRDN(rec.DN)
+	if err != nil {
+		return err
+	}
+	if rdn == "" || parent == "" {
+		return errors.New("invalid distinguished name: " + rec.DN)
+	}
+
+	// the most specific class is listed last
+	class, ok := rec.Attributes.Get("objectClass")
+	if !ok || class.IsEmpty() {
+		return errors.New("no objectClass")
+	}
+	classes := class.Strings()
+
+	var other []string
+	rdnName = strings.ToLower(rdnName)
+	for _, name := range rec.Attributes.Names() {
+		switch strings.ToLower(name) {
+		case "objectclass", "distinguishedname", rdnName:
+			continue
+		}
+		a := rec.Attributes[name]
+		if a.IsEmpty() {
+			continue
+		}
+		other = append(other, ps.QuoteString(name)+"="+a.psExpr())
+	}
+
+	var cmd bytes.Buffer
+	cmd.WriteString("New-ADObject -Server ")
+	cmd.WriteString(ps.QuoteString(c.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(c.Credential.Expr())
+	cmd.WriteString(" -Type ")
+	cmd.WriteString(ps.QuoteString(classes[len(classes)-1]))
+	cmd.WriteString(" -Name ")
+	cmd.WriteString(ps.QuoteString(rdn))
+	cmd.WriteString(" -Path ")
+	cmd.WriteString(ps.QuoteString(parent))
+	if len(other) > 0 {
+		cmd.WriteString(" -OtherAttributes @{")
+		cmd.WriteString(strings.Join(other, "; "))
+		cmd.WriteString("}")
+	}
+
+	_, err = powershell(cmd.String())
+	return err
+}
@@ -0,0 +1,302 @@
+package ad
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jakobii/ps"
+)
+
+func TestLDIFReader(t *testing.T) {
+
+	const in = `version: 1
+
+# a comment
+dn: CN=Jane Doe,OU=Staff,DC=exam
+ ple,DC=com
+objectClass: top
+objectClass: user
+description:: SsO2cmcgbGluZQ==
+objectGUID:: AAECAw==
+thumbnailPhoto;binary:: aGk=
+
+dn: CN=Jane Doe,OU=Staff,DC=example,DC=com
+changetype: modify
+add: member
+member: CN=a,DC=example,DC=com
+member: CN=b,DC=example,DC=com
+-
+delete: member
+member: CN=c,DC=example,DC=com
+-
+delete: info
+-
+replace: title
+title: Engineer
+-
+
+dn: CN=Old,DC=example,DC=com
+changetype: moddn
+newrdn: CN=New
+deleteoldrdn: 1
+newsuperior: OU=Staff,DC=example,DC=com
+
+dn: CN=Gone,DC=example,DC=com
+changetype: delete
+`
+	records, err := ReadLDIF(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("got %d records", len(records))
+	}
+
+	add := records[0]
+	if add.Line != 4 || add.DN != "CN=Jane Doe,OU=Staff,DC=example,DC=com" || add.ChangeType != "" {
+		t.Errorf("content record = %d %q %q", add.Line, add.DN, add.ChangeType)
+	}
+	if class, _ := add.Attributes.Get("objectClass"); !reflect.DeepEqual(class.Strings(), []string{"top", "user"}) {
+		t.Errorf("objectClass = %v", class.Strings())
+	}
+	if d, _ := add.Attributes.Get("description"); d.Binary || d.String() != "Jörg line" {
+		t.Errorf("description = %q, binary %t", d.String(), d.Binary)
+	}
+	if g, _ := add.Attributes.Get("objectGUID"); !g.Binary || !bytes.Equal(g.Values[0], []byte{0, 1, 2, 3}) {
+		t.Errorf("objectGUID = %v, binary %t", g.Values, g.Binary)
+	}
+	if p, _ := add.Attributes.Get("thumbnailPhoto"); !p.Binary || string(p.Values[0]) != "hi" {
+		t.Errorf("thumbnailPhoto = %v, binary %t", p.Values, p.Binary)
+	}
+
+	mod := records[1]
+	if mod.ChangeType != ChangeModify || mod.Line != 12 {
+		t.Errorf("modify record = %d %q", mod.Line, mod.ChangeType)
+	}
+	want := []struct {
+		op, attr string
+		values   []string
+	}{
+		{"add", "member", []string{"CN=a,DC=example,DC=com", "CN=b,DC=example,DC=com"}},
+		{"delete", "member", []string{"CN=c,DC=example,DC=com"}},
+		{"delete", "info", []string{}},
+		{"replace", "title", []string{"Engineer"}},
+	}
+	if len(mod.Modifications) != len(want) {
+		t.Fatalf("modifications = %+v", mod.Modifications)
+	}
+	for i, w := range want {
+		m := mod.Modifications[i]
+		if m.Op != w.op || m.Attribute != w.attr || !reflect.DeepEqual(m.Values.Strings(), w.values) {
+			t.Errorf("modification %d = %s %s %v, want %s %s %v", i, m.Op, m.Attribute, m.Values.Strings(), w.op, w.attr, w.values)
+		}
+	}
+
+	rdn := records[2]
+	if rdn.ChangeType != ChangeModRDN || rdn.NewRDN != "CN=New" || !rdn.DeleteOldRDN || rdn.NewSuperior != "OU=Staff,DC=example,DC=com" {
+		t.Errorf("modrdn record = %+v", rdn)
+	}
+	if records[3].ChangeType != ChangeDelete || records[3].DN != "CN=Gone,DC=example,DC=com" {
+		t.Errorf("delete record = %+v", records[3])
+	}
+}
+
+func TestLDIFReaderErrors(t *testing.T) {
+	tests := []string{
+		"cn: x\n",
+		"dn: CN=x\nchangetype: rename\n",
+		"dn: CN=x\nchangetype: delete\ncn: x\n",
+		"dn: CN=x\nchangetype: modify\nadd: member\ncn: x\n-\n",
+		"dn: CN=x\nchangetype: modify\nmerge: member\n-\n",
+		"dn: CN=x\nchangetype: modrdn\ndeleteoldrdn: 1\n",
+		"dn: CN=x\ndescription:: !!!\n",
+		"dn: CN=x\nphoto:< http://example.com/a.jpg\n",
+		"dn: CN=x\nno colon\n",
+	}
+	for _, in := range tests {
+		if _, err := ReadLDIF(strings.NewReader(in)); err == nil {
+			t.Errorf("ReadLDIF(%q) succeeded", in)
+		}
+	}
+}
+
+func TestLDIFWriterRoundTrip(t *testing.T) {
+	attrs := Attributes{}
+	attrs.Set("description", NewStringAttribute(strings.Repeat("long value ", 20)))
+	attrs.Set("displayName", NewStringAttribute("Jörg"))
+	attrs.Set("objectGUID", Attribute{Binary: true, Values: [][]byte{{0, 1, 2, 3}}})
+
+	var b bytes.Buffer
+	w := NewLDIFWriter(&b)
+	if err := w.WriteEntry("CN=Jörg,DC=example,DC=com", []string{"description", "displayName", "objectGUID"}, attrs); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(b.String(), "\n") {
+		if len(line) > ldifLineLength+1 {
+			t.Errorf("line is not folded: %q", line)
+		}
+	}
+
+	records, err := ReadLDIF(&b)
+	if err != nil || len(records) != 1 {
+		t.Fatalf("ReadLDIF() = %d records, %v", len(records), err)
+	}
+	if records[0].DN != "CN=Jörg,DC=example,DC=com" {
+		t.Errorf("DN = %q", records[0].DN)
+	}
+	for _, name := range []string{"description", "displayName", "objectGUID"} {
+		want, _ := attrs.Get(name)
+		got, _ := records[0].Attributes.Get(name)
+		if !got.Equal(want) {
+			t.Errorf("%s = %v, want %v", name, got.Values, want.Values)
+		}
+	}
+}
+
+func TestApplyLDIFModify(t *testing.T) {
+
+	rec := LDIFRecord{
+		DN:         "CN=Staff,DC=example,DC=com",
+		ChangeType: ChangeModify,
+		Modifications: []LDIFModification{
+			{Op: "add", Attribute: "member", Values: NewStringAttribute("CN=a,DC=example,DC=com")},
+			{Op: "delete", Attribute: "member", Values: NewStringAttribute("CN=b,DC=example,DC=com")},
+			{Op: "add", Attribute: "member", Values: NewStringAttribute("CN=c,DC=example,DC=com")},
+			{Op: "delete", Attribute: "info"},
+			{Op: "replace", Attribute: "description", Values: NewStringAttribute("Staff")},
+		},
+	}
+	scripts := recordPowershell(t, nil)
+	c := NewConnection("dc1", "svc", "secret")
+	if err := c.ApplyLDIFRecord(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		" -Add @{" + ps.QuoteString("member") + "=",
+		" -Remove @{" + ps.QuoteString("member") + "=",
+		" -Add @{" + ps.QuoteString("member") + "=",
+		" -Clear @(" + ps.QuoteString("info") + ")",
+		" -Replace @{" + ps.QuoteString("description") + "=",
+	}
+	if len(*scripts) != len(want) {
+		t.Fatalf("got %d requests, want one per change: %v", len(*scripts), *scripts)
+	}
+	for i, w := range want {
+		if s := (*scripts)[i]; !strings.HasPrefix(s, "Set-ADObject") || !strings.Contains(s, w) {
+			t.Errorf("request %d = %s, want %s", i, s, w)
+		}
+	}
+
+	// the first failing change stops the rest
+	scripts = recordPowershell(t, func(script string) ([]byte, error) {
+		if strings.Contains(script, "-Remove") {
+			return nil, errors.New("no such value")
+		}
+		return nil, nil
+	})
+	if err := c.ApplyLDIFRecord(rec); err == nil || !strings.Contains(err.Error(), "change 2 of 5") {
+		t.Errorf("ApplyLDIFRecord() = %v", err)
+	}
+	if len(*scripts) != 2 {
+		t.Errorf("changes after the failing one were applied: %v", *scripts)
+	}
+}
+
+func TestSplitRDN(t *testing.T) {
+
+	tests := []struct{ dn, attr, value, parent string }{
+		{"CN=Jane Doe,OU=Staff,DC=example,DC=com", "CN", "Jane Doe", "OU=Staff,DC=example,DC=com"},
+		{"cn=jdoe,ou=staff,dc=example,dc=com", "cn", "jdoe", "ou=staff,dc=example,dc=com"},
+		{`CN=Doe\, Jane,OU=Staff,DC=example,DC=com`, "CN", "Doe, Jane", "OU=Staff,DC=example,DC=com"},
+		{`CN=Doe\2C Jane\2b\5C,DC=example,DC=com`, "CN", `Doe, Jane+\`, "DC=example,DC=com"},
+		{"uid=jdoe, DC=example, DC=com", "uid", "jdoe", "DC=example, DC=com"},
+		{"DC=com", "DC", "com", ""},
+	}
+	for _, test := range tests {
+		attr, value, parent, err := splitRDN(test.dn)
+		if err != nil || attr != test.attr || value != test.value || parent != test.parent {
+			t.Errorf("splitRDN(%q) = %q, %q, %q, %v", test.dn, attr, value, parent, err)
+		}
+	}
+
+	for _, dn := range []string{"", "Jane Doe", `CN=Jane\`, "CN=Jane+UID=jdoe,DC=example,DC=com"} {
+		if _, _, _, err := splitRDN(dn); err == nil {
+			t.Errorf("splitRDN(%q) succeeded", dn)
+		}
+	}
+}
+
+func TestApplyLDIFAdd(t *testing.T) {
+
+	scripts := recordPowershell(t, nil)
+	c := NewConnection("dc1", "svc", "secret")
+	rec := LDIFRecord{DN: `cn=Doe\, Jane,ou=Staff,dc=example,dc=com`, Attributes: Attributes{}}
+	rec.Attributes.Set("objectClass", NewStringAttribute("top", "person", "contact"))
+	rec.Attributes.Set("cn", NewStringAttribute("Doe, Jane"))
+	rec.Attributes.Set("sn", NewStringAttribute("Doe"))
+	if err := c.ApplyLDIFRecord(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*scripts) != 1 {
+		t.Fatalf("scripts = %v", *scripts)
+	}
+	for _, want := range []string{
+		" -Type " + ps.QuoteString("contact"),
+		" -Name " + ps.QuoteString("Doe, Jane") + " ",
+		" -Path " + ps.QuoteString("ou=Staff,dc=example,dc=com"),
+		ps.QuoteString("sn") + "=",
+	} {
+		if !strings.Contains((*scripts)[0], want) {
+			t.Errorf("script does not contain %s:\n%s", want, (*scripts)[0])
+		}
+	}
+	if strings.Contains((*scripts)[0], ps.QuoteString("cn")+"=") {
+		t.Errorf("the RDN attribute was set:\n%s", (*scripts)[0])
+	}
+}
+
+func TestLDIFReaderFileURL(t *testing.T) {
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "photo.jpg"), []byte{0xff, 0xd8}, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(outside, []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	record := func(path string) string {
+		return "dn: CN=Jane,DC=example,DC=com\njpegPhoto:< file://" + filepath.ToSlash(path) + "\n"
+	}
+
+	// rejected by default
+	if _, err := NewLDIFReader(strings.NewReader(record(filepath.Join(dir, "photo.jpg")))).Next(); err == nil {
+		t.Error("file URL was read without a FileBase")
+	}
+
+	r := NewLDIFReader(strings.NewReader(record(filepath.Join(dir, "photo.jpg"))))
+	r.FileBase = dir
+	rec, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := rec.Attributes.Get("jpegPhoto"); !a.Binary || !bytes.Equal(a.Bytes(), []byte{0xff, 0xd8}) {
+		t.Errorf("jpegPhoto = %+v", a)
+	}
+
+	for _, path := range []string{outside, filepath.Join(dir, "..", filepath.Base(filepath.Dir(outside)), "secret")} {
+		r := NewLDIFReader(strings.NewReader(record(path)))
+		r.FileBase = dir
+		if _, err := r.Next(); err == nil {
+			t.Errorf("%s outside of FileBase was read", path)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package ad
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jakobii/ps"
+)
+
+// LockoutStatus describes the lockout state of an account.
+//
+// badPwdCount and badPasswordTime are not replicated, so the values returned by
+// User.LockoutStatus are aggregated from every domain controller, and the
+// individual readings are kept in DomainControllers.
+type LockoutStatus struct {
+	Server          string
+	LockedOut       bool
+	LockoutTime     time.Time
+	BadPwdCount     int
+	BadPasswordTime time.Time
+
+	DomainControllers []LockoutStatus
+}
+
+// LockoutStatus queries every domain controller and returns the combined lockout state of the user.
+// Domain controllers that can not be reached are skipped.
+func (u *User) LockoutStatus() (status LockoutStatus, err error) {
+	id, err := u.Identity()
+	if err != nil {
+		return status, err
+	}
+
+	dcs, err := u.DomainControllers()
+	if err != nil {
+		return status, err
+	}
+
+	var lastErr error
+	for _, host := range dcs {
+		dc := u.Connection
+		dc.Server = host
+		s, err := dc.getLockoutStatus(id)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		status.DomainControllers = append(status.DomainControllers, s)
+
+		if s.LockedOut {
+			status.LockedOut = true
+		}
+		if s.LockoutTime.After(status.LockoutTime) {
+			status.LockoutTime = s.LockoutTime
+		}
+		if s.BadPwdCount > status.BadPwdCount {
+			status.BadPwdCount = s.BadPwdCount
+		}
+		if s.BadPasswordTime.After(status.BadPasswordTime) {
+			status.BadPasswordTime = s.BadPasswordTime
+		}
+	}
+
+	if len(status.DomainControllers) == 0 {
+		if lastErr != nil {
+			return status, lastErr
+		}
+		return status, errors.New("no domain controllers found")
+	}
+
+	return status, nil
+}
+
+// getLockoutStatus reads the lockout attributes of an account from c.Server only.
+func (c *Connection) getLockoutStatus(Identity string) (status LockoutStatus, err error) {
+
+	var cmd bytes.Buffer
+	cmd.WriteString("Get-ADUser -Server ")
+	cmd.WriteString(ps.QuoteString(c.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(c.Credential.Expr())
+	cmd.WriteString(" -Identity ")
+	cmd.WriteString(ps.QuoteString(Identity))
+	cmd.WriteString(" -Properties @('LockedOut', 'lockoutTime', 'badPwdCount', 'badPasswordTime') | Select-Object @('LockedOut', 'lockoutTime', 'badPwdCount', 'badPasswordTime') | ConvertTo-Json")
+
+	result, err := powershell(cmd.String())
+	if err != nil {
+		return status, err
+	}
+
+	raw := struct {
+		LockedOut       bool
+		LockoutTime     int64
+		BadPwdCount     int
+		BadPasswordTime int64
+	}{}
+	err = json.Unmarshal(result, &raw)
+	if err != nil {
+		return status, err
+	}
+
+	status.Server = c.Server
+	status.LockedOut = raw.LockedOut
+	status.LockoutTime = FileTimeToTime(raw.LockoutTime)
+	status.BadPwdCount = raw.BadPwdCount
+	status.BadPasswordTime = FileTimeToTime(raw.BadPasswordTime)
+
+	return status, nil
+}
+
+// Unlock clears the lockout of the user.
+func (u *User) Unlock() error {
+	id, err := u.Identity()
+	if err != nil {
+		return err
+	}
+
+	var cmd bytes.Buffer
+	cmd.WriteString("Unlock-ADAccount -Server ")
+	cmd.WriteString(ps.QuoteString(u.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(u.Credential.Expr())
+	cmd.WriteString(" -Identity ")
+	cmd.WriteString(ps.QuoteString(id))
+	cmd.WriteString(" -Confirm:$false")
+
+	_, err = powershell(cmd.String())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// FindLockedOutUsers returns every user account that is currently locked out.
+// Only the identity fields of the returned users are populated, call Pull to load the rest.
+func (c *Connection) FindLockedOutUsers() (users []User, err error) {
+
+	var cmd bytes.Buffer
+	cmd.WriteString("Search-ADAccount -Server ")
+	cmd.WriteString(ps.QuoteString(c.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(c.Credential.Expr())
+	cmd.WriteString(" -LockedOut -UsersOnly | Select-Object @('ObjectGuid', 'ObjectClass',  'DistinguishedName', 'Name', 'SamAccountName', 'UserPrincipalName', 'Enabled') | ConvertTo-Json")
+
+	result, err := powershell(cmd.String())
+	if err != nil {
+		return users, err
+	}
+
+	err = unmarshalList(result, &users)
+	if err != nil {
+		return users, err
+	}
+
+	for i := range users {
+		users[i].Connection = *c
+	}
+
+	return users, nil
+}
@@ -0,0 +1,118 @@
+package ad
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jakobii/ps"
+)
+
+func TestLockoutStatus(t *testing.T) {
+
+	t1 := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	readings := map[string]string{
+		"dc1": fmt.Sprintf(`{"LockedOut":false,"lockoutTime":0,"badPwdCount":1,"badPasswordTime":%d}`, TimeToFileTime(t2)),
+		"dc2": fmt.Sprintf(`{"LockedOut":true,"lockoutTime":%d,"badPwdCount":5,"badPasswordTime":%d}`, TimeToFileTime(t1), TimeToFileTime(t1)),
+	}
+
+	tests := []struct {
+		name    string
+		dcs     string
+		want    LockoutStatus
+		servers []string
+		err     string
+	}{
+		{
+			name:    "aggregated",
+			dcs:     `["dc1","dc2","dc3"]`,
+			want:    LockoutStatus{LockedOut: true, LockoutTime: t1, BadPwdCount: 5, BadPasswordTime: t2},
+			servers: []string{"dc1", "dc2"},
+		},
+		{name: "single", dcs: `"dc1"`, want: LockoutStatus{BadPwdCount: 1, BadPasswordTime: t2}, servers: []string{"dc1"}},
+		{name: "unreachable", dcs: `["dc3"]`, err: "dc3 is unreachable"},
+		{name: "none", dcs: `[]`, err: "no domain controllers found"},
+	}
+
+	id := uuid.New()
+	for _, test := range tests {
+		recordPowershell(t, func(script string) ([]byte, error) {
+			if strings.HasPrefix(script, "Get-ADDomainController") {
+				return []byte(test.dcs), nil
+			}
+			if !strings.Contains(script, " -Identity "+ps.QuoteString(id.String())) {
+				return nil, errors.New("unexpected identity: " + script)
+			}
+			for dc, reading := range readings {
+				if strings.HasPrefix(script, "Get-ADUser -Server "+ps.QuoteString(dc)+" ") {
+					return []byte(reading), nil
+				}
+			}
+			return nil, errors.New("dc3 is unreachable")
+		})
+
+		u := User{}
+		u.Connection = NewConnection("dc1", "svc", "secret")
+		u.ObjectGuid = id
+		status, err := u.LockoutStatus()
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: err = %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		var servers []string
+		for _, s := range status.DomainControllers {
+			servers = append(servers, s.Server)
+		}
+		if fmt.Sprint(servers) != fmt.Sprint(test.servers) {
+			t.Errorf("%s: domain controllers %v, want %v", test.name, servers, test.servers)
+		}
+		status.DomainControllers = nil
+		if !reflect.DeepEqual(status, test.want) {
+			t.Errorf("%s: status = %+v, want %+v", test.name, status, test.want)
+		}
+	}
+}
+
+func TestFindLockedOutUsers(t *testing.T) {
+
+	tests := map[string]int{
+		`[{"ObjectGuid":"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c01","ObjectClass":"user","DistinguishedName":"CN=Jane Doe,DC=example,DC=com","Name":"Jane Doe","SamAccountName":"jdoe","Enabled":true},` +
+			`{"ObjectGuid":"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c02","ObjectClass":"user","DistinguishedName":"CN=Al Smith,DC=example,DC=com","Name":"Al Smith","SamAccountName":"asmith","Enabled":false}]`: 2,
+		`{"ObjectGuid":"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c01","ObjectClass":"user","DistinguishedName":"CN=Jane Doe,DC=example,DC=com","Name":"Jane Doe","SamAccountName":"jdoe","Enabled":true}`: 1,
+		``: 0,
+	}
+
+	for out, want := range tests {
+		scripts := recordPowershell(t, func(string) ([]byte, error) { return []byte(out), nil })
+		c := NewConnection("dc1", "svc", "secret")
+		users, err := c.FindLockedOutUsers()
+		if err != nil {
+			t.Errorf("%q: %v", out, err)
+			continue
+		}
+		if len(*scripts) != 1 || !strings.Contains((*scripts)[0], " -LockedOut -UsersOnly ") {
+			t.Errorf("scripts = %v", *scripts)
+		}
+		if len(users) != want {
+			t.Errorf("%q: %d users, want %d", out, len(users), want)
+			continue
+		}
+		for _, u := range users {
+			if u.Server != "dc1" || u.SamAccountName == "" || u.ObjectGuid == uuid.Nil {
+				t.Errorf("user = %+v", u)
+			}
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package ad
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/jakobii/ps"
+)
+
+// LastLogon queries lastLogon on every domain controller and returns the most recent one.
+// Unlike LastLogonTimestamp, which may lag up to 14 days behind, this is accurate.
+// Domain controllers that can not be reached are skipped.
+func (u *User) LastLogon() (last time.Time, err error) {
+	id, err := u.Identity()
+	if err != nil {
+		return last, err
+	}
+
+	dcs, err := u.DomainControllers()
+	if err != nil {
+		return last, err
+	}
+
+	var lastErr error
+	var ok bool
+	for _, host := range dcs {
+		dc := u.Connection
+		dc.Server = host
+		t, err := dc.getLastLogon(id)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		ok = true
+		if t.After(last) {
+			last = t
+		}
+	}
+
+	if !ok {
+		if lastErr != nil {
+			return last, lastErr
+		}
+		return last, errors.New("no domain controllers found")
+	}
+
+	// lastLogonTimestamp can be newer for logons that do not touch lastLogon,
+	// e.g. S4U or NTLM network logons handled by another DC
+	if u.LastLogonTimestamp.After(last) {
+		last = u.LastLogonTimestamp
+	}
+
+	return last, nil
+}
+
+// getLastLogon reads lastLogon of an account from c.Server only.
+func (c *Connection) getLastLogon(Identity string) (t time.Time, err error) {
+
+	var cmd bytes.Buffer
+	cmd.WriteString("Get-ADObject -Server ")
+	cmd.WriteString(ps.QuoteString(c.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(c.Credential.Expr())
+	cmd.WriteString(" -Identity ")
+	cmd.WriteString(ps.QuoteString(Identity))
+	cmd.WriteString(" -Properties lastLogon | Select-Object @('lastLogon') | ConvertTo-Json")
+
+	result, err := powershell(cmd.String())
+	if err != nil {
+		return t, err
+	}
+
+	raw := struct{ LastLogon int64 }{}
+	err = json.Unmarshal(result, &raw)
+	if err != nil {
+		return t, err
+	}
+
+	return FileTimeToTime(raw.LastLogon), nil
+}
+
+// FindInactiveUsers returns user accounts that have not logged on in the last days days,
+// including accounts older than that which never logged on.
+// Only the identity fields of the returned users are populated, call Pull to load the rest.
+func (c *Connection) FindInactiveUsers(days int) (users []User, err error) {
+	objs, err := c.findInactive(days, "(objectCategory=person)(objectClass=user)")
+	if err != nil {
+		return users, err
+	}
+	users = make([]User, 0, len(objs))
+	for _, v := range objs {
+		users = append(users, User{Object: v})
+	}
+	return users, nil
+}
+
+// FindInactiveComputers returns computer accounts that have not logged on in the last days days,
+// including accounts older than that which never logged on.
+func (c *Connection) FindInactiveComputers(days int) (computers []Object, err error) {
+	return c.findInactive(days, "(objectClass=computer)")
+}
+
+// findInactive uses the replicated lastLogonTimestamp to find candidates, then
+// drops every candidate that any domain controller saw log on since the cutoff.
+func (c *Connection) findInactive(days int, class string) (objs []Object, err error) {
+
+	if days < 1 {
+		return objs, errors.New("days must be greater than zero")
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -days)
+	ft := strconv.FormatInt(TimeToFileTime(cutoff), 10)
+
+	filter := "(&" + class + "(|(lastLogonTimestamp<=" + ft + ")(&(!(lastLogonTimestamp=*))(whenCreated<=" + FormatGeneralizedTime(cutoff) + "))))"
+	objs, err = c.findObjectsLDAP(filter)
+	if err != nil {
+		return objs, err
+	}
+	if len(objs) == 0 {
+		return objs, nil
+	}
+
+	dcs, err := c.DomainControllers()
+	if err != nil {
+		return objs, err
+	}
+
+	active := make(map[string]bool)
+	for _, host := range dcs {
+		dc := *c
+		dc.Server = host
+		recent, err := dc.findObjectsLDAP("(&" + class + "(lastLogon>=" + ft + "))")
+		if err != nil {
+			// an unreachable DC can only make the result less accurate, not wrong
+			continue
+		}
+		for _, v := range recent {
+			active[v.ObjectGuid.String()] = true
+		}
+	}
+
+	inactive := make([]Object, 0, len(objs))
+	for _, v := range objs {
+		if !active[v.ObjectGuid.String()] {
+			inactive = append(inactive, v)
+		}
+	}
+
+	return inactive, nil
+}
+
+// findObjectsLDAP returns every object matching an LDAP filter on c.Server.
+func (c *Connection) findObjectsLDAP(filter string) (objs []Object, err error) {
+
+	var cmd bytes.Buffer
+	cmd.WriteString("Get-ADObject -Server ")
+	cmd.WriteString(ps.QuoteString(c.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(c.Credential.Expr())
+	cmd.WriteString(" -LDAPFilter ")
+	cmd.WriteString(ps.QuoteString(filter))
+	cmd.WriteString(" -ResultSetSize $null | Select-Object @('ObjectGuid', 'ObjectClass',  'DistinguishedName', 'Name') | ConvertTo-Json")
+
+	result, err := powershell(cmd.String())
+	if err != nil {
+		return objs, err
+	}
+
+	err = unmarshalList(result, &objs)
+	if err != nil {
+		return objs, err
+	}
+
+	for i := range objs {
+		objs[i].Connection = *c
+	}
+
+	return objs, nil
+}
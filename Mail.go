@@ -0,0 +1,519 @@
+package ad
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/jakobii/ps"
+)
+
+// psRecipientSelect selects the Exchange recipient attributes of an AD object so they
+// unmarshal into a Recipient. msExchHideFromAddressLists only exists if the schema was
+// extended for Exchange, so objects have to be loaded with -Properties *.
+const psRecipientSelect string = "@{n='ProxyAddresses';e={@($_.proxyAddresses)}}, 'mailNickname', 'targetAddress', @{n='HideFromAddressLists';e={[bool]$_.msExchHideFromAddressLists}}"
+
+// Recipient holds the attributes Exchange uses to route mail to a user, group or contact.
+type Recipient struct {
+	// ProxyAddresses are the addresses mail is accepted for, as type:address.
+	// An uppercase type marks the primary address of that type, see ProxyAddresses.
+	ProxyAddresses ProxyAddresses
+	// MailNickname is the Exchange alias.
+	MailNickname string
+	// TargetAddress is where mail is forwarded to, e.g. the cloud mailbox of a
+	// remote mailbox in a hybrid deployment.
+	TargetAddress string
+	// HideFromAddressLists is msExchHideFromAddressLists.
+	HideFromAddressLists bool
+
+	// original is what was pulled, nil if the recipient was never pulled.
+	original *Recipient
+}
+
+// pulled remembers the current values as the values in the directory.
+func (r *Recipient) pulled() {
+	original := *r
+	original.ProxyAddresses = append(ProxyAddresses(nil), r.ProxyAddresses...)
+	original.original = nil
+	r.original = &original
+}
+
+// changes adds the changes since the recipient was pulled to m. Proxy addresses are
+// added and removed one by one. If the recipient was never pulled, only attributes
+// with a value are written.
+func (r *Recipient) changes(m *modification) {
+
+	if r.original == nil {
+		if len(r.ProxyAddresses) > 0 {
+			m.replace("proxyAddresses", NewStringAttribute(r.ProxyAddresses...))
+		}
+		if r.MailNickname != "" {
+			m.replace("mailNickname", NewStringAttribute(r.MailNickname))
+		}
+		if r.TargetAddress != "" {
+			m.replace("targetAddress", NewStringAttribute(r.TargetAddress))
+		}
+		if r.HideFromAddressLists {
+			m.replace("msExchHideFromAddressLists", NewBoolAttribute(true))
+		}
+		return
+	}
+
+	add, remove := NewStringAttribute(r.ProxyAddresses...).diff(NewStringAttribute(r.original.ProxyAddresses...))
+	m.remove("proxyAddresses", remove)
+	m.add("proxyAddresses", add)
+	if r.MailNickname != r.original.MailNickname {
+		m.replace("mailNickname", NewStringAttribute(r.MailNickname))
+	}
+	if r.TargetAddress != r.original.TargetAddress {
+		m.replace("targetAddress", NewStringAttribute(r.TargetAddress))
+	}
+	if r.HideFromAddressLists != r.original.HideFromAddressLists {
+		if r.HideFromAddressLists {
+			m.replace("msExchHideFromAddressLists", NewBoolAttribute(true))
+		} else {
+			m.clear("msExchHideFromAddressLists")
+		}
+	}
+}
+
+// ApplyAddressPolicy adds the addresses generated by the policy. A generated primary address
+// replaces the current primary of its type, which is kept as a secondary address. Existing
+// addresses are never removed, so mail to old addresses keeps working. A blank MailNickname
+// is set to the alias from v.
+func (r *Recipient) ApplyAddressPolicy(p AddressPolicy, v AddressValues) error {
+	addresses, err := p.Addresses(v)
+	if err != nil {
+		return err
+	}
+	for _, a := range addresses {
+		r.ProxyAddresses.Add(a)
+	}
+	if r.MailNickname == "" {
+		r.MailNickname = v.Alias
+	}
+	return nil
+}
+
+// ProxyAddresses is the proxyAddresses attribute of a recipient. Every value is a type and an
+// address separated by a colon, e.g. smtp:jane@example.com or X500:/o=Example/.... The type of
+// the primary address is uppercase, there is at most one primary address per type.
+type ProxyAddresses []string
+
+// splitProxy returns the type and address of a proxy address. A value without a type is an
+// SMTP address.
+func splitProxy(proxy string) (kind, address string) {
+	i := strings.Index(proxy, ":")
+	if i <= 0 {
+		return "smtp", proxy
+	}
+	return proxy[:i], proxy[i+1:]
+}
+
+// isPrimary returns true if the type of a proxy address is uppercase.
+func isPrimary(kind string) bool {
+	return kind == strings.ToUpper(kind) && kind != strings.ToLower(kind)
+}
+
+// Primary returns the primary address of a type, e.g. smtp or sip, or "" if there is none.
+func (p ProxyAddresses) Primary(kind string) string {
+	for _, v := range p {
+		k, address := splitProxy(v)
+		if k == strings.ToUpper(kind) {
+			return address
+		}
+	}
+	return ""
+}
+
+// PrimarySMTP returns the primary SMTP address, the one with the uppercase SMTP: prefix.
+func (p ProxyAddresses) PrimarySMTP() string {
+	return p.Primary("smtp")
+}
+
+// Contains returns true if the proxy address is in the list, whether it is primary or not.
+// A value without a type is an SMTP address.
+func (p ProxyAddresses) Contains(proxy string) bool {
+	return p.index(proxy) >= 0
+}
+
+func (p ProxyAddresses) index(proxy string) int {
+	kind, address := splitProxy(proxy)
+	for i, v := range p {
+		k, a := splitProxy(v)
+		if strings.EqualFold(k, kind) && strings.EqualFold(a, address) {
+			return i
+		}
+	}
+	return -1
+}
+
+// SetPrimary makes address the primary address of a type. The current primary address of
+// that type becomes a secondary address.
+func (p *ProxyAddresses) SetPrimary(kind, address string) {
+	upper := strings.ToUpper(kind)
+	lower := strings.ToLower(kind)
+	list := make(ProxyAddresses, 0, len(*p)+1)
+	list = append(list, upper+":"+address)
+	for _, v := range *p {
+		k, a := splitProxy(v)
+		if !strings.EqualFold(k, kind) {
+			list = append(list, v)
+			continue
+		}
+		if strings.EqualFold(a, address) {
+			continue
+		}
+		list = append(list, lower+":"+a)
+	}
+	*p = list
+}
+
+// Add adds a proxy address unless it is already there. A value without a type is a
+// secondary SMTP address, a value with an uppercase type becomes the primary address.
+func (p *ProxyAddresses) Add(proxy string) {
+	kind, address := splitProxy(proxy)
+	if isPrimary(kind) {
+		p.SetPrimary(kind, address)
+		return
+	}
+	if p.Contains(proxy) {
+		return
+	}
+	*p = append(*p, strings.ToLower(kind)+":"+address)
+}
+
+// Remove removes a proxy address, whether it is primary or not. A value without a type is
+// an SMTP address.
+func (p *ProxyAddresses) Remove(proxy string) {
+	for i := p.index(proxy); i >= 0; i = p.index(proxy) {
+		*p = append((*p)[:i], (*p)[i+1:]...)
+	}
+}
+
+// Validate checks that no address is listed twice, that every type has at most one primary
+// address, that there is a primary SMTP address if there are any SMTP addresses, and that
+// SMTP addresses are valid.
+func (p ProxyAddresses) Validate() error {
+	seen := make(map[string]bool, len(p))
+	primary := make(map[string]bool)
+	smtp := false
+	for _, v := range p {
+		kind, address := splitProxy(v)
+		if !strings.Contains(v, ":") {
+			return fmt.Errorf("proxy address %q has no type", v)
+		}
+		key := strings.ToLower(v)
+		if seen[key] {
+			return fmt.Errorf("proxy address %q is listed more than once", v)
+		}
+		seen[key] = true
+
+		if isPrimary(kind) {
+			if primary[kind] {
+				return fmt.Errorf("more than one primary %s address", kind)
+			}
+			primary[kind] = true
+		}
+
+		if strings.EqualFold(kind, "smtp") {
+			smtp = true
+			a, err := mail.ParseAddress(address)
+			if err != nil || a.Address != address {
+				return fmt.Errorf("invalid SMTP address %q", address)
+			}
+		}
+	}
+	if smtp && !primary["SMTP"] {
+		return errors.New("no primary SMTP address")
+	}
+	return nil
+}
+
+// AddressConflict is a proxy address that is already used by other objects.
+type AddressConflict struct {
+	Address string
+	Owners  []Object
+}
+
+func (e AddressConflict) Error() string {
+	names := make([]string, 0, len(e.Owners))
+	for _, v := range e.Owners {
+		names = append(names, v.DistinguishedName)
+	}
+	return "address " + e.Address + " is already used by " + strings.Join(names, "; ")
+}
+
+// FindAddressConflicts searches the directory for objects other than self that use any of the
+// proxy addresses, either in proxyAddresses or, for SMTP addresses, in mail. Addresses are
+// compared without regard to case or whether they are primary.
+func (c *Connection) FindAddressConflicts(self Object, proxies ...string) (conflicts []AddressConflict, err error) {
+
+	if len(proxies) == 0 {
+		return conflicts, nil
+	}
+
+	var filter strings.Builder
+	filter.WriteString("(|")
+	for _, v := range proxies {
+		kind, address := splitProxy(v)
+		filter.WriteString("(proxyAddresses=")
+		filter.WriteString(escapeFilterValue(strings.ToLower(kind) + ":" + address))
+		filter.WriteString(")")
+		if strings.EqualFold(kind, "smtp") {
+			filter.WriteString("(mail=")
+			filter.WriteString(escapeFilterValue(address))
+			filter.WriteString(")")
+		}
+	}
+	filter.WriteString(")")
+
+	objs, err := c.FindObjects(Search{Filter: filter.String(), Attributes: []string{"proxyAddresses", "mail"}})
+	if err != nil {
+		return conflicts, err
+	}
+
+	for _, v := range proxies {
+		kind, address := splitProxy(v)
+		conflict := AddressConflict{Address: v}
+		for _, obj := range objs {
+			if obj.Is(self) {
+				continue
+			}
+			proxyAddresses, _ := obj.Attributes.Get("proxyAddresses")
+			mailAttr, _ := obj.Attributes.Get("mail")
+			if ProxyAddresses(proxyAddresses.Strings()).Contains(kind+":"+address) ||
+				(strings.EqualFold(kind, "smtp") && strings.EqualFold(mailAttr.String(), address)) {
+				conflict.Owners = append(conflict.Owners, obj)
+			}
+		}
+		if len(conflict.Owners) > 0 {
+			conflicts = append(conflicts, conflict)
+		}
+	}
+	return conflicts, nil
+}
+
+// AddressValues are the values an AddressPolicy template can refer to.
+type AddressValues struct {
+	GivenName   string // %g
+	Surname     string // %s
+	Initials    string // %i
+	DisplayName string // %d
+	Alias       string // %m
+}
+
+// AddressPolicy generates proxy addresses from templates in the style of Exchange email
+// address policies. A template is a type and an address, e.g.
+//
+//	SMTP:%g.%s@example.com
+//	smtp:%m@example.mail.onmicrosoft.com
+//	smtp:%1g%s@example.com
+//
+// A template without a type is a secondary SMTP address. %g, %s, %i, %d and %m are replaced with
+// the values of AddressValues, %<n>g and so on with the first n characters of the value, and %%
+// with %. %rxy replaces the character x with y in every value that follows it. Characters that
+// are not allowed in the local part of an address are removed from the values.
+type AddressPolicy struct {
+	Templates []string
+}
+
+// Addresses returns the proxy addresses the policy generates for v.
+func (p AddressPolicy) Addresses(v AddressValues) ([]string, error) {
+	addresses := make([]string, 0, len(p.Templates))
+	for _, t := range p.Templates {
+		kind, template := "smtp", t
+		if i := strings.Index(t, ":"); i > 0 && !strings.ContainsAny(t[:i], "%@") {
+			kind, template = t[:i], t[i+1:]
+		}
+		address, err := expandAddressTemplate(template, v)
+		if err != nil {
+			return addresses, fmt.Errorf("address template %q: %v", t, err)
+		}
+		addresses = append(addresses, kind+":"+address)
+	}
+	return addresses, nil
+}
+
+func expandAddressTemplate(template string, v AddressValues) (string, error) {
+
+	fields := map[byte]string{
+		'g': v.GivenName,
+		's': v.Surname,
+		'i': v.Initials,
+		'd': v.DisplayName,
+		'm': v.Alias,
+	}
+
+	var out strings.Builder
+	replacer := strings.NewReplacer()
+	var replacements []string
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' {
+			out.WriteByte(template[i])
+			continue
+		}
+		i++
+		if i >= len(template) {
+			return "", errors.New("template ends with %")
+		}
+		if template[i] == '%' {
+			out.WriteByte('%')
+			continue
+		}
+		if template[i] == 'r' {
+			if i+2 >= len(template) {
+				return "", errors.New("%r needs two characters")
+			}
+			replacements = append(replacements, template[i+1:i+2], template[i+2:i+3])
+			replacer = strings.NewReplacer(replacements...)
+			i += 2
+			continue
+		}
+
+		n := -1
+		j := i
+		for j < len(template) && template[j] >= '0' && template[j] <= '9' {
+			j++
+		}
+		if j > i {
+			n, _ = strconv.Atoi(template[i:j])
+			i = j
+		}
+		if i >= len(template) {
+			return "", errors.New("template ends within a placeholder")
+		}
+		value, ok := fields[template[i]]
+		if !ok {
+			return "", fmt.Errorf("unknown placeholder %%%c", template[i])
+		}
+		value = cleanLocalPart(replacer.Replace(value))
+		if n >= 0 && n < len(value) {
+			value = value[:n]
+		}
+		out.WriteString(value)
+	}
+	return out.String(), nil
+}
+
+// cleanLocalPart removes the characters that are not allowed in the unquoted local part of an
+// email address.
+func cleanLocalPart(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case strings.ContainsRune("!#$%&'*+-/=?^_`{|}~.", r):
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// AddressValues returns the values address policy templates are expanded with. The alias is
+// MailNickname, or SamAccountName if the user has none yet.
+func (u *User) AddressValues() AddressValues {
+	alias := u.MailNickname
+	if alias == "" {
+		alias = u.SamAccountName
+	}
+	return AddressValues{
+		GivenName:   u.GivenName,
+		Surname:     u.Surname,
+		Initials:    u.Initials,
+		DisplayName: u.DisplayName,
+		Alias:       alias,
+	}
+}
+
+// AddressValues returns the values address policy templates are expanded with. The alias is
+// MailNickname, or SamAccountName if the group has none yet.
+func (g *Group) AddressValues() AddressValues {
+	alias := g.MailNickname
+	if alias == "" {
+		alias = g.SamAccountName
+	}
+	return AddressValues{
+		DisplayName: g.DisplayName,
+		Alias:       alias,
+	}
+}
+
+// AddressValues returns the values address policy templates are expanded with. The alias is
+// MailNickname, or the name if the contact has none yet.
+func (c *Contact) AddressValues() AddressValues {
+	alias := c.MailNickname
+	if alias == "" {
+		alias = cleanLocalPart(c.Name)
+	}
+	return AddressValues{
+		GivenName:   c.GivenName,
+		Surname:     c.Surname,
+		Initials:    c.Initials,
+		DisplayName: c.DisplayName,
+		Alias:       alias,
+	}
+}
+
+// getRecipient returns the recipient attributes and the mail attribute of an object.
+func (c *Connection) getRecipient(Identity string) (r Recipient, address string, err error) {
+
+	var cmd bytes.Buffer
+	cmd.WriteString("Get-ADObject -Server ")
+	cmd.WriteString(ps.QuoteString(c.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(c.Credential.Expr())
+	cmd.WriteString(" -Identity ")
+	cmd.WriteString(ps.QuoteString(Identity))
+	cmd.WriteString(" -Properties * | Select-Object @('mail', ")
+	cmd.WriteString(psRecipientSelect)
+	cmd.WriteString(" ) | ConvertTo-Json")
+
+	result, err := powershell(cmd.String())
+	if err != nil {
+		return r, address, err
+	}
+
+	err = json.Unmarshal(result, &r)
+	if err != nil {
+		return r, address, err
+	}
+	m := struct{ Mail string }{}
+	err = json.Unmarshal(result, &m)
+	if err != nil {
+		return r, address, err
+	}
+	r.pulled()
+	return r, m.Mail, nil
+}
+
+// PullMail loads the mail attributes of the group, which GetGroup does not load.
+func (g *Group) PullMail() error {
+	id, err := g.Identity()
+	if err != nil {
+		return err
+	}
+	g.Recipient, g.Mail, err = g.getRecipient(id)
+	return err
+}
+
+// PushMail writes the mail attributes of the group. Before PullMail was called only
+// attributes with a value are written.
+func (g *Group) PushMail() error {
+	var m modification
+	if g.Recipient.original != nil || g.Mail != "" {
+		m.replace("mail", NewStringAttribute(g.Mail))
+	}
+	g.Recipient.changes(&m)
+	err := g.modify(m)
+	if err != nil {
+		return err
+	}
+	g.Recipient.pulled()
+	return nil
+}
@@ -0,0 +1,149 @@
+package ad
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProxyAddresses(t *testing.T) {
+
+	p := ProxyAddresses{"SMTP:jane@example.com", "smtp:j.doe@example.com", "SIP:jane@example.com", "X500:/o=Example/cn=jane"}
+
+	if got := p.PrimarySMTP(); got != "jane@example.com" {
+		t.Errorf("PrimarySMTP() = %q", got)
+	}
+	if got := p.Primary("sip"); got != "jane@example.com" {
+		t.Errorf("Primary(sip) = %q", got)
+	}
+	if got := p.Primary("eum"); got != "" {
+		t.Errorf("Primary(eum) = %q, want none", got)
+	}
+	for _, v := range []string{"smtp:JANE@example.com", "SMTP:j.doe@example.com", "j.doe@example.com", "x500:/o=Example/cn=jane"} {
+		if !p.Contains(v) {
+			t.Errorf("Contains(%q) = false", v)
+		}
+	}
+	if p.Contains("sip:j.doe@example.com") {
+		t.Error("Contains compares addresses of different types")
+	}
+	if err := p.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		edit func(p *ProxyAddresses)
+		want ProxyAddresses
+	}{
+		{
+			name: "SetPrimary existing",
+			edit: func(p *ProxyAddresses) { p.SetPrimary("smtp", "j.doe@example.com") },
+			want: ProxyAddresses{"SMTP:j.doe@example.com", "smtp:jane@example.com", "SIP:jane@example.com", "X500:/o=Example/cn=jane"},
+		},
+		{
+			name: "SetPrimary new",
+			edit: func(p *ProxyAddresses) { p.SetPrimary("SMTP", "doe@example.com") },
+			want: ProxyAddresses{"SMTP:doe@example.com", "smtp:jane@example.com", "smtp:j.doe@example.com", "SIP:jane@example.com", "X500:/o=Example/cn=jane"},
+		},
+		{
+			name: "Add secondary",
+			edit: func(p *ProxyAddresses) { p.Add("doe@example.com") },
+			want: ProxyAddresses{"SMTP:jane@example.com", "smtp:j.doe@example.com", "SIP:jane@example.com", "X500:/o=Example/cn=jane", "smtp:doe@example.com"},
+		},
+		{
+			name: "Add existing",
+			edit: func(p *ProxyAddresses) { p.Add("smtp:J.Doe@example.com") },
+			want: ProxyAddresses{"SMTP:jane@example.com", "smtp:j.doe@example.com", "SIP:jane@example.com", "X500:/o=Example/cn=jane"},
+		},
+		{
+			name: "Add primary",
+			edit: func(p *ProxyAddresses) { p.Add("SIP:doe@example.com") },
+			want: ProxyAddresses{"SIP:doe@example.com", "SMTP:jane@example.com", "smtp:j.doe@example.com", "sip:jane@example.com", "X500:/o=Example/cn=jane"},
+		},
+		{
+			name: "Remove",
+			edit: func(p *ProxyAddresses) { p.Remove("J.DOE@example.com") },
+			want: ProxyAddresses{"SMTP:jane@example.com", "SIP:jane@example.com", "X500:/o=Example/cn=jane"},
+		},
+	}
+
+	for _, test := range tests {
+		got := append(ProxyAddresses{}, p...)
+		test.edit(&got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+		if err := got.Validate(); err != nil {
+			t.Errorf("%s: Validate() = %v", test.name, err)
+		}
+	}
+}
+
+func TestProxyAddressesValidate(t *testing.T) {
+
+	tests := []struct {
+		in    ProxyAddresses
+		valid bool
+	}{
+		{ProxyAddresses{}, true},
+		{ProxyAddresses{"X500:/o=Example/cn=jane"}, true},
+		{ProxyAddresses{"SMTP:jane@example.com", "smtp:jane@example.org"}, true},
+		{ProxyAddresses{"jane@example.com"}, false},
+		{ProxyAddresses{"SMTP:jane@example.com", "smtp:JANE@example.com"}, false},
+		{ProxyAddresses{"SMTP:jane@example.com", "SMTP:jane@example.org"}, false},
+		{ProxyAddresses{"smtp:jane@example.com"}, false},
+		{ProxyAddresses{"SMTP:jane"}, false},
+		{ProxyAddresses{"SMTP:Jane Doe <jane@example.com>"}, false},
+	}
+
+	for _, test := range tests {
+		err := test.in.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("%v.Validate() = %v, want valid %t", test.in, err, test.valid)
+		}
+	}
+}
+
+func TestAddressPolicy(t *testing.T) {
+
+	v := AddressValues{
+		GivenName:   "Jöhn Paul",
+		Surname:     "O'Neil-Smith",
+		Initials:    "JP",
+		DisplayName: "John Paul O'Neil-Smith",
+		Alias:       "jpo",
+	}
+
+	tests := []struct {
+		template string
+		want     string
+		invalid  bool
+	}{
+		{template: "SMTP:%g.%s@example.com", want: "SMTP:JhnPaul.O'Neil-Smith@example.com"},
+		{template: "%m@example.com", want: "smtp:jpo@example.com"},
+		{template: "smtp:%1g%s@example.com", want: "smtp:JO'Neil-Smith@example.com"},
+		{template: "smtp:%3s%99i@example.com", want: "smtp:O'NJP@example.com"},
+		{template: "smtp:%r'_%r-.%s@example.com", want: "smtp:O_Neil.Smith@example.com"},
+		{template: "smtp:%r _%d@example.com", want: "smtp:John_Paul_O'Neil-Smith@example.com"},
+		{template: "smtp:100%%.%m@example.com", want: "smtp:100%.jpo@example.com"},
+		{template: "%m@example.com:8", want: "smtp:jpo@example.com:8"},
+		{template: "SIP:%m@example.com", want: "SIP:jpo@example.com"},
+		{template: "smtp:%m@example.com%", invalid: true},
+		{template: "smtp:%x@example.com", invalid: true},
+		{template: "smtp:%3", invalid: true},
+		{template: "smtp:%r_", invalid: true},
+	}
+
+	for _, test := range tests {
+		got, err := AddressPolicy{Templates: []string{test.template}}.Addresses(v)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("Addresses(%q) = %v, want error", test.template, got)
+			}
+			continue
+		}
+		if err != nil || len(got) != 1 || got[0] != test.want {
+			t.Errorf("Addresses(%q) = %v, %v, want %s", test.template, got, err, test.want)
+		}
+	}
+}
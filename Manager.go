@@ -0,0 +1,266 @@
+package ad
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/jakobii/ps"
+)
+
+// OrgChartNode is a person in a management hierarchy. It only holds
+// directory data, so it can be marshaled and exported as is.
+type OrgChartNode struct {
+	DistinguishedName string
+	Name              string
+	SamAccountName    string
+	DisplayName       string
+	Title             string
+	Department        string
+	Reports           []*OrgChartNode
+}
+
+// orgChartEntry is an object and the distinguished name of its manager.
+type orgChartEntry struct {
+	Object
+	SamAccountName string
+	DisplayName    string
+	Title          string
+	Department     string
+	Manager        string
+}
+
+func (e *orgChartEntry) node() *OrgChartNode {
+	return &OrgChartNode{
+		DistinguishedName: e.DistinguishedName,
+		Name:              e.Name,
+		SamAccountName:    e.SamAccountName,
+		DisplayName:       e.DisplayName,
+		Title:             e.Title,
+		Department:        e.Department,
+	}
+}
+
+// findOrgChartEntries returns every object matching an LDAP filter with its manager.
+func (c *Connection) findOrgChartEntries(filter string) (entries []orgChartEntry, err error) {
+
+	var cmd bytes.Buffer
+	cmd.WriteString("Get-ADObject -Server ")
+	cmd.WriteString(ps.QuoteString(c.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(c.Credential.Expr())
+	cmd.WriteString(" -LDAPFilter ")
+	cmd.WriteString(ps.QuoteString(filter))
+	cmd.WriteString(" -Properties @('sAMAccountName', 'displayName', 'title', 'department', 'manager') -ResultSetSize $null | Select-Object @('ObjectGuid', 'ObjectClass',  'DistinguishedName', 'Name', 'SamAccountName', 'DisplayName', 'Title', 'Department', 'Manager') | ConvertTo-Json")
+
+	result, err := powershell(cmd.String())
+	if err != nil {
+		return entries, err
+	}
+
+	err = unmarshalList(result, &entries)
+	if err != nil {
+		return entries, err
+	}
+
+	for i := range entries {
+		entries[i].Connection = *c
+	}
+	return entries, nil
+}
+
+// distinguishedName returns the distinguished name of the user, looking it up if needed.
+func (u *User) distinguishedName() (string, error) {
+	if u.DistinguishedName != "" {
+		return u.DistinguishedName, nil
+	}
+	id, err := u.Identity()
+	if err != nil {
+		return "", err
+	}
+	obj, err := u.GetObject(id)
+	if err != nil {
+		return "", err
+	}
+	return obj.DistinguishedName, nil
+}
+
+// DirectReports returns the users whose manager is this user.
+// Only the identity, name and position fields of the returned users are populated.
+func (u *User) DirectReports() (users []User, err error) {
+
+	dn, err := u.distinguishedName()
+	if err != nil {
+		return users, err
+	}
+
+	entries, err := u.findOrgChartEntries("(&(objectCategory=person)(objectClass=user)(manager=" + escapeFilterValue(dn) + "))")
+	if err != nil {
+		return users, err
+	}
+
+	users = make([]User, 0, len(entries))
+	for _, v := range entries {
+		users = append(users, User{
+			Object:          v.Object,
+			SamAccountName:  v.SamAccountName,
+			DisplayName:     v.DisplayName,
+			Title:           v.Title,
+			Department:      v.Department,
+			Manager:         u.objectReference(dn),
+			originalManager: u.objectReference(dn),
+		})
+	}
+	return users, nil
+}
+
+// ManagementChain walks up from the user's manager to the top of the hierarchy and returns
+// every manager on the way, nearest first. If the chain loops back on itself the managers
+// up to the loop are returned together with an error.
+func (u *User) ManagementChain() (chain []Object, err error) {
+
+	dn, err := u.distinguishedName()
+	if err != nil {
+		return chain, err
+	}
+
+	visited := map[string]bool{strings.ToLower(dn): true}
+	next := u.Manager.DistinguishedName
+	if next == "" && u.Manager.ObjectGuid.String() != "00000000-0000-0000-0000-000000000000" {
+		obj, err := u.GetObject(u.Manager.ObjectGuid.String())
+		if err != nil {
+			return chain, err
+		}
+		next = obj.DistinguishedName
+	}
+
+	for next != "" {
+		if visited[strings.ToLower(next)] {
+			return chain, errors.New("management chain loops back to " + next)
+		}
+		visited[strings.ToLower(next)] = true
+
+		entries, err := u.findOrgChartEntries("(distinguishedName=" + escapeFilterValue(next) + ")")
+		if err != nil {
+			return chain, err
+		}
+		if len(entries) == 0 {
+			// the manager was deleted or is outside of the domain
+			chain = append(chain, u.objectReference(next))
+			return chain, nil
+		}
+		chain = append(chain, entries[0].Object)
+		next = entries[0].Manager
+	}
+
+	return chain, nil
+}
+
+// ReportingTree walks down from the user through direct reports, depth levels deep or
+// all the way if depth is negative. Every person appears once, loops are cut off.
+func (u *User) ReportingTree(depth int) (root *OrgChartNode, err error) {
+
+	dn, err := u.distinguishedName()
+	if err != nil {
+		return root, err
+	}
+
+	entries, err := u.findOrgChartEntries("(distinguishedName=" + escapeFilterValue(dn) + ")")
+	if err != nil {
+		return root, err
+	}
+	if len(entries) == 0 {
+		return root, errors.New("user not found: " + dn)
+	}
+	root = entries[0].node()
+
+	visited := map[string]bool{strings.ToLower(dn): true}
+	level := map[string]*OrgChartNode{strings.ToLower(dn): root}
+	for d := 0; len(level) > 0 && (depth < 0 || d < depth); d++ {
+
+		var filter strings.Builder
+		filter.WriteString("(&(objectCategory=person)(|")
+		for _, v := range level {
+			filter.WriteString("(manager=")
+			filter.WriteString(escapeFilterValue(v.DistinguishedName))
+			filter.WriteString(")")
+		}
+		filter.WriteString("))")
+
+		entries, err := u.findOrgChartEntries(filter.String())
+		if err != nil {
+			return root, err
+		}
+
+		next := make(map[string]*OrgChartNode)
+		for _, v := range entries {
+			key := strings.ToLower(v.DistinguishedName)
+			if visited[key] {
+				continue
+			}
+			visited[key] = true
+			node := v.node()
+			if parent, ok := level[strings.ToLower(v.Manager)]; ok {
+				parent.Reports = append(parent.Reports, node)
+			}
+			next[key] = node
+		}
+		level = next
+	}
+
+	return root, nil
+}
+
+// OrgChart loads every person that has a manager or direct reports in a single search and
+// returns the management hierarchy. Roots are people without a manager, or whose manager
+// is not in the directory. People in a management loop are added as an extra root.
+func (c *Connection) OrgChart() (roots []*OrgChartNode, err error) {
+
+	entries, err := c.findOrgChartEntries("(&(objectCategory=person)(|(manager=*)(directReports=*)))")
+	if err != nil {
+		return roots, err
+	}
+
+	nodes := make(map[string]*OrgChartNode, len(entries))
+	reports := make(map[string][]string, len(entries))
+	for i := range entries {
+		key := strings.ToLower(entries[i].DistinguishedName)
+		nodes[key] = entries[i].node()
+		if entries[i].Manager != "" {
+			m := strings.ToLower(entries[i].Manager)
+			reports[m] = append(reports[m], key)
+		}
+	}
+
+	visited := make(map[string]bool, len(nodes))
+	var walk func(key string) *OrgChartNode
+	walk = func(key string) *OrgChartNode {
+		visited[key] = true
+		node := nodes[key]
+		for _, r := range reports[key] {
+			if visited[r] {
+				continue
+			}
+			node.Reports = append(node.Reports, walk(r))
+		}
+		return node
+	}
+
+	for _, v := range entries {
+		key := strings.ToLower(v.DistinguishedName)
+		if _, ok := nodes[strings.ToLower(v.Manager)]; ok || visited[key] {
+			continue
+		}
+		roots = append(roots, walk(key))
+	}
+
+	// whatever was not reached hangs off a loop
+	for _, v := range entries {
+		key := strings.ToLower(v.DistinguishedName)
+		if !visited[key] {
+			roots = append(roots, walk(key))
+		}
+	}
+
+	return roots, nil
+}
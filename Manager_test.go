@@ -0,0 +1,135 @@
+package ad
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// managerTestDirectory is a management hierarchy by name: Boss manages A, who manages B, who
+// manages C. X and Y manage each other and X manages Z.
+var managerTestDirectory = []struct{ name, manager string }{
+	{"Boss", ""}, {"A", "Boss"}, {"B", "A"}, {"C", "B"},
+	{"X", "Y"}, {"Y", "X"}, {"Z", "X"},
+}
+
+func managerTestDN(name string) string {
+	return "CN=" + name + ",DC=example,DC=com"
+}
+
+var reManagerTestFilter = regexp.MustCompile(`\((distinguishedName|manager)=([^()]+)\)`)
+
+// recordManagerTestDirectory answers the org chart searches from managerTestDirectory.
+func recordManagerTestDirectory(t *testing.T) {
+	recordPowershell(t, func(script string) ([]byte, error) {
+		dns := make(map[string]string)
+		for _, m := range reManagerTestFilter.FindAllStringSubmatch(script, -1) {
+			dns[strings.ToLower(m[2])] = m[1]
+		}
+		var list []string
+		for _, v := range managerTestDirectory {
+			manager := ""
+			if v.manager != "" {
+				manager = managerTestDN(v.manager)
+			}
+			switch {
+			case strings.Contains(script, "(manager=*)"),
+				dns[strings.ToLower(managerTestDN(v.name))] == "distinguishedName",
+				manager != "" && dns[strings.ToLower(manager)] == "manager":
+				list = append(list, `{"ObjectGuid":"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c01","ObjectClass":"user","DistinguishedName":"`+managerTestDN(v.name)+
+					`","Name":"`+v.name+`","SamAccountName":"`+strings.ToLower(v.name)+`","Manager":"`+manager+`"}`)
+			}
+		}
+		return []byte("[" + strings.Join(list, ",") + "]"), nil
+	})
+}
+
+func TestManagementChain(t *testing.T) {
+	recordManagerTestDirectory(t)
+
+	tests := []struct {
+		user, manager string
+		want          []string
+		loop          bool
+	}{
+		{user: "C", manager: "B", want: []string{"B", "A", "Boss"}},
+		{user: "Boss"},
+		{user: "Z", manager: "X", want: []string{"X", "Y"}, loop: true},
+		{user: "X", manager: "Y", want: []string{"Y"}, loop: true},
+	}
+	for _, test := range tests {
+		u := User{Object: Object{DistinguishedName: managerTestDN(test.user)}}
+		if test.manager != "" {
+			u.Manager = Object{DistinguishedName: managerTestDN(test.manager)}
+		}
+		chain, err := u.ManagementChain()
+		if (err != nil) != test.loop {
+			t.Errorf("%s: err = %v", test.user, err)
+		}
+		var got []string
+		for _, v := range chain {
+			got = append(got, v.Name)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: chain = %v, want %v", test.user, got, test.want)
+		}
+	}
+}
+
+// orgChartNames renders a tree as name(reports...), with reports sorted by name.
+func orgChartNames(n *OrgChartNode) string {
+	var reports []string
+	for _, r := range n.Reports {
+		reports = append(reports, orgChartNames(r))
+	}
+	sort.Strings(reports)
+	if len(reports) == 0 {
+		return n.Name
+	}
+	return n.Name + "(" + strings.Join(reports, " ") + ")"
+}
+
+func TestReportingTree(t *testing.T) {
+	recordManagerTestDirectory(t)
+
+	tests := []struct {
+		user  string
+		depth int
+		want  string
+	}{
+		{"Boss", -1, "Boss(A(B(C)))"},
+		{"Boss", 2, "Boss(A(B))"},
+		{"Boss", 0, "Boss"},
+		{"X", -1, "X(Y Z)"},
+		{"Y", -1, "Y(X(Z))"},
+	}
+	for _, test := range tests {
+		u := User{Object: Object{DistinguishedName: managerTestDN(test.user)}}
+		root, err := u.ReportingTree(test.depth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := orgChartNames(root); got != test.want {
+			t.Errorf("ReportingTree(%s, %d) = %s, want %s", test.user, test.depth, got, test.want)
+		}
+	}
+}
+
+func TestOrgChart(t *testing.T) {
+	recordManagerTestDirectory(t)
+
+	c := NewConnection("dc1", "svc", "secret")
+	roots, err := c.OrgChart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range roots {
+		got = append(got, orgChartNames(r))
+	}
+	if want := []string{"Boss(A(B(C)))", "X(Y Z)"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("OrgChart() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,449 @@
+package ad
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Custom object types map struct fields to attributes with ad struct tags:
+//
+//	type Employee struct {
+//		ad.Object
+//		EmployeeID string   `ad:"employeeID"`
+//		CostCenter string   `ad:"extensionAttribute1,omitempty"`
+//		Aliases    []string `ad:"proxyAddresses"`
+//		Created    time.Time `ad:"whenCreated,readonly"`
+//	}
+//
+// Options:
+//   - omitempty: Push leaves the attribute alone instead of clearing it when the field is empty.
+//     Booleans and numbers are never empty.
+//   - readonly: Push never writes the attribute.
+//   - filetime: a time.Time is an Integer8 FILETIME, not a GeneralizedTime. This is the default
+//     for Integer8 attributes once the schema was loaded.
+//
+// Supported field types are string, []string, bool, the integer types, time.Time, []byte,
+// [][]byte, SID, []SID and uuid.UUID. An embedded Object receives the identity of the entry.
+// Integer attributes are signed 32 bit, so in unsigned fields their values wrap around, like
+// the flags of userAccountControl. Fields of 64 bits keep Integer8 values, like uSNChanged,
+// whole; without a loaded schema a negative 32 bit value is still taken to be an Integer.
+
+// fieldMapping maps one struct field to one attribute.
+type fieldMapping struct {
+	index     []int
+	attribute string
+	omitempty bool
+	readonly  bool
+	filetime  bool
+}
+
+// typeMapping is the parsed ad tags of a struct type.
+type typeMapping struct {
+	object []int // index of the embedded Object, nil if there is none
+	fields []fieldMapping
+}
+
+func (m *typeMapping) attributes() []string {
+	names := make([]string, 0, len(m.fields))
+	for _, f := range m.fields {
+		names = append(names, f.attribute)
+	}
+	return names
+}
+
+var typeMappings sync.Map // reflect.Type -> *typeMapping
+
+var objectType = reflect.TypeOf(Object{})
+
+// mappingOf parses the ad tags of t, which must be a struct type.
+func mappingOf(t reflect.Type) (*typeMapping, error) {
+	if m, ok := typeMappings.Load(t); ok {
+		return m.(*typeMapping), nil
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%s is not a struct", t)
+	}
+
+	m := &typeMapping{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type == objectType {
+			m.object = f.Index
+			continue
+		}
+		tag, ok := f.Tag.Lookup("ad")
+		if !ok || tag == "-" || f.PkgPath != "" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		fm := fieldMapping{index: f.Index, attribute: parts[0]}
+		if fm.attribute == "" {
+			fm.attribute = f.Name
+		}
+		for _, opt := range parts[1:] {
+			switch opt {
+			case "omitempty":
+				fm.omitempty = true
+			case "readonly":
+				fm.readonly = true
+			case "filetime":
+				fm.filetime = true
+			default:
+				return nil, fmt.Errorf("unknown ad tag option %q on %s.%s", opt, t, f.Name)
+			}
+		}
+		m.fields = append(m.fields, fm)
+	}
+
+	typeMappings.Store(t, m)
+	return m, nil
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	sidType  = reflect.TypeOf(SID{})
+	uuidType = reflect.TypeOf(uuid.UUID{})
+)
+
+// guidFromBytes converts a GUID as stored in the directory, whose first three fields are
+// little endian, into a uuid.UUID.
+func guidFromBytes(b []byte) (id uuid.UUID) {
+	copy(id[:], b)
+	id[0], id[1], id[2], id[3] = b[3], b[2], b[1], b[0]
+	id[4], id[5] = b[5], b[4]
+	id[6], id[7] = b[7], b[6]
+	return id
+}
+
+// guidToBytes is the reverse of guidFromBytes.
+func guidToBytes(id uuid.UUID) []byte {
+	b := make([]byte, 16)
+	copy(b, id[:])
+	b[0], b[1], b[2], b[3] = id[3], id[2], id[1], id[0]
+	b[4], b[5] = id[5], id[4]
+	b[6], b[7] = id[7], id[6]
+	return b
+}
+
+// decodeField stores the values of an attribute in a struct field.
+func decodeField(v reflect.Value, f fieldMapping, a Attribute) error {
+
+	if a.IsEmpty() {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	switch v.Type() {
+	case timeType:
+		var t time.Time
+		var err error
+		if f.filetime || a.Syntax == SyntaxInteger8 {
+			t, err = a.FileTime()
+		} else {
+			t, err = a.Time()
+		}
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	case sidType:
+		sid, err := a.SID()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(sid))
+		return nil
+	case uuidType:
+		if len(a.Bytes()) != 16 {
+			return errors.New("GUID must be 16 bytes")
+		}
+		v.Set(reflect.ValueOf(guidFromBytes(a.Bytes())))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(a.String())
+	case reflect.Bool:
+		b, err := a.Bool()
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := a.Int64()
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := a.Int64()
+		if err != nil {
+			return err
+		}
+		if wraps32(v, a.Syntax) || (a.Syntax == SyntaxUnknown && n < 0 && n >= math.MinInt32) {
+			// Integer attributes are signed 32 bit, flags like userAccountControl wrap around
+			n = int64(uint32(n))
+		}
+		v.SetUint(uint64(n))
+	case reflect.Slice:
+		switch v.Type().Elem().Kind() {
+		case reflect.Uint8:
+			v.SetBytes(append([]byte(nil), a.Bytes()...))
+		case reflect.String:
+			v.Set(reflect.ValueOf(a.Strings()).Convert(v.Type()))
+		case reflect.Slice:
+			values := make([][]byte, 0, len(a.Values))
+			for _, b := range a.Values {
+				values = append(values, append([]byte(nil), b...))
+			}
+			v.Set(reflect.ValueOf(values).Convert(v.Type()))
+		case reflect.Struct:
+			if v.Type().Elem() != sidType {
+				return fmt.Errorf("unsupported field type %s", v.Type())
+			}
+			sids := make([]SID, 0, len(a.Values))
+			for _, b := range a.Values {
+				sid, err := Attribute{Binary: a.Binary, Values: [][]byte{b}}.SID()
+				if err != nil {
+					return err
+				}
+				sids = append(sids, sid)
+			}
+			v.Set(reflect.ValueOf(sids))
+		default:
+			return fmt.Errorf("unsupported field type %s", v.Type())
+		}
+	default:
+		return fmt.Errorf("unsupported field type %s", v.Type())
+	}
+	return nil
+}
+
+// encodeField returns the attribute for a struct field. Empty strings, slices, times and
+// identifiers clear the attribute, false and 0 are written as values.
+func encodeField(v reflect.Value, f fieldMapping, syntax Syntax) (Attribute, error) {
+
+	if isEmptyField(v) {
+		return Attribute{Syntax: syntax}, nil
+	}
+
+	switch v.Type() {
+	case timeType:
+		t := v.Interface().(time.Time)
+		if f.filetime || syntax == SyntaxInteger8 {
+			return NewAttribute(SyntaxInteger8, t)
+		}
+		return NewAttribute(SyntaxGeneralizedTime, t)
+	case sidType:
+		return NewAttribute(SyntaxSID, v.Interface().(SID))
+	case uuidType:
+		return NewAttribute(SyntaxOctetString, guidToBytes(v.Interface().(uuid.UUID)))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return NewAttribute(syntax, v.String())
+	case reflect.Bool:
+		return NewAttribute(SyntaxBoolean, v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return NewAttribute(syntax, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if wraps32(v, syntax) {
+			// Integer attributes are signed 32 bit
+			return NewAttribute(syntax, int64(int32(uint32(v.Uint()))))
+		}
+		return NewAttribute(syntax, int64(v.Uint()))
+	case reflect.Slice:
+		switch v.Type().Elem().Kind() {
+		case reflect.Uint8:
+			return NewAttribute(SyntaxOctetString, v.Bytes())
+		case reflect.String:
+			values := make([]interface{}, 0, v.Len())
+			for i := 0; i < v.Len(); i++ {
+				values = append(values, v.Index(i).String())
+			}
+			return NewAttribute(syntax, values...)
+		case reflect.Slice:
+			values := make([]interface{}, 0, v.Len())
+			for i := 0; i < v.Len(); i++ {
+				values = append(values, v.Index(i).Bytes())
+			}
+			return NewAttribute(SyntaxOctetString, values...)
+		case reflect.Struct:
+			if v.Type().Elem() == sidType {
+				values := make([]interface{}, 0, v.Len())
+				for i := 0; i < v.Len(); i++ {
+					values = append(values, v.Index(i).Interface())
+				}
+				return NewAttribute(SyntaxSID, values...)
+			}
+		}
+	}
+	return Attribute{}, fmt.Errorf("unsupported field type %s", v.Type())
+}
+
+// wraps32 reports whether an unsigned field holds a signed 32 bit value, because the field
+// has no more than 32 bits or the attribute is an Integer (2.5.5.9). Larger fields of other
+// attributes, like the Integer8 uSNChanged in a uint64, keep all 64 bits.
+func wraps32(v reflect.Value, syntax Syntax) bool {
+	return v.Type().Bits() <= 32 || syntax == SyntaxInteger || syntax == SyntaxEnumeration
+}
+
+// isEmptyField reports whether a field holds no attribute values.
+func isEmptyField(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Struct, reflect.Array:
+		return v.IsZero() || (v.Kind() == reflect.Slice && v.Len() == 0)
+	}
+	return false
+}
+
+// decodeEntry fills a tagged struct from a directory entry.
+func decodeEntry(dst reflect.Value, m *typeMapping, obj Object) error {
+	if m.object != nil {
+		dst.FieldByIndex(m.object).Set(reflect.ValueOf(obj))
+	}
+	for _, f := range m.fields {
+		a, _ := obj.Attributes.Get(f.attribute)
+		err := decodeField(dst.FieldByIndex(f.index), f, a)
+		if err != nil {
+			return fmt.Errorf("%s: %v", f.attribute, err)
+		}
+	}
+	return nil
+}
+
+// Get reads a single directory entry into a new T, which must be a struct with ad tags.
+func Get[T any](c *Connection, Identity string) (T, error) {
+	var v T
+	m, err := mappingOf(reflect.TypeOf(v))
+	if err != nil {
+		return v, err
+	}
+
+	obj, err := c.GetObject(Identity)
+	if err != nil {
+		return v, err
+	}
+	obj.Attributes, err = c.GetAttributes(Identity, m.attributes()...)
+	if err != nil {
+		return v, err
+	}
+	obj.originalAttributes = obj.Attributes.clone()
+
+	err = decodeEntry(reflect.ValueOf(&v).Elem(), m, obj)
+	return v, err
+}
+
+// Find reads every directory entry matching an LDAP filter into a T, which must be a
+// struct with ad tags. Base and Scope of s are used, its Attributes are taken from T.
+func Find[T any](c *Connection, s Search) ([]T, error) {
+	var zero T
+	m, err := mappingOf(reflect.TypeOf(zero))
+	if err != nil {
+		return nil, err
+	}
+
+	s.Attributes = m.attributes()
+	objs, err := c.FindObjects(s)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]T, len(objs))
+	for i, obj := range objs {
+		err = decodeEntry(reflect.ValueOf(&list[i]).Elem(), m, obj)
+		if err != nil {
+			return list, err
+		}
+	}
+	return list, nil
+}
+
+// Push writes the tagged fields of v to the directory. Only attributes whose values differ
+// from the directory are written, so attributes changed by others in the meantime are kept
+// unless v changes them too. If v embeds an Object without an ObjectGuid, an object of its
+// ObjectClass is created at its DistinguishedName first.
+func Push[T any](c *Connection, v *T) error {
+	m, err := mappingOf(reflect.TypeOf(v).Elem())
+	if err != nil {
+		return err
+	}
+	rv := reflect.ValueOf(v).Elem()
+
+	var obj Object
+	if m.object != nil {
+		obj = rv.FieldByIndex(m.object).Interface().(Object)
+	}
+	if obj.Server == "" {
+		obj.Connection = *c
+	}
+
+	if obj.ObjectGuid.String() == "00000000-0000-0000-0000-000000000000" {
+		if obj.DistinguishedName == "" || obj.ObjectClass == "" {
+			return errors.New("ObjectClass and DistinguishedName are required to create an object")
+		}
+		err = obj.create()
+		if err != nil {
+			return err
+		}
+	}
+
+	id, err := obj.Identity()
+	if err != nil {
+		return err
+	}
+
+	// compare against what is in the directory right now
+	writable := make([]string, 0, len(m.fields))
+	for _, f := range m.fields {
+		if !f.readonly {
+			writable = append(writable, f.attribute)
+		}
+	}
+	current, err := c.GetAttributes(id, writable...)
+	if err != nil {
+		return err
+	}
+	obj.originalAttributes = current
+	obj.Attributes = current.clone()
+
+	for _, f := range m.fields {
+		if f.readonly {
+			continue
+		}
+		fv := rv.FieldByIndex(f.index)
+		if f.omitempty && isEmptyField(fv) {
+			continue
+		}
+		old, _ := current.Get(f.attribute)
+		a, err := encodeField(fv, f, old.Syntax)
+		if err != nil {
+			return fmt.Errorf("%s: %v", f.attribute, err)
+		}
+		// keep the binary flag the directory reported, e.g. for GUIDs stored as strings
+		if old.Binary {
+			a.Binary = true
+		}
+		obj.Attributes.Set(f.attribute, a)
+	}
+
+	err = obj.PushAttributes()
+	if err != nil {
+		return err
+	}
+
+	if m.object != nil {
+		rv.FieldByIndex(m.object).Set(reflect.ValueOf(obj))
+	}
+	return nil
+}
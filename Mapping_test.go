@@ -0,0 +1,174 @@
+package ad
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jakobii/ps"
+)
+
+type mappingTestEntry struct {
+	Object
+	EmployeeID string    `ad:"employeeID"`
+	Aliases    []string  `ad:"proxyAddresses,omitempty"`
+	Flags      uint32    `ad:"userAccountControl"`
+	GroupType  uint      `ad:"groupType"`
+	USN        uint64    `ad:"uSNChanged,readonly"`
+	Created    time.Time `ad:"whenCreated,readonly"`
+}
+
+const (
+	mappingTestGUID  = "6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c01"
+	mappingTestAttrs = `[{"Name":"employeeID","Values":["42"]},{"Name":"proxyAddresses","Values":["SMTP:pat@example.com"]},` +
+		`{"Name":"userAccountControl","Values":["-2147483136"]},{"Name":"groupType","Values":["-2147483646"]},` +
+		`{"Name":"uSNChanged","Values":["6442450944"]},{"Name":"whenCreated","Values":["20240102030405.0Z"]}]`
+)
+
+// mappingTestDirectory answers the scripts of Get, Find and Push with a single entry.
+func mappingTestDirectory(script string) ([]byte, error) {
+	switch {
+	case strings.Contains(script, "ForEach-Object"):
+		return []byte(`{"ObjectGuid":"` + mappingTestGUID + `","ObjectClass":"user","DistinguishedName":"CN=Pat,DC=example,DC=com","Name":"Pat","Attributes":` + mappingTestAttrs + "}\n"), nil
+	case strings.Contains(script, "$o = Get-ADObject"):
+		return []byte(mappingTestAttrs), nil
+	case strings.HasPrefix(script, "Get-ADObject"):
+		return []byte(`{"ObjectGuid":"` + mappingTestGUID + `","ObjectClass":"user","DistinguishedName":"CN=Pat,DC=example,DC=com","Name":"Pat"}`), nil
+	}
+	return nil, nil
+}
+
+func checkMappingTestEntry(t *testing.T, name string, e mappingTestEntry) {
+	t.Helper()
+	want := mappingTestEntry{
+		EmployeeID: "42",
+		Aliases:    []string{"SMTP:pat@example.com"},
+		Flags:      0x80000200,
+		GroupType:  0x80000002,
+		USN:        6442450944,
+		Created:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	e.Object = Object{}
+	if !reflect.DeepEqual(e, want) {
+		t.Errorf("%s = %+v, want %+v", name, e, want)
+	}
+}
+
+func TestGetFind(t *testing.T) {
+
+	c := NewConnection("dc-mapping", "svc", "secret")
+	cacheSchema(t, c.Server,
+		&AttributeSchema{LDAPDisplayName: "groupType", Syntax: SyntaxInteger, SingleValued: true},
+		&AttributeSchema{LDAPDisplayName: "uSNChanged", Syntax: SyntaxInteger8, SingleValued: true},
+	)
+	recordPowershell(t, mappingTestDirectory)
+
+	e, err := Get[mappingTestEntry](&c, mappingTestGUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.ObjectGuid.String() != mappingTestGUID || e.DistinguishedName != "CN=Pat,DC=example,DC=com" {
+		t.Errorf("Object = %+v", e.Object)
+	}
+	checkMappingTestEntry(t, "Get", e)
+
+	list, err := Find[mappingTestEntry](&c, Search{Filter: "(employeeID=42)"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("Find = %d entries", len(list))
+	}
+	checkMappingTestEntry(t, "Find", list[0])
+}
+
+func TestGetWithoutSchema(t *testing.T) {
+
+	// a negative value in a 64 bit field is taken to be a 32 bit Integer
+	c := NewConnection("dc-noschema", "svc", "secret")
+	recordPowershell(t, mappingTestDirectory)
+
+	e, err := Get[mappingTestEntry](&c, mappingTestGUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMappingTestEntry(t, "Get", e)
+}
+
+func TestPush(t *testing.T) {
+
+	c := NewConnection("dc-mapping", "svc", "secret")
+	cacheSchema(t, c.Server,
+		&AttributeSchema{LDAPDisplayName: "employeeID", Syntax: SyntaxUnicode, SingleValued: true},
+		&AttributeSchema{LDAPDisplayName: "proxyAddresses", Syntax: SyntaxUnicode},
+		&AttributeSchema{LDAPDisplayName: "userAccountControl", Syntax: SyntaxInteger, SingleValued: true},
+		&AttributeSchema{LDAPDisplayName: "groupType", Syntax: SyntaxInteger, SingleValued: true},
+	)
+	scripts := recordPowershell(t, mappingTestDirectory)
+
+	e, err := Get[mappingTestEntry](&c, mappingTestGUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*scripts = nil
+
+	// unchanged fields are not written, the readonly USN never is
+	e.USN = 1
+	if err := Push(&c, &e); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range *scripts {
+		if strings.HasPrefix(s, "Set-ADObject") {
+			t.Errorf("unchanged entry was written: %s", s)
+		}
+	}
+
+	*scripts = nil
+	e.EmployeeID = "43"
+	e.Flags = 0x80000202
+	e.GroupType = 0x80000004
+	e.Aliases = nil
+	if err := Push(&c, &e); err != nil {
+		t.Fatal(err)
+	}
+	var modify string
+	for _, s := range *scripts {
+		if strings.HasPrefix(s, "Set-ADObject") {
+			modify = s
+		}
+	}
+	for _, want := range []string{
+		ps.QuoteString("employeeID") + "=" + NewStringAttribute("43").psExpr(),
+		ps.QuoteString("userAccountControl") + "=" + NewStringAttribute("-2147483134").psExpr(),
+		ps.QuoteString("groupType") + "=" + NewStringAttribute("-2147483644").psExpr(),
+	} {
+		if !strings.Contains(modify, want) {
+			t.Errorf("modification does not contain %s:\n%s", want, modify)
+		}
+	}
+	if strings.Contains(modify, "uSNChanged") || strings.Contains(modify, "proxyAddresses") {
+		t.Errorf("readonly or omitted fields were written:\n%s", modify)
+	}
+}
+
+func TestEncodeUnsigned(t *testing.T) {
+
+	tests := []struct {
+		v      interface{}
+		syntax Syntax
+		want   string
+	}{
+		{uint32(0x80000200), SyntaxUnknown, "-2147483136"},
+		{uint(0x80000200), SyntaxInteger, "-2147483136"},
+		{uint(0x80000200), SyntaxEnumeration, "-2147483136"},
+		{uint64(6442450944), SyntaxInteger8, "6442450944"},
+		{uint64(6442450944), SyntaxUnknown, "6442450944"},
+	}
+	for _, test := range tests {
+		a, err := encodeField(reflect.ValueOf(test.v), fieldMapping{}, test.syntax)
+		if err != nil || a.String() != test.want {
+			t.Errorf("encodeField(%T %v, %s) = %q, %v, want %s", test.v, test.v, test.syntax, a.String(), err, test.want)
+		}
+	}
+}
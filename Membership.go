@@ -0,0 +1,311 @@
+package ad
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/jakobii/ps"
+)
+
+// ldapMatchingRuleInChain makes a DN comparison follow nested group membership.
+const ldapMatchingRuleInChain = "1.2.840.113556.1.4.1941"
+
+// Membership is one result of an effective membership resolution.
+// Path lists the distinguished names from the starting object to Object and explains
+// why the membership holds, e.g. user, group A, group B when B contains A contains user.
+type Membership struct {
+	Object
+	Path []string
+}
+
+// Direct returns true if the membership is not inherited through another group.
+func (m *Membership) Direct() bool {
+	return len(m.Path) == 2
+}
+
+// EffectiveMembership is the result of resolving nested group membership.
+// Cycles lists every circular nesting found, each starting and ending with the same group.
+type EffectiveMembership struct {
+	Memberships []Membership
+	Cycles      [][]string
+}
+
+// membershipNode is an object and its memberOf values.
+type membershipNode struct {
+	Object
+	MemberOf []string
+}
+
+// EffectiveGroups returns every group the user is a member of, directly, through nesting,
+// or through its primary group. The domain controller resolves the nesting with
+// LDAP_MATCHING_RULE_IN_CHAIN, if that fails the groups are walked one by one.
+func (u *User) EffectiveGroups() (result EffectiveMembership, err error) {
+
+	self, err := u.membershipSelf()
+	if err != nil {
+		return result, err
+	}
+
+	nodes, err := u.findMembershipNodes("(member:" + ldapMatchingRuleInChain + ":=" + escapeFilterValue(self.DistinguishedName) + ")")
+	if err != nil {
+		nodes, err = u.walkParents(self.MemberOf)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	// the primary group is not stored in member, so it is not part of the chain
+	if self.primaryGroup != "" {
+		self.MemberOf = append(self.MemberOf, self.primaryGroup)
+		if _, ok := nodes[strings.ToLower(self.primaryGroup)]; !ok {
+			more, err := u.walkParents([]string{self.primaryGroup})
+			if err != nil {
+				return result, err
+			}
+			for k, v := range more {
+				nodes[k] = v
+			}
+		}
+	}
+
+	nodes[strings.ToLower(self.DistinguishedName)] = self.membershipNode
+
+	edges := make(map[string][]string, len(nodes))
+	for k, v := range nodes {
+		edges[k] = v.MemberOf
+	}
+
+	return resolveMembership(self.DistinguishedName, nodes, edges), nil
+}
+
+// EffectiveMembers returns every object that is a member of the group, directly or
+// through nesting. Users that only have the group as their primary group are not included.
+func (g *Group) EffectiveMembers() (result EffectiveMembership, err error) {
+
+	id, err := g.Identity()
+	if err != nil {
+		return result, err
+	}
+	root, err := g.GetObject(id)
+	if err != nil {
+		return result, err
+	}
+
+	nodes, err := g.findMembershipNodes("(memberOf:" + ldapMatchingRuleInChain + ":=" + escapeFilterValue(root.DistinguishedName) + ")")
+	if err != nil {
+		nodes, err = g.walkChildren(root.DistinguishedName)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	// the group is in the result when it is nested in itself, keep its memberOf then
+	key := strings.ToLower(root.DistinguishedName)
+	node := nodes[key]
+	node.Object = root
+	nodes[key] = node
+
+	// invert memberOf into member
+	edges := make(map[string][]string, len(nodes))
+	for _, v := range nodes {
+		for _, parent := range v.MemberOf {
+			p := strings.ToLower(parent)
+			edges[p] = append(edges[p], v.DistinguishedName)
+		}
+	}
+
+	return resolveMembership(root.DistinguishedName, nodes, edges), nil
+}
+
+type membershipSelf struct {
+	membershipNode
+	primaryGroup string
+}
+
+// membershipSelf reads the memberOf and primary group of the user.
+func (u *User) membershipSelf() (self membershipSelf, err error) {
+	id, err := u.Identity()
+	if err != nil {
+		return self, err
+	}
+
+	var cmd bytes.Buffer
+	cmd.WriteString("Get-ADUser -Server ")
+	cmd.WriteString(ps.QuoteString(u.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(u.Credential.Expr())
+	cmd.WriteString(" -Identity ")
+	cmd.WriteString(ps.QuoteString(id))
+	cmd.WriteString(" -Properties @('memberOf', 'PrimaryGroup') | Select-Object @('ObjectGuid', 'ObjectClass',  'DistinguishedName', 'Name', 'PrimaryGroup', @{n='MemberOf';e={@($_.memberOf)}}) | ConvertTo-Json")
+
+	result, err := powershell(cmd.String())
+	if err != nil {
+		return self, err
+	}
+
+	var nodes []struct {
+		membershipNode
+		PrimaryGroup string
+	}
+	err = unmarshalList(result, &nodes)
+	if err != nil {
+		return self, err
+	}
+	if len(nodes) != 1 {
+		return self, errors.New("user not found")
+	}
+
+	self.membershipNode = nodes[0].membershipNode
+	self.primaryGroup = nodes[0].PrimaryGroup
+	self.Connection = u.Connection
+	return self, nil
+}
+
+// findMembershipNodes returns every object matching an LDAP filter with its memberOf values,
+// keyed by lower case distinguished name.
+func (c *Connection) findMembershipNodes(filter string) (nodes map[string]membershipNode, err error) {
+
+	var cmd bytes.Buffer
+	cmd.WriteString("Get-ADObject -Server ")
+	cmd.WriteString(ps.QuoteString(c.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(c.Credential.Expr())
+	cmd.WriteString(" -LDAPFilter ")
+	cmd.WriteString(ps.QuoteString(filter))
+	cmd.WriteString(" -Properties memberOf -ResultSetSize $null | Select-Object @('ObjectGuid', 'ObjectClass',  'DistinguishedName', 'Name', @{n='MemberOf';e={@($_.memberOf)}}) | ConvertTo-Json")
+
+	result, err := powershell(cmd.String())
+	if err != nil {
+		return nodes, err
+	}
+
+	var list []membershipNode
+	err = unmarshalList(result, &list)
+	if err != nil {
+		return nodes, err
+	}
+
+	nodes = make(map[string]membershipNode, len(list))
+	for _, v := range list {
+		v.Connection = *c
+		nodes[strings.ToLower(v.DistinguishedName)] = v
+	}
+	return nodes, nil
+}
+
+// walkParents loads groups breadth first by following memberOf, starting at dns.
+func (c *Connection) walkParents(dns []string) (nodes map[string]membershipNode, err error) {
+	nodes = make(map[string]membershipNode)
+	queue := append([]string(nil), dns...)
+	for len(queue) > 0 {
+		dn := queue[0]
+		queue = queue[1:]
+		if _, ok := nodes[strings.ToLower(dn)]; ok {
+			continue
+		}
+		found, err := c.findMembershipNodes("(distinguishedName=" + escapeFilterValue(dn) + ")")
+		if err != nil {
+			return nodes, err
+		}
+		for k, v := range found {
+			nodes[k] = v
+			queue = append(queue, v.MemberOf...)
+		}
+	}
+	return nodes, nil
+}
+
+// walkChildren loads members breadth first by searching for memberOf, starting at dn.
+func (c *Connection) walkChildren(dn string) (nodes map[string]membershipNode, err error) {
+	nodes = make(map[string]membershipNode)
+	visited := map[string]bool{strings.ToLower(dn): true}
+	queue := []string{dn}
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+		found, err := c.findMembershipNodes("(memberOf=" + escapeFilterValue(parent) + ")")
+		if err != nil {
+			return nodes, err
+		}
+		for k, v := range found {
+			nodes[k] = v
+			if v.ObjectClass == "group" && !visited[k] {
+				visited[k] = true
+				queue = append(queue, v.DistinguishedName)
+			}
+		}
+	}
+	return nodes, nil
+}
+
+// resolveMembership walks edges breadth first from start, recording the shortest path to
+// every reachable node, then searches the reachable part of the graph for cycles.
+func resolveMembership(start string, nodes map[string]membershipNode, edges map[string][]string) (result EffectiveMembership) {
+
+	startKey := strings.ToLower(start)
+	paths := map[string][]string{startKey: {start}}
+	queue := []string{startKey}
+	for len(queue) > 0 {
+		key := queue[0]
+		queue = queue[1:]
+		for _, next := range edges[key] {
+			nextKey := strings.ToLower(next)
+			if _, ok := paths[nextKey]; ok {
+				continue
+			}
+			node, ok := nodes[nextKey]
+			if !ok {
+				// outside of the result set, e.g. in another domain
+				node = membershipNode{Object: Object{DistinguishedName: next}}
+				node.Name, _ = ParseDistinguishedName(next)
+			}
+			path := make([]string, len(paths[key]), len(paths[key])+1)
+			copy(path, paths[key])
+			paths[nextKey] = append(path, node.DistinguishedName)
+			result.Memberships = append(result.Memberships, Membership{
+				Object: node.Object,
+				Path:   paths[nextKey],
+			})
+			queue = append(queue, nextKey)
+		}
+	}
+
+	// depth first search for back edges
+	const (
+		unvisited = iota
+		active
+		done
+	)
+	state := make(map[string]int, len(paths))
+	var stack []string
+	var visit func(key string)
+	visit = func(key string) {
+		state[key] = active
+		stack = append(stack, key)
+		for _, next := range edges[key] {
+			nextKey := strings.ToLower(next)
+			switch state[nextKey] {
+			case unvisited:
+				visit(nextKey)
+			case active:
+				var cycle []string
+				for i := len(stack) - 1; i >= 0; i-- {
+					if stack[i] == nextKey {
+						for _, v := range stack[i:] {
+							cycle = append(cycle, paths[v][len(paths[v])-1])
+						}
+						break
+					}
+				}
+				cycle = append(cycle, cycle[0])
+				result.Cycles = append(result.Cycles, cycle)
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[key] = done
+	}
+	visit(startKey)
+
+	return result
+}
@@ -0,0 +1,113 @@
+package ad
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// membershipTestNode returns a JSON membership node as written by findMembershipNodes.
+func membershipTestNode(guid, class, dn string, memberOf ...string) string {
+	name, _ := ParseDistinguishedName(dn)
+	list := `[]`
+	if len(memberOf) > 0 {
+		list = `["` + strings.Join(memberOf, `","`) + `"]`
+	}
+	return `{"ObjectGuid":"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0` + guid + `","ObjectClass":"` + class + `","DistinguishedName":"` + dn + `","Name":"` + name + `","MemberOf":` + list + `}`
+}
+
+func TestEffectiveMembersCycle(t *testing.T) {
+
+	const a, b, pat = "CN=A,DC=example,DC=com", "CN=B,DC=example,DC=com", "CN=Pat,DC=example,DC=com"
+	nested := "[" + membershipTestNode("c02", "group", b, a) + "," +
+		membershipTestNode("c01", "group", a, b) + "," +
+		membershipTestNode("c03", "user", pat, b) + "]"
+
+	for _, chain := range []bool{true, false} {
+		recordPowershell(t, func(script string) ([]byte, error) {
+			switch {
+			case strings.Contains(script, " -Identity "):
+				return []byte(membershipTestNode("c01", "group", a, b)), nil
+			case strings.Contains(script, ldapMatchingRuleInChain):
+				if chain {
+					return []byte(nested), nil
+				}
+				return nil, errors.New("the matching rule is not supported")
+			case strings.Contains(script, "(memberOf=CN=A,"):
+				return []byte(membershipTestNode("c02", "group", b, a)), nil
+			case strings.Contains(script, "(memberOf=CN=B,"):
+				return []byte("[" + membershipTestNode("c01", "group", a, b) + "," + membershipTestNode("c03", "user", pat, b) + "]"), nil
+			}
+			return nil, nil
+		})
+
+		g := Group{Object: Object{DistinguishedName: a}}
+		result, err := g.EffectiveMembers()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		paths := make(map[string][]string)
+		for _, m := range result.Memberships {
+			paths[m.DistinguishedName] = m.Path
+		}
+		want := map[string][]string{b: {a, b}, pat: {a, b, pat}}
+		if !reflect.DeepEqual(paths, want) {
+			t.Errorf("chain %t: paths = %v, want %v", chain, paths, want)
+		}
+		if !reflect.DeepEqual(result.Cycles, [][]string{{a, b, a}}) {
+			t.Errorf("chain %t: cycles = %v", chain, result.Cycles)
+		}
+	}
+}
+
+func TestEffectiveGroups(t *testing.T) {
+
+	const pat, staff, all, users = "CN=Pat,DC=example,DC=com", "CN=Staff,DC=example,DC=com", "CN=All,DC=example,DC=com", "CN=Domain Users,DC=example,DC=com"
+	recordPowershell(t, func(script string) ([]byte, error) {
+		switch {
+		case strings.HasPrefix(script, "Get-ADUser"):
+			return []byte(`{"ObjectGuid":"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c03","ObjectClass":"user","DistinguishedName":"` + pat +
+				`","Name":"Pat","PrimaryGroup":"` + users + `","MemberOf":["` + staff + `"]}`), nil
+		case strings.Contains(script, ldapMatchingRuleInChain):
+			return []byte("[" + membershipTestNode("c01", "group", staff, all) + "," + membershipTestNode("c02", "group", all) + "]"), nil
+		case strings.Contains(script, "(distinguishedName=CN=Domain Users,"):
+			return []byte(membershipTestNode("c04", "group", users)), nil
+		}
+		return nil, nil
+	})
+
+	u := User{Object: Object{DistinguishedName: pat}}
+	result, err := u.EffectiveGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := make(map[string][]string)
+	for _, m := range result.Memberships {
+		paths[m.DistinguishedName] = m.Path
+	}
+	want := map[string][]string{staff: {pat, staff}, all: {pat, staff, all}, users: {pat, users}}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("paths = %v, want %v", paths, want)
+	}
+	if len(result.Cycles) != 0 {
+		t.Errorf("cycles = %v", result.Cycles)
+	}
+	for _, m := range result.Memberships {
+		if m.Direct() != (len(m.Path) == 2) {
+			t.Errorf("%s Direct() = %t", m.DistinguishedName, m.Direct())
+		}
+	}
+}
+
+func TestResolveMembershipOutsideResult(t *testing.T) {
+
+	const a, b = "CN=A,DC=example,DC=com", "CN=Foreign,DC=other,DC=com"
+	nodes := map[string]membershipNode{strings.ToLower(a): {Object: Object{DistinguishedName: a}}}
+	result := resolveMembership(a, nodes, map[string][]string{strings.ToLower(a): {b}})
+	if len(result.Memberships) != 1 || result.Memberships[0].DistinguishedName != b || result.Memberships[0].Name != "Foreign" {
+		t.Errorf("memberships = %+v", result.Memberships)
+	}
+}
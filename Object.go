@@ -1,19 +1,33 @@
 package ad
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"strings"
 
 	"github.com/google/uuid"
+	"github.com/jakobii/ps"
 )
 
+// Object is a directory object. Attributes is a map, so objects can not be compared with ==,
+// use Is to find out whether two refer to the same object.
 type Object struct {
 	Connection
 	Name              string
 	ObjectClass       string
 	ObjectGuid        uuid.UUID
+	ObjectSid         SID
 	DistinguishedName string
+
+	// Attributes holds any other attributes, see PullAttributes and PushAttributes.
+	Attributes         Attributes `json:"-"`
+	originalAttributes Attributes
 }
 
+// Identity returns the ObjectGuid, or else the DistinguishedName, to pass as -Identity.
+// An object with only an ObjectSid is looked up by it first, as Get-ADObject and the other
+// *-ADObject cmdlets do not take a SID, and its ObjectGuid is kept.
 func (o *Object) Identity() (id string, err error) {
 
 	guid := o.ObjectGuid.String()
@@ -26,11 +40,33 @@ func (o *Object) Identity() (id string, err error) {
 
 		return o.DistinguishedName, nil
 
+	} else if !o.ObjectSid.IsZero() {
+
+		found, err := o.GetObjectBySID(o.ObjectSid)
+		if err != nil {
+			return "", err
+		}
+		o.ObjectGuid = found.ObjectGuid
+		return o.ObjectGuid.String(), nil
+
 	}
 
 	return "", errors.New("all identity properties are blank")
 }
 
+// Is returns true if both objects refer to the same directory object. The ObjectGuid
+// is compared when both have one, then the distinguished name, then the ObjectSid.
+func (o Object) Is(other Object) bool {
+	zero := "00000000-0000-0000-0000-000000000000"
+	if o.ObjectGuid.String() != zero && other.ObjectGuid.String() != zero {
+		return o.ObjectGuid == other.ObjectGuid
+	}
+	if o.DistinguishedName != "" && other.DistinguishedName != "" {
+		return strings.EqualFold(o.DistinguishedName, other.DistinguishedName)
+	}
+	return !o.ObjectSid.IsZero() && o.ObjectSid == other.ObjectSid
+}
+
 func (o *Object) Pull() error {
 	id, err := o.Identity()
 	if err != nil {
@@ -43,6 +79,115 @@ func (o *Object) Pull() error {
 	o.Name = obj.Name
 	o.ObjectClass = obj.ObjectClass
 	o.ObjectGuid = obj.ObjectGuid
+	o.ObjectSid = obj.ObjectSid
 	o.DistinguishedName = obj.DistinguishedName
 	return nil
 }
+
+// create adds the object to the directory as an ObjectClass at DistinguishedName and
+// stores the ObjectGuid it was given.
+func (o *Object) create() error {
+	name, parent := ParseDistinguishedName(o.DistinguishedName)
+	if name == "" || parent == "" {
+		return errors.New("invalid distinguished name: " + o.DistinguishedName)
+	}
+
+	var cmd bytes.Buffer
+	cmd.WriteString("New-ADObject -Server ")
+	cmd.WriteString(ps.QuoteString(o.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(o.Credential.Expr())
+	cmd.WriteString(" -Type ")
+	cmd.WriteString(ps.QuoteString(o.ObjectClass))
+	cmd.WriteString(" -Name ")
+	cmd.WriteString(ps.QuoteString(name))
+	cmd.WriteString(" -Path ")
+	cmd.WriteString(ps.QuoteString(parent))
+	cmd.WriteString(" -PassThru | Select-Object @('ObjectGuid', 'ObjectClass', 'DistinguishedName', 'Name') | ConvertTo-Json")
+
+	result, err := powershell(cmd.String())
+	if err != nil {
+		return err
+	}
+
+	var created Object
+	err = json.Unmarshal(result, &created)
+	if err != nil {
+		return err
+	}
+	o.ObjectGuid = created.ObjectGuid
+	o.DistinguishedName = created.DistinguishedName
+	o.Name = created.Name
+	return nil
+}
+
+// Move moves the object into the container or OrgUnit at path.
+func (o *Object) Move(path string) error {
+	id, err := o.Identity()
+	if err != nil {
+		return err
+	}
+
+	var cmd bytes.Buffer
+	cmd.WriteString("Move-ADObject -Server ")
+	cmd.WriteString(ps.QuoteString(o.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(o.Credential.Expr())
+	cmd.WriteString(" -Identity ")
+	cmd.WriteString(ps.QuoteString(id))
+	cmd.WriteString(" -TargetPath ")
+	cmd.WriteString(ps.QuoteString(path))
+	cmd.WriteString(" -PassThru | Select-Object -ExpandProperty DistinguishedName | ConvertTo-Json")
+
+	result, err := powershell(cmd.String())
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(result, &o.DistinguishedName)
+}
+
+// Delete removes the object from the directory. Objects with children, like OrgUnits that are
+// not empty, can not be deleted.
+func (o *Object) Delete() error {
+	id, err := o.Identity()
+	if err != nil {
+		return err
+	}
+
+	var cmd bytes.Buffer
+	cmd.WriteString("Remove-ADObject -Server ")
+	cmd.WriteString(ps.QuoteString(o.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(o.Credential.Expr())
+	cmd.WriteString(" -Identity ")
+	cmd.WriteString(ps.QuoteString(id))
+	cmd.WriteString(" -Confirm:$false")
+
+	_, err = powershell(cmd.String())
+	return err
+}
+
+// rename changes the RDN value of the object, e.g. the CN of a user.
+func (o *Object) rename(name string) error {
+	id, err := o.Identity()
+	if err != nil {
+		return err
+	}
+
+	var cmd bytes.Buffer
+	cmd.WriteString("Rename-ADObject -Server ")
+	cmd.WriteString(ps.QuoteString(o.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(o.Credential.Expr())
+	cmd.WriteString(" -Identity ")
+	cmd.WriteString(ps.QuoteString(id))
+	cmd.WriteString(" -NewName ")
+	cmd.WriteString(ps.QuoteString(name))
+	cmd.WriteString(" -PassThru | Select-Object -ExpandProperty DistinguishedName | ConvertTo-Json")
+
+	result, err := powershell(cmd.String())
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(result, &o.DistinguishedName)
+}
@@ -0,0 +1,279 @@
+package ad
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"strings"
+	"unicode/utf8"
+)
+
+// character classes used by PasswordGenerator
+const (
+	passwordLower     = "abcdefghijklmnopqrstuvwxyz"
+	passwordUpper     = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	passwordDigits    = "0123456789"
+	passwordSymbols   = "!#$%&*+-=?@^_~.:;"
+	passwordAmbiguous = "Il1O0o|`'\".,:;"
+)
+
+// PasswordGenerator generates random passwords using crypto/rand.
+type PasswordGenerator struct {
+	// Length is the number of characters, or the minimum length of a passphrase.
+	Length int
+
+	Lower   bool
+	Upper   bool
+	Digits  bool
+	Symbols bool
+
+	// ExcludeAmbiguous drops characters that are easily confused, like l, 1, O and 0.
+	ExcludeAmbiguous bool
+
+	// Passphrase generates Words words joined by Separator instead of random characters.
+	// One word is capitalized and a digit is appended, so the result still satisfies
+	// the complexity rule when Separator is a symbol.
+	Passphrase bool
+	Words      int
+	Separator  string
+	Wordlist   []string
+
+	// Policy, if set, is validated against every generated password.
+	Policy *PasswordPolicy
+}
+
+// NewPasswordGenerator returns a generator that satisfies policy, using every
+// character class and a length of at least 16.
+func NewPasswordGenerator(policy PasswordPolicy) *PasswordGenerator {
+	length := 16
+	if policy.MinPasswordLength > length {
+		length = policy.MinPasswordLength
+	}
+	return &PasswordGenerator{
+		Length:           length,
+		Lower:            true,
+		Upper:            true,
+		Digits:           true,
+		Symbols:          true,
+		ExcludeAmbiguous: true,
+		Policy:           &policy,
+	}
+}
+
+// Generate returns a new random password.
+func (g *PasswordGenerator) Generate() (string, error) {
+	return g.generate(nil)
+}
+
+// generate retries until the password satisfies the policy, which only fails
+// by chance, e.g. when the password happens to contain the account name.
+func (g *PasswordGenerator) generate(user *User) (string, error) {
+	var err error
+	for i := 0; i < 100; i++ {
+		var password string
+		if g.Passphrase {
+			password, err = g.passphrase()
+		} else {
+			password, err = g.characters()
+		}
+		if err != nil {
+			return "", err
+		}
+		if g.Policy == nil {
+			return password, nil
+		}
+		err = g.Policy.Validate(password, user)
+		if err == nil {
+			return password, nil
+		}
+	}
+	return "", err
+}
+
+func (g *PasswordGenerator) characters() (string, error) {
+
+	var classes []string
+	for _, v := range []struct {
+		on    bool
+		chars string
+	}{
+		{g.Lower, passwordLower},
+		{g.Upper, passwordUpper},
+		{g.Digits, passwordDigits},
+		{g.Symbols, passwordSymbols},
+	} {
+		if !v.on {
+			continue
+		}
+		chars := v.chars
+		if g.ExcludeAmbiguous {
+			chars = strings.Map(func(r rune) rune {
+				if strings.ContainsRune(passwordAmbiguous, r) {
+					return -1
+				}
+				return r
+			}, chars)
+		}
+		classes = append(classes, chars)
+	}
+
+	if len(classes) == 0 {
+		return "", errors.New("no character classes enabled")
+	}
+	if g.Length < len(classes) {
+		return "", errors.New("Length is too short to use every enabled character class")
+	}
+
+	// one character from every class, the rest from all of them
+	password := make([]byte, 0, g.Length)
+	for _, v := range classes {
+		c, err := randomChar(v)
+		if err != nil {
+			return "", err
+		}
+		password = append(password, c)
+	}
+	all := strings.Join(classes, "")
+	for len(password) < g.Length {
+		c, err := randomChar(all)
+		if err != nil {
+			return "", err
+		}
+		password = append(password, c)
+	}
+
+	err := shuffle(len(password), func(i, j int) { password[i], password[j] = password[j], password[i] })
+	if err != nil {
+		return "", err
+	}
+
+	return string(password), nil
+}
+
+func (g *PasswordGenerator) passphrase() (string, error) {
+
+	wordlist := g.Wordlist
+	if len(wordlist) == 0 {
+		wordlist = passphraseWords
+	}
+	for _, v := range wordlist {
+		if strings.TrimSpace(v) == "" {
+			return "", errors.New("Wordlist can not contain blank words")
+		}
+	}
+	words := g.Words
+	if words < 1 {
+		words = 5
+	}
+	separator := g.Separator
+	if separator == "" {
+		separator = "-"
+	}
+
+	var picked []string
+	for len(picked) < words || len(strings.Join(picked, separator))+1 < g.Length {
+		n, err := randomInt(len(wordlist))
+		if err != nil {
+			return "", err
+		}
+		picked = append(picked, wordlist[n])
+	}
+
+	n, err := randomInt(len(picked))
+	if err != nil {
+		return "", err
+	}
+	_, size := utf8.DecodeRuneInString(picked[n])
+	picked[n] = strings.ToUpper(picked[n][:size]) + picked[n][size:]
+
+	digit, err := randomChar(passwordDigits)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join(picked, separator) + string(digit), nil
+}
+
+func randomInt(max int) (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return 0, err
+	}
+	return int(n.Int64()), nil
+}
+
+func randomChar(chars string) (byte, error) {
+	n, err := randomInt(len(chars))
+	if err != nil {
+		return 0, err
+	}
+	return chars[n], nil
+}
+
+// shuffle is a Fisher-Yates shuffle using crypto/rand.
+func shuffle(n int, swap func(i, j int)) error {
+	for i := n - 1; i > 0; i-- {
+		j, err := randomInt(i + 1)
+		if err != nil {
+			return err
+		}
+		swap(i, j)
+	}
+	return nil
+}
+
+// SetRandomPassword resets the password of the user to a newly generated one and returns it.
+// If g is nil a generator for the resultant password policy of the user is used.
+// The password is not kept in AccountPassword, the caller is the only one who sees it.
+func (u *User) SetRandomPassword(g *PasswordGenerator) (string, error) {
+
+	if g == nil {
+		policy, err := u.PasswordPolicy()
+		if err != nil {
+			return "", err
+		}
+		g = NewPasswordGenerator(policy)
+	}
+
+	password, err := g.generate(u)
+	if err != nil {
+		return "", err
+	}
+
+	u.AccountPassword = password
+	err = u.SetPassword()
+	u.AccountPassword = ""
+	if err != nil {
+		return "", err
+	}
+
+	return password, nil
+}
+
+// passphraseWords is a short list of common, unambiguous english words.
+var passphraseWords = strings.Fields(`
+	acid acorn actor adult agent alarm album alert alley amber angle ankle apple apron arena
+	arrow aspen atlas attic audio autumn award bacon badge bagel baker bamboo banjo barn basil
+	basin beach beard bench berry bingo birch bison blade blank blaze bloom board bonus boost
+	brain brass bread brick bride brook brush bucket buddy bugle cabin cable cactus camel canal
+	candy canoe canyon cargo carpet castle cedar chalk charm cherry chess chief cider cinema
+	citrus clerk cliff clock cloud clover coach cobra cocoa comet coral cotton couch cousin
+	crane crater crayon creek crown cubic curry dairy daisy dance delta denim depot desert
+	diary dinner disco diver dolphin donkey dragon drama dream drum eagle easel echo elbow
+	ember empire engine envoy equal fabric falcon farmer fender ferry fiber fiddle figure
+	finch flame flask fleet flute focus forest fossil frame friend frost fruit galaxy garden
+	garlic gecko giant ginger glacier globe goose grain grape gravel guitar hammer harbor
+	hazel helmet heron hiker honey hotel husky igloo index ink island ivory jacket jaguar
+	jelly jersey jockey judge juice jungle kayak kernel kettle kitten koala ladder lagoon
+	lemon lentil lever lilac linen lizard lobster locket lotus lunar magnet mango maple marble
+	meadow melon mentor meteor mirror mocha monkey mosaic motor muffin museum napkin nectar
+	needle nickel noodle novel nutmeg oasis ocean olive onion orbit orchid otter oyster paddle
+	palace panda paper parrot pastel peach pebble pencil pepper piano pickle pigeon pillow
+	pilot planet plaza pocket polar pony potato prism pulse puzzle quartz quest quiver rabbit
+	radar radio raven recipe reef ribbon river robin rocket rodeo rumba saddle salmon sandal
+	satin scarf school scout shadow sierra silver sketch sleigh slope spice spider sponge
+	squid stable statue stream sugar summit sunset swan syrup tablet tango teapot temple
+	tennis thunder tiger timber toast tomato topaz torch tower tractor trumpet tulip tundra
+	turtle tuxedo umbrella unicorn valley velvet violin vision volcano waffle walnut wander
+	wizard walrus willow window winter wombat yacht yogurt zebra zenith zipper
+`)
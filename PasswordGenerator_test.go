@@ -0,0 +1,71 @@
+package ad
+
+import (
+	"strings"
+	"testing"
+	"unicode"
+)
+
+func TestPasswordGeneratorCharacters(t *testing.T) {
+
+	policy := PasswordPolicy{ComplexityEnabled: true, MinPasswordLength: 20}
+	g := NewPasswordGenerator(policy)
+	for i := 0; i < 50; i++ {
+		password, err := g.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(password) != 20 {
+			t.Errorf("len(%q) = %d, want 20", password, len(password))
+		}
+		if strings.ContainsAny(password, passwordAmbiguous) {
+			t.Errorf("%q contains an ambiguous character", password)
+		}
+		if err := policy.Validate(password, nil); err != nil {
+			t.Errorf("%q: %v", password, err)
+		}
+	}
+
+	g = &PasswordGenerator{Length: 8, Digits: true}
+	password, err := g.Generate()
+	if err != nil || strings.IndexFunc(password, func(r rune) bool { return !unicode.IsDigit(r) }) >= 0 {
+		t.Errorf("digits only: %q, %v", password, err)
+	}
+
+	for _, bad := range []*PasswordGenerator{
+		{Length: 8},
+		{Length: 2, Lower: true, Upper: true, Digits: true},
+	} {
+		if _, err := bad.Generate(); err == nil {
+			t.Errorf("%+v generated a password", bad)
+		}
+	}
+}
+
+func TestPasswordGeneratorPassphrase(t *testing.T) {
+
+	g := &PasswordGenerator{Passphrase: true, Words: 4, Separator: "_", Length: 30, Wordlist: []string{"äpfel", "birne"}}
+	for i := 0; i < 20; i++ {
+		password, err := g.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(password) < 30 {
+			t.Errorf("%q is shorter than 30", password)
+		}
+		if !strings.ContainsAny(password, "ÄB") {
+			t.Errorf("%q has no capitalized word", password)
+		}
+		if !unicode.IsDigit(rune(password[len(password)-1])) {
+			t.Errorf("%q does not end with a digit", password)
+		}
+	}
+
+	// blank words would never reach the length, or have no letter to capitalize
+	for _, wordlist := range [][]string{{""}, {"", ""}, {"word", " "}} {
+		g := &PasswordGenerator{Passphrase: true, Length: 10, Wordlist: wordlist}
+		if _, err := g.Generate(); err == nil {
+			t.Errorf("Wordlist %q generated a password", wordlist)
+		}
+	}
+}
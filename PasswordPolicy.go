@@ -0,0 +1,543 @@
+package ad
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jakobii/ps"
+)
+
+// PasswordPolicy is either the default domain password policy or a fine-grained
+// password policy (PSO). Object is blank for the default domain policy.
+type PasswordPolicy struct {
+	Object
+
+	Precedence                  int
+	ComplexityEnabled           bool
+	ReversibleEncryptionEnabled bool
+	MinPasswordLength           int
+	PasswordHistoryCount        int
+	MinPasswordAge              time.Duration
+	MaxPasswordAge              time.Duration
+	LockoutThreshold            int
+	LockoutDuration             time.Duration
+	LockoutObservationWindow    time.Duration
+
+	// PSO only
+	ProtectedFromAccidentalDeletion bool
+	AppliesTo                       []string
+}
+
+// IsDefault returns true for the default domain password policy, which is not an object of
+// its own and so has a blank identity. A PSO referenced only by ObjectGuid, distinguished name
+// or name is not the default policy.
+func (p *PasswordPolicy) IsDefault() bool {
+	return p.ObjectGuid.String() == "00000000-0000-0000-0000-000000000000" && p.DistinguishedName == "" && p.Name == ""
+}
+
+// Identity returns the ObjectGuid or distinguished name of a PSO, or its name, which is unique
+// in the Password Settings Container.
+func (p *PasswordPolicy) Identity() (string, error) {
+	id, err := p.Object.Identity()
+	if err != nil && p.Name != "" {
+		return p.Name, nil
+	}
+	return id, err
+}
+
+// psPasswordPolicySelect converts the TimeSpan properties to ticks so they decode as numbers.
+const psPasswordPolicySelect string = ` | Select-Object @('ObjectGuid', 'ObjectClass',  'DistinguishedName', 'Name', 'Precedence', 'ComplexityEnabled', 'ReversibleEncryptionEnabled', 'MinPasswordLength', 'PasswordHistoryCount', 'LockoutThreshold', @{n='MinPasswordAge';e={$_.MinPasswordAge.Ticks}}, @{n='MaxPasswordAge';e={$_.MaxPasswordAge.Ticks}}, @{n='LockoutDuration';e={$_.LockoutDuration.Ticks}}, @{n='LockoutObservationWindow';e={$_.LockoutObservationWindow.Ticks}}, 'ProtectedFromAccidentalDeletion', 'AppliesTo' ) | ConvertTo-Json`
+
+// decodePasswordPolicy decodes the output of psPasswordPolicySelect.
+func decodePasswordPolicy(data []byte) (p PasswordPolicy, err error) {
+
+	raw := struct {
+		Object
+		Precedence                  int
+		ComplexityEnabled           bool
+		ReversibleEncryptionEnabled bool
+		MinPasswordLength           int
+		PasswordHistoryCount        int
+		LockoutThreshold            int
+		MinPasswordAge              int64
+		MaxPasswordAge              int64
+		LockoutDuration             int64
+		LockoutObservationWindow    int64
+
+		ProtectedFromAccidentalDeletion bool
+		AppliesTo                       []string
+	}{}
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return p, err
+	}
+
+	p.Object = raw.Object
+	p.Precedence = raw.Precedence
+	p.ComplexityEnabled = raw.ComplexityEnabled
+	p.ReversibleEncryptionEnabled = raw.ReversibleEncryptionEnabled
+	p.MinPasswordLength = raw.MinPasswordLength
+	p.PasswordHistoryCount = raw.PasswordHistoryCount
+	p.LockoutThreshold = raw.LockoutThreshold
+	p.ProtectedFromAccidentalDeletion = raw.ProtectedFromAccidentalDeletion
+	p.AppliesTo = raw.AppliesTo
+
+	// TimeSpan ticks are 100ns, the same unit as FILETIME
+	p.MinPasswordAge = time.Duration(raw.MinPasswordAge) * 100
+	p.MaxPasswordAge = time.Duration(raw.MaxPasswordAge) * 100
+	p.LockoutDuration = time.Duration(raw.LockoutDuration) * 100
+	p.LockoutObservationWindow = time.Duration(raw.LockoutObservationWindow) * 100
+
+	return p, nil
+}
+
+// GetDefaultPasswordPolicy returns the default domain password policy.
+func (c *Connection) GetDefaultPasswordPolicy() (policy PasswordPolicy, err error) {
+
+	var cmd bytes.Buffer
+	cmd.WriteString("Get-ADDefaultDomainPasswordPolicy -Server ")
+	cmd.WriteString(ps.QuoteString(c.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(c.Credential.Expr())
+	cmd.WriteString(psPasswordPolicySelect)
+
+	result, err := powershell(cmd.String())
+	if err != nil {
+		return policy, err
+	}
+
+	policy, err = decodePasswordPolicy(result)
+	if err != nil {
+		return policy, err
+	}
+
+	// the default policy is not an object of its own, it lives on the domain head
+	policy.Object = Object{}
+	policy.Connection = *c
+
+	return policy, nil
+}
+
+// PasswordPolicy returns the fine-grained password policy that applies to the user,
+// or the default domain password policy if none does. The resultant policy is
+// computed by the domain controller from msDS-ResultantPSO, which accounts for
+// precedence and for policies applied through nested groups.
+func (u *User) PasswordPolicy() (policy PasswordPolicy, err error) {
+	id, err := u.Identity()
+	if err != nil {
+		return policy, err
+	}
+
+	var cmd bytes.Buffer
+	cmd.WriteString("Get-ADUserResultantPasswordPolicy -Server ")
+	cmd.WriteString(ps.QuoteString(u.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(u.Credential.Expr())
+	cmd.WriteString(" -Identity ")
+	cmd.WriteString(ps.QuoteString(id))
+	cmd.WriteString(psPasswordPolicySelect)
+
+	result, err := powershell(cmd.String())
+	if err != nil {
+		return policy, err
+	}
+
+	// no PSO applies
+	if len(bytes.TrimSpace(result)) == 0 {
+		return u.GetDefaultPasswordPolicy()
+	}
+
+	policy, err = decodePasswordPolicy(result)
+	if err != nil {
+		return policy, err
+	}
+	policy.Connection = u.Connection
+
+	return policy, nil
+}
+
+// PasswordRule names the password policy rule that a password violates.
+type PasswordRule string
+
+// password policy rules
+const (
+	PasswordRuleLength      PasswordRule = "length"
+	PasswordRuleComplexity  PasswordRule = "complexity"
+	PasswordRuleAccountName PasswordRule = "account name"
+	PasswordRuleHistory     PasswordRule = "history"
+)
+
+// PasswordPolicyViolation is returned when a password does not satisfy a password policy.
+type PasswordPolicyViolation struct {
+	Rule    PasswordRule
+	Message string
+	Policy  PasswordPolicy
+}
+
+func (v *PasswordPolicyViolation) Error() string {
+	return "password violates the " + string(v.Rule) + " rule: " + v.Message
+}
+
+// Validate checks password against the length and complexity rules of the policy.
+// If user is not nil, the account name part of the complexity rule is checked as well.
+// Password history can only be enforced by a domain controller.
+func (p *PasswordPolicy) Validate(password string, user *User) error {
+
+	length := len([]rune(password))
+	if length < p.MinPasswordLength {
+		return &PasswordPolicyViolation{
+			Rule:    PasswordRuleLength,
+			Message: fmt.Sprintf("password must be at least %d characters, got %d", p.MinPasswordLength, length),
+			Policy:  *p,
+		}
+	}
+
+	if p.ComplexityEnabled {
+		n := passwordCategories(password)
+		if n < 3 {
+			return &PasswordPolicyViolation{
+				Rule:    PasswordRuleComplexity,
+				Message: fmt.Sprintf("password must contain characters from at least 3 of 5 categories, got %d", n),
+				Policy:  *p,
+			}
+		}
+
+		if user != nil {
+			if token, ok := passwordContainsAccountName(password, user); ok {
+				return &PasswordPolicyViolation{
+					Rule:    PasswordRuleAccountName,
+					Message: "password must not contain the account name or display name token " + strconv.Quote(token),
+					Policy:  *p,
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// passwordCategories counts the character categories used by the Windows complexity rule:
+// uppercase, lowercase, digits, symbols, and other unicode letters.
+func passwordCategories(password string) int {
+	var upper, lower, digit, symbol, other bool
+	for _, r := range password {
+		switch {
+		case r < unicode.MaxASCII && unicode.IsUpper(r):
+			upper = true
+		case r < unicode.MaxASCII && unicode.IsLower(r):
+			lower = true
+		case r < unicode.MaxASCII && unicode.IsDigit(r):
+			digit = true
+		case strings.ContainsRune("~!@#$%^&*_-+=`|\\(){}[]:;\"'<>,.?/ ", r):
+			symbol = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsLetter(r):
+			other = true
+		}
+	}
+	n := 0
+	for _, v := range []bool{upper, lower, digit, symbol, other} {
+		if v {
+			n++
+		}
+	}
+	return n
+}
+
+var reDisplayNameDelimiters = regexp.MustCompile("[,.\\-_#\\t ]+")
+
+// passwordContainsAccountName implements the account name part of the Windows complexity rule.
+// The sAMAccountName is checked as a whole if it is at least 3 characters, and the
+// display name is split on delimiters and every token of at least 3 characters is checked.
+func passwordContainsAccountName(password string, user *User) (string, bool) {
+	lower := strings.ToLower(password)
+
+	if len([]rune(user.SamAccountName)) >= 3 && strings.Contains(lower, strings.ToLower(user.SamAccountName)) {
+		return user.SamAccountName, true
+	}
+
+	for _, token := range reDisplayNameDelimiters.Split(user.DisplayName, -1) {
+		if len([]rune(token)) < 3 {
+			continue
+		}
+		if strings.Contains(lower, strings.ToLower(token)) {
+			return token, true
+		}
+	}
+
+	return "", false
+}
+
+var rePasswordRejected = regexp.MustCompile("(?i)does not meet the length, complexity, or history requirement")
+
+// passwordError turns the error a domain controller returns for a rejected password into
+// a PasswordPolicyViolation. Length and complexity are validated before the password is
+// sent, so a rejection that gets past them is reported as a history violation.
+func passwordError(err error, policy PasswordPolicy) error {
+	if err == nil || !rePasswordRejected.MatchString(err.Error()) {
+		return err
+	}
+	return &PasswordPolicyViolation{
+		Rule:    PasswordRuleHistory,
+		Message: fmt.Sprintf("the domain controller rejected the password, it may be one of the last %d passwords: %s", policy.PasswordHistoryCount, strings.TrimSpace(err.Error())),
+		Policy:  policy,
+	}
+}
+
+// GetPasswordPolicy returns a fine-grained password policy (PSO).
+func (c *Connection) GetPasswordPolicy(Identity string) (policy PasswordPolicy, err error) {
+
+	var cmd bytes.Buffer
+	cmd.WriteString("Get-ADFineGrainedPasswordPolicy -Server ")
+	cmd.WriteString(ps.QuoteString(c.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(c.Credential.Expr())
+	cmd.WriteString(" -Identity ")
+	cmd.WriteString(ps.QuoteString(Identity))
+	cmd.WriteString(" -Properties ProtectedFromAccidentalDeletion")
+	cmd.WriteString(psPasswordPolicySelect)
+
+	result, err := powershell(cmd.String())
+	if err != nil {
+		return policy, err
+	}
+
+	policy, err = decodePasswordPolicy(result)
+	if err != nil {
+		return policy, err
+	}
+	policy.Connection = *c
+
+	return policy, nil
+}
+
+// FindPasswordPolicies returns every fine-grained password policy (PSO) ordered by precedence.
+func (c *Connection) FindPasswordPolicies() (policies []PasswordPolicy, err error) {
+
+	var cmd bytes.Buffer
+	cmd.WriteString("Get-ADFineGrainedPasswordPolicy -Server ")
+	cmd.WriteString(ps.QuoteString(c.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(c.Credential.Expr())
+	cmd.WriteString(" -Filter * -Properties ProtectedFromAccidentalDeletion | Sort-Object Precedence")
+	cmd.WriteString(psPasswordPolicySelect)
+
+	result, err := powershell(cmd.String())
+	if err != nil {
+		return policies, err
+	}
+
+	var raw []json.RawMessage
+	err = unmarshalList(result, &raw)
+	if err != nil {
+		return policies, err
+	}
+
+	policies = make([]PasswordPolicy, 0, len(raw))
+	for _, v := range raw {
+		policy, err := decodePasswordPolicy(v)
+		if err != nil {
+			return policies, err
+		}
+		policy.Connection = *c
+		policies = append(policies, policy)
+	}
+
+	return policies, nil
+}
+
+// Pull updates the policy with data from Active Directory.
+func (p *PasswordPolicy) Pull() error {
+	if p.IsDefault() {
+		policy, err := p.GetDefaultPasswordPolicy()
+		if err != nil {
+			return err
+		}
+		*p = policy
+		return nil
+	}
+
+	id, err := p.Identity()
+	if err != nil {
+		return err
+	}
+	policy, err := p.GetPasswordPolicy(id)
+	if err != nil {
+		return err
+	}
+	*p = policy
+	return nil
+}
+
+// Push creates the fine-grained password policy if it has no ObjectGuid yet, otherwise it updates it.
+// The default domain password policy is managed through group policy and can not be pushed.
+func (p *PasswordPolicy) Push() error {
+
+	if strings.TrimSpace(p.Name) == "" {
+		return errors.New("Name can not be blank")
+	}
+	if p.Precedence < 1 {
+		return errors.New("Precedence must be greater than zero")
+	}
+
+	var params bytes.Buffer
+	params.WriteString(" -Precedence ")
+	params.WriteString(strconv.Itoa(p.Precedence))
+	params.WriteString(" -ComplexityEnabled ")
+	params.WriteString(ps.FormatBool(p.ComplexityEnabled))
+	params.WriteString(" -ReversibleEncryptionEnabled ")
+	params.WriteString(ps.FormatBool(p.ReversibleEncryptionEnabled))
+	params.WriteString(" -MinPasswordLength ")
+	params.WriteString(strconv.Itoa(p.MinPasswordLength))
+	params.WriteString(" -PasswordHistoryCount ")
+	params.WriteString(strconv.Itoa(p.PasswordHistoryCount))
+	params.WriteString(" -MinPasswordAge ")
+	params.WriteString(psTimeSpan(p.MinPasswordAge))
+	params.WriteString(" -MaxPasswordAge ")
+	params.WriteString(psTimeSpan(p.MaxPasswordAge))
+	params.WriteString(" -LockoutThreshold ")
+	params.WriteString(strconv.Itoa(p.LockoutThreshold))
+	params.WriteString(" -LockoutDuration ")
+	params.WriteString(psTimeSpan(p.LockoutDuration))
+	params.WriteString(" -LockoutObservationWindow ")
+	params.WriteString(psTimeSpan(p.LockoutObservationWindow))
+	params.WriteString(" -ProtectedFromAccidentalDeletion ")
+	params.WriteString(ps.FormatBool(p.ProtectedFromAccidentalDeletion))
+
+	var cmd bytes.Buffer
+	if p.ObjectGuid.String() == "00000000-0000-0000-0000-000000000000" {
+		cmd.WriteString("New-ADFineGrainedPasswordPolicy -Server ")
+		cmd.WriteString(ps.QuoteString(p.Server))
+		cmd.WriteString(" -Credential ")
+		cmd.WriteString(p.Credential.Expr())
+		cmd.WriteString(" -Name ")
+		cmd.WriteString(ps.QuoteString(p.Name))
+		cmd.WriteString(params.String())
+		cmd.WriteString(" -PassThru")
+	} else {
+		id, err := p.Identity()
+		if err != nil {
+			return err
+		}
+		cmd.WriteString("Set-ADFineGrainedPasswordPolicy -Server ")
+		cmd.WriteString(ps.QuoteString(p.Server))
+		cmd.WriteString(" -Credential ")
+		cmd.WriteString(p.Credential.Expr())
+		cmd.WriteString(" -Identity ")
+		cmd.WriteString(ps.QuoteString(id))
+		cmd.WriteString(params.String())
+		cmd.WriteString(" -Confirm:$false -PassThru")
+	}
+	cmd.WriteString(" | Select-Object @('ObjectGuid', 'DistinguishedName') | ConvertTo-Json")
+
+	result, err := powershell(cmd.String())
+	if err != nil {
+		return err
+	}
+
+	obj := Object{}
+	err = json.Unmarshal(result, &obj)
+	if err != nil {
+		return err
+	}
+	p.ObjectGuid = obj.ObjectGuid
+	p.DistinguishedName = obj.DistinguishedName
+	p.ObjectClass = "msDS-PasswordSettings"
+
+	return nil
+}
+
+// Delete removes the fine-grained password policy.
+// Policies protected from accidental deletion must be unprotected with Push first.
+func (p *PasswordPolicy) Delete() error {
+	if p.IsDefault() {
+		return errors.New("the default domain password policy can not be deleted")
+	}
+
+	id, err := p.Identity()
+	if err != nil {
+		return err
+	}
+
+	var cmd bytes.Buffer
+	cmd.WriteString("Remove-ADFineGrainedPasswordPolicy -Server ")
+	cmd.WriteString(ps.QuoteString(p.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(p.Credential.Expr())
+	cmd.WriteString(" -Identity ")
+	cmd.WriteString(ps.QuoteString(id))
+	cmd.WriteString(" -Confirm:$false")
+
+	_, err = powershell(cmd.String())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ApplyTo applies the policy to users and global security groups.
+func (p *PasswordPolicy) ApplyTo(subjects ...Object) error {
+	return p.setSubjects("Add-ADFineGrainedPasswordPolicySubject", subjects)
+}
+
+// RemoveFrom removes the policy from users and global security groups.
+func (p *PasswordPolicy) RemoveFrom(subjects ...Object) error {
+	return p.setSubjects("Remove-ADFineGrainedPasswordPolicySubject", subjects)
+}
+
+func (p *PasswordPolicy) setSubjects(cmdlet string, subjects []Object) error {
+
+	if len(subjects) < 1 {
+		return nil
+	}
+	if p.IsDefault() {
+		return errors.New("the default domain password policy applies to every user")
+	}
+
+	var Subjects = make([]string, 0, len(subjects))
+	for _, v := range subjects {
+		id, err := v.Identity()
+		if err != nil {
+			return err
+		}
+		Subjects = append(Subjects, ps.QuoteString(id))
+	}
+
+	id, err := p.Identity()
+	if err != nil {
+		return err
+	}
+
+	var cmd bytes.Buffer
+	cmd.WriteString(cmdlet)
+	cmd.WriteString(" -Server ")
+	cmd.WriteString(ps.QuoteString(p.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(p.Credential.Expr())
+	cmd.WriteString(" -Identity ")
+	cmd.WriteString(ps.QuoteString(id))
+	cmd.WriteString(" -Subjects @(")
+	cmd.WriteString(strings.Join(Subjects, ","))
+	cmd.WriteString(") -Confirm:$false")
+
+	_, err = powershell(cmd.String())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// psTimeSpan returns a PowerShell expression for d.
+func psTimeSpan(d time.Duration) string {
+	return "([TimeSpan]::FromTicks(" + strconv.FormatInt(int64(d/100), 10) + "))"
+}
@@ -0,0 +1,80 @@
+package ad
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestPasswordPolicyIsDefault(t *testing.T) {
+
+	guid, _ := uuid.Parse("5f6c3c1e-0b5a-4f43-9d3c-2f1a9b8e7d6c")
+	tests := []struct {
+		name   string
+		policy PasswordPolicy
+		want   bool
+	}{
+		{"blank", PasswordPolicy{}, true},
+		{"loaded PSO", PasswordPolicy{Object: Object{ObjectGuid: guid, ObjectClass: "msDS-PasswordSettings"}}, false},
+		{"PSO by ObjectGuid", PasswordPolicy{Object: Object{ObjectGuid: guid}}, false},
+		{"PSO by distinguished name", PasswordPolicy{Object: Object{DistinguishedName: "CN=Admins,CN=Password Settings Container,CN=System,DC=example,DC=com"}}, false},
+		{"PSO by name", PasswordPolicy{Object: Object{Name: "Admins"}}, false},
+	}
+
+	for _, test := range tests {
+		if got := test.policy.IsDefault(); got != test.want {
+			t.Errorf("%s: IsDefault() = %t, want %t", test.name, got, test.want)
+		}
+	}
+
+	p := PasswordPolicy{Object: Object{Name: "Admins"}}
+	if id, err := p.Identity(); err != nil || id != "Admins" {
+		t.Errorf("Identity() = %q, %v", id, err)
+	}
+	if err := (&PasswordPolicy{}).Delete(); err == nil {
+		t.Error("the default policy was deleted")
+	}
+}
+
+func TestPasswordContainsAccountName(t *testing.T) {
+
+	tests := []struct {
+		password, sam, display string
+		want                   bool
+	}{
+		{"xxJDoe42!", "jdoe", "", true},
+		{"xxJö42!", "jö", "", false},
+		{"xxJöR42!", "jör", "", true},
+		{"Doe-Jane-1", "x", "Jane Doe", true},
+		{"Jo-1234", "x", "Jo Li", false},
+	}
+	for _, test := range tests {
+		_, got := passwordContainsAccountName(test.password, &User{SamAccountName: test.sam, DisplayName: test.display})
+		if got != test.want {
+			t.Errorf("passwordContainsAccountName(%q, %q, %q) = %t", test.password, test.sam, test.display, got)
+		}
+	}
+}
+
+func TestSetPasswordPolicyError(t *testing.T) {
+
+	scripts := recordPowershell(t, func(script string) ([]byte, error) {
+		if strings.HasPrefix(script, "Get-ADUserResultantPasswordPolicy") {
+			return nil, errors.New("server busy")
+		}
+		return nil, nil
+	})
+
+	u := User{Object: Object{DistinguishedName: "CN=Pat,DC=example,DC=com"}, AccountPassword: "Secret-123"}
+	err := u.SetPassword()
+	if err == nil || !strings.Contains(err.Error(), "server busy") {
+		t.Errorf("SetPassword() = %v", err)
+	}
+	for _, v := range *scripts {
+		if strings.HasPrefix(v, "Set-ADAccountPassword") {
+			t.Error("the password was set without a policy")
+		}
+	}
+}
@@ -0,0 +1,702 @@
+package ad
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/jakobii/ps"
+	"gopkg.in/yaml.v3"
+)
+
+// PruneAction is what Reconcile does with users and groups in scope that are not declared.
+type PruneAction string
+
+const (
+	// PruneNone leaves undeclared objects alone.
+	PruneNone PruneAction = ""
+	// PruneDisable disables undeclared users. Groups can not be disabled and are left alone.
+	PruneDisable PruneAction = "disable"
+	// PruneDelete deletes undeclared users and groups.
+	PruneDelete PruneAction = "delete"
+)
+
+// DesiredState declares OrgUnits, groups and users the directory should converge to.
+// Blank fields are not managed, so attributes maintained by other tools are left alone.
+type DesiredState struct {
+	// Scope is the distinguished name of the subtree that is managed. Undeclared users
+	// and groups are only pruned in Scope, and nothing is pruned if it is blank.
+	Scope string
+	Prune PruneAction
+
+	OrgUnits []DesiredOrgUnit
+	Groups   []DesiredGroup
+	Users    []DesiredUser
+}
+
+// DesiredOrgUnit declares an OrgUnit.
+type DesiredOrgUnit struct {
+	DistinguishedName string
+	Description       string
+}
+
+// DesiredGroup declares a group, identified by SamAccountName.
+type DesiredGroup struct {
+	SamAccountName string
+	Name           string // defaults to SamAccountName
+	Path           string // distinguished name of the parent OrgUnit
+	GroupScope     string // Global, Universal or DomainLocal, defaults to Global
+	GroupCategory  string // Security or Distribution, defaults to Security
+	DisplayName    string
+	Description    string
+
+	// Members are the SamAccountNames or distinguished names of the members. A nil list
+	// leaves the membership alone, an empty list removes every member.
+	Members []string
+}
+
+// DesiredUser declares a user, identified by SamAccountName.
+type DesiredUser struct {
+	SamAccountName string
+	Name           string // defaults to SamAccountName
+	Path           string // distinguished name of the parent OrgUnit
+	Enabled        *bool
+
+	UserPrincipalName string
+	EmployeeID        string
+	EmployeeNumber    string
+	EmailAddress      string
+	DisplayName       string
+	GivenName         string
+	Surname           string
+	Initials          string
+	Title             string
+	Division          string
+	Department        string
+	Office            string
+	Company           string
+	Description       string
+	OfficePhone       string
+	MobilePhone       string
+
+	// Attributes are any other attributes by LDAP display name.
+	Attributes map[string][]string
+}
+
+// ReadDesiredState decodes a DesiredState from YAML or JSON. Field names are matched
+// without regard to case, and unknown fields are an error.
+func ReadDesiredState(r io.Reader) (state DesiredState, err error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return state, err
+	}
+
+	// YAML is converted to JSON, so both formats are decoded by the same rules
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] != '{' {
+		var v interface{}
+		if err = yaml.Unmarshal(data, &v); err != nil {
+			return state, err
+		}
+		if data, err = json.Marshal(v); err != nil {
+			return state, err
+		}
+	}
+
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	err = d.Decode(&state)
+	return state, err
+}
+
+// ReconcileAction is a kind of change made by Reconcile.
+type ReconcileAction string
+
+const (
+	ActionCreate       ReconcileAction = "create"
+	ActionUpdate       ReconcileAction = "update"
+	ActionMove         ReconcileAction = "move"
+	ActionAddMember    ReconcileAction = "add-member"
+	ActionRemoveMember ReconcileAction = "remove-member"
+	ActionDisable      ReconcileAction = "disable"
+	ActionDelete       ReconcileAction = "delete"
+)
+
+// ReconcileChange is a single change Reconcile made, or failed to make.
+type ReconcileChange struct {
+	Action ReconcileAction
+	Kind   string // orgUnit, group or user
+	Target string
+	Detail string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+
+	// Password is the random initial password of a created user that is enabled but was
+	// not given one. It is the only copy, so a report with passwords must be kept secret.
+	Password string `json:",omitempty"`
+}
+
+// ReconcileReport lists every change of a Reconcile run in the order they were made.
+type ReconcileReport struct {
+	DryRun  bool
+	Changes []ReconcileChange
+}
+
+// Failed returns the changes that could not be made.
+func (r *ReconcileReport) Failed() []ReconcileChange {
+	var failed []ReconcileChange
+	for _, v := range r.Changes {
+		if v.Error != "" {
+			failed = append(failed, v)
+		}
+	}
+	return failed
+}
+
+func (r *ReconcileReport) add(action ReconcileAction, kind, target, detail string, err error) *ReconcileChange {
+	change := ReconcileChange{Action: action, Kind: kind, Target: target, Detail: detail}
+	if err != nil {
+		change.Error = err.Error()
+	}
+	r.Changes = append(r.Changes, change)
+	return &r.Changes[len(r.Changes)-1]
+}
+
+// ReconcileOptions controls Reconcile.
+type ReconcileOptions struct {
+	// DryRun only reports what would change.
+	DryRun bool
+}
+
+// Reconcile converges the directory to the desired state. OrgUnits are created first, parents
+// before children, then groups, then users, then group memberships, and undeclared objects are
+// pruned last. A change that fails is recorded in the report and the rest carries on; the
+// returned error is only set if the run could not continue at all.
+func (c *Connection) Reconcile(state DesiredState, opts ReconcileOptions) (report ReconcileReport, err error) {
+
+	report.DryRun = opts.DryRun
+	r := reconciler{c: c, opts: opts, report: &report}
+
+	switch state.Prune {
+	case PruneNone, PruneDisable, PruneDelete:
+	default:
+		return report, fmt.Errorf("unknown prune action %q", state.Prune)
+	}
+	for _, v := range state.Groups {
+		if v.SamAccountName == "" {
+			return report, errors.New("every group needs a SamAccountName")
+		}
+	}
+	for _, v := range state.Users {
+		if v.SamAccountName == "" {
+			return report, errors.New("every user needs a SamAccountName")
+		}
+	}
+
+	// parents first
+	ous := append([]DesiredOrgUnit(nil), state.OrgUnits...)
+	sort.SliceStable(ous, func(i, j int) bool {
+		return strings.Count(ous[i].DistinguishedName, ",") < strings.Count(ous[j].DistinguishedName, ",")
+	})
+	for _, v := range ous {
+		r.orgUnit(v)
+	}
+
+	for _, v := range state.Groups {
+		r.group(v)
+	}
+
+	for _, v := range state.Users {
+		r.user(v)
+	}
+
+	for _, v := range state.Groups {
+		if v.Members != nil {
+			r.members(v)
+		}
+	}
+
+	if state.Prune != PruneNone && state.Scope != "" {
+		err = r.prune(state)
+	}
+
+	return report, err
+}
+
+// reconciler carries the state of a single Reconcile run.
+type reconciler struct {
+	c      *Connection
+	opts   ReconcileOptions
+	report *ReconcileReport
+}
+
+// find returns the object matching an LDAP filter, or nil if there is none.
+func (r *reconciler) find(filter string) (*Object, error) {
+	objs, err := r.c.findObjectsLDAP(filter)
+	if err != nil || len(objs) == 0 {
+		return nil, err
+	}
+	return &objs[0], nil
+}
+
+func (r *reconciler) orgUnit(d DesiredOrgUnit) {
+
+	obj, err := r.find("(&(objectClass=organizationalUnit)(distinguishedName=" + escapeFilterValue(d.DistinguishedName) + "))")
+	if err != nil {
+		r.report.add(ActionCreate, "orgUnit", d.DistinguishedName, "", err)
+		return
+	}
+
+	if obj == nil {
+		if !r.opts.DryRun {
+			err = r.c.newOrgUnit(d)
+		}
+		r.report.add(ActionCreate, "orgUnit", d.DistinguishedName, "", err)
+		return
+	}
+
+	if d.Description == "" {
+		return
+	}
+	ou, err := r.c.GetOrgUnit(d.DistinguishedName)
+	if err != nil || ou.Description != d.Description {
+		if err == nil && !r.opts.DryRun {
+			var m modification
+			m.replace("description", NewStringAttribute(d.Description))
+			err = ou.modify(m)
+		}
+		r.report.add(ActionUpdate, "orgUnit", d.DistinguishedName, "Description", err)
+	}
+}
+
+func (c *Connection) newOrgUnit(d DesiredOrgUnit) error {
+	name, path := ParseDistinguishedName(d.DistinguishedName)
+
+	var cmd bytes.Buffer
+	cmd.WriteString("New-ADOrganizationalUnit -Server ")
+	cmd.WriteString(ps.QuoteString(c.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(c.Credential.Expr())
+	cmd.WriteString(" -Name ")
+	cmd.WriteString(ps.QuoteString(name))
+	cmd.WriteString(" -Path ")
+	cmd.WriteString(ps.QuoteString(path))
+	if d.Description != "" {
+		cmd.WriteString(ps.Param("Description", ps.QuoteString(d.Description)))
+	}
+
+	_, err := powershell(cmd.String())
+	return err
+}
+
+func (r *reconciler) group(d DesiredGroup) {
+
+	obj, err := r.find("(&(objectClass=group)(sAMAccountName=" + escapeFilterValue(d.SamAccountName) + "))")
+	if err != nil {
+		r.report.add(ActionCreate, "group", d.SamAccountName, "", err)
+		return
+	}
+
+	if obj == nil {
+		if !r.opts.DryRun {
+			err = r.c.newGroup(d)
+		}
+		r.report.add(ActionCreate, "group", d.SamAccountName, "", err)
+		return
+	}
+
+	if d.Path != "" {
+		r.move(obj, "group", d.SamAccountName, d.Path)
+	}
+
+	var m modification
+	var drift []string
+	if d.DisplayName != "" || d.Description != "" {
+		group, err := r.c.getGroupAttributes(obj.DistinguishedName)
+		if err != nil {
+			r.report.add(ActionUpdate, "group", d.SamAccountName, "", err)
+			return
+		}
+		if d.DisplayName != "" && d.DisplayName != group.DisplayName {
+			m.replace("displayName", NewStringAttribute(d.DisplayName))
+			drift = append(drift, "DisplayName")
+		}
+		if d.Description != "" && d.Description != group.Description {
+			m.replace("description", NewStringAttribute(d.Description))
+			drift = append(drift, "Description")
+		}
+	}
+	if len(drift) == 0 {
+		return
+	}
+	if !r.opts.DryRun {
+		err = obj.modify(m)
+	}
+	r.report.add(ActionUpdate, "group", d.SamAccountName, strings.Join(drift, ", "), err)
+}
+
+// getGroupAttributes returns a group without loading its parents or members.
+func (c *Connection) getGroupAttributes(Identity string) (group Group, err error) {
+	attrs, err := c.GetAttributes(Identity, "displayName", "description")
+	if err != nil {
+		return group, err
+	}
+	displayName, _ := attrs.Get("displayName")
+	description, _ := attrs.Get("description")
+	group.DisplayName = displayName.String()
+	group.Description = description.String()
+	return group, nil
+}
+
+func (c *Connection) newGroup(d DesiredGroup) error {
+	name := d.Name
+	if name == "" {
+		name = d.SamAccountName
+	}
+	scope := d.GroupScope
+	if scope == "" {
+		scope = "Global"
+	}
+	category := d.GroupCategory
+	if category == "" {
+		category = "Security"
+	}
+
+	var cmd bytes.Buffer
+	cmd.WriteString("New-ADGroup -Server ")
+	cmd.WriteString(ps.QuoteString(c.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(c.Credential.Expr())
+	cmd.WriteString(" -Name ")
+	cmd.WriteString(ps.QuoteString(name))
+	cmd.WriteString(" -SamAccountName ")
+	cmd.WriteString(ps.QuoteString(d.SamAccountName))
+	cmd.WriteString(" -GroupScope ")
+	cmd.WriteString(ps.QuoteString(scope))
+	cmd.WriteString(" -GroupCategory ")
+	cmd.WriteString(ps.QuoteString(category))
+	if d.Path != "" {
+		cmd.WriteString(ps.Param("Path", ps.QuoteString(d.Path)))
+	}
+	if d.DisplayName != "" {
+		cmd.WriteString(ps.Param("DisplayName", ps.QuoteString(d.DisplayName)))
+	}
+	if d.Description != "" {
+		cmd.WriteString(ps.Param("Description", ps.QuoteString(d.Description)))
+	}
+
+	_, err := powershell(cmd.String())
+	return err
+}
+
+// move moves obj to path unless it is already there.
+func (r *reconciler) move(obj *Object, kind, target, path string) {
+	_, parent := ParseDistinguishedName(obj.DistinguishedName)
+	if strings.EqualFold(parent, path) {
+		return
+	}
+	var err error
+	if !r.opts.DryRun {
+		err = obj.Move(path)
+	}
+	r.report.add(ActionMove, kind, target, parent+" -> "+path, err)
+}
+
+func (r *reconciler) user(d DesiredUser) {
+
+	obj, err := r.find("(&(objectCategory=person)(objectClass=user)(sAMAccountName=" + escapeFilterValue(d.SamAccountName) + "))")
+	if err != nil {
+		r.report.add(ActionUpdate, "user", d.SamAccountName, "", err)
+		return
+	}
+
+	action := ActionUpdate
+	if obj == nil {
+		action = ActionCreate
+		if r.opts.DryRun {
+			r.report.add(action, "user", d.SamAccountName, "", nil)
+			return
+		}
+		err = r.c.newUser(d)
+		if err != nil {
+			r.report.add(action, "user", d.SamAccountName, "", err)
+			return
+		}
+	} else if d.Path != "" {
+		r.move(obj, "user", d.SamAccountName, d.Path)
+	}
+
+	u, err := r.c.GetUserWithOptions(d.SamAccountName, UserOptions{Load: LoadReferences, Attributes: mapKeys(d.Attributes)})
+	if err != nil {
+		r.report.add(action, "user", d.SamAccountName, "", err)
+		return
+	}
+
+	drift := d.apply(&u)
+	if action == ActionUpdate && len(drift) == 0 {
+		return
+	}
+
+	var password string
+	if !r.opts.DryRun {
+		// a new user can only be enabled once it has a password
+		if action == ActionCreate && u.Enabled && u.AccountPassword == "" {
+			password, err = u.SetRandomPassword(nil)
+		}
+		if err == nil {
+			err = u.Push()
+		}
+	}
+	change := r.report.add(action, "user", d.SamAccountName, strings.Join(drift, ", "), err)
+	change.Password = password
+}
+
+func (c *Connection) newUser(d DesiredUser) error {
+	name := d.Name
+	if name == "" {
+		name = d.SamAccountName
+	}
+
+	var cmd bytes.Buffer
+	cmd.WriteString("New-ADUser -Server ")
+	cmd.WriteString(ps.QuoteString(c.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(c.Credential.Expr())
+	cmd.WriteString(" -Name ")
+	cmd.WriteString(ps.QuoteString(name))
+	cmd.WriteString(" -SamAccountName ")
+	cmd.WriteString(ps.QuoteString(d.SamAccountName))
+	if d.Path != "" {
+		cmd.WriteString(ps.Param("Path", ps.QuoteString(d.Path)))
+	}
+
+	_, err := powershell(cmd.String())
+	return err
+}
+
+// apply copies the declared fields of d onto u and returns the names of the fields that differed.
+func (d *DesiredUser) apply(u *User) (drift []string) {
+
+	dv := reflect.ValueOf(d).Elem()
+	uv := reflect.ValueOf(u).Elem()
+	for i := 0; i < dv.NumField(); i++ {
+		f := dv.Type().Field(i)
+		if f.Type.Kind() != reflect.String || f.Name == "SamAccountName" || f.Name == "Name" || f.Name == "Path" {
+			continue
+		}
+		want := dv.Field(i).String()
+		have := uv.FieldByName(f.Name)
+		if !have.IsValid() || have.Kind() != reflect.String || want == "" || have.String() == want {
+			continue
+		}
+		have.SetString(want)
+		drift = append(drift, f.Name)
+	}
+
+	if d.Enabled != nil && u.Enabled != *d.Enabled {
+		u.Enabled = *d.Enabled
+		drift = append(drift, "Enabled")
+	}
+
+	for _, name := range mapKeys(d.Attributes) {
+		want := NewStringAttribute(d.Attributes[name]...)
+		have, _ := u.Attributes.Get(name)
+		if !have.IsEmpty() {
+			want.Syntax, want.Binary = have.Syntax, have.Binary
+		}
+		if have.Equal(want) {
+			continue
+		}
+		u.Attributes.Set(name, want)
+		drift = append(drift, name)
+	}
+
+	return drift
+}
+
+// mapKeys returns the keys of m in order.
+func mapKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (r *reconciler) members(d DesiredGroup) {
+
+	group, err := r.find("(&(objectClass=group)(sAMAccountName=" + escapeFilterValue(d.SamAccountName) + "))")
+	if err == nil && group == nil {
+		if r.opts.DryRun {
+			// the group would have been created, so every member would be added
+			for _, v := range d.Members {
+				r.report.add(ActionAddMember, "group", d.SamAccountName, v, nil)
+			}
+			return
+		}
+		err = errors.New("group not found")
+	}
+	if err != nil {
+		r.report.add(ActionAddMember, "group", d.SamAccountName, "", err)
+		return
+	}
+
+	current, err := r.c.getMembers(group.DistinguishedName)
+	if err != nil {
+		r.report.add(ActionAddMember, "group", d.SamAccountName, "", err)
+		return
+	}
+
+	// resolve the declared members to distinguished names. A failed lookup stops the sync
+	// of the group, as the member would otherwise look undeclared and be removed.
+	wanted := make(map[string]string, len(d.Members))
+	unresolved := make(map[string]bool)
+	for _, v := range d.Members {
+		filter := "(sAMAccountName=" + escapeFilterValue(v) + ")"
+		if strings.Contains(v, "=") {
+			filter = "(distinguishedName=" + escapeFilterValue(v) + ")"
+		}
+		obj, err := r.find(filter)
+		if err != nil {
+			r.report.add(ActionAddMember, "group", d.SamAccountName, v, err)
+			return
+		}
+		if obj == nil {
+			r.report.add(ActionAddMember, "group", d.SamAccountName, v, errors.New("member not found"))
+			unresolved[strings.ToLower(v)] = true
+			continue
+		}
+		wanted[strings.ToLower(obj.DistinguishedName)] = obj.DistinguishedName
+	}
+
+	have := make(map[string]bool, len(current))
+	var remove []string
+	for _, v := range current {
+		have[strings.ToLower(v)] = true
+		if _, ok := wanted[strings.ToLower(v)]; !ok && !unresolved[strings.ToLower(v)] {
+			remove = append(remove, v)
+		}
+	}
+	var add []string
+	for k, v := range wanted {
+		if !have[k] {
+			add = append(add, v)
+		}
+	}
+	sort.Strings(add)
+
+	if len(add) > 0 {
+		if !r.opts.DryRun {
+			err = group.AddValues("member", add...)
+		}
+		for _, v := range add {
+			r.report.add(ActionAddMember, "group", d.SamAccountName, v, err)
+		}
+	}
+	if len(remove) > 0 {
+		if !r.opts.DryRun {
+			err = group.RemoveValues("member", remove...)
+		}
+		for _, v := range remove {
+			r.report.add(ActionRemoveMember, "group", d.SamAccountName, v, err)
+		}
+	}
+}
+
+// getMembers returns the distinguished names of every direct member of a group.
+func (c *Connection) getMembers(dn string) (members []string, err error) {
+	for next := 0; ; {
+		var page []string
+		page, next, err = c.memberRange(dn, next)
+		if err != nil {
+			return members, err
+		}
+		members = append(members, page...)
+		if next <= 0 {
+			return members, nil
+		}
+	}
+}
+
+// prune disables or deletes the users and groups in scope that are not declared. Critical
+// system objects and the account the connection binds as are never pruned.
+func (r *reconciler) prune(state DesiredState) error {
+
+	declared := make(map[string]bool, len(state.Users)+len(state.Groups))
+	for _, v := range state.Users {
+		declared[strings.ToLower(v.SamAccountName)] = true
+	}
+	for _, v := range state.Groups {
+		declared[strings.ToLower(v.SamAccountName)] = true
+	}
+
+	objs, err := r.c.FindObjects(Search{
+		Base:       state.Scope,
+		Filter:     "(&(|(&(objectCategory=person)(objectClass=user))(objectClass=group))(!(isCriticalSystemObject=TRUE)))",
+		Attributes: []string{"sAMAccountName", "userPrincipalName", "userAccountControl"},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range objs {
+		sam, _ := obj.Attributes.Get("sAMAccountName")
+		if declared[strings.ToLower(sam.String())] {
+			continue
+		}
+		kind := "user"
+		if obj.ObjectClass == "group" {
+			kind = "group"
+		}
+		if kind == "user" {
+			upn, _ := obj.Attributes.Get("userPrincipalName")
+			if r.c.isBindAccount(sam.String(), upn.String()) {
+				r.report.add(ActionDisable, kind, sam.String(), obj.DistinguishedName, errors.New("refusing to prune the account the connection binds as"))
+				continue
+			}
+		}
+
+		switch state.Prune {
+		case PruneDelete:
+			if !r.opts.DryRun {
+				err = obj.Delete()
+			}
+			r.report.add(ActionDelete, kind, sam.String(), obj.DistinguishedName, err)
+		case PruneDisable:
+			if kind != "user" {
+				continue
+			}
+			uac, _ := obj.Attributes.Get("userAccountControl")
+			n, _ := uac.Int64()
+			if UserAccountControl(n).Disabled() {
+				continue
+			}
+			if !r.opts.DryRun {
+				u := User{Object: obj}
+				err = u.SetUserAccountControl(UserAccountControl(n).Set(UACAccountDisable))
+			}
+			r.report.add(ActionDisable, kind, sam.String(), obj.DistinguishedName, err)
+		}
+	}
+	return nil
+}
+
+// isBindAccount returns true if the SamAccountName or UserPrincipalName is the user name of
+// the connection's credential, which may be a bare name, DOMAIN\name or a UPN.
+func (c *Connection) isBindAccount(sam, upn string) bool {
+	name := c.Credential.UserName
+	if name == "" {
+		return false
+	}
+	if upn != "" && strings.EqualFold(name, upn) {
+		return true
+	}
+	if i := strings.LastIndex(name, "\\"); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.EqualFold(name, sam)
+}
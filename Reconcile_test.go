@@ -0,0 +1,209 @@
+package ad
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jakobii/ps"
+)
+
+func TestReadDesiredState(t *testing.T) {
+
+	enabled := true
+	want := DesiredState{
+		Scope: "OU=Staff,DC=example,DC=com",
+		Prune: PruneDisable,
+		Groups: []DesiredGroup{
+			{SamAccountName: "staff", Members: []string{"jdoe"}},
+		},
+		Users: []DesiredUser{
+			{SamAccountName: "jdoe", Enabled: &enabled, GivenName: "Jane", Attributes: map[string][]string{"employeeType": {"Staff"}}},
+		},
+	}
+
+	tests := map[string]string{
+		"yaml": `
+scope: OU=Staff,DC=example,DC=com
+prune: disable
+groups:
+  - samAccountName: staff
+    members: [jdoe]
+users:
+  - SamAccountName: jdoe
+    Enabled: true
+    GivenName: Jane
+    Attributes:
+      employeeType: [Staff]
+`,
+		"json": `{"Scope": "OU=Staff,DC=example,DC=com", "Prune": "disable",
+			"Groups": [{"SamAccountName": "staff", "Members": ["jdoe"]}],
+			"Users": [{"SamAccountName": "jdoe", "Enabled": true, "GivenName": "Jane", "Attributes": {"employeeType": ["Staff"]}}]}`,
+	}
+	for format, in := range tests {
+		got, err := ReadDesiredState(strings.NewReader(in))
+		if err != nil {
+			t.Errorf("%s: %v", format, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", format, got, want)
+		}
+	}
+
+	for _, in := range []string{"users:\n  - SamAcountName: jdoe\n", `{"Users": [{"SamAcountName": "jdoe"}]}`, "users: [\n"} {
+		if _, err := ReadDesiredState(strings.NewReader(in)); err == nil {
+			t.Errorf("ReadDesiredState(%q) succeeded", in)
+		}
+	}
+}
+
+func TestDesiredUserApply(t *testing.T) {
+
+	disabled := false
+	d := DesiredUser{
+		SamAccountName: "jdoe",
+		Name:           "Jane Doe",
+		Enabled:        &disabled,
+		GivenName:      "Jane",
+		Title:          "Engineer",
+		Attributes:     map[string][]string{"employeeType": {"Staff"}},
+	}
+	u := User{Enabled: true, GivenName: "Jane", Title: "Intern"}
+	u.Attributes = Attributes{}
+
+	drift := d.apply(&u)
+	if want := []string{"Title", "Enabled", "employeeType"}; !reflect.DeepEqual(drift, want) {
+		t.Errorf("drift = %v, want %v", drift, want)
+	}
+	if u.Title != "Engineer" || u.Enabled {
+		t.Errorf("fields were not applied: %+v", u)
+	}
+	if drift := d.apply(&u); len(drift) != 0 {
+		t.Errorf("second apply drifted %v", drift)
+	}
+}
+
+func TestReconcileUnknownPrune(t *testing.T) {
+	scripts := recordPowershell(t, nil)
+	c := NewConnection("dc1", "svc", "secret")
+	_, err := c.Reconcile(DesiredState{Scope: "DC=example,DC=com", Prune: "archive", OrgUnits: []DesiredOrgUnit{{DistinguishedName: "OU=New,DC=example,DC=com"}}}, ReconcileOptions{})
+	if err == nil {
+		t.Error("unknown prune action was accepted")
+	}
+	if len(*scripts) != 0 {
+		t.Errorf("changes were made before the prune action was checked: %v", *scripts)
+	}
+}
+
+func TestPrune(t *testing.T) {
+
+	found := `{"ObjectGuid":"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c01","ObjectClass":"user","DistinguishedName":"CN=jdoe,OU=Staff,DC=example,DC=com","Name":"jdoe","Attributes":[{"Name":"sAMAccountName","Values":["jdoe"]},{"Name":"userAccountControl","Values":["512"]}]}
+{"ObjectGuid":"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c02","ObjectClass":"user","DistinguishedName":"CN=Sync,OU=Staff,DC=example,DC=com","Name":"Sync","Attributes":[{"Name":"sAMAccountName","Values":["svc-sync"]},{"Name":"userAccountControl","Values":["512"]}]}
+{"ObjectGuid":"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c03","ObjectClass":"user","DistinguishedName":"CN=old,OU=Staff,DC=example,DC=com","Name":"old","Attributes":[{"Name":"sAMAccountName","Values":["old"]},{"Name":"userAccountControl","Values":["512"]}]}
+`
+	scripts := recordPowershell(t, func(script string) ([]byte, error) {
+		if strings.Contains(script, "Get-ADObject") {
+			return []byte(found), nil
+		}
+		return nil, nil
+	})
+
+	c := NewConnection("dc1", `EXAMPLE\svc-sync`, "secret")
+	var report ReconcileReport
+	r := reconciler{c: &c, report: &report}
+	err := r.prune(DesiredState{Scope: "OU=Staff,DC=example,DC=com", Prune: PruneDelete, Users: []DesiredUser{{SamAccountName: "JDoe"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*scripts) != 2 {
+		t.Fatalf("scripts = %v", *scripts)
+	}
+	if !strings.Contains((*scripts)[0], "(!(isCriticalSystemObject=TRUE))") {
+		t.Errorf("critical system objects are not excluded: %s", (*scripts)[0])
+	}
+	if !strings.HasPrefix((*scripts)[1], "Remove-ADObject") || !strings.Contains((*scripts)[1], ps.QuoteString("6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c03")) {
+		t.Errorf("deleted %s", (*scripts)[1])
+	}
+
+	if len(report.Changes) != 2 || report.Changes[0].Target != "svc-sync" || report.Changes[0].Error == "" ||
+		report.Changes[1].Target != "old" || report.Changes[1].Error != "" {
+		t.Errorf("report = %+v", report.Changes)
+	}
+}
+
+func TestIsBindAccount(t *testing.T) {
+
+	tests := []struct {
+		user, sam, upn string
+		want           bool
+	}{
+		{"svc-sync", "svc-sync", "", true},
+		{`EXAMPLE\SVC-Sync`, "svc-sync", "", true},
+		{"sync@example.com", "svc-sync", "sync@example.com", true},
+		{"sync@example.com", "sync", "sync@example.org", false},
+		{"svc-sync", "jdoe", "svc-sync@example.com", false},
+		{"", "", "", false},
+	}
+	for _, test := range tests {
+		c := NewConnection("dc1", test.user, "")
+		if got := c.isBindAccount(test.sam, test.upn); got != test.want {
+			t.Errorf("%q isBindAccount(%q, %q) = %t", test.user, test.sam, test.upn, got)
+		}
+	}
+}
+
+func TestReconcileMembers(t *testing.T) {
+
+	group := `{"ObjectGuid":"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c10","ObjectClass":"group","DistinguishedName":"CN=staff,OU=Staff,DC=example,DC=com","Name":"staff"}`
+	members := `{"MemberRange":"member;range=0-*","Members":["CN=jdoe,OU=Staff,DC=example,DC=com","CN=bob,OU=Staff,DC=example,DC=com","CN=Gone,OU=Staff,DC=example,DC=com","CN=old,OU=Staff,DC=example,DC=com"]}`
+	jdoe := `{"ObjectGuid":"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c01","ObjectClass":"user","DistinguishedName":"CN=jdoe,OU=Staff,DC=example,DC=com","Name":"jdoe"}`
+
+	tests := []struct {
+		name    string
+		members []string
+		busy    bool
+		removed []string
+	}{
+		{name: "lookup failed", members: []string{"jdoe", "bob"}, busy: true},
+		{name: "not found", members: []string{"jdoe", "CN=Gone,OU=Staff,DC=example,DC=com"}, removed: []string{"CN=bob,OU=Staff,DC=example,DC=com", "CN=old,OU=Staff,DC=example,DC=com"}},
+	}
+
+	for _, test := range tests {
+		scripts := recordPowershell(t, func(script string) ([]byte, error) {
+			switch {
+			case strings.Contains(script, "member;range="):
+				return []byte(members), nil
+			case strings.Contains(script, "(objectClass=group)"):
+				return []byte(group), nil
+			case strings.Contains(script, "(sAMAccountName=jdoe)"):
+				return []byte(jdoe), nil
+			case strings.Contains(script, "(sAMAccountName=bob)") && test.busy:
+				return nil, errors.New("server busy")
+			}
+			return nil, nil
+		})
+
+		c := NewConnection("dc1", "svc", "secret")
+		var report ReconcileReport
+		r := reconciler{c: &c, report: &report}
+		r.members(DesiredGroup{SamAccountName: "staff", Members: test.members})
+
+		var removed []string
+		for _, v := range report.Changes {
+			if v.Action == ActionRemoveMember {
+				removed = append(removed, v.Detail)
+			}
+		}
+		if !reflect.DeepEqual(removed, test.removed) {
+			t.Errorf("%s: removed %v, want %v", test.name, removed, test.removed)
+		}
+		for _, v := range *scripts {
+			if strings.HasPrefix(v, "Set-ADObject") && strings.Contains(v, "-Remove") != (len(test.removed) > 0) {
+				t.Errorf("%s: %s", test.name, v)
+			}
+		}
+	}
+}
@@ -0,0 +1,1118 @@
+package ad
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	SCIMUserSchema           = "urn:ietf:params:scim:schemas:core:2.0:User"
+	SCIMGroupSchema          = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	SCIMEnterpriseUserSchema = "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"
+
+	scimListResponse  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchOp       = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema   = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimServiceConfig = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+)
+
+// DefaultSCIMUserMapping maps SCIM user attributes to LDAP attributes. Sub-attributes are
+// separated by a dot, and extension attributes are qualified with their schema.
+var DefaultSCIMUserMapping = map[string]string{
+	"userName":        "sAMAccountName",
+	"externalId":      "employeeID",
+	"displayName":     "displayName",
+	"name.givenName":  "givenName",
+	"name.familyName": "sn",
+	"title":           "title",
+	"emails":          "mail",
+	"phoneNumbers":    "telephoneNumber",
+	SCIMEnterpriseUserSchema + ":employeeNumber": "employeeNumber",
+	SCIMEnterpriseUserSchema + ":department":     "department",
+	SCIMEnterpriseUserSchema + ":division":       "division",
+	SCIMEnterpriseUserSchema + ":organization":   "company",
+}
+
+// DefaultSCIMGroupMapping maps SCIM group attributes to LDAP attributes.
+var DefaultSCIMGroupMapping = map[string]string{
+	"displayName": "sAMAccountName",
+	"externalId":  "description",
+}
+
+// scimMultiValued are the SCIM attributes rendered as a list of values.
+var scimMultiValued = map[string]bool{
+	"emails": true, "phonenumbers": true, "ims": true, "photos": true, "addresses": true,
+	"entitlements": true, "roles": true, "x509certificates": true,
+}
+
+// SCIMHandler serves the SCIM 2.0 (RFC 7644) /Users and /Groups endpoints from the directory,
+// along with /ServiceProviderConfig, /Schemas and /ResourceTypes. Resources are identified by
+// ObjectGuid. Mount it with http.StripPrefix if it is not served from the root, and put
+// authentication in front of it, the handler does none.
+//
+// Users have the mapped attributes, active, which is the inverse of the ACCOUNTDISABLE flag, and
+// the write-only password. Groups have the mapped attributes and members. A user can only be
+// enabled once it has a password, so a user created without one stays disabled, whatever active
+// says, until a client sets a password and active. Values of multi-valued SCIM attributes
+// replace the values of the LDAP attribute they are mapped to.
+type SCIMHandler struct {
+	Connection *Connection
+	// UserBase and GroupBase are where resources are searched and created. Blank searches
+	// the whole domain and creates in the default containers.
+	UserBase  string
+	GroupBase string
+	// UserMapping and GroupMapping map SCIM attribute paths to LDAP attributes,
+	// DefaultSCIMUserMapping and DefaultSCIMGroupMapping if nil.
+	UserMapping  map[string]string
+	GroupMapping map[string]string
+	// BaseURL is the URL the handler is served at, used in meta.location.
+	BaseURL string
+	// MaxResults caps the page size of list requests, 100 if it is not set.
+	MaxResults int
+}
+
+// scimError is an error response. Type is the scimType of RFC 7644 section 3.12.
+type scimError struct {
+	Status int
+	Type   string
+	Detail string
+}
+
+func (e scimError) Error() string {
+	return e.Detail
+}
+
+// scimResourceType is a SCIM endpoint and how it maps to the directory.
+type scimResourceType struct {
+	name     string
+	endpoint string
+	schema   string
+	filter   string
+	base     string
+	mapping  map[string]string
+}
+
+func (h *SCIMHandler) resourceType(endpoint string) (rt scimResourceType, ok bool) {
+	switch endpoint {
+	case "Users":
+		rt = scimResourceType{name: "User", endpoint: endpoint, schema: SCIMUserSchema,
+			filter: "(&(objectCategory=person)(objectClass=user))", base: h.UserBase, mapping: h.UserMapping}
+		if rt.mapping == nil {
+			rt.mapping = DefaultSCIMUserMapping
+		}
+	case "Groups":
+		rt = scimResourceType{name: "Group", endpoint: endpoint, schema: SCIMGroupSchema,
+			filter: "(objectClass=group)", base: h.GroupBase, mapping: h.GroupMapping}
+		if rt.mapping == nil {
+			rt.mapping = DefaultSCIMGroupMapping
+		}
+	default:
+		return rt, false
+	}
+	return rt, true
+}
+
+// attribute returns the LDAP attribute a SCIM attribute path is mapped to.
+func (rt scimResourceType) attribute(path string) (string, bool) {
+	if len(path) > len(rt.schema) && strings.EqualFold(path[:len(rt.schema)+1], rt.schema+":") {
+		path = path[len(rt.schema)+1:]
+	}
+	switch strings.ToLower(path) {
+	case "meta.created":
+		return "whenCreated", true
+	case "meta.lastmodified":
+		return "whenChanged", true
+	}
+	for k, v := range rt.mapping {
+		if strings.EqualFold(k, path) {
+			return v, true
+		}
+	}
+	if strings.HasSuffix(strings.ToLower(path), ".value") {
+		return rt.attribute(path[:len(path)-len(".value")])
+	}
+	return "", false
+}
+
+// attributes returns the LDAP attributes needed to render a resource.
+func (rt scimResourceType) attributes() []string {
+	names := []string{"whenCreated", "whenChanged"}
+	if rt.name == "User" {
+		names = append(names, "userAccountControl")
+	} else {
+		names = append(names, "member")
+	}
+	for _, v := range rt.mapping {
+		if !containsFold(names, v) {
+			names = append(names, v)
+		}
+	}
+	return names
+}
+
+func (h *SCIMHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) == 1 && parts[0] == "ServiceProviderConfig" {
+		h.serviceProviderConfig(w)
+		return
+	}
+	if (parts[0] == "Schemas" || parts[0] == "ResourceTypes") && len(parts) <= 2 {
+		if err := h.discovery(w, r, parts); err != nil {
+			writeSCIMError(w, err)
+		}
+		return
+	}
+	rt, ok := h.resourceType(parts[0])
+	if !ok || len(parts) > 2 {
+		writeSCIMError(w, scimError{Status: http.StatusNotFound, Detail: "unknown endpoint " + r.URL.Path})
+		return
+	}
+
+	var err error
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		err = h.list(w, r, rt)
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		err = h.create(w, r, rt)
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		err = h.get(w, r, rt, parts[1])
+	case len(parts) == 2 && r.Method == http.MethodPut:
+		err = h.replace(w, r, rt, parts[1])
+	case len(parts) == 2 && r.Method == http.MethodPatch:
+		err = h.patch(w, r, rt, parts[1])
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		err = h.delete(w, r, rt, parts[1])
+	default:
+		err = scimError{Status: http.StatusMethodNotAllowed, Detail: r.Method + " is not supported on " + r.URL.Path}
+	}
+	if err != nil {
+		writeSCIMError(w, err)
+	}
+}
+
+func writeSCIM(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeSCIMError(w http.ResponseWriter, err error) {
+	var e scimError
+	if !errors.As(err, &e) {
+		e = scimError{Status: http.StatusInternalServerError, Detail: err.Error()}
+		var violation *PasswordPolicyViolation
+		if errors.As(err, &violation) {
+			e = scimError{Status: http.StatusBadRequest, Type: "invalidValue", Detail: err.Error()}
+		}
+	}
+	body := map[string]interface{}{
+		"schemas": []string{scimErrorSchema},
+		"status":  strconv.Itoa(e.Status),
+		"detail":  e.Detail,
+	}
+	if e.Type != "" {
+		body["scimType"] = e.Type
+	}
+	writeSCIM(w, e.Status, body)
+}
+
+func (h *SCIMHandler) serviceProviderConfig(w http.ResponseWriter) {
+	supported := func(b bool) map[string]interface{} { return map[string]interface{}{"supported": b} }
+	writeSCIM(w, http.StatusOK, map[string]interface{}{
+		"schemas":               []string{scimServiceConfig},
+		"patch":                 supported(true),
+		"bulk":                  map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":                map[string]interface{}{"supported": true, "maxResults": h.maxResults()},
+		"changePassword":        supported(true),
+		"sort":                  supported(false),
+		"etag":                  supported(true),
+		"authenticationSchemes": []interface{}{},
+	})
+}
+
+func (h *SCIMHandler) maxResults() int {
+	if h.MaxResults > 0 {
+		return h.MaxResults
+	}
+	return 100
+}
+
+// find returns the resources matching an LDAP filter.
+func (h *SCIMHandler) find(rt scimResourceType, filter string) ([]Object, error) {
+	return h.Connection.FindObjects(Search{
+		Base:       rt.base,
+		Filter:     "(&" + rt.filter + filter + ")",
+		Attributes: rt.attributes(),
+	})
+}
+
+// load returns the resource with the id.
+func (h *SCIMHandler) load(rt scimResourceType, id string) (obj Object, err error) {
+	guid, err := uuid.Parse(id)
+	if err != nil {
+		return obj, scimError{Status: http.StatusNotFound, Detail: rt.name + " " + id + " not found"}
+	}
+	objs, err := h.find(rt, "(objectGUID="+escapeFilterBytes(guidToBytes(guid))+")")
+	if err != nil {
+		return obj, err
+	}
+	if len(objs) == 0 {
+		return obj, scimError{Status: http.StatusNotFound, Detail: rt.name + " " + id + " not found"}
+	}
+	return objs[0], nil
+}
+
+// render returns the SCIM representation of a resource, with members unless they are left
+// out. The version in meta is a weak ETag of the representation without meta, in which the
+// members are the distinguished names of the member attribute, so the version is the same
+// whether members are rendered or not.
+func (h *SCIMHandler) render(rt scimResourceType, obj Object, members bool) (map[string]interface{}, error) {
+
+	res := map[string]interface{}{
+		"schemas": []string{rt.schema},
+		"id":      obj.ObjectGuid.String(),
+	}
+	for path, name := range rt.mapping {
+		a, ok := obj.Attributes.Get(name)
+		if !ok || a.IsEmpty() {
+			continue
+		}
+		setSCIMValue(res, path, a.Strings())
+	}
+
+	if rt.name == "User" {
+		uac, _ := obj.Attributes.Get("userAccountControl")
+		n, _ := uac.Int64()
+		res["active"] = !UserAccountControl(n).Disabled()
+	}
+
+	// maps are marshaled with sorted keys, so the hash is stable
+	b, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	hash.Write(b)
+	if rt.name == "Group" {
+		a, _ := obj.Attributes.Get("member")
+		dns := a.Strings()
+		for i := range dns {
+			dns[i] = strings.ToLower(dns[i])
+		}
+		sort.Strings(dns)
+		for _, dn := range dns {
+			hash.Write([]byte("\n" + dn))
+		}
+	}
+
+	if rt.name == "Group" && members {
+		a, _ := obj.Attributes.Get("member")
+		found, err := h.Connection.typeMembers(a.Strings())
+		if err != nil {
+			return nil, err
+		}
+		list := make([]interface{}, 0, len(found))
+		for _, m := range found {
+			if m.ObjectGuid == uuid.Nil {
+				continue
+			}
+			member := map[string]interface{}{"value": m.ObjectGuid.String(), "display": m.Name}
+			switch m.Kind {
+			case MemberUser:
+				member["type"] = "User"
+				member["$ref"] = h.BaseURL + "/Users/" + m.ObjectGuid.String()
+			case MemberGroup:
+				member["type"] = "Group"
+				member["$ref"] = h.BaseURL + "/Groups/" + m.ObjectGuid.String()
+			}
+			list = append(list, member)
+		}
+		res["members"] = list
+	}
+
+	sum := hash.Sum(nil)
+	meta := map[string]interface{}{
+		"resourceType": rt.name,
+		"location":     h.BaseURL + "/" + rt.endpoint + "/" + obj.ObjectGuid.String(),
+		"version":      `W/"` + hex.EncodeToString(sum[:8]) + `"`,
+	}
+	if a, ok := obj.Attributes.Get("whenCreated"); ok {
+		if t, err := a.Time(); err == nil {
+			meta["created"] = t.UTC().Format(time.RFC3339)
+		}
+	}
+	if a, ok := obj.Attributes.Get("whenChanged"); ok {
+		if t, err := a.Time(); err == nil {
+			meta["lastModified"] = t.UTC().Format(time.RFC3339)
+		}
+	}
+	res["meta"] = meta
+	return res, nil
+}
+
+// setSCIMValue sets an attribute path of a resource.
+func setSCIMValue(res map[string]interface{}, path string, values []string) {
+
+	target := res
+	if i := strings.LastIndex(path, ":"); i >= 0 {
+		ext := path[:i]
+		path = path[i+1:]
+		m, ok := res[ext].(map[string]interface{})
+		if !ok {
+			m = make(map[string]interface{})
+			res[ext] = m
+			res["schemas"] = append(res["schemas"].([]string), ext)
+		}
+		target = m
+	}
+	if i := strings.Index(path, "."); i >= 0 {
+		m, ok := target[path[:i]].(map[string]interface{})
+		if !ok {
+			m = make(map[string]interface{})
+			target[path[:i]] = m
+		}
+		target = m
+		path = path[i+1:]
+	}
+
+	if !scimMultiValued[strings.ToLower(path)] {
+		target[path] = values[0]
+		return
+	}
+	list := make([]interface{}, len(values))
+	for i, v := range values {
+		list[i] = map[string]interface{}{"value": v, "primary": i == 0}
+	}
+	target[path] = list
+}
+
+// scimLookup returns the value of an attribute path in a request body. Keys are matched
+// case-insensitively.
+func scimLookup(body map[string]interface{}, path string) (interface{}, bool) {
+	if i := strings.LastIndex(path, ":"); i >= 0 {
+		ext, ok := getFold(body, path[:i])
+		m, _ := ext.(map[string]interface{})
+		if !ok || m == nil {
+			return nil, false
+		}
+		body, path = m, path[i+1:]
+	}
+	if i := strings.Index(path, "."); i >= 0 {
+		v, _ := getFold(body, path[:i])
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		body, path = m, path[i+1:]
+	}
+	return getFold(body, path)
+}
+
+func getFold(m map[string]interface{}, key string) (interface{}, bool) {
+	if v, ok := m[key]; ok {
+		return v, true
+	}
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// scimStrings returns the LDAP values of a SCIM value. Complex values contribute their value
+// sub-attribute.
+func scimStrings(v interface{}) []string {
+	switch x := v.(type) {
+	case string:
+		if x == "" {
+			return nil
+		}
+		return []string{x}
+	case bool:
+		if x {
+			return []string{"TRUE"}
+		}
+		return []string{"FALSE"}
+	case float64:
+		return []string{strconv.FormatFloat(x, 'f', -1, 64)}
+	case map[string]interface{}:
+		value, _ := getFold(x, "value")
+		return scimStrings(value)
+	case []interface{}:
+		var values []string
+		for _, e := range x {
+			values = append(values, scimStrings(e)...)
+		}
+		return values
+	}
+	return nil
+}
+
+// scimBool reads a boolean, which some clients send as a string.
+func scimBool(v interface{}) (bool, error) {
+	switch x := v.(type) {
+	case bool:
+		return x, nil
+	case string:
+		if b, err := strconv.ParseBool(x); err == nil {
+			return b, nil
+		}
+	}
+	return false, scimError{Status: http.StatusBadRequest, Type: "invalidValue", Detail: "not a boolean"}
+}
+
+func decodeSCIMBody(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(v)
+	if err != nil {
+		return scimError{Status: http.StatusBadRequest, Type: "invalidSyntax", Detail: err.Error()}
+	}
+	return nil
+}
+
+// checkVersion compares the If-Match header with the current version of a resource.
+func checkVersion(r *http.Request, res map[string]interface{}) error {
+	match := r.Header.Get("If-Match")
+	if match == "" || match == "*" {
+		return nil
+	}
+	version := res["meta"].(map[string]interface{})["version"].(string)
+	for _, v := range strings.Split(match, ",") {
+		if strings.TrimSpace(v) == version {
+			return nil
+		}
+	}
+	return scimError{Status: http.StatusPreconditionFailed, Detail: "resource was changed, version is " + version}
+}
+
+func (h *SCIMHandler) list(w http.ResponseWriter, r *http.Request, rt scimResourceType) error {
+
+	q := r.URL.Query()
+	filter := ""
+	if f := q.Get("filter"); f != "" {
+		var err error
+		filter, err = translateSCIMFilter(f, func(path string) (string, error) {
+			if name, ok := rt.attribute(path); ok {
+				return name, nil
+			}
+			return "", scimInvalidFilter("unknown attribute " + path)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	start, _ := strconv.Atoi(q.Get("startIndex"))
+	if start < 1 {
+		start = 1
+	}
+	count := h.maxResults()
+	if v := q.Get("count"); v != "" {
+		n, _ := strconv.Atoi(v)
+		if n < 0 {
+			n = 0
+		}
+		if n < count {
+			count = n
+		}
+	}
+	members := !containsFold(strings.Split(q.Get("excludedAttributes"), ","), "members")
+
+	objs, err := h.find(rt, filter)
+	if err != nil {
+		return err
+	}
+	// ObjectGuids never change, so pages stay stable while objects are renamed
+	sort.Slice(objs, func(i, j int) bool { return objs[i].ObjectGuid.String() < objs[j].ObjectGuid.String() })
+
+	page := objs[:0]
+	if start <= len(objs) {
+		page = objs[start-1:]
+	}
+	if len(page) > count {
+		page = page[:count]
+	}
+	resources := make([]interface{}, 0, len(page))
+	for _, obj := range page {
+		res, err := h.render(rt, obj, members)
+		if err != nil {
+			return err
+		}
+		resources = append(resources, res)
+	}
+
+	writeSCIM(w, http.StatusOK, map[string]interface{}{
+		"schemas":      []string{scimListResponse},
+		"totalResults": len(objs),
+		"startIndex":   start,
+		"itemsPerPage": len(resources),
+		"Resources":    resources,
+	})
+	return nil
+}
+
+func (h *SCIMHandler) get(w http.ResponseWriter, r *http.Request, rt scimResourceType, id string) error {
+	obj, err := h.load(rt, id)
+	if err != nil {
+		return err
+	}
+	res, err := h.render(rt, obj, true)
+	if err != nil {
+		return err
+	}
+	version := res["meta"].(map[string]interface{})["version"].(string)
+	w.Header().Set("ETag", version)
+	for _, v := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if strings.TrimSpace(v) == version {
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+	}
+	writeSCIM(w, http.StatusOK, res)
+	return nil
+}
+
+// respond writes the current representation of a resource.
+func (h *SCIMHandler) respond(w http.ResponseWriter, rt scimResourceType, id string, status int) error {
+	obj, err := h.load(rt, id)
+	if err != nil {
+		return err
+	}
+	res, err := h.render(rt, obj, true)
+	if err != nil {
+		return err
+	}
+	meta := res["meta"].(map[string]interface{})
+	w.Header().Set("ETag", meta["version"].(string))
+	if status == http.StatusCreated {
+		w.Header().Set("Location", meta["location"].(string))
+	}
+	writeSCIM(w, status, res)
+	return nil
+}
+
+func (h *SCIMHandler) create(w http.ResponseWriter, r *http.Request, rt scimResourceType) error {
+
+	var body map[string]interface{}
+	if err := decodeSCIMBody(r, &body); err != nil {
+		return err
+	}
+
+	ch := newSCIMChanges()
+	err := h.collect(rt, body, "replace", &ch)
+	if err != nil {
+		return err
+	}
+
+	// the SamAccountName is given when the object is created
+	naming := "userName"
+	if rt.name == "Group" {
+		naming = "displayName"
+	}
+	v, _ := scimLookup(body, naming)
+	name, _ := v.(string)
+	if name == "" {
+		return scimError{Status: http.StatusBadRequest, Type: "invalidValue", Detail: naming + " is required"}
+	}
+	if rt.name == "User" {
+		ch.splitUPN()
+	}
+	sam := name
+	if values := ch.values["samaccountname"]; len(values) > 0 {
+		sam = values[0]
+	} else if i := strings.Index(sam, "@"); i > 0 {
+		sam = sam[:i]
+	}
+	display := name
+	if v, ok := scimLookup(body, "displayName"); ok {
+		if s, _ := v.(string); s != "" {
+			display = s
+		}
+	}
+
+	existing, err := h.Connection.FindObjects(Search{Filter: "(sAMAccountName=" + escapeFilterValue(sam) + ")"})
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return scimError{Status: http.StatusConflict, Type: "uniqueness", Detail: sam + " already exists"}
+	}
+
+	if rt.name == "User" {
+		err = h.Connection.newUser(DesiredUser{SamAccountName: sam, Name: display, Path: rt.base})
+	} else {
+		err = h.Connection.newGroup(DesiredGroup{SamAccountName: sam, Name: display, Path: rt.base})
+	}
+	if err != nil {
+		return err
+	}
+	objs, err := h.find(rt, "(sAMAccountName="+escapeFilterValue(sam)+")")
+	if err != nil {
+		return err
+	}
+	if len(objs) == 0 {
+		return errors.New("created " + sam + " but can not find it in " + rt.base)
+	}
+	obj := objs[0]
+
+	// a new user can only be enabled once it has a password
+	if rt.name == "User" && (ch.password == nil || *ch.password == "") {
+		active := false
+		ch.active = &active
+	} else if rt.name == "User" && ch.active == nil {
+		active := true
+		ch.active = &active
+	}
+	err = h.apply(&obj, ch)
+	if err != nil {
+		// remove the half made object again, so the client can retry the request
+		if derr := obj.Delete(); derr != nil {
+			return fmt.Errorf("%v, and %s could not be removed again: %v", err, sam, derr)
+		}
+		return err
+	}
+	return h.respond(w, rt, obj.ObjectGuid.String(), http.StatusCreated)
+}
+
+func (h *SCIMHandler) replace(w http.ResponseWriter, r *http.Request, rt scimResourceType, id string) error {
+
+	var body map[string]interface{}
+	if err := decodeSCIMBody(r, &body); err != nil {
+		return err
+	}
+	obj, err := h.load(rt, id)
+	if err != nil {
+		return err
+	}
+	current, err := h.render(rt, obj, true)
+	if err != nil {
+		return err
+	}
+	if err = checkVersion(r, current); err != nil {
+		return err
+	}
+
+	ch := newSCIMChanges()
+	err = h.collect(rt, body, "replace", &ch)
+	if err != nil {
+		return err
+	}
+	if rt.name == "User" {
+		ch.splitUPN()
+	}
+
+	// attributes missing from the body are cleared, except the naming attribute
+	for _, name := range rt.mapping {
+		lower := strings.ToLower(name)
+		if _, ok := ch.values[lower]; ok || lower == "samaccountname" {
+			continue
+		}
+		if a, ok := obj.Attributes.Get(name); ok && !a.IsEmpty() {
+			ch.set(name, nil)
+		}
+	}
+	if rt.name == "Group" && !ch.members {
+		ch.member("replace", nil)
+	}
+
+	err = h.apply(&obj, ch)
+	if err != nil {
+		return err
+	}
+	return h.respond(w, rt, id, http.StatusOK)
+}
+
+// scimPatch is the body of a PATCH request.
+type scimPatch struct {
+	Schemas    []string
+	Operations []struct {
+		Op    string
+		Path  string
+		Value interface{}
+	}
+}
+
+func (h *SCIMHandler) patch(w http.ResponseWriter, r *http.Request, rt scimResourceType, id string) error {
+
+	var body scimPatch
+	if err := decodeSCIMBody(r, &body); err != nil {
+		return err
+	}
+	if len(body.Schemas) > 0 && !containsFold(body.Schemas, scimPatchOp) {
+		return scimError{Status: http.StatusBadRequest, Type: "invalidSyntax", Detail: "expected " + scimPatchOp}
+	}
+	obj, err := h.load(rt, id)
+	if err != nil {
+		return err
+	}
+	current, err := h.render(rt, obj, true)
+	if err != nil {
+		return err
+	}
+	if err = checkVersion(r, current); err != nil {
+		return err
+	}
+
+	ch := newSCIMChanges()
+	for _, op := range body.Operations {
+		o := strings.ToLower(op.Op)
+		if o != "add" && o != "replace" && o != "remove" {
+			return scimError{Status: http.StatusBadRequest, Type: "invalidSyntax", Detail: "unknown operation " + op.Op}
+		}
+		if op.Path == "" {
+			value, ok := op.Value.(map[string]interface{})
+			if !ok || o == "remove" {
+				return scimError{Status: http.StatusBadRequest, Type: "noTarget", Detail: op.Op + " needs a path"}
+			}
+			err = h.collect(rt, value, o, &ch)
+		} else {
+			err = h.collectPath(rt, op.Path, o, op.Value, &ch)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if rt.name == "User" {
+		ch.splitUPN()
+	}
+
+	err = h.apply(&obj, ch)
+	if err != nil {
+		return err
+	}
+	return h.respond(w, rt, id, http.StatusOK)
+}
+
+func (h *SCIMHandler) delete(w http.ResponseWriter, r *http.Request, rt scimResourceType, id string) error {
+	obj, err := h.load(rt, id)
+	if err != nil {
+		return err
+	}
+	if r.Header.Get("If-Match") != "" {
+		current, err := h.render(rt, obj, true)
+		if err != nil {
+			return err
+		}
+		if err = checkVersion(r, current); err != nil {
+			return err
+		}
+	}
+	err = obj.Delete()
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// scimChanges collects the changes of a request, so they are written with a single
+// modification. Every change is merged into the result of the changes before it, as if
+// the operations of a PATCH were applied one after the other.
+type scimChanges struct {
+	// values are the values set by LDAP attribute, lower case, nil to clear it
+	values map[string][]string
+	names  map[string]string
+
+	// members is true if the members change. If they are replaced, memberList is the new
+	// list, otherwise memberAdds and memberRemoves are the members added and removed.
+	members       bool
+	replaced      bool
+	memberList    []string
+	memberAdds    []string
+	memberRemoves []string
+
+	active   *bool
+	password *string
+}
+
+func newSCIMChanges() scimChanges {
+	return scimChanges{values: make(map[string][]string), names: make(map[string]string)}
+}
+
+// set replaces the values of an LDAP attribute, or clears it if there are none.
+func (ch *scimChanges) set(name string, values []string) {
+	lower := strings.ToLower(name)
+	ch.values[lower] = values
+	ch.names[lower] = name
+}
+
+// splitUPN turns a SamAccountName in UPN form, as sent by clients that use the UPN as the
+// userName, into the part before the @. The UPN becomes the UserPrincipalName, unless
+// that is set too.
+func (ch *scimChanges) splitUPN() {
+	values := ch.values["samaccountname"]
+	if len(values) != 1 {
+		return
+	}
+	i := strings.Index(values[0], "@")
+	if i <= 0 {
+		return
+	}
+	if len(ch.values["userprincipalname"]) == 0 {
+		ch.set("userPrincipalName", []string{values[0]})
+	}
+	ch.set(ch.names["samaccountname"], []string{values[0][:i]})
+}
+
+// member adds, removes or replaces members by distinguished name.
+func (ch *scimChanges) member(op string, dns []string) {
+	ch.members = true
+	switch {
+	case op == "add" && ch.replaced:
+		ch.memberList = appendFold(ch.memberList, dns...)
+	case op == "add":
+		ch.memberRemoves = removeFold(ch.memberRemoves, dns...)
+		ch.memberAdds = appendFold(ch.memberAdds, dns...)
+	case op == "remove" && ch.replaced:
+		ch.memberList = removeFold(ch.memberList, dns...)
+	case op == "remove":
+		ch.memberAdds = removeFold(ch.memberAdds, dns...)
+		ch.memberRemoves = appendFold(ch.memberRemoves, dns...)
+	default:
+		ch.replaced = true
+		ch.memberList = appendFold(nil, dns...)
+		ch.memberAdds, ch.memberRemoves = nil, nil
+	}
+}
+
+// modification returns the modification that makes the changes to an object with the
+// current attributes. Members that are already there are not added again, and members that
+// are not there are not removed, as AD rejects both.
+func (ch *scimChanges) modification(current Attributes) (m modification) {
+	keys := make([]string, 0, len(ch.values))
+	for k := range ch.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		m.replace(ch.names[k], NewStringAttribute(ch.values[k]...))
+	}
+
+	if !ch.members {
+		return m
+	}
+	if ch.replaced {
+		m.replace("member", NewStringAttribute(ch.memberList...))
+		return m
+	}
+	have, _ := current.Get("member")
+	var adds, removes []string
+	for _, dn := range ch.memberAdds {
+		if !containsFold(have.Strings(), dn) {
+			adds = append(adds, dn)
+		}
+	}
+	for _, dn := range ch.memberRemoves {
+		if containsFold(have.Strings(), dn) {
+			removes = append(removes, dn)
+		}
+	}
+	m.remove("member", NewStringAttribute(removes...))
+	m.add("member", NewStringAttribute(adds...))
+	return m
+}
+
+// appendFold appends the values that are not in list yet, without regard to case.
+func appendFold(list []string, values ...string) []string {
+	for _, v := range values {
+		if !containsFold(list, v) {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// removeFold removes values from list, without regard to case.
+func removeFold(list []string, values ...string) []string {
+	kept := list[:0]
+	for _, v := range list {
+		if !containsFold(values, v) {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// collect adds the attributes of a resource body to ch.
+func (h *SCIMHandler) collect(rt scimResourceType, body map[string]interface{}, op string, ch *scimChanges) error {
+
+	for path, name := range rt.mapping {
+		v, ok := scimLookup(body, path)
+		if !ok {
+			continue
+		}
+		ch.set(name, scimStrings(v))
+	}
+
+	if rt.name == "User" {
+		if v, ok := getFold(body, "active"); ok {
+			active, err := scimBool(v)
+			if err != nil {
+				return err
+			}
+			ch.active = &active
+		}
+		if v, ok := getFold(body, "password"); ok {
+			password, _ := v.(string)
+			ch.password = &password
+		}
+	} else if v, ok := getFold(body, "members"); ok {
+		return h.collectMembers(op, scimStrings(v), ch)
+	}
+	return nil
+}
+
+// collectPath adds a PATCH operation with a path to ch.
+func (h *SCIMHandler) collectPath(rt scimResourceType, path, op string, value interface{}, ch *scimChanges) error {
+
+	lower := strings.ToLower(path)
+	if rt.name == "Group" && strings.HasPrefix(lower, "members") {
+		// members[value eq "id"]
+		if i := strings.Index(path, "["); i >= 0 && strings.HasSuffix(path, "]") && op == "remove" {
+			fields := strings.Fields(path[i+1 : len(path)-1])
+			if len(fields) != 3 || !strings.EqualFold(fields[0], "value") || !strings.EqualFold(fields[1], "eq") {
+				return scimError{Status: http.StatusBadRequest, Type: "invalidFilter", Detail: "unsupported filter " + path}
+			}
+			return h.collectMembers("remove", []string{strings.Trim(fields[2], `"`)}, ch)
+		}
+		if lower != "members" {
+			return scimError{Status: http.StatusBadRequest, Type: "invalidPath", Detail: "unsupported path " + path}
+		}
+		if op == "remove" && value == nil {
+			return h.collectMembers("replace", nil, ch)
+		}
+		return h.collectMembers(op, scimStrings(value), ch)
+	}
+
+	// emails[type eq "work"].value and the like address the only value there is
+	if i := strings.Index(path, "["); i >= 0 {
+		if j := strings.Index(path[i:], "]"); j >= 0 {
+			path = path[:i] + path[i+j+1:]
+		}
+	}
+	if op == "remove" {
+		value = nil
+	}
+
+	name, ok := rt.attribute(path)
+	if !ok {
+		if _, isMap := value.(map[string]interface{}); isMap || (op != "remove" && (lower == "active" || lower == "password")) {
+			return h.collect(rt, map[string]interface{}{path: value}, op, ch)
+		}
+		// removing a complex attribute removes its sub-attributes
+		found := false
+		for k, v := range rt.mapping {
+			k = strings.ToLower(k)
+			if strings.HasPrefix(k, lower+".") || strings.HasPrefix(k, lower+":") {
+				ch.set(v, nil)
+				found = true
+			}
+		}
+		if !found {
+			return scimError{Status: http.StatusBadRequest, Type: "invalidPath", Detail: "unknown attribute " + path}
+		}
+		return nil
+	}
+
+	ch.set(name, scimStrings(value))
+	return nil
+}
+
+// collectMembers adds, removes or replaces members by id.
+func (h *SCIMHandler) collectMembers(op string, ids []string, ch *scimChanges) error {
+	dns, err := h.memberDNs(ids)
+	if err != nil {
+		return err
+	}
+	ch.member(op, dns)
+	return nil
+}
+
+// memberDNs returns the distinguished names of the objects with the ids. Ids that are
+// given more than once are looked up once.
+func (h *SCIMHandler) memberDNs(ids []string) (dns []string, err error) {
+
+	guids := make([]uuid.UUID, 0, len(ids))
+	seen := make(map[uuid.UUID]bool, len(ids))
+	for _, id := range ids {
+		guid, err := uuid.Parse(id)
+		if err != nil {
+			return dns, scimError{Status: http.StatusBadRequest, Type: "invalidValue", Detail: "invalid member id " + id}
+		}
+		if !seen[guid] {
+			seen[guid] = true
+			guids = append(guids, guid)
+		}
+	}
+
+	for len(guids) > 0 {
+		n := memberTypeBatchSize
+		if n > len(guids) {
+			n = len(guids)
+		}
+		batch := guids[:n]
+		guids = guids[n:]
+
+		var filter strings.Builder
+		filter.WriteString("(|")
+		for _, guid := range batch {
+			filter.WriteString("(objectGUID=")
+			filter.WriteString(escapeFilterBytes(guidToBytes(guid)))
+			filter.WriteString(")")
+		}
+		filter.WriteString(")")
+
+		found, err := h.Connection.FindObjects(Search{Filter: filter.String()})
+		if err != nil {
+			return dns, err
+		}
+		if len(found) < len(batch) {
+			return dns, scimError{Status: http.StatusBadRequest, Type: "invalidValue", Detail: "unknown member id"}
+		}
+		for _, obj := range found {
+			dns = append(dns, obj.DistinguishedName)
+		}
+	}
+	return dns, nil
+}
+
+// apply writes the collected changes to obj.
+func (h *SCIMHandler) apply(obj *Object, ch scimChanges) error {
+
+	err := obj.modify(ch.modification(obj.Attributes))
+	if err != nil {
+		return err
+	}
+	if ch.password == nil && ch.active == nil {
+		return nil
+	}
+
+	u, err := h.Connection.GetUser(obj.ObjectGuid.String())
+	if err != nil {
+		return err
+	}
+	if ch.password != nil {
+		u.AccountPassword = *ch.password
+		err = u.SetPassword()
+		u.AccountPassword = ""
+		if err != nil {
+			return err
+		}
+	}
+	if ch.active != nil && *ch.active == u.UserAccountControl.Disabled() {
+		return u.SetUserAccountControl(u.UserAccountControl.Toggle(UACAccountDisable, !*ch.active))
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package ad
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// scimFilter translates a SCIM filter (RFC 7644 section 3.4.2.2) into an LDAP filter.
+type scimFilter struct {
+	tokens []string
+	pos    int
+	// attribute returns the LDAP attribute for a SCIM attribute path.
+	attribute func(path string) (string, error)
+}
+
+// translateSCIMFilter returns the LDAP filter for a SCIM filter.
+func translateSCIMFilter(filter string, attribute func(string) (string, error)) (string, error) {
+	tokens, err := scimTokens(filter)
+	if err != nil {
+		return "", err
+	}
+	f := &scimFilter{tokens: tokens, attribute: attribute}
+	ldap, err := f.or("")
+	if err != nil {
+		return "", err
+	}
+	if f.pos < len(f.tokens) {
+		return "", scimInvalidFilter("unexpected " + f.tokens[f.pos])
+	}
+	return ldap, nil
+}
+
+func scimInvalidFilter(detail string) error {
+	return scimError{Status: 400, Type: "invalidFilter", Detail: detail}
+}
+
+// scimTokens splits a filter into parentheses, brackets, JSON strings and words.
+func scimTokens(s string) (tokens []string, err error) {
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case strings.IndexByte("()[]", c) >= 0:
+			tokens = append(tokens, s[i:i+1])
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, scimInvalidFilter("unterminated string")
+			}
+			tokens = append(tokens, s[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for j < len(s) && strings.IndexByte(" \t()[]\"", s[j]) < 0 {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+func (f *scimFilter) peek() string {
+	if f.pos < len(f.tokens) {
+		return f.tokens[f.pos]
+	}
+	return ""
+}
+
+func (f *scimFilter) next() string {
+	t := f.peek()
+	f.pos++
+	return t
+}
+
+func (f *scimFilter) expect(t string) error {
+	if f.next() != t {
+		return scimInvalidFilter("expected " + t)
+	}
+	return nil
+}
+
+// or parses a filter. prefix is the attribute of an enclosing value path, like emails in
+// emails[type eq "work"].
+func (f *scimFilter) or(prefix string) (string, error) {
+	left, err := f.and(prefix)
+	if err != nil {
+		return "", err
+	}
+	for strings.EqualFold(f.peek(), "or") {
+		f.next()
+		right, err := f.and(prefix)
+		if err != nil {
+			return "", err
+		}
+		left = "(|" + left + right + ")"
+	}
+	return left, nil
+}
+
+func (f *scimFilter) and(prefix string) (string, error) {
+	left, err := f.not(prefix)
+	if err != nil {
+		return "", err
+	}
+	for strings.EqualFold(f.peek(), "and") {
+		f.next()
+		right, err := f.not(prefix)
+		if err != nil {
+			return "", err
+		}
+		left = "(&" + left + right + ")"
+	}
+	return left, nil
+}
+
+func (f *scimFilter) not(prefix string) (string, error) {
+	if !strings.EqualFold(f.peek(), "not") {
+		return f.primary(prefix)
+	}
+	f.next()
+	if err := f.expect("("); err != nil {
+		return "", err
+	}
+	inner, err := f.or(prefix)
+	if err != nil {
+		return "", err
+	}
+	if err := f.expect(")"); err != nil {
+		return "", err
+	}
+	return "(!" + inner + ")", nil
+}
+
+func (f *scimFilter) primary(prefix string) (string, error) {
+	if f.peek() == "(" {
+		f.next()
+		inner, err := f.or(prefix)
+		if err != nil {
+			return "", err
+		}
+		return inner, f.expect(")")
+	}
+
+	path := f.next()
+	if path == "" {
+		return "", scimInvalidFilter("unexpected end of filter")
+	}
+	if prefix != "" {
+		path = prefix + "." + path
+	}
+
+	// value path, e.g. emails[type eq "work" and value co "@example.com"]
+	if f.peek() == "[" {
+		f.next()
+		inner, err := f.or(path)
+		if err != nil {
+			return "", err
+		}
+		return inner, f.expect("]")
+	}
+
+	op := strings.ToLower(f.next())
+	if op == "pr" {
+		return f.compare(path, op, nil)
+	}
+	raw := f.next()
+	var value interface{}
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		return "", scimInvalidFilter("invalid value " + raw)
+	}
+	return f.compare(path, op, value)
+}
+
+// scimMatchAll is an LDAP filter that is always true, for sub-attributes like type and primary
+// that have no equivalent in the directory.
+const scimMatchAll = "(objectClass=*)"
+
+// compare translates a single attribute comparison.
+func (f *scimFilter) compare(path, op string, value interface{}) (string, error) {
+
+	lower := strings.ToLower(path)
+	for _, sub := range []string{".type", ".primary", ".display"} {
+		if strings.HasSuffix(lower, sub) {
+			return scimMatchAll, nil
+		}
+	}
+
+	switch lower {
+	case "id":
+		s, _ := value.(string)
+		id, err := uuid.Parse(s)
+		if err != nil || (op != "eq" && op != "ne") {
+			return "", scimInvalidFilter("id can only be compared with eq and ne to a valid id")
+		}
+		ldap := "(objectGUID=" + escapeFilterBytes(guidToBytes(id)) + ")"
+		if op == "ne" {
+			ldap = "(!" + ldap + ")"
+		}
+		return ldap, nil
+
+	case "active":
+		b, ok := value.(bool)
+		if !ok || (op != "eq" && op != "ne") {
+			return "", scimInvalidFilter("active can only be compared with eq and ne to true or false")
+		}
+		disabled := "(userAccountControl:1.2.840.113556.1.4.803:=2)"
+		if b == (op == "eq") {
+			return "(!" + disabled + ")", nil
+		}
+		return disabled, nil
+	}
+
+	attr, err := f.attribute(path)
+	if err != nil {
+		return "", err
+	}
+
+	var v string
+	switch x := value.(type) {
+	case nil:
+		if op == "pr" {
+			return "(" + attr + "=*)", nil
+		}
+		if op == "eq" {
+			return "(!(" + attr + "=*))", nil
+		}
+		if op == "ne" {
+			return "(" + attr + "=*)", nil
+		}
+		return "", scimInvalidFilter(op + " can not compare to null")
+	case bool:
+		v = "FALSE"
+		if x {
+			v = "TRUE"
+		}
+	case float64:
+		v = strconv.FormatFloat(x, 'f', -1, 64)
+	case string:
+		v = escapeFilterValue(x)
+		if lower == "meta.created" || lower == "meta.lastmodified" {
+			t, err := time.Parse(time.RFC3339, x)
+			if err != nil {
+				return "", scimInvalidFilter("invalid date " + x)
+			}
+			v = FormatGeneralizedTime(t)
+		}
+	default:
+		return "", scimInvalidFilter("invalid value")
+	}
+
+	switch op {
+	case "eq":
+		return "(" + attr + "=" + v + ")", nil
+	case "ne":
+		return "(!(" + attr + "=" + v + "))", nil
+	case "co":
+		return "(" + attr + "=*" + v + "*)", nil
+	case "sw":
+		return "(" + attr + "=" + v + "*)", nil
+	case "ew":
+		return "(" + attr + "=*" + v + ")", nil
+	case "gt":
+		return "(&(" + attr + ">=" + v + ")(!(" + attr + "=" + v + ")))", nil
+	case "ge":
+		return "(" + attr + ">=" + v + ")", nil
+	case "lt":
+		return "(&(" + attr + "<=" + v + ")(!(" + attr + "=" + v + ")))", nil
+	case "le":
+		return "(" + attr + "<=" + v + ")", nil
+	}
+	return "", scimInvalidFilter("unknown operator " + op)
+}
+
+// escapeFilterBytes escapes every byte of a binary value for an LDAP filter.
+func escapeFilterBytes(b []byte) string {
+	var s strings.Builder
+	for _, c := range b {
+		s.WriteString("\\")
+		s.WriteString(hex.EncodeToString([]byte{c}))
+	}
+	return s.String()
+}
@@ -0,0 +1,207 @@
+package ad
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	scimSchemaSchema       = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+	scimResourceTypeSchema = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+)
+
+// scimEndpoints are the resource endpoints in the order they are listed.
+var scimEndpoints = []string{"Users", "Groups"}
+
+// discovery serves the /Schemas and /ResourceTypes endpoints (RFC 7644 section 4). Both are
+// derived from the mappings, so they describe the attributes the handler actually serves.
+func (h *SCIMHandler) discovery(w http.ResponseWriter, r *http.Request, parts []string) error {
+
+	if r.Method != http.MethodGet {
+		return scimError{Status: http.StatusMethodNotAllowed, Detail: r.Method + " is not supported on " + r.URL.Path}
+	}
+
+	var resources []map[string]interface{}
+	for _, endpoint := range scimEndpoints {
+		rt, _ := h.resourceType(endpoint)
+		if parts[0] == "ResourceTypes" {
+			resources = append(resources, h.scimResourceTypeResource(rt))
+		} else {
+			resources = append(resources, h.scimSchemaResources(rt)...)
+		}
+	}
+
+	if len(parts) == 2 {
+		for _, res := range resources {
+			if res["id"] == parts[1] {
+				writeSCIM(w, http.StatusOK, res)
+				return nil
+			}
+		}
+		return scimError{Status: http.StatusNotFound, Detail: parts[0] + " " + parts[1] + " not found"}
+	}
+
+	list := make([]interface{}, len(resources))
+	for i, res := range resources {
+		list[i] = res
+	}
+	writeSCIM(w, http.StatusOK, map[string]interface{}{
+		"schemas":      []string{scimListResponse},
+		"totalResults": len(list),
+		"startIndex":   1,
+		"itemsPerPage": len(list),
+		"Resources":    list,
+	})
+	return nil
+}
+
+// extensions returns the extension schemas the mapping has attributes of.
+func (rt scimResourceType) extensions() []string {
+	var list []string
+	for path := range rt.mapping {
+		if i := strings.LastIndex(path, ":"); i >= 0 && !containsFold(list, path[:i]) {
+			list = append(list, path[:i])
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (h *SCIMHandler) scimResourceTypeResource(rt scimResourceType) map[string]interface{} {
+	extensions := make([]interface{}, 0)
+	for _, ext := range rt.extensions() {
+		extensions = append(extensions, map[string]interface{}{"schema": ext, "required": false})
+	}
+	return map[string]interface{}{
+		"schemas":          []string{scimResourceTypeSchema},
+		"id":               rt.name,
+		"name":             rt.name,
+		"endpoint":         "/" + rt.endpoint,
+		"schema":           rt.schema,
+		"schemaExtensions": extensions,
+		"meta": map[string]interface{}{
+			"resourceType": "ResourceType",
+			"location":     h.BaseURL + "/ResourceTypes/" + rt.name,
+		},
+	}
+}
+
+// scimSchemaResources returns the core schema of a resource type and its extension schemas.
+func (h *SCIMHandler) scimSchemaResources(rt scimResourceType) []map[string]interface{} {
+
+	// the mapped paths by schema, without the schema
+	paths := map[string][]string{rt.schema: nil}
+	for path := range rt.mapping {
+		schema := rt.schema
+		if i := strings.LastIndex(path, ":"); i >= 0 {
+			schema, path = path[:i], path[i+1:]
+		}
+		paths[schema] = append(paths[schema], path)
+	}
+
+	naming := "userName"
+	if rt.name == "Group" {
+		naming = "displayName"
+	}
+
+	schemas := append([]string{rt.schema}, rt.extensions()...)
+	list := make([]map[string]interface{}, 0, len(schemas))
+	for _, schema := range schemas {
+		var attrs []map[string]interface{}
+		complexAttrs := make(map[string]map[string]interface{})
+		for _, path := range paths[schema] {
+			name, sub := path, ""
+			if i := strings.Index(path, "."); i >= 0 {
+				name, sub = path[:i], path[i+1:]
+			}
+			if sub == "" {
+				a := scimAttributeDefinition(name, "string", scimMultiValued[strings.ToLower(name)])
+				if schema == rt.schema && name == naming {
+					a["required"] = true
+					a["uniqueness"] = "server"
+				}
+				attrs = append(attrs, a)
+				continue
+			}
+			parent, ok := complexAttrs[name]
+			if !ok {
+				parent = scimAttributeDefinition(name, "complex", false)
+				parent["subAttributes"] = []map[string]interface{}{}
+				complexAttrs[name] = parent
+				attrs = append(attrs, parent)
+			}
+			parent["subAttributes"] = append(parent["subAttributes"].([]map[string]interface{}), scimAttributeDefinition(sub, "string", false))
+		}
+
+		name := rt.name
+		if schema != rt.schema {
+			name = schema[strings.LastIndex(schema, ":")+1:]
+			if schema == SCIMEnterpriseUserSchema {
+				name = "EnterpriseUser"
+			}
+		} else if rt.name == "User" {
+			active := scimAttributeDefinition("active", "boolean", false)
+			password := scimAttributeDefinition("password", "string", false)
+			password["mutability"] = "writeOnly"
+			password["returned"] = "never"
+			attrs = append(attrs, active, password)
+		} else {
+			members := scimAttributeDefinition("members", "complex", true)
+			value := scimAttributeDefinition("value", "string", false)
+			value["mutability"] = "immutable"
+			ref := scimAttributeDefinition("$ref", "reference", false)
+			ref["mutability"] = "immutable"
+			ref["referenceTypes"] = []string{"User", "Group"}
+			display := scimAttributeDefinition("display", "string", false)
+			display["mutability"] = "readOnly"
+			kind := scimAttributeDefinition("type", "string", false)
+			kind["mutability"] = "readOnly"
+			kind["canonicalValues"] = []string{"User", "Group"}
+			members["subAttributes"] = []map[string]interface{}{value, ref, display, kind}
+			attrs = append(attrs, members)
+		}
+
+		sort.Slice(attrs, func(i, j int) bool { return attrs[i]["name"].(string) < attrs[j]["name"].(string) })
+		for _, a := range attrs {
+			if subs, ok := a["subAttributes"].([]map[string]interface{}); ok && a["name"] != "members" {
+				sort.Slice(subs, func(i, j int) bool { return subs[i]["name"].(string) < subs[j]["name"].(string) })
+			}
+		}
+
+		list = append(list, map[string]interface{}{
+			"schemas":    []string{scimSchemaSchema},
+			"id":         schema,
+			"name":       name,
+			"attributes": attrs,
+			"meta": map[string]interface{}{
+				"resourceType": "Schema",
+				"location":     h.BaseURL + "/Schemas/" + schema,
+			},
+		})
+	}
+	return list
+}
+
+// scimAttributeDefinition returns the definition of an attribute in a schema. Multi-valued
+// attributes are rendered as a list of values with a primary flag.
+func scimAttributeDefinition(name, kind string, multiValued bool) map[string]interface{} {
+	a := map[string]interface{}{
+		"name":        name,
+		"type":        kind,
+		"multiValued": multiValued,
+		"required":    false,
+		"caseExact":   false,
+		"mutability":  "readWrite",
+		"returned":    "default",
+		"uniqueness":  "none",
+	}
+	if multiValued && kind == "string" {
+		a["type"] = "complex"
+		a["subAttributes"] = []map[string]interface{}{
+			scimAttributeDefinition("value", "string", false),
+			scimAttributeDefinition("primary", "boolean", false),
+		}
+	}
+	return a
+}
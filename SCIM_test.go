@@ -0,0 +1,345 @@
+package ad
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jakobii/ps"
+)
+
+func TestSCIMChangesMerge(t *testing.T) {
+
+	a, b, c := "CN=a,DC=example,DC=com", "CN=b,DC=example,DC=com", "CN=c,DC=example,DC=com"
+	current := Attributes{}
+	current.Set("member", NewStringAttribute(c))
+
+	tests := []struct {
+		name    string
+		changes func(ch *scimChanges)
+		want    modification
+	}{
+		{
+			name: "two adds",
+			changes: func(ch *scimChanges) {
+				ch.member("add", []string{a})
+				ch.member("add", []string{b, "cn=A,DC=example,DC=com"})
+			},
+			want: modification{adds: []string{ps.QuoteString("member") + "=" + NewStringAttribute(a, b).psExpr()}},
+		},
+		{
+			name: "add then remove",
+			changes: func(ch *scimChanges) {
+				ch.member("add", []string{a, b})
+				ch.member("remove", []string{a, c})
+			},
+			want: modification{
+				removes: []string{ps.QuoteString("member") + "=" + NewStringAttribute(c).psExpr()},
+				adds:    []string{ps.QuoteString("member") + "=" + NewStringAttribute(b).psExpr()},
+			},
+		},
+		{
+			name: "existing members",
+			changes: func(ch *scimChanges) {
+				ch.member("add", []string{c})
+				ch.member("remove", []string{a})
+			},
+		},
+		{
+			name: "replace then add",
+			changes: func(ch *scimChanges) {
+				ch.member("replace", []string{a})
+				ch.member("add", []string{b})
+				ch.member("remove", []string{a})
+			},
+			want: modification{replaces: []string{ps.QuoteString("member") + "=" + NewStringAttribute(b).psExpr()}},
+		},
+		{
+			name: "clear then set",
+			changes: func(ch *scimChanges) {
+				ch.set("givenName", nil)
+				ch.set("sn", nil)
+				ch.set("givenName", []string{"Jane"})
+			},
+			want: modification{
+				replaces: []string{ps.QuoteString("givenName") + "=" + NewStringAttribute("Jane").psExpr()},
+				clears:   []string{ps.QuoteString("sn")},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		ch := newSCIMChanges()
+		test.changes(&ch)
+		if got := ch.modification(current); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+const scimTestGUID = "6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c01"
+
+// scimTestUser answers the searches of the SCIM handler with a single user.
+func scimTestUser(script string) ([]byte, error) {
+	if !strings.Contains(script, "Get-ADObject") {
+		return nil, nil
+	}
+	return []byte(`{"ObjectGuid":"` + scimTestGUID + `","ObjectClass":"user","DistinguishedName":"CN=jdoe,DC=example,DC=com","Name":"jdoe","Attributes":[` +
+		`{"Name":"sAMAccountName","Values":["jdoe"]},{"Name":"givenName","Values":["Jane"]},{"Name":"sn","Values":["Doe"]},{"Name":"userAccountControl","Values":["512"]}]}`), nil
+}
+
+func TestSCIMPatchSequential(t *testing.T) {
+
+	scripts := recordPowershell(t, scimTestUser)
+	c := NewConnection("dc1", "svc", "secret")
+	h := &SCIMHandler{Connection: &c}
+
+	body := `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[
+		{"op":"remove","path":"name"},
+		{"op":"add","path":"name.givenName","value":"Janet"},
+		{"op":"replace","path":"title","value":"Engineer"},
+		{"op":"replace","path":"title","value":"Manager"}]}`
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPatch, "/Users/"+scimTestGUID, strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PATCH = %d %s", rec.Code, rec.Body)
+	}
+
+	var modify []string
+	for _, s := range *scripts {
+		if strings.HasPrefix(s, "Set-ADObject") {
+			modify = append(modify, s)
+		}
+	}
+	if len(modify) != 1 {
+		t.Fatalf("modifications = %v", modify)
+	}
+	want := " -Replace @{" + ps.QuoteString("givenName") + "=" + NewStringAttribute("Janet").psExpr() + "; " +
+		ps.QuoteString("title") + "=" + NewStringAttribute("Manager").psExpr() + "} -Clear @(" + ps.QuoteString("sn") + ")"
+	if !strings.Contains(modify[0], want) {
+		t.Errorf("modification = %s, want %s", modify[0], want)
+	}
+}
+
+func TestSCIMCreate(t *testing.T) {
+
+	created := false
+	scripts := recordPowershell(t, func(script string) ([]byte, error) {
+		switch {
+		case strings.HasPrefix(script, "New-ADUser"):
+			created = true
+		case strings.HasPrefix(script, "Set-ADObject"):
+			return nil, errors.New("constraint violation")
+		case strings.Contains(script, "Get-ADObject") && created:
+			return scimTestUser(script)
+		}
+		return nil, nil
+	})
+	c := NewConnection("dc1", "svc", "secret")
+	h := &SCIMHandler{Connection: &c}
+
+	body := `{"schemas":["urn:ietf:params:scim:schemas:core:2.0:User"],"userName":"jdoe@example.com","title":"Engineer"}`
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/Users", strings.NewReader(body)))
+	if rec.Code == http.StatusCreated {
+		t.Fatalf("POST = %d, although the attributes could not be set", rec.Code)
+	}
+
+	var create, modify, remove string
+	for _, s := range *scripts {
+		switch {
+		case strings.HasPrefix(s, "New-ADUser"):
+			create = s
+		case strings.HasPrefix(s, "Set-ADObject"):
+			modify = s
+		case strings.HasPrefix(s, "Remove-ADObject"):
+			remove = s
+		}
+	}
+	if !strings.Contains(create, " -SamAccountName "+ps.QuoteString("jdoe")) {
+		t.Errorf("created %s", create)
+	}
+	for _, want := range []string{
+		ps.QuoteString("sAMAccountName") + "=" + NewStringAttribute("jdoe").psExpr(),
+		ps.QuoteString("userPrincipalName") + "=" + NewStringAttribute("jdoe@example.com").psExpr(),
+	} {
+		if !strings.Contains(modify, want) {
+			t.Errorf("modification does not contain %s:\n%s", want, modify)
+		}
+	}
+	if !strings.Contains(remove, ps.QuoteString(scimTestGUID)) {
+		t.Errorf("the new user was not removed again: %q", remove)
+	}
+}
+
+func TestSCIMMemberDNsDuplicates(t *testing.T) {
+
+	scripts := recordPowershell(t, scimTestUser)
+	c := NewConnection("dc1", "svc", "secret")
+	h := &SCIMHandler{Connection: &c}
+
+	dns, err := h.memberDNs([]string{scimTestGUID, strings.ToUpper(scimTestGUID), scimTestGUID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dns) != 1 || dns[0] != "CN=jdoe,DC=example,DC=com" {
+		t.Errorf("memberDNs = %v", dns)
+	}
+	if len(*scripts) != 1 || strings.Count((*scripts)[0], "(objectGUID=") != 1 {
+		t.Errorf("scripts = %v", *scripts)
+	}
+}
+
+func TestSCIMVersion(t *testing.T) {
+
+	recordPowershell(t, func(script string) ([]byte, error) { return []byte("[]"), nil })
+	c := NewConnection("dc1", "svc", "secret")
+	h := &SCIMHandler{Connection: &c}
+	rt, _ := h.resourceType("Groups")
+
+	group := Object{ObjectClass: "group", DistinguishedName: "CN=staff,DC=example,DC=com", Attributes: Attributes{}}
+	group.Attributes.Set("sAMAccountName", NewStringAttribute("staff"))
+	group.Attributes.Set("member", NewStringAttribute("CN=b,DC=example,DC=com", "CN=a,DC=example,DC=com"))
+	version := func(obj Object, members bool) string {
+		res, err := h.render(rt, obj, members)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res["meta"].(map[string]interface{})["version"].(string)
+	}
+
+	v := version(group, true)
+	if version(group, false) != v {
+		t.Error("the version depends on excludedAttributes=members")
+	}
+	group.Attributes.Set("member", NewStringAttribute("cn=A,DC=example,DC=com", "CN=b,DC=example,DC=com"))
+	if version(group, false) != v {
+		t.Error("the version depends on the order of members")
+	}
+	group.Attributes.Set("member", NewStringAttribute("CN=a,DC=example,DC=com"))
+	if version(group, false) == v {
+		t.Error("the version does not change with the members")
+	}
+}
+
+func TestSCIMDiscovery(t *testing.T) {
+
+	c := NewConnection("dc1", "svc", "secret")
+	h := &SCIMHandler{Connection: &c, BaseURL: "https://idp.example.com/scim"}
+	get := func(path string) (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var body map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body
+	}
+
+	code, body := get("/ResourceTypes")
+	if code != http.StatusOK || body["totalResults"] != float64(2) {
+		t.Fatalf("ResourceTypes = %d %v", code, body)
+	}
+	code, body = get("/ResourceTypes/User")
+	if code != http.StatusOK || body["endpoint"] != "/Users" || body["schema"] != SCIMUserSchema {
+		t.Errorf("ResourceTypes/User = %d %v", code, body)
+	}
+	if ext, _ := body["schemaExtensions"].([]interface{}); len(ext) != 1 || ext[0].(map[string]interface{})["schema"] != SCIMEnterpriseUserSchema {
+		t.Errorf("schemaExtensions = %v", body["schemaExtensions"])
+	}
+
+	code, body = get("/Schemas")
+	if code != http.StatusOK || body["totalResults"] != float64(3) {
+		t.Fatalf("Schemas = %d %v", code, body)
+	}
+	code, body = get("/Schemas/" + SCIMUserSchema)
+	if code != http.StatusOK || body["id"] != SCIMUserSchema {
+		t.Fatalf("Schemas/User = %d %v", code, body)
+	}
+	attrs := make(map[string]map[string]interface{})
+	for _, a := range body["attributes"].([]interface{}) {
+		m := a.(map[string]interface{})
+		attrs[m["name"].(string)] = m
+	}
+	for _, name := range []string{"userName", "externalId", "name", "emails", "active", "password"} {
+		if attrs[name] == nil {
+			t.Errorf("attribute %s is missing", name)
+		}
+	}
+	if attrs["userName"]["required"] != true || attrs["password"]["returned"] != "never" || attrs["emails"]["multiValued"] != true {
+		t.Errorf("attributes = %v", attrs)
+	}
+	if subs, _ := attrs["name"]["subAttributes"].([]interface{}); len(subs) != 2 {
+		t.Errorf("name.subAttributes = %v", attrs["name"]["subAttributes"])
+	}
+
+	if code, _ := get("/Schemas/urn:example:nope"); code != http.StatusNotFound {
+		t.Errorf("unknown schema = %d", code)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/Schemas", strings.NewReader("{}")))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /Schemas = %d", rec.Code)
+	}
+}
+
+func TestTranslateSCIMFilter(t *testing.T) {
+
+	rt, _ := (&SCIMHandler{}).resourceType("Users")
+	attribute := func(path string) (string, error) {
+		if name, ok := rt.attribute(path); ok {
+			return name, nil
+		}
+		return "", scimInvalidFilter("unknown attribute " + path)
+	}
+
+	tests := []struct {
+		in      string
+		want    string
+		invalid bool
+	}{
+		{in: `userName eq "jdoe"`, want: "(sAMAccountName=jdoe)"},
+		{in: `USERNAME Eq "jdoe"`, want: "(sAMAccountName=jdoe)"},
+		{in: `userName eq "a*(b)"`, want: `(sAMAccountName=a\2a\28b\29)`},
+		{in: `name.givenName sw "J" and name.familyName ew "oe"`, want: "(&(givenName=J*)(sn=*oe))"},
+		{in: `title co "eng" or title pr`, want: "(|(title=*eng*)(title=*))"},
+		{in: `not (title pr)`, want: "(!(title=*))"},
+		{in: `title ne "x"`, want: "(!(title=x))"},
+		{in: `title eq null`, want: "(!(title=*))"},
+		{in: `a eq "1" or title eq "2" and title eq "3"`, invalid: true},
+		{in: `title eq "1" or (title eq "2" and title eq "3")`, want: "(|(title=1)(&(title=2)(title=3)))"},
+		{in: `emails[type eq "work" and value co "@example.com"]`, want: "(&(objectClass=*)(mail=*@example.com*))"},
+		{in: `emails.value eq "jane@example.com"`, want: "(mail=jane@example.com)"},
+		{in: `active eq true`, want: "(!(userAccountControl:1.2.840.113556.1.4.803:=2))"},
+		{in: `active ne true`, want: "(userAccountControl:1.2.840.113556.1.4.803:=2)"},
+		{in: `id eq "6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c01"`, want: `(objectGUID=\e4\c1\1e\6f\8b\5a\8e\4a\9d\3e\1c\1e\9d\6a\0c\01)`},
+		{in: `meta.lastModified gt "2020-01-01T00:00:00Z"`, want: "(&(whenChanged>=20200101000000.0Z)(!(whenChanged=20200101000000.0Z)))"},
+		{in: SCIMEnterpriseUserSchema + `:department eq "IT"`, want: "(department=IT)"},
+		{in: `externalId le 10`, want: "(employeeID<=10)"},
+		{in: `userName eq`, invalid: true},
+		{in: `userName eq "jdoe`, invalid: true},
+		{in: `userName regex "j"`, invalid: true},
+		{in: `nickName eq "j"`, invalid: true},
+		{in: `(userName eq "jdoe"`, invalid: true},
+		{in: `userName eq "jdoe")`, invalid: true},
+		{in: `active eq "yes"`, invalid: true},
+		{in: `id co "6f1e"`, invalid: true},
+		{in: `title gt null`, invalid: true},
+		{in: `meta.created gt "yesterday"`, invalid: true},
+	}
+
+	for _, test := range tests {
+		got, err := translateSCIMFilter(test.in, attribute)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("translateSCIMFilter(%q) = %s, want error", test.in, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("translateSCIMFilter(%q) = %s, %v, want %s", test.in, got, err, test.want)
+		}
+	}
+}
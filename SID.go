@@ -0,0 +1,405 @@
+package ad
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jakobii/ps"
+)
+
+// SID is a Windows security identifier as stored in objectSid and sIDHistory.
+// The sub authorities are held in an array, so SIDs can be compared with == and used
+// as map keys.
+type SID struct {
+	Revision  byte
+	Authority uint64
+	count     byte
+	sub       [15]uint32
+}
+
+// SubAuthorities returns the sub authorities of the SID, the last one being the RID.
+func (s SID) SubAuthorities() []uint32 {
+	return append([]uint32(nil), s.sub[:s.count]...)
+}
+
+// appendSub adds a sub authority.
+func (s *SID) appendSub(v uint32) {
+	s.sub[s.count] = v
+	s.count++
+}
+
+// ParseSID parses the string form of a security identifier, e.g. "S-1-5-21-1-2-3-500".
+func ParseSID(s string) (sid SID, err error) {
+
+	pieces := strings.Split(strings.TrimSpace(s), "-")
+	if len(pieces) < 3 || !strings.EqualFold(pieces[0], "S") {
+		return sid, fmt.Errorf("invalid SID %q", s)
+	}
+
+	rev, err := strconv.ParseUint(pieces[1], 10, 8)
+	if err != nil {
+		return sid, fmt.Errorf("invalid SID revision %q", s)
+	}
+	sid.Revision = byte(rev)
+
+	// the authority is written in hex when it does not fit in 32 bits
+	if strings.HasPrefix(pieces[2], "0x") || strings.HasPrefix(pieces[2], "0X") {
+		sid.Authority, err = strconv.ParseUint(pieces[2][2:], 16, 48)
+	} else {
+		sid.Authority, err = strconv.ParseUint(pieces[2], 10, 48)
+	}
+	if err != nil {
+		return sid, fmt.Errorf("invalid SID authority %q", s)
+	}
+
+	if len(pieces)-3 > 15 {
+		return sid, fmt.Errorf("too many sub authorities in SID %q", s)
+	}
+	for _, v := range pieces[3:] {
+		sub, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return sid, fmt.Errorf("invalid SID sub authority %q", s)
+		}
+		sid.appendSub(uint32(sub))
+	}
+
+	return sid, nil
+}
+
+// SIDFromBytes decodes the binary form of a security identifier.
+func SIDFromBytes(b []byte) (sid SID, err error) {
+
+	if len(b) < 8 {
+		return sid, errors.New("SID is too short")
+	}
+
+	count := int(b[1])
+	if count > 15 {
+		return sid, errors.New("too many sub authorities in SID")
+	}
+	if len(b) != 8+4*count {
+		return sid, errors.New("SID length does not match sub authority count")
+	}
+
+	sid.Revision = b[0]
+
+	// the authority is a 48 bit big endian number
+	for _, v := range b[2:8] {
+		sid.Authority = sid.Authority<<8 | uint64(v)
+	}
+
+	// sub authorities are little endian
+	for i := 0; i < count; i++ {
+		sid.appendSub(binary.LittleEndian.Uint32(b[8+4*i:]))
+	}
+
+	return sid, nil
+}
+
+// IsZero returns true if the SID has not been set.
+func (s SID) IsZero() bool {
+	return s == SID{}
+}
+
+// String returns the SDDL string form of the SID.
+func (s SID) String() string {
+
+	if s.IsZero() {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString("S-")
+	b.WriteString(strconv.FormatUint(uint64(s.Revision), 10))
+	b.WriteString("-")
+	if s.Authority >= 1<<32 {
+		b.WriteString("0x")
+		b.WriteString(strings.ToUpper(strconv.FormatUint(s.Authority, 16)))
+	} else {
+		b.WriteString(strconv.FormatUint(s.Authority, 10))
+	}
+	for _, v := range s.sub[:s.count] {
+		b.WriteString("-")
+		b.WriteString(strconv.FormatUint(uint64(v), 10))
+	}
+	return b.String()
+}
+
+// Bytes returns the binary form of the SID.
+func (s SID) Bytes() []byte {
+
+	b := make([]byte, 8+4*int(s.count))
+	b[0] = s.Revision
+	b[1] = s.count
+	for i := 0; i < 6; i++ {
+		b[7-i] = byte(s.Authority >> (8 * uint(i)))
+	}
+	for i, v := range s.sub[:s.count] {
+		binary.LittleEndian.PutUint32(b[8+4*i:], v)
+	}
+	return b
+}
+
+// Equal returns true if both SIDs are identical.
+func (s SID) Equal(o SID) bool {
+	return s == o
+}
+
+// RID returns the relative identifier, which is the last sub authority.
+func (s SID) RID() uint32 {
+	if s.count == 0 {
+		return 0
+	}
+	return s.sub[s.count-1]
+}
+
+// IsDomainSID returns true if the SID belongs to an account domain (S-1-5-21-x-y-z-rid).
+func (s SID) IsDomainSID() bool {
+	return s.Authority == 5 && s.count == 5 && s.sub[0] == 21
+}
+
+// Domain returns the domain part of an account SID, which is the SID without its RID.
+func (s SID) Domain() SID {
+	if !s.IsDomainSID() {
+		return SID{}
+	}
+	d := s
+	d.count = 4
+	d.sub[4] = 0
+	return d
+}
+
+// WellKnownName returns the name of a well-known SID, e.g. "Everyone" or "Domain Admins".
+func (s SID) WellKnownName() (string, bool) {
+
+	if name, ok := wellKnownSIDs[s.String()]; ok {
+		return name, true
+	}
+
+	if s.IsDomainSID() {
+		if name, ok := wellKnownRIDs[s.RID()]; ok {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// IsWellKnown returns true if the SID is a well-known SID.
+func (s SID) IsWellKnown() bool {
+	_, ok := s.WellKnownName()
+	return ok
+}
+
+// MarshalJSON encodes the SID in its string form.
+func (s SID) MarshalJSON() ([]byte, error) {
+	if s.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(s.String())
+}
+
+// UnmarshalJSON accepts the string form, a byte array, or a serialized
+// SecurityIdentifier object as produced by ConvertTo-Json.
+func (s *SID) UnmarshalJSON(data []byte) error {
+
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		*s = SID{}
+		return nil
+	}
+
+	switch data[0] {
+	case '"':
+		var str string
+		err := json.Unmarshal(data, &str)
+		if err != nil {
+			return err
+		}
+		if str == "" {
+			*s = SID{}
+			return nil
+		}
+		sid, err := ParseSID(str)
+		if err != nil {
+			return err
+		}
+		*s = sid
+		return nil
+
+	case '[':
+		var raw []int
+		err := json.Unmarshal(data, &raw)
+		if err != nil {
+			return err
+		}
+		b := make([]byte, 0, len(raw))
+		for _, v := range raw {
+			b = append(b, byte(v))
+		}
+		sid, err := SIDFromBytes(b)
+		if err != nil {
+			return err
+		}
+		*s = sid
+		return nil
+
+	case '{':
+		v := struct{ Value string }{}
+		err := json.Unmarshal(data, &v)
+		if err != nil {
+			return err
+		}
+		return s.UnmarshalJSON([]byte(strconv.Quote(v.Value)))
+	}
+
+	return fmt.Errorf("cannot decode SID from %s", data)
+}
+
+// well known SIDs
+const (
+	SIDNull                     = "S-1-0-0"
+	SIDEveryone                 = "S-1-1-0"
+	SIDCreatorOwner             = "S-1-3-0"
+	SIDCreatorGroup             = "S-1-3-1"
+	SIDNetwork                  = "S-1-5-2"
+	SIDBatch                    = "S-1-5-3"
+	SIDInteractive              = "S-1-5-4"
+	SIDService                  = "S-1-5-6"
+	SIDAnonymous                = "S-1-5-7"
+	SIDEnterpriseControllers    = "S-1-5-9"
+	SIDSelf                     = "S-1-5-10"
+	SIDAuthenticatedUsers       = "S-1-5-11"
+	SIDLocalSystem              = "S-1-5-18"
+	SIDLocalService             = "S-1-5-19"
+	SIDNetworkService           = "S-1-5-20"
+	SIDBuiltinAdministrators    = "S-1-5-32-544"
+	SIDBuiltinUsers             = "S-1-5-32-545"
+	SIDBuiltinGuests            = "S-1-5-32-546"
+	SIDAccountOperators         = "S-1-5-32-548"
+	SIDServerOperators          = "S-1-5-32-549"
+	SIDPrintOperators           = "S-1-5-32-550"
+	SIDBackupOperators          = "S-1-5-32-551"
+	SIDRemoteDesktopUsers       = "S-1-5-32-555"
+	SIDPreWindows2000Compatible = "S-1-5-32-554"
+)
+
+var wellKnownSIDs = map[string]string{
+	SIDNull:                     "Null SID",
+	SIDEveryone:                 "Everyone",
+	SIDCreatorOwner:             "Creator Owner",
+	SIDCreatorGroup:             "Creator Group",
+	SIDNetwork:                  "Network",
+	SIDBatch:                    "Batch",
+	SIDInteractive:              "Interactive",
+	SIDService:                  "Service",
+	SIDAnonymous:                "Anonymous Logon",
+	SIDEnterpriseControllers:    "Enterprise Domain Controllers",
+	SIDSelf:                     "Self",
+	SIDAuthenticatedUsers:       "Authenticated Users",
+	SIDLocalSystem:              "Local System",
+	SIDLocalService:             "Local Service",
+	SIDNetworkService:           "Network Service",
+	SIDBuiltinAdministrators:    "Administrators",
+	SIDBuiltinUsers:             "Users",
+	SIDBuiltinGuests:            "Guests",
+	SIDAccountOperators:         "Account Operators",
+	SIDServerOperators:          "Server Operators",
+	SIDPrintOperators:           "Print Operators",
+	SIDBackupOperators:          "Backup Operators",
+	SIDRemoteDesktopUsers:       "Remote Desktop Users",
+	SIDPreWindows2000Compatible: "Pre-Windows 2000 Compatible Access",
+}
+
+// well known relative identifiers of domain accounts
+const (
+	RIDAdministrator           uint32 = 500
+	RIDGuest                   uint32 = 501
+	RIDKrbtgt                  uint32 = 502
+	RIDDomainAdmins            uint32 = 512
+	RIDDomainUsers             uint32 = 513
+	RIDDomainGuests            uint32 = 514
+	RIDDomainComputers         uint32 = 515
+	RIDDomainControllers       uint32 = 516
+	RIDCertPublishers          uint32 = 517
+	RIDSchemaAdmins            uint32 = 518
+	RIDEnterpriseAdmins        uint32 = 519
+	RIDGroupPolicyCreatorOwner uint32 = 520
+	RIDReadOnlyControllers     uint32 = 521
+	RIDProtectedUsers          uint32 = 525
+)
+
+var wellKnownRIDs = map[uint32]string{
+	RIDAdministrator:           "Administrator",
+	RIDGuest:                   "Guest",
+	RIDKrbtgt:                  "krbtgt",
+	RIDDomainAdmins:            "Domain Admins",
+	RIDDomainUsers:             "Domain Users",
+	RIDDomainGuests:            "Domain Guests",
+	RIDDomainComputers:         "Domain Computers",
+	RIDDomainControllers:       "Domain Controllers",
+	RIDCertPublishers:          "Cert Publishers",
+	RIDSchemaAdmins:            "Schema Admins",
+	RIDEnterpriseAdmins:        "Enterprise Admins",
+	RIDGroupPolicyCreatorOwner: "Group Policy Creator Owners",
+	RIDReadOnlyControllers:     "Read-only Domain Controllers",
+	RIDProtectedUsers:          "Protected Users",
+}
+
+// GetObjectBySID finds the object whose objectSid or sIDHistory contains sid.
+// Well-known SIDs from outside the domain resolve to their foreign security principal.
+func (c *Connection) GetObjectBySID(sid SID) (obj Object, err error) {
+
+	if sid.IsZero() {
+		return obj, errors.New("SID can not be blank")
+	}
+
+	filter := "objectSid -eq '" + sid.String() + "' -or sIDHistory -eq '" + sid.String() + "'"
+
+	var cmd bytes.Buffer
+	cmd.WriteString("Get-ADObject -Server ")
+	cmd.WriteString(ps.QuoteString(c.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(c.Credential.Expr())
+	cmd.WriteString(" -Filter ")
+	cmd.WriteString(ps.QuoteString(filter))
+	cmd.WriteString(" -Properties objectSid | Select-Object -First 1 @('ObjectGuid', 'ObjectClass',  'DistinguishedName', 'Name', @{n='ObjectSid';e={$_.objectSid.Value}}) | ConvertTo-Json")
+
+	result, err := powershell(cmd.String())
+	if err != nil {
+		return obj, err
+	}
+	if len(bytes.TrimSpace(result)) == 0 {
+		return obj, fmt.Errorf("no object found with SID %s", sid)
+	}
+
+	err = json.Unmarshal(result, &obj)
+	if err != nil {
+		return obj, err
+	}
+
+	obj.Connection = *c
+
+	return obj, nil
+}
+
+// ResolveSID returns a display name for sid. Well-known SIDs are resolved
+// locally, everything else is looked up in the directory.
+func (c *Connection) ResolveSID(sid SID) (string, error) {
+	if name, ok := sid.WellKnownName(); ok && !sid.IsDomainSID() {
+		return name, nil
+	}
+	obj, err := c.GetObjectBySID(sid)
+	if err != nil {
+		if name, ok := sid.WellKnownName(); ok {
+			return name, nil
+		}
+		return "", err
+	}
+	return obj.Name, nil
+}
@@ -0,0 +1,168 @@
+package ad
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseSID(t *testing.T) {
+
+	tests := []struct {
+		in      string
+		out     string
+		rid     uint32
+		domain  bool
+		invalid bool
+	}{
+		{in: "S-1-1-0", out: "S-1-1-0"},
+		{in: "S-1-5-32-544", out: "S-1-5-32-544", rid: 544},
+		{in: "s-1-5-21-1004336348-1177238915-682003330-512", out: "S-1-5-21-1004336348-1177238915-682003330-512", rid: 512, domain: true},
+		{in: " S-1-5-18 ", out: "S-1-5-18", rid: 18},
+		{in: "S-1-0x10000000000-1", out: "S-1-0x10000000000-1", rid: 1},
+		{in: "S-1", invalid: true},
+		{in: "X-1-5-18", invalid: true},
+		{in: "S-1-5-x", invalid: true},
+		{in: "S-256-5-18", invalid: true},
+		{in: "S-1-5-4294967296", invalid: true},
+		{in: "S-1-5-1-2-3-4-5-6-7-8-9-10-11-12-13-14-15-16", invalid: true},
+	}
+
+	for _, test := range tests {
+		sid, err := ParseSID(test.in)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("ParseSID(%q) = %s, want error", test.in, sid)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSID(%q): %v", test.in, err)
+			continue
+		}
+		if sid.String() != test.out {
+			t.Errorf("ParseSID(%q) = %s, want %s", test.in, sid, test.out)
+		}
+		if sid.RID() != test.rid {
+			t.Errorf("ParseSID(%q).RID() = %d, want %d", test.in, sid.RID(), test.rid)
+		}
+		if sid.IsDomainSID() != test.domain {
+			t.Errorf("ParseSID(%q).IsDomainSID() = %t", test.in, sid.IsDomainSID())
+		}
+
+		// binary round trip
+		back, err := SIDFromBytes(sid.Bytes())
+		if err != nil {
+			t.Errorf("SIDFromBytes(%s): %v", sid, err)
+		} else if back != sid {
+			t.Errorf("SIDFromBytes(%s.Bytes()) = %s", sid, back)
+		}
+	}
+}
+
+func TestSIDFromBytes(t *testing.T) {
+
+	// S-1-5-21-1-2-3-500
+	b := []byte{1, 5, 0, 0, 0, 0, 0, 5, 21, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0, 0xf4, 1, 0, 0}
+	sid, err := SIDFromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sid.String() != "S-1-5-21-1-2-3-500" {
+		t.Errorf("got %s", sid)
+	}
+	if !bytes.Equal(sid.Bytes(), b) {
+		t.Errorf("Bytes() = %v, want %v", sid.Bytes(), b)
+	}
+	if sid.Domain().String() != "S-1-5-21-1-2-3" {
+		t.Errorf("Domain() = %s", sid.Domain())
+	}
+	if name, ok := sid.WellKnownName(); !ok || name != "Administrator" {
+		t.Errorf("WellKnownName() = %q, %t", name, ok)
+	}
+
+	for _, bad := range [][]byte{nil, {1, 5, 0, 0}, b[:len(b)-1], {1, 16, 0, 0, 0, 0, 0, 5}} {
+		if _, err := SIDFromBytes(bad); err == nil {
+			t.Errorf("SIDFromBytes(%v) succeeded", bad)
+		}
+	}
+}
+
+func TestSIDComparable(t *testing.T) {
+	a, _ := ParseSID("S-1-5-21-1-2-3-1104")
+	b, _ := SIDFromBytes(a.Bytes())
+	if a != b || !a.Equal(b) {
+		t.Errorf("%s != %s", a, b)
+	}
+	seen := map[SID]bool{a: true}
+	if !seen[b] {
+		t.Error("SID does not work as a map key")
+	}
+	if (SID{}).String() != "" || !(SID{}).IsZero() || a.IsZero() {
+		t.Error("zero SID")
+	}
+}
+
+func TestSIDJSON(t *testing.T) {
+
+	tests := map[string]string{
+		`"S-1-5-32-544"`: "S-1-5-32-544",
+		`{"BinaryLength":16,"AccountDomainSid":null,"Value":"S-1-5-32-544"}`: "S-1-5-32-544",
+		`[1,2,0,0,0,0,0,5,32,0,0,0,32,2,0,0]`:                                "S-1-5-32-544",
+		`null`:                                                               "",
+		`""`:                                                                 "",
+	}
+	for in, want := range tests {
+		var sid SID
+		if err := json.Unmarshal([]byte(in), &sid); err != nil {
+			t.Errorf("Unmarshal(%s): %v", in, err)
+			continue
+		}
+		if sid.String() != want {
+			t.Errorf("Unmarshal(%s) = %s, want %s", in, sid, want)
+		}
+	}
+
+	b, _ := json.Marshal(struct{ S SID }{})
+	if string(b) != `{"S":null}` {
+		t.Errorf("Marshal zero SID = %s", b)
+	}
+}
+
+func TestObjectIdentity(t *testing.T) {
+	sid, _ := ParseSID("S-1-5-21-1-2-3-1104")
+	const guid = "6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c01"
+	scripts := recordPowershell(t, func(script string) ([]byte, error) {
+		return []byte(`{"ObjectGuid":"` + guid + `","ObjectClass":"user","DistinguishedName":"CN=a,DC=example,DC=com","Name":"a"}`), nil
+	})
+
+	// the *-ADObject cmdlets do not take a SID, so it is resolved to the GUID
+	o := Object{ObjectSid: sid}
+	id, err := o.Identity()
+	if err != nil || id != guid {
+		t.Errorf("Identity() = %q, %v", id, err)
+	}
+	if len(*scripts) != 1 || !strings.Contains((*scripts)[0], sid.String()) {
+		t.Errorf("scripts = %v", *scripts)
+	}
+	if id, _ := o.Identity(); id != guid || len(*scripts) != 1 {
+		t.Errorf("Identity() = %q after %d lookups", id, len(*scripts))
+	}
+
+	o = Object{ObjectSid: sid}
+	o.DistinguishedName = "CN=a,DC=example,DC=com"
+	if id, _ := o.Identity(); id != o.DistinguishedName {
+		t.Errorf("Identity() = %q, want the distinguished name", id)
+	}
+	if _, err := (&Object{}).Identity(); err == nil {
+		t.Error("blank object has an identity")
+	}
+
+	if !(Object{ObjectSid: sid}).Is(Object{ObjectSid: sid}) {
+		t.Error("objects with the same SID are not the same")
+	}
+	if (Object{}).Is(Object{}) {
+		t.Error("blank objects are the same")
+	}
+}
@@ -0,0 +1,334 @@
+package ad
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/jakobii/ps"
+)
+
+// Syntax is the syntax of an attribute, derived from attributeSyntax and oMSyntax.
+type Syntax string
+
+// attribute syntaxes
+const (
+	SyntaxUnknown              Syntax = ""
+	SyntaxDN                   Syntax = "DN"
+	SyntaxOID                  Syntax = "OID"
+	SyntaxCaseExactString      Syntax = "CaseExactString"
+	SyntaxCaseIgnoreString     Syntax = "CaseIgnoreString"
+	SyntaxPrintableString      Syntax = "PrintableString"
+	SyntaxIA5String            Syntax = "IA5String"
+	SyntaxNumericString        Syntax = "NumericString"
+	SyntaxDNBinary             Syntax = "DNBinary"
+	SyntaxORName               Syntax = "ORName"
+	SyntaxBoolean              Syntax = "Boolean"
+	SyntaxInteger              Syntax = "Integer"
+	SyntaxEnumeration          Syntax = "Enumeration"
+	SyntaxOctetString          Syntax = "OctetString"
+	SyntaxReplicaLink          Syntax = "ReplicaLink"
+	SyntaxGeneralizedTime      Syntax = "GeneralizedTime"
+	SyntaxUTCTime              Syntax = "UTCTime"
+	SyntaxUnicode              Syntax = "Unicode"
+	SyntaxPresentationAddress  Syntax = "PresentationAddress"
+	SyntaxDNString             Syntax = "DNString"
+	SyntaxNTSecurityDescriptor Syntax = "NTSecurityDescriptor"
+	SyntaxInteger8             Syntax = "Integer8"
+	SyntaxSID                  Syntax = "SID"
+)
+
+// syntaxFromSchema maps attributeSyntax and oMSyntax to a Syntax as documented in MS-ADTS 3.1.1.2.2.2.
+func syntaxFromSchema(attributeSyntax string, oMSyntax int) Syntax {
+	switch attributeSyntax {
+	case "2.5.5.1":
+		return SyntaxDN
+	case "2.5.5.2":
+		return SyntaxOID
+	case "2.5.5.3":
+		return SyntaxCaseExactString
+	case "2.5.5.4":
+		return SyntaxCaseIgnoreString
+	case "2.5.5.5":
+		if oMSyntax == 22 {
+			return SyntaxIA5String
+		}
+		return SyntaxPrintableString
+	case "2.5.5.6":
+		return SyntaxNumericString
+	case "2.5.5.7":
+		if oMSyntax == 127 {
+			return SyntaxDNBinary
+		}
+		return SyntaxORName
+	case "2.5.5.8":
+		return SyntaxBoolean
+	case "2.5.5.9":
+		if oMSyntax == 10 {
+			return SyntaxEnumeration
+		}
+		return SyntaxInteger
+	case "2.5.5.10":
+		if oMSyntax == 127 {
+			return SyntaxReplicaLink
+		}
+		return SyntaxOctetString
+	case "2.5.5.11":
+		if oMSyntax == 23 {
+			return SyntaxUTCTime
+		}
+		return SyntaxGeneralizedTime
+	case "2.5.5.12":
+		return SyntaxUnicode
+	case "2.5.5.13":
+		return SyntaxPresentationAddress
+	case "2.5.5.14":
+		return SyntaxDNString
+	case "2.5.5.15":
+		return SyntaxNTSecurityDescriptor
+	case "2.5.5.16":
+		return SyntaxInteger8
+	case "2.5.5.17":
+		return SyntaxSID
+	}
+	return SyntaxUnknown
+}
+
+// IsBinary returns true for syntaxes whose values are raw bytes.
+func (s Syntax) IsBinary() bool {
+	switch s {
+	case SyntaxOctetString, SyntaxReplicaLink, SyntaxNTSecurityDescriptor, SyntaxSID:
+		return true
+	}
+	return false
+}
+
+// AttributeSchema describes an attributeSchema object.
+type AttributeSchema struct {
+	LDAPDisplayName string
+	AttributeID     string
+	Syntax          Syntax
+	SingleValued    bool
+	// ReplicatedToGC is true if the attribute is in the partial attribute set of the global catalog.
+	ReplicatedToGC bool
+	SystemOnly     bool
+	RangeLower     *int64
+	RangeUpper     *int64
+	// LinkID is even for forward links, odd for back links, and 0 for everything else.
+	LinkID      int
+	SearchFlags int
+}
+
+// IsLinked returns true for forward and back link attributes, like member and memberOf.
+func (a *AttributeSchema) IsLinked() bool {
+	return a.LinkID != 0
+}
+
+// IsBackLink returns true for back link attributes, which are computed and can not be written.
+func (a *AttributeSchema) IsBackLink() bool {
+	return a.LinkID%2 == 1
+}
+
+// ClassSchema describes a classSchema object.
+type ClassSchema struct {
+	LDAPDisplayName string
+	GovernsID       string
+	SubClassOf      string
+	// Category is 0 for 88 classes, 1 for structural, 2 for abstract and 3 for auxiliary classes.
+	Category        int
+	MustContain     []string
+	MayContain      []string
+	AuxiliaryClass  []string
+	PossibleParents []string
+}
+
+// Schema is the schema of a forest.
+type Schema struct {
+	attributes map[string]*AttributeSchema
+	classes    map[string]*ClassSchema
+}
+
+// Attribute returns the definition of an attribute by its lDAPDisplayName.
+func (s *Schema) Attribute(name string) (*AttributeSchema, bool) {
+	a, ok := s.attributes[strings.ToLower(name)]
+	return a, ok
+}
+
+// Class returns the definition of a class by its lDAPDisplayName.
+func (s *Schema) Class(name string) (*ClassSchema, bool) {
+	c, ok := s.classes[strings.ToLower(name)]
+	return c, ok
+}
+
+// Attributes returns every attribute in the schema.
+func (s *Schema) Attributes() []*AttributeSchema {
+	list := make([]*AttributeSchema, 0, len(s.attributes))
+	for _, v := range s.attributes {
+		list = append(list, v)
+	}
+	return list
+}
+
+// Classes returns every class in the schema.
+func (s *Schema) Classes() []*ClassSchema {
+	list := make([]*ClassSchema, 0, len(s.classes))
+	for _, v := range s.classes {
+		list = append(list, v)
+	}
+	return list
+}
+
+// ClassAttributes returns the mandatory and optional attributes of a class,
+// including those inherited from its super classes and auxiliary classes.
+func (s *Schema) ClassAttributes(name string) (must []string, may []string) {
+	seenClass := make(map[string]bool)
+	seenMust := make(map[string]bool)
+	seenMay := make(map[string]bool)
+
+	var walk func(name string)
+	walk = func(name string) {
+		c, ok := s.Class(name)
+		if !ok || seenClass[strings.ToLower(name)] {
+			return
+		}
+		seenClass[strings.ToLower(name)] = true
+		for _, v := range c.MustContain {
+			if !seenMust[strings.ToLower(v)] {
+				seenMust[strings.ToLower(v)] = true
+				must = append(must, v)
+			}
+		}
+		for _, v := range c.MayContain {
+			if !seenMay[strings.ToLower(v)] {
+				seenMay[strings.ToLower(v)] = true
+				may = append(may, v)
+			}
+		}
+		for _, v := range c.AuxiliaryClass {
+			walk(v)
+		}
+		// top is its own super class
+		if !strings.EqualFold(c.SubClassOf, name) {
+			walk(c.SubClassOf)
+		}
+	}
+	walk(name)
+
+	return must, may
+}
+
+// schemaCache holds the schema of every server it was loaded from, since
+// Connection is passed around by value and can not hold it itself.
+var schemaCache = struct {
+	sync.Mutex
+	m map[string]*Schema
+}{m: make(map[string]*Schema)}
+
+// cachedSchema returns the schema of c.Server if Schema was called for it before.
+func (c *Connection) cachedSchema() *Schema {
+	schemaCache.Lock()
+	defer schemaCache.Unlock()
+	return schemaCache.m[strings.ToLower(c.Server)]
+}
+
+const psGetSchema string = `$nc = (Get-ADRootDSE -Server $Server -Credential $Credential).schemaNamingContext; ConvertTo-Json -Depth 3 -Compress -InputObject @{
+	Attributes = @(Get-ADObject -Server $Server -Credential $Credential -SearchBase $nc -LDAPFilter '(objectClass=attributeSchema)' -Properties @('lDAPDisplayName', 'attributeID', 'attributeSyntax', 'oMSyntax', 'isSingleValued', 'isMemberOfPartialAttributeSet', 'systemOnly', 'rangeLower', 'rangeUpper', 'linkID', 'searchFlags') -ResultSetSize $null | Select-Object @('lDAPDisplayName', 'attributeID', 'attributeSyntax', 'oMSyntax', 'isSingleValued', 'isMemberOfPartialAttributeSet', 'systemOnly', 'rangeLower', 'rangeUpper', 'linkID', 'searchFlags'))
+	Classes = @(Get-ADObject -Server $Server -Credential $Credential -SearchBase $nc -LDAPFilter '(objectClass=classSchema)' -Properties @('lDAPDisplayName', 'governsID', 'subClassOf', 'objectClassCategory', 'mustContain', 'systemMustContain', 'mayContain', 'systemMayContain', 'auxiliaryClass', 'systemAuxiliaryClass', 'possSuperiors', 'systemPossSuperiors') -ResultSetSize $null | Select-Object @('lDAPDisplayName', 'governsID', 'subClassOf', 'objectClassCategory', @{n='MustContain';e={@($_.mustContain) + @($_.systemMustContain)}}, @{n='MayContain';e={@($_.mayContain) + @($_.systemMayContain)}}, @{n='AuxiliaryClass';e={@($_.auxiliaryClass) + @($_.systemAuxiliaryClass)}}, @{n='PossibleParents';e={@($_.possSuperiors) + @($_.systemPossSuperiors)}}))
+}`
+
+// Schema reads the attribute and class definitions from the schema naming context.
+// The schema is cached per server, and once loaded GetAttributes uses it to decode values
+// and PushAttributes to encode them.
+func (c *Connection) Schema() (*Schema, error) {
+
+	if s := c.cachedSchema(); s != nil {
+		return s, nil
+	}
+
+	script := strings.Replace(psGetSchema, "$Server", ps.QuoteString(c.Server), -1)
+	script = strings.Replace(script, "$Credential", c.Credential.Expr(), -1)
+
+	result, err := powershell(script)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := struct {
+		Attributes []struct {
+			LDAPDisplayName               string
+			AttributeID                   string
+			AttributeSyntax               string
+			OMSyntax                      int
+			IsSingleValued                bool
+			IsMemberOfPartialAttributeSet bool
+			SystemOnly                    bool
+			RangeLower                    *int64
+			RangeUpper                    *int64
+			LinkID                        int
+			SearchFlags                   int
+		}
+		Classes []struct {
+			LDAPDisplayName     string
+			GovernsID           string
+			SubClassOf          string
+			ObjectClassCategory int
+			MustContain         []string
+			MayContain          []string
+			AuxiliaryClass      []string
+			PossibleParents     []string
+		}
+	}{}
+	err = json.Unmarshal(bytes.TrimSpace(result), &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Schema{
+		attributes: make(map[string]*AttributeSchema, len(raw.Attributes)),
+		classes:    make(map[string]*ClassSchema, len(raw.Classes)),
+	}
+	for _, v := range raw.Attributes {
+		s.attributes[strings.ToLower(v.LDAPDisplayName)] = &AttributeSchema{
+			LDAPDisplayName: v.LDAPDisplayName,
+			AttributeID:     v.AttributeID,
+			Syntax:          syntaxFromSchema(v.AttributeSyntax, v.OMSyntax),
+			SingleValued:    v.IsSingleValued,
+			ReplicatedToGC:  v.IsMemberOfPartialAttributeSet,
+			SystemOnly:      v.SystemOnly,
+			RangeLower:      v.RangeLower,
+			RangeUpper:      v.RangeUpper,
+			LinkID:          v.LinkID,
+			SearchFlags:     v.SearchFlags,
+		}
+	}
+	for _, v := range raw.Classes {
+		s.classes[strings.ToLower(v.LDAPDisplayName)] = &ClassSchema{
+			LDAPDisplayName: v.LDAPDisplayName,
+			GovernsID:       v.GovernsID,
+			SubClassOf:      v.SubClassOf,
+			Category:        v.ObjectClassCategory,
+			MustContain:     nonEmpty(v.MustContain),
+			MayContain:      nonEmpty(v.MayContain),
+			AuxiliaryClass:  nonEmpty(v.AuxiliaryClass),
+			PossibleParents: nonEmpty(v.PossibleParents),
+		}
+	}
+
+	schemaCache.Lock()
+	schemaCache.m[strings.ToLower(c.Server)] = s
+	schemaCache.Unlock()
+
+	return s, nil
+}
+
+// nonEmpty drops the blank entries that concatenating empty PowerShell arrays leaves behind.
+func nonEmpty(list []string) []string {
+	out := list[:0]
+	for _, v := range list {
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,165 @@
+package ad
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyntaxFromSchema(t *testing.T) {
+
+	tests := []struct {
+		attributeSyntax string
+		oMSyntax        int
+		want            Syntax
+	}{
+		{"2.5.5.1", 127, SyntaxDN},
+		{"2.5.5.5", 19, SyntaxPrintableString},
+		{"2.5.5.5", 22, SyntaxIA5String},
+		{"2.5.5.7", 127, SyntaxDNBinary},
+		{"2.5.5.7", 21, SyntaxORName},
+		{"2.5.5.8", 1, SyntaxBoolean},
+		{"2.5.5.9", 2, SyntaxInteger},
+		{"2.5.5.9", 10, SyntaxEnumeration},
+		{"2.5.5.10", 4, SyntaxOctetString},
+		{"2.5.5.10", 127, SyntaxReplicaLink},
+		{"2.5.5.11", 24, SyntaxGeneralizedTime},
+		{"2.5.5.11", 23, SyntaxUTCTime},
+		{"2.5.5.12", 64, SyntaxUnicode},
+		{"2.5.5.15", 66, SyntaxNTSecurityDescriptor},
+		{"2.5.5.16", 65, SyntaxInteger8},
+		{"2.5.5.17", 4, SyntaxSID},
+		{"2.5.5.99", 4, SyntaxUnknown},
+	}
+
+	for _, test := range tests {
+		if got := syntaxFromSchema(test.attributeSyntax, test.oMSyntax); got != test.want {
+			t.Errorf("syntaxFromSchema(%s, %d) = %q, want %q", test.attributeSyntax, test.oMSyntax, got, test.want)
+		}
+	}
+}
+
+const schemaTestJSON = `{"Attributes":[
+{"lDAPDisplayName":"objectSid","attributeID":"1.2.840.113556.1.4.146","attributeSyntax":"2.5.5.17","oMSyntax":4,"isSingleValued":true,"isMemberOfPartialAttributeSet":true,"systemOnly":true,"rangeLower":0,"rangeUpper":28,"linkID":null,"searchFlags":9},
+{"lDAPDisplayName":"member","attributeID":"2.5.4.31","attributeSyntax":"2.5.5.1","oMSyntax":127,"isSingleValued":false,"linkID":2},
+{"lDAPDisplayName":"memberOf","attributeID":"1.2.840.113556.1.2.102","attributeSyntax":"2.5.5.1","oMSyntax":127,"isSingleValued":false,"systemOnly":true,"linkID":3}],
+"Classes":[
+{"lDAPDisplayName":"top","governsID":"2.5.6.0","subClassOf":"top","objectClassCategory":2,"MustContain":["objectClass"],"MayContain":["cn","description"],"AuxiliaryClass":[""],"PossibleParents":["lostAndFound"]},
+{"lDAPDisplayName":"securityPrincipal","governsID":"1.2.840.113556.1.5.6","subClassOf":"top","objectClassCategory":3,"MustContain":["objectSid",""],"MayContain":["sAMAccountName"],"AuxiliaryClass":[],"PossibleParents":[]},
+{"lDAPDisplayName":"group","governsID":"1.2.840.113556.1.5.8","subClassOf":"top","objectClassCategory":1,"MustContain":["groupType"],"MayContain":["member","cn"],"AuxiliaryClass":["securityPrincipal"],"PossibleParents":["organizationalUnit"]}]}
+`
+
+func TestSchema(t *testing.T) {
+
+	scripts := recordPowershell(t, func(string) ([]byte, error) { return []byte(schemaTestJSON), nil })
+	c := NewConnection("dc-schema", "svc", "secret")
+	t.Cleanup(func() {
+		schemaCache.Lock()
+		delete(schemaCache.m, strings.ToLower(c.Server))
+		schemaCache.Unlock()
+	})
+
+	s, err := c.Schema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*scripts) != 1 || !strings.Contains((*scripts)[0], "(Get-ADRootDSE -Server 'dc-schema' -Credential $cred).schemaNamingContext") {
+		t.Errorf("scripts = %v", *scripts)
+	}
+
+	lower, upper := int64(0), int64(28)
+	want := &AttributeSchema{
+		LDAPDisplayName: "objectSid",
+		AttributeID:     "1.2.840.113556.1.4.146",
+		Syntax:          SyntaxSID,
+		SingleValued:    true,
+		ReplicatedToGC:  true,
+		SystemOnly:      true,
+		RangeLower:      &lower,
+		RangeUpper:      &upper,
+		SearchFlags:     9,
+	}
+	if a, ok := s.Attribute("OBJECTSID"); !ok || !reflect.DeepEqual(a, want) {
+		t.Errorf("objectSid = %+v, want %+v", a, want)
+	}
+	member, _ := s.Attribute("member")
+	memberOf, _ := s.Attribute("memberOf")
+	if member == nil || memberOf == nil || !member.IsLinked() || member.IsBackLink() || !memberOf.IsBackLink() || member.RangeUpper != nil {
+		t.Errorf("member = %+v, memberOf = %+v", member, memberOf)
+	}
+	if len(s.Attributes()) != 3 || len(s.Classes()) != 3 {
+		t.Errorf("%d attributes, %d classes", len(s.Attributes()), len(s.Classes()))
+	}
+
+	top, _ := s.Class("top")
+	if top == nil || len(top.AuxiliaryClass) != 0 || top.Category != 2 {
+		t.Errorf("top = %+v", top)
+	}
+	must, may := s.ClassAttributes("Group")
+	if want := []string{"groupType", "objectSid", "objectClass"}; !reflect.DeepEqual(must, want) {
+		t.Errorf("must = %v, want %v", must, want)
+	}
+	if want := []string{"member", "cn", "sAMAccountName", "description"}; !reflect.DeepEqual(may, want) {
+		t.Errorf("may = %v, want %v", may, want)
+	}
+
+	if cached, err := c.Schema(); err != nil || cached != s || len(*scripts) != 1 {
+		t.Errorf("the schema was not cached: %v, %d scripts", err, len(*scripts))
+	}
+	if c.cachedSchema() != s {
+		t.Error("cachedSchema did not return the loaded schema")
+	}
+}
+
+func TestAttributeValue(t *testing.T) {
+
+	sid, _ := ParseSID("S-1-5-21-1-2-3-1001")
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		a    Attribute
+		want []interface{}
+		err  bool
+	}{
+		{a: Attribute{Syntax: SyntaxBoolean, Values: [][]byte{[]byte("TRUE"), []byte("FALSE")}}, want: []interface{}{true, false}},
+		{a: Attribute{Syntax: SyntaxInteger, Values: [][]byte{[]byte("-2147483646")}}, want: []interface{}{int64(-2147483646)}},
+		{a: Attribute{Syntax: SyntaxEnumeration, Values: [][]byte{[]byte("805306368")}}, want: []interface{}{int64(805306368)}},
+		{a: Attribute{Syntax: SyntaxInteger8, Values: [][]byte{[]byte("133485000000000000")}}, want: []interface{}{int64(133485000000000000)}},
+		{a: Attribute{Syntax: SyntaxGeneralizedTime, Values: [][]byte{[]byte("20240102030405.0Z")}}, want: []interface{}{created}},
+		{a: Attribute{Syntax: SyntaxSID, Binary: true, Values: [][]byte{sid.Bytes()}}, want: []interface{}{sid}},
+		{a: Attribute{Syntax: SyntaxOctetString, Binary: true, Values: [][]byte{{1, 2, 3}}}, want: []interface{}{[]byte{1, 2, 3}}},
+		{a: Attribute{Syntax: SyntaxDN, Values: [][]byte{[]byte("CN=x,DC=example,DC=com")}}, want: []interface{}{"CN=x,DC=example,DC=com"}},
+		{a: Attribute{Values: [][]byte{[]byte("text")}}, want: []interface{}{"text"}},
+		{a: Attribute{Syntax: SyntaxInteger, Values: [][]byte{[]byte("many")}}, err: true},
+		{a: Attribute{Syntax: SyntaxBoolean, Values: [][]byte{[]byte("maybe")}}, err: true},
+	}
+
+	for _, test := range tests {
+		got, err := test.a.Value()
+		if test.err {
+			if err == nil {
+				t.Errorf("%s %q.Value() = %v, want error", test.a.Syntax, test.a.Values, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s %q.Value() = %v, %v, want %v", test.a.Syntax, test.a.Values, got, err, test.want)
+		}
+	}
+
+	for _, syntax := range []Syntax{SyntaxInteger8, SyntaxGeneralizedTime} {
+		a, err := NewAttribute(syntax, created)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := a.Value()
+		if err != nil || len(got) != 1 {
+			t.Errorf("%s: %v, %v", syntax, got, err)
+			continue
+		}
+		if v, ok := got[0].(int64); ok && !FileTimeToTime(v).Equal(created) || !ok && !reflect.DeepEqual(got[0], created) {
+			t.Errorf("%s round trip = %v", syntax, got[0])
+		}
+	}
+}
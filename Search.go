@@ -0,0 +1,144 @@
+package ad
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/jakobii/ps"
+)
+
+// Scope is the scope of a directory search.
+type Scope int
+
+const (
+	// ScopeSubtree searches the base object and everything below it.
+	ScopeSubtree Scope = iota
+	// ScopeOneLevel searches the immediate children of the base object.
+	ScopeOneLevel
+	// ScopeBase searches the base object only.
+	ScopeBase
+)
+
+func (s Scope) String() string {
+	switch s {
+	case ScopeOneLevel:
+		return "OneLevel"
+	case ScopeBase:
+		return "Base"
+	}
+	return "Subtree"
+}
+
+// Search describes a directory search. A blank Base searches the default naming context,
+// and a blank Filter matches every object.
+type Search struct {
+	Base       string
+	Scope      Scope
+	Filter     string
+	Attributes []string
+	// IncludeDeleted also returns deleted objects, which live in CN=Deleted Objects.
+	IncludeDeleted bool
+}
+
+// searchParams returns the Get-ADObject parameters for s.
+func (s Search) searchParams() string {
+	filter := s.Filter
+	if strings.TrimSpace(filter) == "" {
+		filter = "(objectClass=*)"
+	}
+
+	var p bytes.Buffer
+	p.WriteString(" -LDAPFilter ")
+	p.WriteString(ps.QuoteString(filter))
+	if s.Base != "" {
+		p.WriteString(" -SearchBase ")
+		p.WriteString(ps.QuoteString(s.Base))
+	}
+	p.WriteString(" -SearchScope ")
+	p.WriteString(s.Scope.String())
+	p.WriteString(" -ResultSetSize $null")
+	if s.IncludeDeleted {
+		p.WriteString(" -IncludeDeletedObjects")
+	}
+	return p.String()
+}
+
+// psNames returns a PowerShell array expression of attribute names.
+func psNames(names []string) string {
+	quoted := make([]string, 0, len(names))
+	for _, v := range names {
+		quoted = append(quoted, ps.QuoteString(v))
+	}
+	return "@(" + strings.Join(quoted, ",") + ")"
+}
+
+// FindObjects returns every object matching the search, with s.Attributes loaded into
+// Object.Attributes. Changes to the attributes can be written back with PushAttributes.
+func (c *Connection) FindObjects(s Search) (objs []Object, err error) {
+	err = c.eachObject(s, func(obj Object) error {
+		objs = append(objs, obj)
+		return nil
+	})
+	return objs, err
+}
+
+// eachObject calls fn for every object matching the search. Every object is written as a
+// line of JSON and decoded as it is read from the output of PowerShell, so neither the output
+// nor the objects are held in memory. An error returned by fn stops the search.
+func (c *Connection) eachObject(s Search, fn func(Object) error) (err error) {
+
+	var cmd bytes.Buffer
+	cmd.WriteString(psAttributesFunc)
+	cmd.WriteString("$names = ")
+	cmd.WriteString(psNames(s.Attributes))
+	cmd.WriteString("; Get-ADObject -Server ")
+	cmd.WriteString(ps.QuoteString(c.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(c.Credential.Expr())
+	cmd.WriteString(s.searchParams())
+	if len(s.Attributes) > 0 {
+		cmd.WriteString(" -Properties $names")
+	}
+	cmd.WriteString(" | ForEach-Object { ConvertTo-Json -Depth 5 -Compress -InputObject ([pscustomobject]@{ ObjectGuid = $_.ObjectGuid; ObjectClass = $_.ObjectClass; DistinguishedName = $_.DistinguishedName; Name = $_.Name; Attributes = @(ConvertTo-ADAttributes $_ $names) }) }")
+
+	out, err := powershellStream(cmd.String())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	d := json.NewDecoder(out)
+	for {
+		var raw struct {
+			Object
+			Attributes json.RawMessage
+		}
+		err = d.Decode(&raw)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		obj := raw.Object
+		obj.Connection = *c
+		obj.Attributes, err = decodeAttributes(raw.Attributes)
+		if err != nil {
+			return err
+		}
+		c.applySchema(obj.Attributes)
+		obj.originalAttributes = obj.Attributes.clone()
+
+		err = fn(obj)
+		if err != nil {
+			return err
+		}
+	}
+}
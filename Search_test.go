@@ -0,0 +1,61 @@
+package ad
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// fakeStream is PowerShell output that records whether it was closed.
+type fakeStream struct {
+	io.Reader
+	closed bool
+	err    error
+}
+
+func (f *fakeStream) Close() error {
+	f.closed = true
+	return f.err
+}
+
+func TestEachObject(t *testing.T) {
+
+	const objs = `{"ObjectGuid":"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c01","ObjectClass":"user","DistinguishedName":"CN=a,DC=example,DC=com","Name":"a","Attributes":[{"Name":"sAMAccountName","Values":["a"]}]}
+{"ObjectGuid":"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c02","ObjectClass":"user","DistinguishedName":"CN=b,DC=example,DC=com","Name":"b","Attributes":{"Name":"sAMAccountName","Values":["b"]}}
+`
+	var stream *fakeStream
+	old := powershellStream
+	t.Cleanup(func() { powershellStream = old })
+	powershellStream = func(script string) (io.ReadCloser, error) {
+		return stream, nil
+	}
+	c := NewConnection("dc1", "svc", "secret")
+
+	stream = &fakeStream{Reader: strings.NewReader(objs)}
+	found, err := c.FindObjects(Search{Attributes: []string{"sAMAccountName"}})
+	if err != nil || len(found) != 2 || !stream.closed {
+		t.Fatalf("FindObjects() = %d objects, %v, closed %t", len(found), err, stream.closed)
+	}
+	if sam, _ := found[1].Attributes.Get("sAMAccountName"); sam.String() != "b" || found[1].Server != "dc1" {
+		t.Errorf("second object = %+v", found[1])
+	}
+
+	// an error of the script is reported once the output was read
+	stream = &fakeStream{Reader: strings.NewReader(objs), err: errors.New("directory object not found")}
+	if _, err := c.FindObjects(Search{}); err == nil || err.Error() != "directory object not found" {
+		t.Errorf("FindObjects() = %v, want the script error", err)
+	}
+
+	// stopping early closes the output and keeps the error of fn
+	stop := errors.New("stop")
+	n := 0
+	stream = &fakeStream{Reader: strings.NewReader(objs)}
+	err = c.eachObject(Search{}, func(Object) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 || !stream.closed {
+		t.Errorf("eachObject() = %v after %d objects, closed %t", err, n, stream.closed)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,6 +14,8 @@ import (
 
 type User struct {
 	Object
+	// Recipient holds the Exchange mail attributes, EmailAddress is the mail attribute.
+	Recipient
 
 	SamAccountName string
 	// identity without unique constraint
@@ -22,10 +26,25 @@ type User struct {
 
 	// security
 	AccountExpirationDate time.Time
+	SIDHistory            []SID
 	OrgUnit               OrgUnit
 	Enabled               bool
 	Groups                []Group
 	originalGroups        []Group
+	load                  LoadStrategy
+
+	// UserAccountControl is written by Push after the individual flags
+	// below, and only when it differs from the value last pulled. Enabled,
+	// PasswordNeverExpires and PasswordNotRequired are folded into it first,
+	// a field changed since the last pull wins over its bit.
+	UserAccountControl         UserAccountControl
+	originalUserAccountControl UserAccountControl
+
+	// logon, read only. lastLogon is not replicated, see LastLogon.
+	LastLogonTimestamp time.Time `json:"-"`
+	PasswordLastSet    time.Time `json:"-"`
+	WhenCreated        time.Time `json:"-"`
+	WhenChanged        time.Time `json:"-"`
 
 	// password
 	AccountPassword       string
@@ -50,6 +69,10 @@ type User struct {
 	Organization string
 	HomePage     string
 	Description  string
+	// Manager is a reference, only its distinguished name and name are loaded. Push
+	// only writes it when it differs from the manager last pulled.
+	Manager         Object `json:"-"`
+	originalManager Object
 
 	// phone
 	OfficePhone string
@@ -57,6 +80,15 @@ type User struct {
 	HomePhone   string
 	Fax         string
 
+	// multi-valued, Push adds and removes single values instead of replacing the
+	// whole attribute, so values added by other tools since the last pull are kept.
+	// ProxyAddresses is part of Recipient and pushed the same way.
+	OtherMobile           []string
+	OtherTelephone        []string
+	URL                   []string
+	ServicePrincipalNames []string
+	originalValues        map[string][]string
+
 	// mail
 	POBox         string
 	StreetAddress string
@@ -77,6 +109,10 @@ func (u *User) Identity() (string, error) {
 
 		return u.DistinguishedName, nil
 
+	} else if !u.ObjectSid.IsZero() {
+
+		return u.ObjectSid.String(), nil
+
 	} else if u.Name != "" {
 
 		return u.Name, nil
@@ -90,12 +126,20 @@ func (u *User) Identity() (string, error) {
 	return "", errors.New("all identity properties are blank")
 }
 
+// UserOptions controls how GetUserWithOptions loads a user.
+type UserOptions struct {
+	// Load controls how the OrgUnit and Groups are loaded, the default is LoadEager.
+	Load LoadStrategy
+	// Attributes lists additional attributes to load into User.Attributes.
+	Attributes []string
+}
+
 func (u *User) Pull() error {
 	id, err := u.Identity()
 	if err != nil {
 		return err
 	}
-	user, err := u.GetUser(id)
+	user, err := u.GetUserWithOptions(id, UserOptions{Load: u.load, Attributes: u.Attributes.Names()})
 	if err != nil {
 		return err
 	}
@@ -164,17 +208,9 @@ func (u *User) Push() (err error) {
 	var exists bool
 	var groupsToRemove []Group
 	for _, v := range u.originalGroups {
-		vid, err := v.Identity()
-		if err != nil {
-			return err
-		}
 		exists = false
 		for _, z := range u.Groups {
-			zid, err := z.Identity()
-			if err != nil {
-				return err
-			}
-			if vid == zid {
+			if v.Object.Is(z.Object) {
 				exists = true
 				break
 			}
@@ -191,17 +227,9 @@ func (u *User) Push() (err error) {
 	// join groups
 	var groupsToAdd []Group
 	for _, v := range u.Groups {
-		vid, err := v.Identity()
-		if err != nil {
-			return err
-		}
 		exists = false
 		for _, z := range u.originalGroups {
-			zid, err := z.Identity()
-			if err != nil {
-				return err
-			}
-			if vid == zid {
+			if v.Object.Is(z.Object) {
 				exists = true
 				break
 			}
@@ -216,6 +244,7 @@ func (u *User) Push() (err error) {
 	}
 
 	// everything else
+	u.syncUserAccountControl()
 	var cmd bytes.Buffer
 	cmd.WriteString("Set-ADUser -Server ")
 	cmd.WriteString(ps.QuoteString(u.Server))
@@ -348,6 +377,19 @@ func (u *User) Push() (err error) {
 		cmd.WriteString(ps.Param("Description", ps.QuoteString(u.Description)))
 	}
 
+	// only a changed manager is written, so users built rather than pulled keep theirs
+	if u.managerChanged() {
+		if isBlankReference(u.Manager) {
+			cmd.WriteString(ps.Param("Manager", "$null"))
+		} else {
+			mid, err := u.Manager.Identity()
+			if err != nil {
+				return err
+			}
+			cmd.WriteString(ps.Param("Manager", ps.QuoteString(mid)))
+		}
+	}
+
 	if u.OfficePhone == "" {
 		cmd.WriteString(ps.Param("OfficePhone", "$null"))
 	} else {
@@ -402,20 +444,174 @@ func (u *User) Push() (err error) {
 		cmd.WriteString(ps.Param("Country", ps.QuoteString(u.Country)))
 	}
 
-	fmt.Println(cmd.String())
+	_, err = powershell(cmd.String())
+	if err != nil {
+		return err
+	}
+
+	// userAccountControl
+	if u.UserAccountControl != u.originalUserAccountControl {
+		err = u.SetUserAccountControl(u.UserAccountControl)
+		if err != nil {
+			return err
+		}
+	}
+
+	// multi-valued fields
+	err = u.pushValues()
+	if err != nil {
+		return err
+	}
+
+	// everything not modeled as a field
+	err = u.PushAttributes()
+	if err != nil {
+		return err
+	}
+
+	u.originalManager = u.Manager
+	return nil
+}
+
+// managerChanged reports whether Manager differs from the manager last pulled. A user that
+// was never pulled has none.
+func (u *User) managerChanged() bool {
+	if isBlankReference(u.Manager) || isBlankReference(u.originalManager) {
+		return isBlankReference(u.Manager) != isBlankReference(u.originalManager)
+	}
+	return !u.Manager.Is(u.originalManager)
+}
+
+// isBlankReference reports whether a reference does not identify any object.
+func isBlankReference(o Object) bool {
+	return o.ObjectGuid.String() == "00000000-0000-0000-0000-000000000000" && o.DistinguishedName == "" && o.ObjectSid.IsZero()
+}
+
+// values returns the multi-valued fields of the user by attribute name.
+func (u *User) values() map[string]*[]string {
+	return map[string]*[]string{
+		"otherMobile":          &u.OtherMobile,
+		"otherTelephone":       &u.OtherTelephone,
+		"url":                  &u.URL,
+		"servicePrincipalName": &u.ServicePrincipalNames,
+	}
+}
+
+// pushValues writes the values added to and removed from the multi-valued fields since the
+// user was pulled, and the mail attributes. Attributes that were never pulled are replaced.
+func (u *User) pushValues() error {
+	var m modification
+	values := u.values()
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	// in a stable order, so the same changes always make the same command
+	sort.Strings(names)
+	for _, name := range names {
+		v := NewStringAttribute(*values[name]...)
+		old, ok := u.originalValues[name]
+		if !ok {
+			if !v.IsEmpty() {
+				m.replace(name, v)
+			}
+			continue
+		}
+		add, remove := v.diff(NewStringAttribute(old...))
+		m.add(name, add)
+		m.remove(name, remove)
+	}
+	u.Recipient.changes(&m)
+
+	err := u.modify(m)
+	if err != nil {
+		return err
+	}
+	u.Recipient.pulled()
+
+	u.originalValues = make(map[string][]string)
+	for name, field := range u.values() {
+		u.originalValues[name] = append([]string(nil), *field...)
+	}
+	return nil
+}
+
+// syncUserAccountControl settles the flags that are both fields and bits of UserAccountControl,
+// so that writing the mask after the fields does not undo them. A field that changed since the
+// last pull wins over its bit, otherwise the bit wins. A user that was never pulled and has no
+// mask set keeps the fields only.
+func (u *User) syncUserAccountControl() {
+	if u.UserAccountControl == 0 {
+		return
+	}
+	orig := u.originalUserAccountControl
+
+	if u.Enabled != !orig.Disabled() {
+		u.UserAccountControl = u.UserAccountControl.Toggle(UACAccountDisable, !u.Enabled)
+	} else {
+		u.Enabled = !u.UserAccountControl.Disabled()
+	}
+	if u.PasswordNeverExpires != orig.PasswordNeverExpires() {
+		u.UserAccountControl = u.UserAccountControl.Toggle(UACDontExpirePassword, u.PasswordNeverExpires)
+	} else {
+		u.PasswordNeverExpires = u.UserAccountControl.PasswordNeverExpires()
+	}
+	if u.PasswordNotRequired != orig.PasswordNotRequired() {
+		u.UserAccountControl = u.UserAccountControl.Toggle(UACPasswdNotRequired, u.PasswordNotRequired)
+	} else {
+		u.PasswordNotRequired = u.UserAccountControl.PasswordNotRequired()
+	}
+}
+
+// SetUserAccountControl replaces the userAccountControl bitmask of the user.
+func (u *User) SetUserAccountControl(uac UserAccountControl) error {
+	id, err := u.Identity()
+	if err != nil {
+		return err
+	}
+
+	var cmd bytes.Buffer
+	cmd.WriteString("Set-ADUser -Server ")
+	cmd.WriteString(ps.QuoteString(u.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(u.Credential.Expr())
+	cmd.WriteString(" -Identity ")
+	cmd.WriteString(ps.QuoteString(id))
+	cmd.WriteString(" -Replace @{userAccountControl=")
+	cmd.WriteString(strconv.FormatUint(uint64(uac), 10))
+	cmd.WriteString("} -Confirm:$false")
 
 	_, err = powershell(cmd.String())
 	if err != nil {
 		return err
 	}
+
+	u.UserAccountControl = uac
+	u.originalUserAccountControl = uac
+	u.Enabled = !uac.Disabled()
+	u.PasswordNeverExpires = uac.PasswordNeverExpires()
+	u.PasswordNotRequired = uac.PasswordNotRequired()
 	return nil
 }
 
+// SetPassword resets the password of the user to AccountPassword.
+// The password is validated against the resultant password policy first, and a
+// *PasswordPolicyViolation is returned if it or the domain controller rejects it.
+// If the policy can not be read the password is sent without validation.
 func (u *User) SetPassword() error {
 	id, err := u.Identity()
 	if err != nil {
 		return err
 	}
+
+	policy, err := u.PasswordPolicy()
+	if err != nil {
+		return fmt.Errorf("reading the password policy: %v", err)
+	}
+	err = policy.Validate(u.AccountPassword, u)
+	if err != nil {
+		return err
+	}
 	// get the main stuff
 	var cmd bytes.Buffer
 	cmd.WriteString("Set-ADAccountPassword -Server ")
@@ -428,11 +624,9 @@ func (u *User) SetPassword() error {
 	cmd.WriteString(ps.SecureString(u.AccountPassword))
 	cmd.WriteString(" -Reset -Confirm:$false")
 
-	fmt.Println(cmd.String())
-
 	_, err = powershell(cmd.String())
 	if err != nil {
-		return err
+		return passwordError(err, policy)
 	}
 	return nil
 }
@@ -588,3 +782,36 @@ func (u *User) TestEmailAddress() (bool, error) {
 func (u *User) TestName() (bool, error) {
 	return u.TestADUser("Name", u.Name)
 }
+
+// OrganizationalUnit returns the OrgUnit of the user, loading it first if the user was
+// loaded lazily. With LoadReferences the reference is returned as is.
+func (u *User) OrganizationalUnit() (OrgUnit, error) {
+	if u.load == LoadLazy && u.OrgUnit.ObjectGuid.String() == "00000000-0000-0000-0000-000000000000" && u.OrgUnit.DistinguishedName != "" {
+		ou, err := u.Connection.GetOrgUnit(u.OrgUnit.DistinguishedName)
+		if err != nil {
+			return ou, err
+		}
+		u.OrgUnit = ou
+	}
+	return u.OrgUnit, nil
+}
+
+// MemberOf returns the groups of the user, loading any references first if the
+// user was loaded lazily. With LoadReferences the references are returned as is.
+func (u *User) MemberOf() ([]Group, error) {
+	if u.load != LoadLazy {
+		return u.Groups, nil
+	}
+	groups := newGroupLoader(&u.Connection)
+	for i, v := range u.Groups {
+		if !v.IsReference() {
+			continue
+		}
+		group, err := groups.load(v.DistinguishedName, 0)
+		if err != nil {
+			return nil, err
+		}
+		u.Groups[i] = group
+	}
+	return u.Groups, nil
+}
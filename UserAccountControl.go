@@ -0,0 +1,188 @@
+package ad
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// UserAccountControl is the userAccountControl bitmask of an account.
+type UserAccountControl uint32
+
+// userAccountControl flags as documented for MS-ADTS.
+const (
+	UACScript                     UserAccountControl = 0x00000001
+	UACAccountDisable             UserAccountControl = 0x00000002
+	UACHomeDirRequired            UserAccountControl = 0x00000008
+	UACLockout                    UserAccountControl = 0x00000010
+	UACPasswdNotRequired          UserAccountControl = 0x00000020
+	UACPasswdCantChange           UserAccountControl = 0x00000040
+	UACEncryptedTextPwdAllowed    UserAccountControl = 0x00000080
+	UACTempDuplicateAccount       UserAccountControl = 0x00000100
+	UACNormalAccount              UserAccountControl = 0x00000200
+	UACInterdomainTrustAccount    UserAccountControl = 0x00000800
+	UACWorkstationTrustAccount    UserAccountControl = 0x00001000
+	UACServerTrustAccount         UserAccountControl = 0x00002000
+	UACDontExpirePassword         UserAccountControl = 0x00010000
+	UACMNSLogonAccount            UserAccountControl = 0x00020000
+	UACSmartcardRequired          UserAccountControl = 0x00040000
+	UACTrustedForDelegation       UserAccountControl = 0x00080000
+	UACNotDelegated               UserAccountControl = 0x00100000
+	UACUseDESKeyOnly              UserAccountControl = 0x00200000
+	UACDontReqPreauth             UserAccountControl = 0x00400000
+	UACPasswordExpired            UserAccountControl = 0x00800000
+	UACTrustedToAuthForDelegation UserAccountControl = 0x01000000
+	UACPartialSecretsAccount      UserAccountControl = 0x04000000
+	UACUseAESKeys                 UserAccountControl = 0x08000000
+)
+
+var uacNames = map[UserAccountControl]string{
+	UACScript:                     "SCRIPT",
+	UACAccountDisable:             "ACCOUNTDISABLE",
+	UACHomeDirRequired:            "HOMEDIR_REQUIRED",
+	UACLockout:                    "LOCKOUT",
+	UACPasswdNotRequired:          "PASSWD_NOTREQD",
+	UACPasswdCantChange:           "PASSWD_CANT_CHANGE",
+	UACEncryptedTextPwdAllowed:    "ENCRYPTED_TEXT_PWD_ALLOWED",
+	UACTempDuplicateAccount:       "TEMP_DUPLICATE_ACCOUNT",
+	UACNormalAccount:              "NORMAL_ACCOUNT",
+	UACInterdomainTrustAccount:    "INTERDOMAIN_TRUST_ACCOUNT",
+	UACWorkstationTrustAccount:    "WORKSTATION_TRUST_ACCOUNT",
+	UACServerTrustAccount:         "SERVER_TRUST_ACCOUNT",
+	UACDontExpirePassword:         "DONT_EXPIRE_PASSWORD",
+	UACMNSLogonAccount:            "MNS_LOGON_ACCOUNT",
+	UACSmartcardRequired:          "SMARTCARD_REQUIRED",
+	UACTrustedForDelegation:       "TRUSTED_FOR_DELEGATION",
+	UACNotDelegated:               "NOT_DELEGATED",
+	UACUseDESKeyOnly:              "USE_DES_KEY_ONLY",
+	UACDontReqPreauth:             "DONT_REQ_PREAUTH",
+	UACPasswordExpired:            "PASSWORD_EXPIRED",
+	UACTrustedToAuthForDelegation: "TRUSTED_TO_AUTH_FOR_DELEGATION",
+	UACPartialSecretsAccount:      "PARTIAL_SECRETS_ACCOUNT",
+	UACUseAESKeys:                 "USE_AES_KEYS",
+}
+
+// Has returns true if every bit in flag is set.
+func (u UserAccountControl) Has(flag UserAccountControl) bool {
+	return u&flag == flag
+}
+
+// Set returns the value with flag set.
+func (u UserAccountControl) Set(flag UserAccountControl) UserAccountControl {
+	return u | flag
+}
+
+// Clear returns the value with flag cleared.
+func (u UserAccountControl) Clear(flag UserAccountControl) UserAccountControl {
+	return u &^ flag
+}
+
+// Toggle returns the value with flag set or cleared depending on on.
+func (u UserAccountControl) Toggle(flag UserAccountControl, on bool) UserAccountControl {
+	if on {
+		return u.Set(flag)
+	}
+	return u.Clear(flag)
+}
+
+// Diff compares u against old and returns the flags that were set and the flags that were cleared.
+func (u UserAccountControl) Diff(old UserAccountControl) (set UserAccountControl, cleared UserAccountControl) {
+	return u &^ old, old &^ u
+}
+
+// Flags returns the documented names of all set flags, e.g. "NORMAL_ACCOUNT".
+// Undocumented bits are returned in hex.
+func (u UserAccountControl) Flags() []string {
+	names := make([]string, 0, 4)
+	for bit := UserAccountControl(1); bit != 0; bit <<= 1 {
+		if !u.Has(bit) {
+			continue
+		}
+		if name, ok := uacNames[bit]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, "0x"+strconv.FormatUint(uint64(bit), 16))
+		}
+	}
+	return names
+}
+
+// String returns the set flags joined with "|".
+func (u UserAccountControl) String() string {
+	return strings.Join(u.Flags(), "|")
+}
+
+// ParseUserAccountControl decodes a "|" or "," separated list of flag names, or a decimal number.
+func ParseUserAccountControl(s string) (UserAccountControl, error) {
+
+	if n, err := strconv.ParseUint(strings.TrimSpace(s), 10, 32); err == nil {
+		return UserAccountControl(n), nil
+	}
+
+	var u UserAccountControl
+	for _, v := range strings.FieldsFunc(s, func(r rune) bool { return r == '|' || r == ',' }) {
+		v = strings.ToUpper(strings.TrimSpace(v))
+		if v == "" {
+			continue
+		}
+		found := false
+		for bit, name := range uacNames {
+			if name == v {
+				u |= bit
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, errors.New("unknown userAccountControl flag " + strconv.Quote(v))
+		}
+	}
+	return u, nil
+}
+
+// Disabled returns true if ACCOUNTDISABLE is set.
+func (u UserAccountControl) Disabled() bool { return u.Has(UACAccountDisable) }
+
+// LockedOut returns true if LOCKOUT is set. Domain controllers compute
+// lockout from lockoutTime, so this bit is rarely set on modern domains.
+func (u UserAccountControl) LockedOut() bool { return u.Has(UACLockout) }
+
+// PasswordNotRequired returns true if PASSWD_NOTREQD is set.
+func (u UserAccountControl) PasswordNotRequired() bool { return u.Has(UACPasswdNotRequired) }
+
+// PasswordNeverExpires returns true if DONT_EXPIRE_PASSWORD is set.
+func (u UserAccountControl) PasswordNeverExpires() bool { return u.Has(UACDontExpirePassword) }
+
+// PasswordExpired returns true if PASSWORD_EXPIRED is set.
+func (u UserAccountControl) PasswordExpired() bool { return u.Has(UACPasswordExpired) }
+
+// SmartcardRequired returns true if SMARTCARD_REQUIRED is set.
+func (u UserAccountControl) SmartcardRequired() bool { return u.Has(UACSmartcardRequired) }
+
+// TrustedForDelegation returns true if TRUSTED_FOR_DELEGATION is set.
+func (u UserAccountControl) TrustedForDelegation() bool { return u.Has(UACTrustedForDelegation) }
+
+// TrustedToAuthForDelegation returns true if TRUSTED_TO_AUTH_FOR_DELEGATION is set.
+func (u UserAccountControl) TrustedToAuthForDelegation() bool {
+	return u.Has(UACTrustedToAuthForDelegation)
+}
+
+// NotDelegated returns true if NOT_DELEGATED is set.
+func (u UserAccountControl) NotDelegated() bool { return u.Has(UACNotDelegated) }
+
+// UseDESKeyOnly returns true if USE_DES_KEY_ONLY is set.
+func (u UserAccountControl) UseDESKeyOnly() bool { return u.Has(UACUseDESKeyOnly) }
+
+// DontRequirePreauth returns true if DONT_REQ_PREAUTH is set.
+func (u UserAccountControl) DontRequirePreauth() bool { return u.Has(UACDontReqPreauth) }
+
+// NormalAccount returns true if NORMAL_ACCOUNT is set.
+func (u UserAccountControl) NormalAccount() bool { return u.Has(UACNormalAccount) }
+
+// WorkstationTrustAccount returns true if WORKSTATION_TRUST_ACCOUNT is set.
+func (u UserAccountControl) WorkstationTrustAccount() bool {
+	return u.Has(UACWorkstationTrustAccount)
+}
+
+// ServerTrustAccount returns true if SERVER_TRUST_ACCOUNT is set.
+func (u UserAccountControl) ServerTrustAccount() bool { return u.Has(UACServerTrustAccount) }
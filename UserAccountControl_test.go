@@ -0,0 +1,105 @@
+package ad
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUserAccountControl(t *testing.T) {
+
+	tests := []struct {
+		in      string
+		want    UserAccountControl
+		invalid bool
+	}{
+		{in: "512", want: UACNormalAccount},
+		{in: " 514 ", want: UACNormalAccount | UACAccountDisable},
+		{in: "NORMAL_ACCOUNT", want: UACNormalAccount},
+		{in: "normal_account|accountdisable", want: UACNormalAccount | UACAccountDisable},
+		{in: "NORMAL_ACCOUNT, DONT_EXPIRE_PASSWORD,", want: UACNormalAccount | UACDontExpirePassword},
+		{in: "", want: 0},
+		{in: "NORMAL_ACCOUNT|BOGUS", invalid: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseUserAccountControl(test.in)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("ParseUserAccountControl(%q) = %s, want error", test.in, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("ParseUserAccountControl(%q) = %d, %v, want %d", test.in, got, err, test.want)
+		}
+	}
+}
+
+func TestUserAccountControlFlags(t *testing.T) {
+
+	tests := []struct {
+		in   UserAccountControl
+		want []string
+	}{
+		{0, []string{}},
+		{UACNormalAccount, []string{"NORMAL_ACCOUNT"}},
+		{UACNormalAccount | UACAccountDisable, []string{"ACCOUNTDISABLE", "NORMAL_ACCOUNT"}},
+		{1 << 30, []string{"0x40000000"}},
+	}
+
+	for _, test := range tests {
+		got := test.in.Flags()
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%d.Flags() = %v, want %v", test.in, got, test.want)
+		}
+		back, err := ParseUserAccountControl(test.in.String())
+		if err == nil && back != test.in {
+			t.Errorf("ParseUserAccountControl(%q) = %d, want %d", test.in.String(), back, test.in)
+		}
+	}
+
+	set, cleared := (UACNormalAccount | UACSmartcardRequired).Diff(UACNormalAccount | UACAccountDisable)
+	if set != UACSmartcardRequired || cleared != UACAccountDisable {
+		t.Errorf("Diff() = %s, %s", set, cleared)
+	}
+}
+
+func TestSyncUserAccountControl(t *testing.T) {
+
+	pulled := UACNormalAccount
+	u := User{
+		Enabled:                    true,
+		UserAccountControl:         pulled,
+		originalUserAccountControl: pulled,
+	}
+
+	// a changed field and a changed bit in the same push both survive
+	u.PasswordNeverExpires = true
+	u.UserAccountControl = u.UserAccountControl.Set(UACSmartcardRequired)
+	u.syncUserAccountControl()
+	want := UACNormalAccount | UACSmartcardRequired | UACDontExpirePassword
+	if u.UserAccountControl != want || !u.PasswordNeverExpires || !u.Enabled {
+		t.Errorf("got %s, PasswordNeverExpires %t, Enabled %t", u.UserAccountControl, u.PasswordNeverExpires, u.Enabled)
+	}
+
+	// a changed bit updates the unchanged field
+	u = User{Enabled: true, UserAccountControl: pulled | UACAccountDisable, originalUserAccountControl: pulled}
+	u.syncUserAccountControl()
+	if u.Enabled {
+		t.Error("disabling through UserAccountControl was undone by Enabled")
+	}
+
+	// a changed field wins over the unchanged bit
+	u = User{Enabled: false, UserAccountControl: pulled, originalUserAccountControl: pulled}
+	u.syncUserAccountControl()
+	if !u.UserAccountControl.Disabled() {
+		t.Error("Enabled = false was not folded into UserAccountControl")
+	}
+
+	// a user that was never pulled keeps its fields only
+	u = User{Enabled: true}
+	u.syncUserAccountControl()
+	if u.UserAccountControl != 0 {
+		t.Errorf("UserAccountControl = %s, want 0", u.UserAccountControl)
+	}
+}
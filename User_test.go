@@ -0,0 +1,196 @@
+package ad
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jakobii/ps"
+)
+
+func TestPushValuesOrder(t *testing.T) {
+	scripts := recordPowershell(t, nil)
+
+	u := User{Object: Object{DistinguishedName: "CN=Pat,DC=example,DC=com"}}
+	u.OtherMobile = []string{"1", "11"}
+	u.OtherTelephone = []string{"22"}
+	u.URL = []string{"https://b.example.com"}
+	u.ServicePrincipalNames = []string{"HTTP/a", "HTTP/b"}
+	want := u
+
+	for i := 0; i < 20; i++ {
+		u = want
+		u.originalValues = map[string][]string{
+			"otherMobile":          {"1"},
+			"otherTelephone":       {"2"},
+			"url":                  {"https://a.example.com"},
+			"servicePrincipalName": {"HTTP/a"},
+		}
+		if err := u.pushValues(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, v := range (*scripts)[1:] {
+		if v != (*scripts)[0] {
+			t.Fatalf("commands differ between runs:\n%s\n%s", (*scripts)[0], v)
+		}
+	}
+
+	script := (*scripts)[0]
+	mobile := strings.Index(script, ps.QuoteString("otherMobile"))
+	spn := strings.Index(script, ps.QuoteString("servicePrincipalName"))
+	if mobile < 0 || spn < 0 || mobile > spn {
+		t.Errorf("attributes are not sorted:\n%s", script)
+	}
+	if !strings.Contains(script, "-Remove @{"+ps.QuoteString("otherTelephone")+"=@("+ps.QuoteString("2")+")") {
+		t.Errorf("removed value is missing:\n%s", script)
+	}
+}
+
+func TestPushManager(t *testing.T) {
+	scripts := recordPowershell(t, nil)
+	manager := Object{DistinguishedName: "CN=Boss,DC=example,DC=com"}
+
+	setUser := func() string {
+		for _, v := range *scripts {
+			if strings.HasPrefix(v, "Set-ADUser") && strings.Contains(v, " -Title ") {
+				return v
+			}
+		}
+		t.Fatalf("no Set-ADUser in %v", *scripts)
+		return ""
+	}
+
+	// a user that was built rather than pulled keeps its manager
+	u := User{Object: Object{ObjectGuid: uuid.New(), Name: "Pat"}, Title: "Engineer"}
+	if err := u.Push(); err != nil {
+		t.Fatal(err)
+	}
+	if s := setUser(); strings.Contains(s, "-Manager") {
+		t.Errorf("unset manager was written:\n%s", s)
+	}
+
+	*scripts = nil
+	u.Manager = manager
+	if err := u.Push(); err != nil {
+		t.Fatal(err)
+	}
+	if s := setUser(); !strings.Contains(s, " -Manager "+ps.QuoteString(manager.DistinguishedName)) {
+		t.Errorf("new manager was not written:\n%s", s)
+	}
+
+	*scripts = nil
+	if err := u.Push(); err != nil {
+		t.Fatal(err)
+	}
+	if s := setUser(); strings.Contains(s, "-Manager") {
+		t.Errorf("unchanged manager was written:\n%s", s)
+	}
+
+	// clearing the manager of a pulled user writes $null
+	*scripts = nil
+	u.Manager = Object{}
+	if err := u.Push(); err != nil {
+		t.Fatal(err)
+	}
+	if s := setUser(); !strings.Contains(s, " -Manager $null") {
+		t.Errorf("cleared manager was not written:\n%s", s)
+	}
+}
+
+// loadTestDirectory answers GetUserWithOptions with a user in two groups, where Staff is
+// itself a member of All, and counts the scripts by cmdlet.
+func loadTestDirectory(t *testing.T) map[string]int {
+	calls := make(map[string]int)
+	groups := map[string]string{
+		"CN=Staff,OU=Groups,DC=example,DC=com": `{"ObjectGuid":"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c11","ObjectClass":"group","DistinguishedName":"CN=Staff,OU=Groups,DC=example,DC=com","Name":"Staff","SamAccountName":"staff","memberOf":["CN=All,OU=Groups,DC=example,DC=com"]}`,
+		"CN=All,OU=Groups,DC=example,DC=com":   `{"ObjectGuid":"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c12","ObjectClass":"group","DistinguishedName":"CN=All,OU=Groups,DC=example,DC=com","Name":"All","SamAccountName":"all","memberOf":[]}`,
+	}
+	recordPowershell(t, func(script string) ([]byte, error) {
+		cmdlet := script[:strings.Index(script, " ")]
+		calls[cmdlet]++
+		switch cmdlet {
+		case "Get-ADUser":
+			return []byte(`{"ObjectGuid":"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c01","ObjectClass":"user","DistinguishedName":"CN=Jane Doe,OU=Staff,DC=example,DC=com","Name":"Jane Doe","SamAccountName":"jdoe",` +
+				`"userAccountControl":512,"whenCreated":"20240102030405.0Z","whenChanged":"20240102030405.0Z","MemberOf":["CN=Staff,OU=Groups,DC=example,DC=com","CN=All,OU=Groups,DC=example,DC=com"]}`), nil
+		case "Get-ADOrganizationalUnit":
+			return []byte(`{"ObjectGuid":"6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0c20","ObjectClass":"organizationalUnit","DistinguishedName":"OU=Staff,DC=example,DC=com","Name":"Staff"}`), nil
+		case "Get-ADGroup":
+			for dn, group := range groups {
+				if strings.Contains(script, " -Identity "+ps.QuoteString(dn)+" ") {
+					return []byte(group), nil
+				}
+			}
+		}
+		return nil, errors.New("unexpected script " + script)
+	})
+	return calls
+}
+
+func TestUserLoadStrategies(t *testing.T) {
+
+	tests := []struct {
+		load LoadStrategy
+		// the scripts run by GetUserWithOptions, and by OrganizationalUnit and MemberOf after it
+		get, access map[string]int
+	}{
+		{load: LoadEager, get: map[string]int{"Get-ADUser": 1, "Get-ADOrganizationalUnit": 1, "Get-ADGroup": 2}, access: map[string]int{}},
+		{load: LoadLazy, get: map[string]int{"Get-ADUser": 1}, access: map[string]int{"Get-ADOrganizationalUnit": 1, "Get-ADGroup": 2}},
+		{load: LoadReferences, get: map[string]int{"Get-ADUser": 1}, access: map[string]int{}},
+	}
+
+	c := NewConnection("dc1", "svc", "secret")
+	for _, test := range tests {
+		calls := loadTestDirectory(t)
+		u, err := c.GetUserWithOptions("jdoe", UserOptions{Load: test.load})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(calls, test.get) {
+			t.Errorf("load %d: GetUserWithOptions ran %v, want %v", test.load, calls, test.get)
+		}
+		if u.OrgUnit.DistinguishedName != "OU=Staff,DC=example,DC=com" || len(u.Groups) != 2 || u.Groups[0].DistinguishedName != "CN=Staff,OU=Groups,DC=example,DC=com" {
+			t.Errorf("load %d: OrgUnit = %+v, Groups = %+v", test.load, u.OrgUnit, u.Groups)
+		}
+		if (test.load == LoadEager) == u.Groups[0].IsReference() {
+			t.Errorf("load %d: group loaded = %t", test.load, !u.Groups[0].IsReference())
+		}
+
+		for k := range calls {
+			delete(calls, k)
+		}
+		for i := 0; i < 2; i++ {
+			ou, err := u.OrganizationalUnit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			groups, err := u.MemberOf()
+			if err != nil {
+				t.Fatal(err)
+			}
+			loaded := ou.ObjectGuid != uuid.Nil && !groups[0].IsReference() && !groups[1].IsReference()
+			if loaded == (test.load == LoadReferences) {
+				t.Errorf("load %d: OrgUnit = %+v, Groups = %+v", test.load, ou, groups)
+			}
+		}
+		if !reflect.DeepEqual(calls, test.access) {
+			t.Errorf("load %d: OrganizationalUnit and MemberOf ran %v, want %v", test.load, calls, test.access)
+		}
+		if test.load != LoadReferences && (len(u.Groups[0].Groups) != 1 || u.Groups[0].Groups[0].Name != "All") {
+			t.Errorf("load %d: parents of Staff = %+v", test.load, u.Groups[0].Groups)
+		}
+
+		// Pull keeps the strategy the user was loaded with
+		for k := range calls {
+			delete(calls, k)
+		}
+		if err := u.Pull(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(calls, test.get) {
+			t.Errorf("load %d: Pull ran %v, want %v", test.load, calls, test.get)
+		}
+	}
+}
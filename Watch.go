@@ -0,0 +1,241 @@
+package ad
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// EventType is the kind of change a watch event reports.
+type EventType string
+
+const (
+	EventAdd    EventType = "add"
+	EventModify EventType = "modify"
+	EventMove   EventType = "move"
+	EventDelete EventType = "delete"
+)
+
+// watchFilter limits a watch to users, groups and OrgUnits. It matches tombstones too,
+// which keep objectClass but lose objectCategory.
+const watchFilter = "(|(&(objectClass=user)(!(objectClass=computer)))(objectClass=group)(objectClass=organizationalUnit))"
+
+// Event is a change to a user, group or OrgUnit.
+type Event struct {
+	Type EventType
+	// Object is the object after the change. For deletions it is the tombstone, whose
+	// DistinguishedName is in CN=Deleted Objects.
+	Object Object
+	// OldDistinguishedName is where the object was before a move, rename or deletion,
+	// if the watch had seen it before.
+	OldDistinguishedName string
+	// Cookie is set on the last event of every batch of changes. Once that event was
+	// handled, the cookie can be persisted and passed in WatchOptions to resume.
+	Cookie string
+}
+
+// WatchOptions controls WatchWithOptions.
+type WatchOptions struct {
+	// Search limits the watch. Its filter is combined with a filter for users, groups and
+	// OrgUnits, and Attributes are loaded into Event.Object. An object moved out of Base is
+	// no longer found by the polls, it is reported as deleted by the next resync.
+	Search
+	// Cookie resumes from a cookie of a previous watch or of Changes.
+	Cookie string
+	// Interval is the time between polls, 30 seconds if it is not set.
+	Interval time.Duration
+	// MaxRetryInterval caps the backoff after errors, 5 minutes if it is not set.
+	MaxRetryInterval time.Duration
+	// OnError is called with errors the watch recovers from, e.g. an unreachable
+	// domain controller. It must not block.
+	OnError func(error)
+}
+
+// Watch sends an event on the returned channel for every user, group and OrgUnit matching the
+// LDAP filter that is added, modified, moved or deleted, until ctx is done. See WatchWithOptions.
+func (c *Connection) Watch(ctx context.Context, filter string) (<-chan Event, <-chan error) {
+	return c.WatchWithOptions(ctx, WatchOptions{Search: Search{Filter: filter}})
+}
+
+// WatchWithOptions watches for changes like Watch. The ActiveDirectory module supports neither
+// persistent search nor the change notification control, so the directory is polled with
+// Changes. Errors are retried with backoff. If the domain controller of the cookie stays
+// unreachable, or its database was restored, the watch starts over on another domain
+// controller and compares the objects it finds with what it has seen, which reports additions,
+// moves and deletions, but not modifications made in the meantime.
+//
+// Moves are recognized for objects the watch has seen, so it lists every matching object once
+// when it starts. With a Base, moves within it are reported, but an object that is moved out
+// of it is not seen again by the polls and only reported, as deleted, when the watch resyncs. The event channel is closed when ctx is done or the watch can not go on, in
+// which case the error is sent on the error channel.
+func (c *Connection) WatchWithOptions(ctx context.Context, opts WatchOptions) (<-chan Event, <-chan error) {
+
+	out := make(chan Event)
+	errc := make(chan error, 1)
+
+	if opts.Interval <= 0 {
+		opts.Interval = 30 * time.Second
+	}
+	if opts.MaxRetryInterval <= 0 {
+		opts.MaxRetryInterval = 5 * time.Minute
+	}
+	s := opts.Search
+	if s.Filter == "" {
+		s.Filter = watchFilter
+	} else {
+		s.Filter = "(&" + watchFilter + s.Filter + ")"
+	}
+
+	w := &watcher{c: c, s: s, out: out, known: make(map[uuid.UUID]string)}
+
+	go func() {
+		defer close(out)
+		defer close(errc)
+
+		cookie := opts.Cookie
+		retry := opts.Interval
+		failures := 0
+		seeded := false
+		for {
+			var err error
+			switch {
+			case !seeded:
+				var next string
+				next, err = w.resync(ctx, false)
+				if err == nil {
+					seeded = true
+					if cookie == "" {
+						cookie = next
+					}
+				}
+			case failures >= 3 || cookie == "":
+				cookie, err = w.resync(ctx, true)
+			default:
+				cookie, err = w.poll(ctx, cookie)
+			}
+
+			if ctx.Err() != nil {
+				errc <- ctx.Err()
+				return
+			}
+			wait := opts.Interval
+			if err != nil {
+				if errors.Is(err, ErrResyncRequired) {
+					cookie = ""
+				}
+				failures++
+				if opts.OnError != nil {
+					opts.OnError(err)
+				}
+				wait = retry
+				retry *= 2
+				if retry > opts.MaxRetryInterval {
+					retry = opts.MaxRetryInterval
+				}
+			} else {
+				failures = 0
+				retry = opts.Interval
+			}
+
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	return out, errc
+}
+
+// watcher remembers where it last saw every object, by ObjectGuid.
+type watcher struct {
+	c     *Connection
+	s     Search
+	out   chan Event
+	known map[uuid.UUID]string
+}
+
+func (w *watcher) send(ctx context.Context, events []Event, cookie string) error {
+	for i, e := range events {
+		if i == len(events)-1 {
+			e.Cookie = cookie
+		}
+		select {
+		case w.out <- e:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// poll sends the changes since cookie and returns the next cookie.
+func (w *watcher) poll(ctx context.Context, cookie string) (string, error) {
+
+	changes, next, err := w.c.ChangesWithOptions(cookie, w.s)
+	if err != nil {
+		return cookie, err
+	}
+
+	events := make([]Event, 0, len(changes))
+	for _, ch := range changes {
+		old, seen := w.known[ch.ObjectGuid]
+		e := Event{Object: ch.Object, OldDistinguishedName: old}
+		switch {
+		case ch.Deleted:
+			e.Type = EventDelete
+			delete(w.known, ch.ObjectGuid)
+		case !seen || ch.Created:
+			e.Type = EventAdd
+			w.known[ch.ObjectGuid] = ch.DistinguishedName
+		case old != ch.DistinguishedName:
+			e.Type = EventMove
+			w.known[ch.ObjectGuid] = ch.DistinguishedName
+		default:
+			e.Type = EventModify
+		}
+		events = append(events, e)
+	}
+
+	return next, w.send(ctx, events, next)
+}
+
+// resync lists every matching object and returns a new cookie. If report is set the objects
+// are compared with the ones seen before, and additions, moves and deletions are sent.
+func (w *watcher) resync(ctx context.Context, report bool) (string, error) {
+
+	changes, next, err := w.c.ChangesWithOptions("", w.s)
+	if err != nil {
+		return "", err
+	}
+
+	known := make(map[uuid.UUID]string, len(changes))
+	var events []Event
+	for _, ch := range changes {
+		known[ch.ObjectGuid] = ch.DistinguishedName
+		old, seen := w.known[ch.ObjectGuid]
+		switch {
+		case !seen:
+			events = append(events, Event{Type: EventAdd, Object: ch.Object})
+		case old != ch.DistinguishedName:
+			events = append(events, Event{Type: EventMove, Object: ch.Object, OldDistinguishedName: old})
+		}
+	}
+	for id, dn := range w.known {
+		if _, ok := known[id]; !ok {
+			obj := w.c.objectReference(dn)
+			obj.ObjectGuid = id
+			events = append(events, Event{Type: EventDelete, Object: obj, OldDistinguishedName: dn})
+		}
+	}
+	w.known = known
+
+	if !report {
+		return next, nil
+	}
+	return next, w.send(ctx, events, next)
+}
@@ -0,0 +1,157 @@
+package ad
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jakobii/ps"
+)
+
+const watchTestState = `{"Server":"dc1.example.com","InvocationID":"2f5c1a0e-7f4b-4f7e-8d8e-0a8c0f4a1b2c","USN":900}`
+
+func watchTestGUID(n string) uuid.UUID {
+	id, _ := uuid.Parse("6f1ec1e4-5a8b-4a8e-9d3e-1c1e9d6a0" + n)
+	return id
+}
+
+func TestWatcherPoll(t *testing.T) {
+
+	recordPowershell(t, func(script string) ([]byte, error) {
+		if strings.Contains(script, "Get-ADRootDSE") {
+			return []byte(watchTestState), nil
+		}
+		if strings.Contains(script, "(isDeleted=TRUE)") {
+			return nil, nil
+		}
+		return []byte(
+			changeTestObject("c01", "CN=new,DC=example,DC=com", 100, 601, false, "") +
+				changeTestObject("c02", "CN=moved,OU=New,DC=example,DC=com", 100, 602, false, "") +
+				changeTestObject("c03", "CN=same,DC=example,DC=com", 100, 603, false, "") +
+				changeTestObject("c04", "CN=recreated,DC=example,DC=com", 550, 604, false, "") +
+				changeTestObject("c05", "CN=gone DEL:1,CN=Deleted Objects,DC=example,DC=com", 100, 605, true, "DC=example,DC=com")), nil
+	})
+
+	c := NewConnection("example.com", "svc", "secret")
+	w := &watcher{c: &c, out: make(chan Event, 10), known: map[uuid.UUID]string{
+		watchTestGUID("c02"): "CN=moved,OU=Old,DC=example,DC=com",
+		watchTestGUID("c03"): "CN=same,DC=example,DC=com",
+		watchTestGUID("c04"): "CN=recreated,DC=example,DC=com",
+		watchTestGUID("c05"): "CN=gone,DC=example,DC=com",
+	}}
+
+	next, err := w.poll(context.Background(), changeTestCookie(500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(w.out)
+
+	want := []struct {
+		typ EventType
+		old string
+	}{
+		{EventAdd, ""},
+		{EventMove, "CN=moved,OU=Old,DC=example,DC=com"},
+		{EventModify, "CN=same,DC=example,DC=com"},
+		{EventAdd, "CN=recreated,DC=example,DC=com"},
+		{EventDelete, "CN=gone,DC=example,DC=com"},
+	}
+	var events []Event
+	for e := range w.out {
+		events = append(events, e)
+	}
+	if len(events) != len(want) {
+		t.Fatalf("events = %+v", events)
+	}
+	for i, e := range events {
+		if e.Type != want[i].typ || e.OldDistinguishedName != want[i].old {
+			t.Errorf("event %d = %s %q, want %s %q", i, e.Type, e.OldDistinguishedName, want[i].typ, want[i].old)
+		}
+		if (e.Cookie != "") != (i == len(events)-1) {
+			t.Errorf("event %d has cookie %q", i, e.Cookie)
+		}
+	}
+	if events[len(events)-1].Cookie != next {
+		t.Error("the last event does not carry the next cookie")
+	}
+
+	if _, ok := w.known[watchTestGUID("c05")]; ok {
+		t.Error("deleted object is still known")
+	}
+	if w.known[watchTestGUID("c01")] != "CN=new,DC=example,DC=com" || w.known[watchTestGUID("c02")] != "CN=moved,OU=New,DC=example,DC=com" {
+		t.Errorf("known = %v", w.known)
+	}
+}
+
+func TestWatchResync(t *testing.T) {
+
+	var mu sync.Mutex
+	listings, failures := 0, 0
+	recordPowershell(t, func(script string) ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.Contains(script, "Get-ADRootDSE -Server "+ps.QuoteString("dc1.example.com")):
+			// the domain controller of the cookie is gone
+			return nil, errors.New("the server is not operational")
+		case strings.Contains(script, "Get-ADRootDSE"):
+			return []byte(watchTestState), nil
+		}
+		listings++
+		if listings == 1 {
+			return []byte(changeTestObject("c01", "CN=a,OU=Old,DC=example,DC=com", 100, 100, false, "") +
+				changeTestObject("c02", "CN=b,DC=example,DC=com", 100, 100, false, "")), nil
+		}
+		return []byte(changeTestObject("c01", "CN=a,OU=New,DC=example,DC=com", 100, 700, false, "") +
+			changeTestObject("c03", "CN=c,DC=example,DC=com", 100, 800, false, "")), nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewConnection("example.com", "svc", "secret")
+	events, errc := c.WatchWithOptions(ctx, WatchOptions{
+		Interval:         time.Millisecond,
+		MaxRetryInterval: time.Millisecond,
+		OnError: func(err error) {
+			mu.Lock()
+			failures++
+			mu.Unlock()
+		},
+	})
+
+	got := make(map[EventType]Event)
+	timeout := time.After(5 * time.Second)
+	for len(got) < 3 {
+		select {
+		case e := <-events:
+			got[e.Type] = e
+		case <-timeout:
+			t.Fatalf("got %v before the timeout", got)
+		}
+	}
+	cancel()
+	for range events {
+	}
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("watch ended with %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if failures < 3 {
+		t.Errorf("resynced after %d failures", failures)
+	}
+	if e := got[EventMove]; e.Object.ObjectGuid != watchTestGUID("c01") || e.OldDistinguishedName != "CN=a,OU=Old,DC=example,DC=com" {
+		t.Errorf("move = %+v", e)
+	}
+	if e := got[EventAdd]; e.Object.ObjectGuid != watchTestGUID("c03") {
+		t.Errorf("add = %+v", e)
+	}
+	if e := got[EventDelete]; e.Object.ObjectGuid != watchTestGUID("c02") || e.OldDistinguishedName != "CN=b,DC=example,DC=com" {
+		t.Errorf("delete = %+v", e)
+	}
+}
@@ -1,7 +1,14 @@
 package ad
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"os/exec"
 	"regexp"
+	"runtime"
 	"strings"
 
 	"github.com/jakobii/ps"
@@ -9,6 +16,18 @@ import (
 
 type Credential = ps.Credential
 
+// LoadStrategy controls how related objects, like the OrgUnit and groups of a user, are loaded.
+type LoadStrategy int
+
+const (
+	// LoadEager fetches related objects immediately.
+	LoadEager LoadStrategy = iota
+	// LoadLazy stores references and fetches related objects on first access.
+	LoadLazy
+	// LoadReferences only stores references, which have the name and distinguished name set.
+	LoadReferences
+)
+
 var reDC = regexp.MustCompile("^DC=.*$")
 
 func ParseDistinguishedName(dn string) (cn string, ou string) {
@@ -24,6 +43,96 @@ func ParseDistinguishedName(dn string) (cn string, ou string) {
 	return cn, strings.Join(pieces[1:], ",")
 }
 
-func powershell(script string) ([]byte, error) {
+// powershell runs a script with the ActiveDirectory module loaded and returns its output.
+// It is a variable so tests can record scripts instead of running them.
+var powershell = func(script string) ([]byte, error) {
 	return ps.Invoke("$Env:ADPS_LoadDefaultDrive = 0; Import-module ActiveDirectory; " + script)
 }
+
+// powershellStream runs a script like powershell, but returns the output as it is written
+// instead of after the script has finished. Close returns the error of the script once the
+// output was read to the end; closing before that stops the script. It is a variable so
+// tests can answer scripts without running them.
+var powershellStream = func(script string) (io.ReadCloser, error) {
+
+	exe := "pwsh"
+	if runtime.GOOS == "windows" {
+		exe = "powershell.exe"
+	}
+
+	// the script is passed on stdin as a single line, so it is neither limited by the
+	// length of a command line nor visible in the process list
+	script = "$ErrorActionPreference = 'Stop'; $ProgressPreference = 'SilentlyContinue'; $WarningPreference = 'SilentlyContinue'; " +
+		"[Console]::OutputEncoding = [Text.Encoding]::UTF8; " +
+		"$Env:ADPS_LoadDefaultDrive = 0; Import-module ActiveDirectory; " + script
+	line := "Invoke-Expression ([Text.Encoding]::UTF8.GetString([Convert]::FromBase64String('" +
+		base64.StdEncoding.EncodeToString([]byte(script)) + "')))\n"
+
+	p := &psProcess{cmd: exec.Command(exe, "-NoProfile", "-NonInteractive", "-Command", "-")}
+	p.cmd.Stdin = strings.NewReader(line)
+	p.cmd.Stderr = &p.stderr
+	out, err := p.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	p.out = out
+	if err = p.cmd.Start(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// psProcess is the output of a script started by powershellStream.
+type psProcess struct {
+	cmd    *exec.Cmd
+	out    io.Reader
+	stderr bytes.Buffer
+	eof    bool
+}
+
+func (p *psProcess) Read(b []byte) (n int, err error) {
+	n, err = p.out.Read(b)
+	if err == io.EOF {
+		p.eof = true
+	}
+	return n, err
+}
+
+// Close waits for the script to exit. If the output was not read to the end, the script is
+// stopped and its error, if any, is not reported.
+func (p *psProcess) Close() error {
+	if !p.eof {
+		p.cmd.Process.Kill()
+		p.cmd.Wait()
+		return nil
+	}
+	err := p.cmd.Wait()
+	if msg := strings.TrimSpace(p.stderr.String()); msg != "" {
+		return errors.New(msg)
+	}
+	return err
+}
+
+// unmarshalList decodes ConvertTo-Json output into a slice. ConvertTo-Json
+// emits a bare object for a single result and nothing at all for none.
+func unmarshalList(data []byte, v interface{}) error {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		data = []byte("[]")
+	} else if data[0] != '[' {
+		data = append(append([]byte("["), data...), ']')
+	}
+	return json.Unmarshal(data, v)
+}
+
+// escapeFilterValue escapes a value for use in an LDAP filter (RFC 4515).
+func escapeFilterValue(s string) string {
+	r := strings.NewReplacer(
+		"\\", "\\5c",
+		"*", "\\2a",
+		"(", "\\28",
+		")", "\\29",
+		"\x00", "\\00",
+	)
+	return r.Replace(s)
+}
@@ -0,0 +1,81 @@
+package ad
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// recordPowershell replaces powershell and powershellStream for the duration of the test.
+// Every script is recorded and answered by respond, or with no output if respond is nil.
+func recordPowershell(t *testing.T, respond func(script string) ([]byte, error)) *[]string {
+	t.Helper()
+	scripts := new([]string)
+	old, oldStream := powershell, powershellStream
+	powershell = func(script string) ([]byte, error) {
+		*scripts = append(*scripts, script)
+		if respond == nil {
+			return nil, nil
+		}
+		return respond(script)
+	}
+	powershellStream = func(script string) (io.ReadCloser, error) {
+		out, err := powershell(script)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(out)), nil
+	}
+	t.Cleanup(func() { powershell, powershellStream = old, oldStream })
+	return scripts
+}
+
+// cacheSchema makes attrs the cached schema of server for the duration of the test.
+func cacheSchema(t *testing.T, server string, attrs ...*AttributeSchema) {
+	t.Helper()
+	s := &Schema{attributes: make(map[string]*AttributeSchema), classes: make(map[string]*ClassSchema)}
+	for _, a := range attrs {
+		s.attributes[strings.ToLower(a.LDAPDisplayName)] = a
+	}
+	schemaCache.Lock()
+	schemaCache.m[strings.ToLower(server)] = s
+	schemaCache.Unlock()
+	t.Cleanup(func() {
+		schemaCache.Lock()
+		delete(schemaCache.m, strings.ToLower(server))
+		schemaCache.Unlock()
+	})
+}
+
+func TestEscapeFilterValue(t *testing.T) {
+	tests := map[string]string{
+		"plain":        "plain",
+		"a*b":          `a\2ab`,
+		"(cn=x)":       `\28cn=x\29`,
+		`back\slash`:   `back\5cslash`,
+		"nul\x00":      `nul\00`,
+		`\*()`:         `\5c\2a\28\29`,
+		"ünïcödé":      "ünïcödé",
+		"O'Brien, Pat": "O'Brien, Pat",
+	}
+	for in, want := range tests {
+		if got := escapeFilterValue(in); got != want {
+			t.Errorf("escapeFilterValue(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestParseDistinguishedName(t *testing.T) {
+	tests := []struct{ dn, cn, parent string }{
+		{"CN=Pat,OU=Staff,DC=example,DC=com", "Pat", "OU=Staff,DC=example,DC=com"},
+		{"OU=Staff,DC=example,DC=com", "Staff", "DC=example,DC=com"},
+		{"DC=example,DC=com", "", "DC=example,DC=com"},
+	}
+	for _, test := range tests {
+		cn, parent := ParseDistinguishedName(test.dn)
+		if cn != test.cn || parent != test.parent {
+			t.Errorf("ParseDistinguishedName(%q) = %q, %q", test.dn, cn, parent)
+		}
+	}
+}
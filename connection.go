@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/jakobii/ps"
@@ -42,6 +43,28 @@ func (c *Connection) Test() bool {
 	return true
 }
 
+// DomainControllers returns the host names of all domain controllers in the domain.
+func (c *Connection) DomainControllers() (hosts []string, err error) {
+
+	var cmd bytes.Buffer
+	cmd.WriteString("Get-ADDomainController -Server ")
+	cmd.WriteString(ps.QuoteString(c.Server))
+	cmd.WriteString(" -Credential ")
+	cmd.WriteString(c.Credential.Expr())
+	cmd.WriteString(" -Filter * | Select-Object -ExpandProperty HostName | ConvertTo-Json")
+
+	result, err := powershell(cmd.String())
+	if err != nil {
+		return hosts, err
+	}
+
+	err = unmarshalList(result, &hosts)
+	if err != nil {
+		return hosts, err
+	}
+	return hosts, nil
+}
+
 func (c *Connection) GetObject(Identity string) (obj Object, err error) {
 
 	var cmd bytes.Buffer
@@ -51,7 +74,7 @@ func (c *Connection) GetObject(Identity string) (obj Object, err error) {
 	cmd.WriteString(c.Credential.Expr())
 	cmd.WriteString(" -Identity ")
 	cmd.WriteString(ps.QuoteString(Identity))
-	cmd.WriteString(" | Select-Object @('ObjectGuid', 'ObjectClass',  'DistinguishedName', 'Name') | ConvertTo-Json")
+	cmd.WriteString(" -Properties objectSid | Select-Object @('ObjectGuid', 'ObjectClass',  'DistinguishedName', 'Name', @{n='ObjectSid';e={$_.objectSid.Value}}) | ConvertTo-Json")
 
 	result, err := powershell(cmd.String())
 	if err != nil {
@@ -68,7 +91,13 @@ func (c *Connection) GetObject(Identity string) (obj Object, err error) {
 	return obj, nil
 }
 
+// GetUser returns a user with its OrgUnit and groups loaded.
 func (c *Connection) GetUser(Identity string) (user User, err error) {
+	return c.GetUserWithOptions(Identity, UserOptions{})
+}
+
+// GetUserWithOptions returns a user with its OrgUnit and groups loaded as configured by opts.
+func (c *Connection) GetUserWithOptions(Identity string, opts UserOptions) (user User, err error) {
 
 	// get the main stuff
 	var cmd bytes.Buffer
@@ -78,7 +107,7 @@ func (c *Connection) GetUser(Identity string) (user User, err error) {
 	cmd.WriteString(c.Credential.Expr())
 	cmd.WriteString(" -Identity ")
 	cmd.WriteString(ps.QuoteString(Identity))
-	cmd.WriteString(" -Properties * | Select-Object @('ObjectGuid', 'ObjectClass',  'DistinguishedName', 'Name', 'SamAccountName', 'EmployeeID', 'EmployeeNumber', 'EmailAddress', 'UserPrincipalName', 'AccountExpirationDate', 'Enabled', 'MemberOf', 'CannotChangePassword', 'PasswordNeverExpires', 'PasswordNotRequired', 'DisplayName', 'GivenName', 'Surname', 'OtherName', 'Initials', 'Title', 'Division', 'Department', 'Office', 'Company', 'Organization', 'HomePage', 'Description', 'OfficePhone', 'MobilePhone', 'HomePhone', 'Fax', 'POBox', 'StreetAddress', 'City', 'State', 'PostalCode', 'Country' ) | ConvertTo-Json")
+	cmd.WriteString(" -Properties * | Select-Object @('ObjectGuid', 'ObjectClass',  'DistinguishedName', 'Name', 'SamAccountName', 'EmployeeID', 'EmployeeNumber', 'EmailAddress', 'UserPrincipalName', 'AccountExpirationDate', 'Enabled', 'userAccountControl', 'MemberOf', 'CannotChangePassword', 'PasswordNeverExpires', 'PasswordNotRequired', 'DisplayName', 'GivenName', 'Surname', 'OtherName', 'Initials', 'Title', 'Division', 'Department', 'Office', 'Company', 'Organization', 'HomePage', 'Description', 'Manager', 'OfficePhone', 'MobilePhone', 'HomePhone', 'Fax', 'POBox', 'StreetAddress', 'City', 'State', 'PostalCode', 'Country', @{n='ObjectSid';e={$_.objectSid.Value}}, @{n='SIDHistory';e={@($_.sIDHistory | ForEach-Object { $_.Value })}}, 'lastLogonTimestamp', 'pwdLastSet', @{n='whenCreated';e={$_.whenCreated.ToUniversalTime().ToString('yyyyMMddHHmmss.0Z')}}, @{n='whenChanged';e={$_.whenChanged.ToUniversalTime().ToString('yyyyMMddHHmmss.0Z')}}, " + psRecipientSelect + ", @{n='OtherMobile';e={@($_.otherMobile)}}, @{n='OtherTelephone';e={@($_.otherTelephone)}}, @{n='URL';e={@($_.url)}}, @{n='ServicePrincipalNames';e={@($_.servicePrincipalName)}} ) | ConvertTo-Json")
 
 	//fmt.Println(cmd.String())
 
@@ -99,13 +128,50 @@ func (c *Connection) GetUser(Identity string) (user User, err error) {
 		return user, err
 	}
 
-	// OrgUnit
-	_, ou := ParseDistinguishedName(user.DistinguishedName)
-	user.OrgUnit, err = c.GetOrgUnit(ou)
+	// logon times
+	t := struct {
+		LastLogonTimestamp int64
+		PwdLastSet         int64
+		WhenCreated        string
+		WhenChanged        string
+	}{}
+	err = json.Unmarshal(result, &t)
+	if err != nil {
+		return user, err
+	}
+	user.LastLogonTimestamp = FileTimeToTime(t.LastLogonTimestamp)
+	user.PasswordLastSet = FileTimeToTime(t.PwdLastSet)
+	user.WhenCreated, err = ParseGeneralizedTime(t.WhenCreated)
+	if err != nil {
+		return user, err
+	}
+	user.WhenChanged, err = ParseGeneralizedTime(t.WhenChanged)
 	if err != nil {
 		return user, err
 	}
 
+	// Manager
+	mgr := struct{ Manager string }{}
+	err = json.Unmarshal(result, &mgr)
+	if err != nil {
+		return user, err
+	}
+	if mgr.Manager != "" {
+		user.Manager = c.objectReference(mgr.Manager)
+	}
+	user.originalManager = user.Manager
+
+	// OrgUnit
+	_, ou := ParseDistinguishedName(user.DistinguishedName)
+	if opts.Load == LoadEager {
+		user.OrgUnit, err = c.GetOrgUnit(ou)
+		if err != nil {
+			return user, err
+		}
+	} else {
+		user.OrgUnit = c.orgUnitReference(ou)
+	}
+
 	// []Group
 	m := struct{ MemberOf []string }{}
 	err = json.Unmarshal(result, &m)
@@ -115,17 +181,37 @@ func (c *Connection) GetUser(Identity string) (user User, err error) {
 
 	user.Groups = make([]Group, 0, len(m.MemberOf))
 	user.originalGroups = make([]Group, 0, len(m.MemberOf))
+	groups := newGroupLoader(c)
 	for _, v := range m.MemberOf {
-		group, err := c.GetGroup(v)
-		if err != nil {
-			return user, err
+		group := c.groupReference(v)
+		if opts.Load == LoadEager {
+			group, err = groups.load(v, -1)
+			if err != nil {
+				return user, err
+			}
 		}
 		user.Groups = append(user.Groups, group)
 		user.originalGroups = append(user.originalGroups, group)
 	}
 
+	user.originalUserAccountControl = user.UserAccountControl
+	user.Recipient.pulled()
+	user.originalValues = make(map[string][]string)
+	for name, field := range user.values() {
+		user.originalValues[name] = append([]string(nil), *field...)
+	}
+	user.load = opts.Load
+
 	user.Connection = *c
 
+	// Attributes
+	if len(opts.Attributes) > 0 {
+		err = user.PullAttributes(opts.Attributes...)
+		if err != nil {
+			return user, err
+		}
+	}
+
 	return user, nil
 }
 
@@ -224,7 +310,86 @@ func (c *Connection) GetOrgUnit(Identity string) (ou OrgUnit, err error) {
 	return ou, nil
 }
 
+// GetGroup returns a group with all of its parent groups loaded.
+// Circular nesting is cut off with a reference to the group that closes the cycle.
 func (c *Connection) GetGroup(Identity string) (group Group, err error) {
+	return c.GetGroupWithOptions(Identity, GroupOptions{Depth: -1})
+}
+
+// GetGroupWithOptions returns a group with its parent groups loaded as configured by opts.
+// Every group is fetched at most once per call.
+func (c *Connection) GetGroupWithOptions(Identity string, opts GroupOptions) (group Group, err error) {
+	l := newGroupLoader(c)
+	return l.load(Identity, opts.Depth)
+}
+
+// groupLoader loads groups and their parents, remembering every group it has
+// fetched and every group it is in the middle of loading.
+type groupLoader struct {
+	c       *Connection
+	memo    map[string]loadedGroup
+	loading map[string]bool
+}
+
+type loadedGroup struct {
+	group Group
+	depth int
+}
+
+func newGroupLoader(c *Connection) *groupLoader {
+	return &groupLoader{
+		c:       c,
+		memo:    make(map[string]loadedGroup),
+		loading: make(map[string]bool),
+	}
+}
+
+// load fetches a group and its parents up to depth levels, a negative depth is unlimited.
+func (l *groupLoader) load(Identity string, depth int) (group Group, err error) {
+
+	// reuse a group if it was loaded at least as deep as requested
+	if m, ok := l.memo[strings.ToLower(Identity)]; ok && (m.depth < 0 || (depth >= 0 && m.depth >= depth)) {
+		return m.group, nil
+	}
+
+	group, memberOf, err := l.c.getGroup(Identity)
+	if err != nil {
+		return group, err
+	}
+	key := strings.ToLower(group.DistinguishedName)
+
+	l.loading[key] = true
+	defer delete(l.loading, key)
+
+	group.Groups = make([]Group, 0, len(memberOf))
+	for _, v := range memberOf {
+		if depth == 0 || l.loading[strings.ToLower(v)] {
+			group.Groups = append(group.Groups, l.c.groupReference(v))
+			continue
+		}
+		parent, err := l.load(v, depth-1)
+		if err != nil {
+			return group, err
+		}
+		group.Groups = append(group.Groups, parent)
+	}
+	// a parent cut off by depth or by a cycle is still a reference, ParentGroups loads it later
+	group.groupsLoaded = true
+	for _, v := range group.Groups {
+		if v.IsReference() {
+			group.groupsLoaded = false
+			break
+		}
+	}
+
+	l.memo[key] = loadedGroup{group, depth}
+	l.memo[strings.ToLower(Identity)] = loadedGroup{group, depth}
+
+	return group, nil
+}
+
+// getGroup fetches a single group and the distinguished names of its parent groups.
+func (c *Connection) getGroup(Identity string) (group Group, memberOf []string, err error) {
 
 	// get the main stuff
 	var cmd bytes.Buffer
@@ -234,19 +399,23 @@ func (c *Connection) GetGroup(Identity string) (group Group, err error) {
 	cmd.WriteString(c.Credential.Expr())
 	cmd.WriteString(" -Identity ")
 	cmd.WriteString(ps.QuoteString(Identity))
-	cmd.WriteString(" -Properties * | Select-Object @('ObjectGuid', 'ObjectClass',  'DistinguishedName', 'Name', 'SamAccountName', 'DisplayName', 'Description', 'GroupCategory', 'memberOf', 'members' ) | ConvertTo-Json")
+	cmd.WriteString(" -Properties @('DisplayName', 'Description', 'memberOf', 'objectSid', 'sIDHistory', 'member;range=0-")
+	cmd.WriteString(strconv.Itoa(memberRangeSize - 1))
+	cmd.WriteString("') | Select-Object @('ObjectGuid', 'ObjectClass',  'DistinguishedName', 'Name', 'SamAccountName', 'DisplayName', 'Description', 'GroupCategory', 'memberOf', @{n='ObjectSid';e={$_.objectSid.Value}}, @{n='SIDHistory';e={@($_.sIDHistory | ForEach-Object { $_.Value })}}, ")
+	cmd.WriteString(psMemberRangeSelect)
+	cmd.WriteString(" ) | ConvertTo-Json")
 
 	//fmt.Println(cmd.String())
 
 	result, err := powershell(cmd.String())
 	if err != nil {
-		return group, err
+		return group, memberOf, err
 	}
 
 	// Object
 	err = json.Unmarshal(result, &group.Object)
 	if err != nil {
-		return group, err
+		return group, memberOf, err
 	}
 
 	group.Connection = *c
@@ -254,23 +423,52 @@ func (c *Connection) GetGroup(Identity string) (group Group, err error) {
 	// Group
 	err = json.Unmarshal(result, &group)
 	if err != nil {
-		return group, err
+		return group, memberOf, err
 	}
 
 	// []Group
-	m := struct{ MemberOf []string }{}
+	m := struct {
+		MemberOf    []string
+		MemberRange string
+	}{}
 	err = json.Unmarshal(result, &m)
 	if err != nil {
-		return group, err
+		return group, memberOf, err
 	}
-	group.Groups = make([]Group, 0, len(m.MemberOf))
-	for _, v := range m.MemberOf {
-		group, err := c.GetGroup(v)
+
+	// large groups are returned in ranges
+	next, err := nextMemberRange(m.MemberRange)
+	if err != nil {
+		return group, m.MemberOf, err
+	}
+	for next > 0 {
+		var members []string
+		members, next, err = c.memberRange(group.DistinguishedName, next)
 		if err != nil {
-			return group, err
+			return group, m.MemberOf, err
 		}
-		group.Groups = append(group.Groups, group)
+		group.Members = append(group.Members, members...)
 	}
 
-	return group, nil
+	return group, m.MemberOf, nil
+}
+
+// objectReference returns an Object with only its distinguished name and name set.
+func (c *Connection) objectReference(dn string) Object {
+	cn, _ := ParseDistinguishedName(dn)
+	return Object{
+		Connection:        *c,
+		Name:              cn,
+		DistinguishedName: dn,
+	}
+}
+
+// orgUnitReference returns an OrgUnit with only its distinguished name and name set.
+func (c *Connection) orgUnitReference(dn string) OrgUnit {
+	return OrgUnit{Object: c.objectReference(dn)}
+}
+
+// groupReference returns a group with only its distinguished name and name set.
+func (c *Connection) groupReference(dn string) Group {
+	return Group{Object: c.objectReference(dn)}
 }
@@ -0,0 +1,106 @@
+package ad
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"time"
+)
+
+// fileTimeEpoch is 1601-01-01 to 1970-01-01 in 100ns intervals.
+const fileTimeEpoch = 116444736000000000
+
+// FileTimeToTime converts a Windows FILETIME (100ns intervals since 1601-01-01 UTC),
+// as used by Integer8 attributes like lastLogon and pwdLastSet, to a time.Time.
+// 0 and the max int64 both mean never and are returned as the zero time.
+func FileTimeToTime(ft int64) time.Time {
+	if ft <= 0 || ft == math.MaxInt64 {
+		return time.Time{}
+	}
+	return time.Unix(0, (ft-fileTimeEpoch)*100).UTC()
+}
+
+// TimeToFileTime converts t to a Windows FILETIME. The zero time is returned as 0.
+func TimeToFileTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UTC().UnixNano()/100 + fileTimeEpoch
+}
+
+// ParseGeneralizedTime parses an LDAP GeneralizedTime value, e.g. "20190102150405.0Z".
+func ParseGeneralizedTime(s string) (time.Time, error) {
+
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if len(s) < 10 {
+		return time.Time{}, errors.New("invalid generalized time " + s)
+	}
+
+	// split off the zone, which is either Z or +hhmm/-hhmm
+	zone := "Z"
+	if strings.HasSuffix(s, "Z") || strings.HasSuffix(s, "z") {
+		s = s[:len(s)-1]
+	} else if i := strings.LastIndexAny(s, "+-"); i > 0 {
+		zone = s[i:]
+		s = s[:i]
+	}
+
+	// the fraction may be separated with a dot or a comma
+	frac := ""
+	if i := strings.IndexAny(s, ".,"); i >= 0 {
+		frac = s[i+1:]
+		s = s[:i]
+	}
+
+	var layout string
+	switch len(s) {
+	case 10:
+		layout = "2006010215"
+	case 12:
+		layout = "200601021504"
+	case 14:
+		layout = "20060102150405"
+	default:
+		return time.Time{}, errors.New("invalid generalized time " + s)
+	}
+
+	loc := time.UTC
+	if zone != "Z" {
+		z, err := time.Parse("-0700", zone)
+		if err != nil {
+			return time.Time{}, errors.New("invalid generalized time zone " + zone)
+		}
+		loc = z.Location()
+	}
+
+	t, err := time.ParseInLocation(layout, s, loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// the fraction applies to the last unit present in the value
+	if frac != "" {
+		f, err := time.ParseDuration("0." + frac + "s")
+		if err != nil {
+			return time.Time{}, errors.New("invalid generalized time fraction " + frac)
+		}
+		switch len(s) {
+		case 10:
+			t = t.Add(time.Duration(float64(time.Hour) * f.Seconds()))
+		case 12:
+			t = t.Add(time.Duration(float64(time.Minute) * f.Seconds()))
+		default:
+			t = t.Add(f)
+		}
+	}
+
+	return t.UTC(), nil
+}
+
+// FormatGeneralizedTime formats t the way Active Directory stores GeneralizedTime values.
+func FormatGeneralizedTime(t time.Time) string {
+	return t.UTC().Format("20060102150405") + ".0Z"
+}
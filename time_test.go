@@ -0,0 +1,88 @@
+package ad
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestFileTime(t *testing.T) {
+
+	tests := []struct {
+		ft   int64
+		want time.Time
+	}{
+		{0, time.Time{}},
+		{-1, time.Time{}},
+		{math.MaxInt64, time.Time{}},
+		{fileTimeEpoch, time.Unix(0, 0).UTC()},
+		{132223104000000000, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{132223104000000001, time.Date(2020, 1, 1, 0, 0, 0, 100, time.UTC)},
+	}
+
+	for _, test := range tests {
+		got := FileTimeToTime(test.ft)
+		if !got.Equal(test.want) {
+			t.Errorf("FileTimeToTime(%d) = %s, want %s", test.ft, got, test.want)
+		}
+		if test.ft > 0 && test.ft != math.MaxInt64 {
+			if back := TimeToFileTime(got); back != test.ft {
+				t.Errorf("TimeToFileTime(%s) = %d, want %d", got, back, test.ft)
+			}
+		}
+	}
+
+	if TimeToFileTime(time.Time{}) != 0 {
+		t.Error("the zero time is not 0")
+	}
+	local := time.Date(2020, 1, 1, 1, 0, 0, 0, time.FixedZone("CET", 3600))
+	if TimeToFileTime(local) != 132223104000000000 {
+		t.Error("time zones are not converted to UTC")
+	}
+}
+
+func TestGeneralizedTime(t *testing.T) {
+
+	tests := []struct {
+		in      string
+		want    time.Time
+		invalid bool
+	}{
+		{in: "20190102150405.0Z", want: time.Date(2019, 1, 2, 15, 4, 5, 0, time.UTC)},
+		{in: "20190102150405Z", want: time.Date(2019, 1, 2, 15, 4, 5, 0, time.UTC)},
+		{in: "20190102150405.5Z", want: time.Date(2019, 1, 2, 15, 4, 5, 5e8, time.UTC)},
+		{in: "20190102150405,25Z", want: time.Date(2019, 1, 2, 15, 4, 5, 25e7, time.UTC)},
+		{in: "201901021504Z", want: time.Date(2019, 1, 2, 15, 4, 0, 0, time.UTC)},
+		{in: "2019010215.5Z", want: time.Date(2019, 1, 2, 15, 30, 0, 0, time.UTC)},
+		{in: "20190102150405+0200", want: time.Date(2019, 1, 2, 13, 4, 5, 0, time.UTC)},
+		{in: "20190102150405.0-0130", want: time.Date(2019, 1, 2, 16, 34, 5, 0, time.UTC)},
+		{in: "", want: time.Time{}},
+		{in: "2019", invalid: true},
+		{in: "201901021504051Z", invalid: true},
+		{in: "20191302150405Z", invalid: true},
+		{in: "20190102150405+02", invalid: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseGeneralizedTime(test.in)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("ParseGeneralizedTime(%q) = %s, want error", test.in, got)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(test.want) {
+			t.Errorf("ParseGeneralizedTime(%q) = %s, %v, want %s", test.in, got, err, test.want)
+		}
+	}
+
+	// round trip, at the precision Active Directory stores
+	now := time.Now().Truncate(time.Second)
+	back, err := ParseGeneralizedTime(FormatGeneralizedTime(now))
+	if err != nil || !back.Equal(now) {
+		t.Errorf("round trip of %s = %s, %v", now, back, err)
+	}
+	if s := FormatGeneralizedTime(time.Date(2019, 1, 2, 16, 4, 5, 0, time.FixedZone("", 3600))); s != "20190102150405.0Z" {
+		t.Errorf("FormatGeneralizedTime = %s", s)
+	}
+}